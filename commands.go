@@ -0,0 +1,181 @@
+package tpmproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// ErrUnsupportedCommand is the error of Decode for the commands without
+// registered structures.
+var ErrUnsupportedCommand = errors.New("unsupported command")
+
+// CommandType holds the constructors of the structures of a command.
+// The structures are those of go-tpm, or alike with the handles tagged
+// `gotpm:"handle"`, so that RoughParser can parse them.
+type CommandType struct {
+	// Name is the name of the command, such as "Unseal".
+	Name string
+	// NewCommand returns a pointer to a new command structure.
+	NewCommand func() any
+	// NewResponse returns a pointer to a new response structure.
+	NewResponse func() any
+}
+
+var (
+	commandTypesMu sync.RWMutex
+	commandTypes   = make(map[tpm2.TPMCC]*CommandType)
+)
+
+func init() {
+	RegisterCommand[tpm2.Shutdown, tpm2.ShutdownResponse]()
+	RegisterCommand[tpm2.Startup, tpm2.StartupResponse]()
+	RegisterCommand[tpm2.StartAuthSession, tpm2.StartAuthSessionResponse]()
+	RegisterCommand[tpm2.Create, tpm2.CreateResponse]()
+	RegisterCommand[tpm2.Load, tpm2.LoadResponse]()
+	RegisterCommand[tpm2.LoadExternal, tpm2.LoadExternalResponse]()
+	RegisterCommand[tpm2.ReadPublic, tpm2.ReadPublicResponse]()
+	RegisterCommand[tpm2.ActivateCredential, tpm2.ActivateCredentialResponse]()
+	RegisterCommand[tpm2.MakeCredential, tpm2.MakeCredentialResponse]()
+	RegisterCommand[tpm2.Unseal, tpm2.UnsealResponse]()
+	RegisterCommand[tpm2.ObjectChangeAuth, tpm2.ObjectChangeAuthResponse]()
+	RegisterCommand[tpm2.CreateLoaded, tpm2.CreateLoadedResponse]()
+	RegisterCommand[tpm2.RSAEncrypt, tpm2.RSAEncryptResponse]()
+	RegisterCommand[tpm2.RSADecrypt, tpm2.RSADecryptResponse]()
+	RegisterCommand[tpm2.ECDHZGen, tpm2.ECDHZGenResponse]()
+	RegisterCommand[tpm2.Hash, tpm2.HashResponse]()
+	RegisterCommand[tpm2.GetRandom, tpm2.GetRandomResponse]()
+	RegisterCommand[tpm2.HashSequenceStart, tpm2.HashSequenceStartResponse]()
+	RegisterCommand[tpm2.HmacStart, tpm2.HmacStartResponse]()
+	RegisterCommand[tpm2.SequenceUpdate, tpm2.SequenceUpdateResponse]()
+	RegisterCommand[tpm2.SequenceComplete, tpm2.SequenceCompleteResponse]()
+	RegisterCommand[tpm2.Certify, tpm2.CertifyResponse]()
+	RegisterCommand[tpm2.CertifyCreation, tpm2.CertifyCreationResponse]()
+	RegisterCommand[tpm2.Quote, tpm2.QuoteResponse]()
+	RegisterCommand[tpm2.GetSessionAuditDigest, tpm2.GetSessionAuditDigestResponse]()
+	RegisterCommand[tpm2.Commit, tpm2.CommitResponse]()
+	RegisterCommand[tpm2.VerifySignature, tpm2.VerifySignatureResponse]()
+	RegisterCommand[tpm2.Sign, tpm2.SignResponse]()
+	RegisterCommand[tpm2.PCRExtend, tpm2.PCRExtendResponse]()
+	RegisterCommand[tpm2.PCREvent, tpm2.PCREventResponse]()
+	RegisterCommand[tpm2.PCRRead, tpm2.PCRReadResponse]()
+	RegisterCommand[tpm2.PCRReset, tpm2.PCRResetResponse]()
+	RegisterCommand[tpm2.PolicySigned, tpm2.PolicySignedResponse]()
+	RegisterCommand[tpm2.PolicySecret, tpm2.PolicySecretResponse]()
+	RegisterCommand[tpm2.PolicyOr, tpm2.PolicyOrResponse]()
+	RegisterCommand[tpm2.PolicyPCR, tpm2.PolicyPCRResponse]()
+	RegisterCommand[tpm2.PolicyNV, tpm2.PolicyNVResponse]()
+	RegisterCommand[tpm2.PolicyCommandCode, tpm2.PolicyCommandCodeResponse]()
+	RegisterCommand[tpm2.PolicyCPHash, tpm2.PolicyCPHashResponse]()
+	RegisterCommand[tpm2.PolicyAuthorize, tpm2.PolicyAuthorizeResponse]()
+	RegisterCommand[tpm2.PolicyGetDigest, tpm2.PolicyGetDigestResponse]()
+	RegisterCommand[tpm2.PolicyNVWritten, tpm2.PolicyNVWrittenResponse]()
+	RegisterCommand[tpm2.PolicyAuthorizeNV, tpm2.PolicyAuthorizeNVResponse]()
+	RegisterCommand[tpm2.CreatePrimary, tpm2.CreatePrimaryResponse]()
+	RegisterCommand[tpm2.Clear, tpm2.ClearResponse]()
+	RegisterCommand[tpm2.HierarchyChangeAuth, tpm2.HierarchyChangeAuthResponse]()
+	RegisterCommand[tpm2.ContextSave, tpm2.ContextSaveResponse]()
+	RegisterCommand[tpm2.ContextLoad, tpm2.ContextLoadResponse]()
+	RegisterCommand[tpm2.FlushContext, tpm2.FlushContextResponse]()
+	RegisterCommand[tpm2.EvictControl, tpm2.EvictControlResponse]()
+	RegisterCommand[tpm2.Duplicate, tpm2.DuplicateResponse]()
+	RegisterCommand[tpm2.Import, tpm2.ImportResponse]()
+	RegisterCommand[tpm2.GetCapability, tpm2.GetCapabilityResponse]()
+	RegisterCommand[tpm2.TestParms, tpm2.TestParmsResponse]()
+	RegisterCommand[tpm2.NVDefineSpace, tpm2.NVDefineSpaceResponse]()
+	RegisterCommand[tpm2.NVUndefineSpace, tpm2.NVUndefineSpaceResponse]()
+	RegisterCommand[tpm2.NVUndefineSpaceSpecial, tpm2.NVUndefineSpaceSpecialResponse]()
+	RegisterCommand[tpm2.NVReadPublic, tpm2.NVReadPublicResponse]()
+	RegisterCommand[tpm2.NVWrite, tpm2.NVWriteResponse]()
+	RegisterCommand[tpm2.NVIncrement, tpm2.NVIncrementResponse]()
+	RegisterCommand[tpm2.NVWriteLock, tpm2.NVWriteLockResponse]()
+	RegisterCommand[tpm2.NVRead, tpm2.NVReadResponse]()
+	RegisterCommand[tpm2.NVCertify, tpm2.NVCertifyResponse]()
+}
+
+// RegisterCommand registers the go-tpm structures C and R of a command under
+// its command code.
+func RegisterCommand[C tpm2.Command[R, *R], R any]() {
+	var c C
+	RegisterCommandType(c.Command(), &CommandType{
+		Name:        reflect.TypeOf(c).Name(),
+		NewCommand:  func() any { return new(C) },
+		NewResponse: func() any { return new(R) },
+	})
+}
+
+// RegisterCommandType registers the structures of the command code,
+// replacing those registered before. It allows decoding vendor commands and
+// those go-tpm does not model.
+func RegisterCommandType(cc tpm2.TPMCC, t *CommandType) {
+	commandTypesMu.Lock()
+	defer commandTypesMu.Unlock()
+	commandTypes[cc] = t
+}
+
+// LookupCommand returns the CommandType registered for the command code, or
+// nil if there is none.
+func LookupCommand(cc tpm2.TPMCC) *CommandType {
+	commandTypesMu.RLock()
+	defer commandTypesMu.RUnlock()
+	return commandTypes[cc]
+}
+
+// CommandName returns the name of the command, or its name in TPM 2.0 Part 3
+// if it is not registered, or its code in hex if it is in neither.
+func CommandName(cc tpm2.TPMCC) string {
+	if t := LookupCommand(cc); t != nil {
+		return t.Name
+	}
+	if s := commandSchemas[cc]; s != nil {
+		return s.name
+	}
+	return fmt.Sprintf("0x%08x", uint32(cc))
+}
+
+// commandHandles returns the number of handles of the command structure.
+func commandHandles(cmd any) int {
+	return len(taggedMembers(reflect.ValueOf(cmd).Elem(), "handle", false))
+}
+
+// Decode parses the raw command and response with RoughParser into the
+// registered structures of the command. It returns pointers to them, such as
+// *tpm2.Unseal and *tpm2.UnsealResponse.
+// The commands without registered structures are decoded by their layouts in
+// TPM 2.0 Part 3 into *SchemaField trees instead.
+// If response is nil, only the command is parsed and rsp is nil. If the
+// response is an error, cmd is returned with a nil rsp and the *ResponseCode
+// as the error.
+func Decode(request, response []byte) (cmd any, rsp any, err error) {
+	if len(request) < TpmHeaderSize {
+		return nil, nil, fmt.Errorf("invalid TPM command size %d", len(request))
+	}
+	cc := tpm2.TPMCC(binary.BigEndian.Uint32(request[6:10]))
+	t := LookupCommand(cc)
+	if t == nil {
+		return decodeSchema(request, response)
+	}
+	p := RoughParser{
+		RawRequest:  request,
+		RawResponse: response,
+		Cmd:         t.NewCommand(),
+		Rsp:         t.NewResponse(),
+	}
+	if err := p.ParseCommand(); err != nil {
+		return nil, nil, err
+	}
+	if response == nil {
+		return p.Cmd, nil, nil
+	}
+	if err := p.ParseResponse(); err != nil {
+		if p.RspCode != nil {
+			return p.Cmd, nil, err
+		}
+		return nil, nil, err
+	}
+	return p.Cmd, p.Rsp, nil
+}
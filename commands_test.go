@@ -0,0 +1,110 @@
+package tpmproxy
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+func TestDecode(t *testing.T) {
+	command := []byte{0x80, 0x01, 0, 0, 0, 0x0c, 0, 0, 0x01, 0x7b, 0, 4}
+	response := []byte{0x80, 0x01, 0, 0, 0, 0x10, 0, 0, 0, 0, 0, 4, 1, 2, 3, 4}
+	cmd, rsp, err := Decode(command, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := cmd.(*tpm2.GetRandom); !ok || c.BytesRequested != 4 {
+		t.Errorf("unexpected command %#v", cmd)
+	}
+	if r, ok := rsp.(*tpm2.GetRandomResponse); !ok || !bytes.Equal(r.RandomBytes.Buffer, []byte{1, 2, 3, 4}) {
+		t.Errorf("unexpected response %#v", rsp)
+	}
+	if cmd, rsp, err := Decode(command, nil); err != nil || cmd.(*tpm2.GetRandom).BytesRequested != 4 || rsp != nil {
+		t.Errorf("command only: %v, %v, %v", cmd, rsp, err)
+	}
+	if name := CommandName(tpm2.TPMCCGetRandom); name != "GetRandom" {
+		t.Errorf("name %q", name)
+	}
+
+	// a vendor command
+	command = []byte{0x80, 0x01, 0, 0, 0, 0x0b, 0x20, 0, 0x10, 0, 3}
+	response = []byte{0x80, 0x01, 0, 0, 0, 0x0a, 0, 0, 0, 0}
+	if _, _, err := Decode(command, response); !errors.Is(err, ErrUnsupportedCommand) {
+		t.Errorf("unregistered command: %v", err)
+	}
+	type setLocality struct {
+		Locality uint8
+	}
+	type setLocalityResponse struct{}
+	RegisterCommandType(TpmCCVtpmSetLocality, &CommandType{
+		Name:        "VtpmSetLocality",
+		NewCommand:  func() any { return &setLocality{} },
+		NewResponse: func() any { return &setLocalityResponse{} },
+	})
+	defer func() {
+		commandTypesMu.Lock()
+		delete(commandTypes, TpmCCVtpmSetLocality)
+		commandTypesMu.Unlock()
+	}()
+	cmd, _, err = Decode(command, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := cmd.(*setLocality); c.Locality != 3 {
+		t.Errorf("locality %d", c.Locality)
+	}
+}
+
+// captureTPM is a TPM that keeps the command and fails it.
+type captureTPM struct {
+	command []byte
+}
+
+func (c *captureTPM) Send(input []byte) ([]byte, error) {
+	c.command = bytes.Clone(input)
+	return []byte{0x80, 0x01, 0, 0, 0, 0x0a, 0, 0, 0x01, 0x01}, nil
+}
+
+func TestParseRegisteredCommands(t *testing.T) {
+	commandTypesMu.RLock()
+	types := make(map[tpm2.TPMCC]*CommandType, len(commandTypes))
+	for cc, ct := range commandTypes {
+		types[cc] = ct
+	}
+	commandTypesMu.RUnlock()
+
+	for _, ct := range types {
+		// a minimal command marshalled by go-tpm
+		cmd := reflect.ValueOf(ct.NewCommand()).Elem()
+		for i := 0; i < cmd.NumField(); i++ {
+			if hasTag(cmd.Type().Field(i), "handle") {
+				if err := setHandle(cmd.Field(i), 0x80000001); err != nil {
+					t.Fatalf("%s: %v", ct.Name, err)
+				}
+			}
+		}
+		switch c := cmd.Addr().Interface().(type) {
+		case *tpm2.HmacStart:
+			c.Handle.Auth = tpm2.PasswordAuth(nil)
+		case *tpm2.TestParms:
+			c.Parameters = tpm2.TPMTPublicParms{
+				Type:       tpm2.TPMAlgKeyedHash,
+				Parameters: tpm2.NewTPMUPublicParms(tpm2.TPMAlgKeyedHash, &tpm2.TPMSKeyedHashParms{}),
+			}
+		}
+		tpm := &captureTPM{}
+		out := cmd.MethodByName("Execute").Call([]reflect.Value{reflect.ValueOf(tpm)})
+		if tpm.command == nil {
+			t.Errorf("%s: not marshalled: %v", ct.Name, out[len(out)-1])
+			continue
+		}
+
+		p := RoughParser{RawRequest: tpm.command, Cmd: ct.NewCommand()}
+		if err := p.ParseCommand(); err != nil {
+			t.Errorf("%s: %v", ct.Name, err)
+		}
+	}
+}
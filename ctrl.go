@@ -0,0 +1,645 @@
+package tpmproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// CtrlCmd is a command code of the swtpm control channel protocol.
+// See swtpm's tpm_ioctl.h for the definitions.
+type CtrlCmd uint32
+
+const (
+	CtrlCmdGetCapability       CtrlCmd = 1
+	CtrlCmdInit                CtrlCmd = 2
+	CtrlCmdShutdown            CtrlCmd = 3
+	CtrlCmdGetTpmEstablished   CtrlCmd = 4
+	CtrlCmdSetLocality         CtrlCmd = 5
+	CtrlCmdHashStart           CtrlCmd = 6
+	CtrlCmdHashData            CtrlCmd = 7
+	CtrlCmdHashEnd             CtrlCmd = 8
+	CtrlCmdCancelTpmCmd        CtrlCmd = 9
+	CtrlCmdStoreVolatile       CtrlCmd = 10
+	CtrlCmdResetTpmEstablished CtrlCmd = 11
+	CtrlCmdGetStateBlob        CtrlCmd = 12
+	CtrlCmdSetStateBlob        CtrlCmd = 13
+	CtrlCmdStop                CtrlCmd = 14
+	CtrlCmdGetConfig           CtrlCmd = 15
+	CtrlCmdSetDatafd           CtrlCmd = 16
+	CtrlCmdSetBufferSize       CtrlCmd = 17
+	CtrlCmdGetInfo             CtrlCmd = 18
+	CtrlCmdLockStorage         CtrlCmd = 19
+)
+
+var ctrlCmdNames = map[CtrlCmd]string{
+	CtrlCmdGetCapability:       "CMD_GET_CAPABILITY",
+	CtrlCmdInit:                "CMD_INIT",
+	CtrlCmdShutdown:            "CMD_SHUTDOWN",
+	CtrlCmdGetTpmEstablished:   "CMD_GET_TPMESTABLISHED",
+	CtrlCmdSetLocality:         "CMD_SET_LOCALITY",
+	CtrlCmdHashStart:           "CMD_HASH_START",
+	CtrlCmdHashData:            "CMD_HASH_DATA",
+	CtrlCmdHashEnd:             "CMD_HASH_END",
+	CtrlCmdCancelTpmCmd:        "CMD_CANCEL_TPM_CMD",
+	CtrlCmdStoreVolatile:       "CMD_STORE_VOLATILE",
+	CtrlCmdResetTpmEstablished: "CMD_RESET_TPMESTABLISHED",
+	CtrlCmdGetStateBlob:        "CMD_GET_STATEBLOB",
+	CtrlCmdSetStateBlob:        "CMD_SET_STATEBLOB",
+	CtrlCmdStop:                "CMD_STOP",
+	CtrlCmdGetConfig:           "CMD_GET_CONFIG",
+	CtrlCmdSetDatafd:           "CMD_SET_DATAFD",
+	CtrlCmdSetBufferSize:       "CMD_SET_BUFFERSIZE",
+	CtrlCmdGetInfo:             "CMD_GET_INFO",
+	CtrlCmdLockStorage:         "CMD_LOCK_STORAGE",
+}
+
+func (c CtrlCmd) String() string {
+	if name, ok := ctrlCmdNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("CMD_UNKNOWN(%d)", uint32(c))
+}
+
+// Capability bits returned by CMD_GET_CAPABILITY.
+const (
+	CtrlCapInit                uint64 = 1 << 0
+	CtrlCapShutdown            uint64 = 1 << 1
+	CtrlCapGetTpmEstablished   uint64 = 1 << 2
+	CtrlCapSetLocality         uint64 = 1 << 3
+	CtrlCapHashing             uint64 = 1 << 4
+	CtrlCapCancelTpmCmd        uint64 = 1 << 5
+	CtrlCapStoreVolatile       uint64 = 1 << 6
+	CtrlCapResetTpmEstablished uint64 = 1 << 7
+	CtrlCapGetStateBlob        uint64 = 1 << 8
+	CtrlCapSetStateBlob        uint64 = 1 << 9
+	CtrlCapStop                uint64 = 1 << 10
+	CtrlCapGetConfig           uint64 = 1 << 11
+	CtrlCapSetDatafd           uint64 = 1 << 12
+	CtrlCapSetBufferSize       uint64 = 1 << 13
+	CtrlCapGetInfo             uint64 = 1 << 14
+	CtrlCapSendCommandHeader   uint64 = 1 << 15
+	CtrlCapLockStorage         uint64 = 1 << 16
+)
+
+// Result codes carried in control channel responses (TPM 1.2 style).
+const (
+	CtrlResultSuccess      uint32 = 0x00
+	CtrlResultBadParameter uint32 = 0x03
+	CtrlResultFail         uint32 = 0x09
+	CtrlResultBadOrdinal   uint32 = 0x0a
+	CtrlResultIoError      uint32 = 0x1f
+)
+
+// Flags and types used by the control channel commands.
+const (
+	CtrlInitFlagDeleteVolatile uint32 = 1 << 0
+
+	CtrlStateFlagDecrypted uint32 = 1 << 0
+	CtrlStateFlagEncrypted uint32 = 1 << 1
+
+	CtrlBlobTypePermanent uint32 = 1
+	CtrlBlobTypeVolatile  uint32 = 2
+	CtrlBlobTypeSavestate uint32 = 3
+)
+
+// CtrlPayload is an interface implemented by the typed parameters of control
+// channel requests and responses.
+type CtrlPayload interface {
+	// MarshalCtrl serializes the payload.
+	MarshalCtrl() []byte
+	// UnmarshalCtrl deserializes the payload.
+	UnmarshalCtrl(b []byte) error
+}
+
+func marshalCtrlFixed(v any) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, v)
+	return buf.Bytes()
+}
+
+func unmarshalCtrlFixed(b []byte, v any) error {
+	if size := binary.Size(v); len(b) < size {
+		return fmt.Errorf("control payload too short: %d bytes, expected %d", len(b), size)
+	}
+	return binary.Read(bytes.NewReader(b), binary.BigEndian, v)
+}
+
+// unmarshalCtrlResult decodes a response whose first field is a result code.
+// swtpm sends only the result code when a command fails, so a short
+// response with a non-zero result is accepted.
+// It returns true if the remaining fields are present.
+func unmarshalCtrlResult(b []byte, result *uint32) (bool, error) {
+	if len(b) < 4 {
+		return false, fmt.Errorf("control response too short: %d bytes", len(b))
+	}
+	*result = binary.BigEndian.Uint32(b)
+	if len(b) == 4 && *result != CtrlResultSuccess {
+		return false, nil
+	}
+	return true, nil
+}
+
+// CtrlEmpty is the payload of requests without parameters.
+type CtrlEmpty struct {
+}
+
+func (p *CtrlEmpty) MarshalCtrl() []byte {
+	return nil
+}
+
+func (p *CtrlEmpty) UnmarshalCtrl(b []byte) error {
+	return nil
+}
+
+// CtrlInitRequest is the payload of CMD_INIT.
+type CtrlInitRequest struct {
+	InitFlags uint32
+}
+
+func (p *CtrlInitRequest) MarshalCtrl() []byte {
+	return marshalCtrlFixed(p)
+}
+
+func (p *CtrlInitRequest) UnmarshalCtrl(b []byte) error {
+	return unmarshalCtrlFixed(b, p)
+}
+
+// CtrlLocalityRequest is the payload of CMD_SET_LOCALITY and
+// CMD_RESET_TPMESTABLISHED.
+type CtrlLocalityRequest struct {
+	Locality uint8
+}
+
+func (p *CtrlLocalityRequest) MarshalCtrl() []byte {
+	return marshalCtrlFixed(p)
+}
+
+func (p *CtrlLocalityRequest) UnmarshalCtrl(b []byte) error {
+	return unmarshalCtrlFixed(b, p)
+}
+
+// CtrlHashDataRequest is the payload of CMD_HASH_DATA.
+type CtrlHashDataRequest struct {
+	Data []byte
+}
+
+func (p *CtrlHashDataRequest) MarshalCtrl() []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(p.Data)))
+	return append(b, p.Data...)
+}
+
+func (p *CtrlHashDataRequest) UnmarshalCtrl(b []byte) error {
+	if len(b) < 4 {
+		return fmt.Errorf("control payload too short: %d bytes", len(b))
+	}
+	length := binary.BigEndian.Uint32(b)
+	if uint64(length) > uint64(len(b)-4) {
+		return fmt.Errorf("hash data length %d exceeds payload size %d", length, len(b)-4)
+	}
+	p.Data = b[4 : 4+length]
+	return nil
+}
+
+// CtrlGetStateBlobRequest is the payload of CMD_GET_STATEBLOB.
+type CtrlGetStateBlobRequest struct {
+	StateFlags uint32
+	Type       uint32
+	Offset     uint32
+}
+
+func (p *CtrlGetStateBlobRequest) MarshalCtrl() []byte {
+	return marshalCtrlFixed(p)
+}
+
+func (p *CtrlGetStateBlobRequest) UnmarshalCtrl(b []byte) error {
+	return unmarshalCtrlFixed(b, p)
+}
+
+// CtrlSetStateBlobRequest is the payload of CMD_SET_STATEBLOB.
+// Length is the announced blob length; Data holds the bytes of the blob that
+// are part of this message, which may be fewer than Length.
+type CtrlSetStateBlobRequest struct {
+	StateFlags uint32
+	Type       uint32
+	Length     uint32
+	Data       []byte
+}
+
+func (p *CtrlSetStateBlobRequest) MarshalCtrl() []byte {
+	b := marshalCtrlFixed([]uint32{p.StateFlags, p.Type, p.Length})
+	return append(b, p.Data...)
+}
+
+func (p *CtrlSetStateBlobRequest) UnmarshalCtrl(b []byte) error {
+	var fixed [3]uint32
+	if err := unmarshalCtrlFixed(b, &fixed); err != nil {
+		return err
+	}
+	p.StateFlags, p.Type, p.Length = fixed[0], fixed[1], fixed[2]
+	p.Data = b[12:]
+	return nil
+}
+
+// CtrlSetBufferSizeRequest is the payload of CMD_SET_BUFFERSIZE.
+// A BufferSize of zero queries the current size.
+type CtrlSetBufferSizeRequest struct {
+	BufferSize uint32
+}
+
+func (p *CtrlSetBufferSizeRequest) MarshalCtrl() []byte {
+	return marshalCtrlFixed(p)
+}
+
+func (p *CtrlSetBufferSizeRequest) UnmarshalCtrl(b []byte) error {
+	return unmarshalCtrlFixed(b, p)
+}
+
+// CtrlGetInfoRequest is the payload of CMD_GET_INFO.
+type CtrlGetInfoRequest struct {
+	Flags  uint64
+	Offset uint32
+	_      uint32
+}
+
+func (p *CtrlGetInfoRequest) MarshalCtrl() []byte {
+	return marshalCtrlFixed(p)
+}
+
+func (p *CtrlGetInfoRequest) UnmarshalCtrl(b []byte) error {
+	return unmarshalCtrlFixed(b, p)
+}
+
+// CtrlLockStorageRequest is the payload of CMD_LOCK_STORAGE.
+type CtrlLockStorageRequest struct {
+	Retries uint32
+}
+
+func (p *CtrlLockStorageRequest) MarshalCtrl() []byte {
+	return marshalCtrlFixed(p)
+}
+
+func (p *CtrlLockStorageRequest) UnmarshalCtrl(b []byte) error {
+	return unmarshalCtrlFixed(b, p)
+}
+
+// CtrlResultResponse is the response of commands that only return a result code.
+type CtrlResultResponse struct {
+	Result uint32
+}
+
+func (p *CtrlResultResponse) MarshalCtrl() []byte {
+	return marshalCtrlFixed(p)
+}
+
+func (p *CtrlResultResponse) UnmarshalCtrl(b []byte) error {
+	return unmarshalCtrlFixed(b, p)
+}
+
+// CtrlCapabilityResponse is the response of CMD_GET_CAPABILITY.
+// It carries no result code.
+type CtrlCapabilityResponse struct {
+	Caps uint64
+}
+
+func (p *CtrlCapabilityResponse) MarshalCtrl() []byte {
+	return marshalCtrlFixed(p)
+}
+
+func (p *CtrlCapabilityResponse) UnmarshalCtrl(b []byte) error {
+	return unmarshalCtrlFixed(b, p)
+}
+
+// CtrlEstablishedResponse is the response of CMD_GET_TPMESTABLISHED.
+type CtrlEstablishedResponse struct {
+	Result uint32
+	Bit    uint8
+	_      [3]byte
+}
+
+func (p *CtrlEstablishedResponse) MarshalCtrl() []byte {
+	return marshalCtrlFixed(p)
+}
+
+func (p *CtrlEstablishedResponse) UnmarshalCtrl(b []byte) error {
+	if ok, err := unmarshalCtrlResult(b, &p.Result); !ok || err != nil {
+		return err
+	}
+	return unmarshalCtrlFixed(b, p)
+}
+
+// CtrlGetStateBlobResponse is the response of CMD_GET_STATEBLOB.
+type CtrlGetStateBlobResponse struct {
+	Result      uint32
+	StateFlags  uint32
+	TotalLength uint32
+	Data        []byte
+}
+
+func (p *CtrlGetStateBlobResponse) MarshalCtrl() []byte {
+	b := marshalCtrlFixed([]uint32{p.Result, p.StateFlags, p.TotalLength, uint32(len(p.Data))})
+	return append(b, p.Data...)
+}
+
+func (p *CtrlGetStateBlobResponse) UnmarshalCtrl(b []byte) error {
+	if ok, err := unmarshalCtrlResult(b, &p.Result); !ok || err != nil {
+		return err
+	}
+	var fixed [4]uint32
+	if err := unmarshalCtrlFixed(b, &fixed); err != nil {
+		return err
+	}
+	p.StateFlags, p.TotalLength = fixed[1], fixed[2]
+	p.Data = b[16:]
+	if length := fixed[3]; uint64(length) < uint64(len(p.Data)) {
+		p.Data = p.Data[:length]
+	}
+	return nil
+}
+
+// CtrlGetConfigResponse is the response of CMD_GET_CONFIG.
+type CtrlGetConfigResponse struct {
+	Result uint32
+	Flags  uint32
+}
+
+func (p *CtrlGetConfigResponse) MarshalCtrl() []byte {
+	return marshalCtrlFixed(p)
+}
+
+func (p *CtrlGetConfigResponse) UnmarshalCtrl(b []byte) error {
+	if ok, err := unmarshalCtrlResult(b, &p.Result); !ok || err != nil {
+		return err
+	}
+	return unmarshalCtrlFixed(b, p)
+}
+
+// CtrlSetBufferSizeResponse is the response of CMD_SET_BUFFERSIZE.
+type CtrlSetBufferSizeResponse struct {
+	Result     uint32
+	BufferSize uint32
+	MinSize    uint32
+	MaxSize    uint32
+}
+
+func (p *CtrlSetBufferSizeResponse) MarshalCtrl() []byte {
+	return marshalCtrlFixed(p)
+}
+
+func (p *CtrlSetBufferSizeResponse) UnmarshalCtrl(b []byte) error {
+	if ok, err := unmarshalCtrlResult(b, &p.Result); !ok || err != nil {
+		return err
+	}
+	return unmarshalCtrlFixed(b, p)
+}
+
+// CtrlGetInfoResponse is the response of CMD_GET_INFO.
+type CtrlGetInfoResponse struct {
+	Result      uint32
+	TotalLength uint32
+	Data        []byte
+}
+
+func (p *CtrlGetInfoResponse) MarshalCtrl() []byte {
+	b := marshalCtrlFixed([]uint32{p.Result, p.TotalLength, uint32(len(p.Data))})
+	return append(b, p.Data...)
+}
+
+func (p *CtrlGetInfoResponse) UnmarshalCtrl(b []byte) error {
+	if ok, err := unmarshalCtrlResult(b, &p.Result); !ok || err != nil {
+		return err
+	}
+	var fixed [3]uint32
+	if err := unmarshalCtrlFixed(b, &fixed); err != nil {
+		return err
+	}
+	p.TotalLength = fixed[1]
+	p.Data = b[12:]
+	if length := fixed[2]; uint64(length) < uint64(len(p.Data)) {
+		p.Data = p.Data[:length]
+	}
+	return nil
+}
+
+// NewCtrlRequestPayload returns a zero-valued request payload for the command.
+func NewCtrlRequestPayload(cmd CtrlCmd) CtrlPayload {
+	switch cmd {
+	case CtrlCmdInit:
+		return &CtrlInitRequest{}
+	case CtrlCmdSetLocality, CtrlCmdResetTpmEstablished:
+		return &CtrlLocalityRequest{}
+	case CtrlCmdHashData:
+		return &CtrlHashDataRequest{}
+	case CtrlCmdGetStateBlob:
+		return &CtrlGetStateBlobRequest{}
+	case CtrlCmdSetStateBlob:
+		return &CtrlSetStateBlobRequest{}
+	case CtrlCmdSetBufferSize:
+		return &CtrlSetBufferSizeRequest{}
+	case CtrlCmdGetInfo:
+		return &CtrlGetInfoRequest{}
+	case CtrlCmdLockStorage:
+		return &CtrlLockStorageRequest{}
+	default:
+		return &CtrlEmpty{}
+	}
+}
+
+// NewCtrlResponsePayload returns a zero-valued response payload for the command.
+func NewCtrlResponsePayload(cmd CtrlCmd) CtrlPayload {
+	switch cmd {
+	case CtrlCmdGetCapability:
+		return &CtrlCapabilityResponse{}
+	case CtrlCmdGetTpmEstablished:
+		return &CtrlEstablishedResponse{}
+	case CtrlCmdGetStateBlob:
+		return &CtrlGetStateBlobResponse{}
+	case CtrlCmdGetConfig:
+		return &CtrlGetConfigResponse{}
+	case CtrlCmdSetBufferSize:
+		return &CtrlSetBufferSizeResponse{}
+	case CtrlCmdGetInfo:
+		return &CtrlGetInfoResponse{}
+	default:
+		return &CtrlResultResponse{}
+	}
+}
+
+// CtrlRequestSize returns the total size of the control channel request
+// beginning with b.
+// If b is too short to tell, it returns the number of bytes needed to
+// determine the size. For unknown commands, it returns len(b).
+func CtrlRequestSize(b []byte) int {
+	if len(b) < 4 {
+		return 4
+	}
+	switch CtrlCmd(binary.BigEndian.Uint32(b)) {
+	case CtrlCmdGetCapability, CtrlCmdShutdown, CtrlCmdGetTpmEstablished,
+		CtrlCmdHashStart, CtrlCmdHashEnd, CtrlCmdCancelTpmCmd,
+		CtrlCmdStoreVolatile, CtrlCmdStop, CtrlCmdGetConfig, CtrlCmdSetDatafd:
+		return 4
+	case CtrlCmdSetLocality, CtrlCmdResetTpmEstablished:
+		return 5
+	case CtrlCmdInit, CtrlCmdSetBufferSize, CtrlCmdLockStorage:
+		return 8
+	case CtrlCmdGetStateBlob:
+		return 16
+	case CtrlCmdGetInfo:
+		return 20
+	case CtrlCmdHashData:
+		if len(b) < 8 {
+			return 8
+		}
+		return 8 + int(binary.BigEndian.Uint32(b[4:]))
+	case CtrlCmdSetStateBlob:
+		if len(b) < 16 {
+			return 16
+		}
+		return 16 + int(binary.BigEndian.Uint32(b[12:]))
+	default:
+		return len(b)
+	}
+}
+
+// CtrlResponseSize returns the total size of the response to the command
+// beginning with b.
+// If b is too short to tell, it returns the number of bytes needed to
+// determine the size. Failed commands only carry the result code.
+func CtrlResponseSize(cmd CtrlCmd, b []byte) int {
+	if cmd == CtrlCmdGetCapability {
+		return 8
+	}
+	if len(b) < 4 {
+		return 4
+	}
+	if binary.BigEndian.Uint32(b) != CtrlResultSuccess {
+		return 4
+	}
+	switch cmd {
+	case CtrlCmdGetTpmEstablished, CtrlCmdGetConfig:
+		return 8
+	case CtrlCmdSetBufferSize:
+		return 16
+	case CtrlCmdGetStateBlob:
+		if len(b) < 16 {
+			return 16
+		}
+		return 16 + int(binary.BigEndian.Uint32(b[12:]))
+	case CtrlCmdGetInfo:
+		if len(b) < 12 {
+			return 12
+		}
+		return 12 + int(binary.BigEndian.Uint32(b[8:]))
+	default:
+		return 4
+	}
+}
+
+// ReadCtrlMessage completes a control channel message whose first bytes are
+// in msg by reading from r until size reports that it is complete.
+func ReadCtrlMessage(r io.Reader, msg []byte, size func([]byte) int) ([]byte, error) {
+	for {
+		n := size(msg)
+		if n <= len(msg) {
+			return msg, nil
+		}
+		if n > DefaultMaxMessageSize*16 {
+			return nil, fmt.Errorf("control message too large: %d bytes", n)
+		}
+		rest := make([]byte, n-len(msg))
+		if _, err := io.ReadFull(r, rest); err != nil {
+			return nil, err
+		}
+		msg = append(msg, rest...)
+	}
+}
+
+// CtrlRequest is a struct that contains a control channel command code and raw request.
+type CtrlRequest struct {
+	// Cmd is the control command code.
+	Cmd CtrlCmd
+	// Raw is the raw request including the command code.
+	Raw []byte
+}
+
+// ParseCtrlRequest parses the command code of a raw control channel request.
+func ParseCtrlRequest(raw []byte) (*CtrlRequest, error) {
+	if len(raw) < 4 {
+		return nil, fmt.Errorf("control request too short: %d bytes", len(raw))
+	}
+	return &CtrlRequest{
+		Cmd: CtrlCmd(binary.BigEndian.Uint32(raw)),
+		Raw: raw,
+	}, nil
+}
+
+// Payload decodes the request parameters into a typed payload.
+func (r *CtrlRequest) Payload() (CtrlPayload, error) {
+	if len(r.Raw) < 4 {
+		return nil, errors.New("control request has no command code")
+	}
+	p := NewCtrlRequestPayload(r.Cmd)
+	if err := p.UnmarshalCtrl(r.Raw[4:]); err != nil {
+		return nil, fmt.Errorf("unmarshalling %v request: %w", r.Cmd, err)
+	}
+	return p, nil
+}
+
+// ParseCtrlResponse decodes a raw control channel response to the command
+// into a typed payload.
+func ParseCtrlResponse(cmd CtrlCmd, raw []byte) (CtrlPayload, error) {
+	p := NewCtrlResponsePayload(cmd)
+	if err := p.UnmarshalCtrl(raw); err != nil {
+		return nil, fmt.Errorf("unmarshalling %v response: %w", cmd, err)
+	}
+	return p, nil
+}
+
+// ctrlSetLocality returns the locality set by the request if it is a
+// CMD_SET_LOCALITY the response reports successful.
+func ctrlSetLocality(request, response []byte) (uint8, bool) {
+	req, err := ParseCtrlRequest(request)
+	if err != nil || req.Cmd != CtrlCmdSetLocality {
+		return 0, false
+	}
+	p, err := req.Payload()
+	if err != nil {
+		return 0, false
+	}
+	rsp, err := ParseCtrlResponse(req.Cmd, response)
+	if err != nil || rsp.(*CtrlResultResponse).Result != CtrlResultSuccess {
+		return 0, false
+	}
+	return p.(*CtrlLocalityRequest).Locality, true
+}
+
+// MarshalCtrlRequest serializes a control channel request.
+func MarshalCtrlRequest(cmd CtrlCmd, payload CtrlPayload) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(cmd))
+	if payload != nil {
+		b = append(b, payload.MarshalCtrl()...)
+	}
+	return b
+}
+
+// NewCtrlErrorResponse builds a response to the command that only carries
+// the result code.
+// For CMD_GET_CAPABILITY, which has no result code, it reports no capabilities.
+func NewCtrlErrorResponse(cmd CtrlCmd, result uint32) []byte {
+	if cmd == CtrlCmdGetCapability {
+		return (&CtrlCapabilityResponse{}).MarshalCtrl()
+	}
+	return (&CtrlResultResponse{Result: result}).MarshalCtrl()
+}
+
+// CtrlInterceptor is an interface that intercepts control channel requests and responses.
+type CtrlInterceptor interface {
+	// HandleCtrlRequest handles a request and returns a modified request.
+	// Returning nil blocks the request: it is not forwarded and
+	// HandleCtrlResponse is called with a nil response.
+	HandleCtrlRequest(request *CtrlRequest) []byte
+	// HandleCtrlResponse handles a response and returns a modified response.
+	HandleCtrlResponse(request *CtrlRequest, response []byte) []byte
+}
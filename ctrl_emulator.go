@@ -0,0 +1,152 @@
+package tpmproxy
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	// DefaultCtrlEmulatorCaps are the capabilities reported by CtrlEmulator.
+	// They cover what QEMU's emulator backend requires of a TPM 2.0.
+	DefaultCtrlEmulatorCaps = CtrlCapInit | CtrlCapShutdown | CtrlCapGetTpmEstablished |
+		CtrlCapSetLocality | CtrlCapResetTpmEstablished | CtrlCapStop |
+		CtrlCapGetConfig | CtrlCapSetDatafd | CtrlCapSetBufferSize
+	// DefaultCtrlEmulatorBufferSize is the buffer size reported by CtrlEmulator.
+	DefaultCtrlEmulatorBufferSize = 4096
+)
+
+// CtrlEmulator is a Forwarder that answers swtpm control channel requests
+// locally.
+// It allows serving a TPM without a control channel, such as a hardware TPM
+// opened with IoForwarderFactory, to QEMU's emulator backend.
+// The TPM state is not touched; CMD_INIT and the like simply succeed.
+type CtrlEmulator struct {
+	// Caps are the capabilities reported by CMD_GET_CAPABILITY.
+	Caps uint64
+	// BufferSize is the buffer size reported by CMD_SET_BUFFERSIZE.
+	BufferSize uint32
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	locality uint8
+	pending  []byte
+	closed   bool
+}
+
+// NewCtrlEmulator creates a new CtrlEmulator.
+func NewCtrlEmulator() *CtrlEmulator {
+	e := &CtrlEmulator{
+		Caps:       DefaultCtrlEmulatorCaps,
+		BufferSize: DefaultCtrlEmulatorBufferSize,
+	}
+	e.cond = sync.NewCond(&e.mu)
+	return e
+}
+
+// Locality returns the locality last set by CMD_SET_LOCALITY.
+func (e *CtrlEmulator) Locality() uint8 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.locality
+}
+
+// Write handles a complete control channel request.
+func (e *CtrlEmulator) Write(p []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return 0, net.ErrClosed
+	}
+	e.pending = append(e.pending, e.handle(p)...)
+	e.cond.Broadcast()
+	return len(p), nil
+}
+
+// Read reads the responses of the requests written so far.
+func (e *CtrlEmulator) Read(p []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for len(e.pending) == 0 && !e.closed {
+		e.cond.Wait()
+	}
+	if len(e.pending) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, e.pending)
+	e.pending = e.pending[n:]
+	return n, nil
+}
+
+func (e *CtrlEmulator) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	e.cond.Broadcast()
+	return nil
+}
+
+// handle returns the response to the request. The caller must hold e.mu.
+func (e *CtrlEmulator) handle(raw []byte) []byte {
+	req, err := ParseCtrlRequest(raw)
+	if err != nil {
+		return NewCtrlErrorResponse(0, CtrlResultBadParameter)
+	}
+	payload, err := req.Payload()
+	if err != nil || len(raw) < CtrlRequestSize(raw) {
+		return NewCtrlErrorResponse(req.Cmd, CtrlResultBadParameter)
+	}
+
+	switch req.Cmd {
+	case CtrlCmdGetCapability:
+		return (&CtrlCapabilityResponse{Caps: e.Caps}).MarshalCtrl()
+	case CtrlCmdSetLocality:
+		locality := payload.(*CtrlLocalityRequest).Locality
+		if locality > 4 {
+			return NewCtrlErrorResponse(req.Cmd, CtrlResultBadParameter)
+		}
+		e.locality = locality
+		return (&CtrlResultResponse{}).MarshalCtrl()
+	case CtrlCmdGetTpmEstablished:
+		return (&CtrlEstablishedResponse{}).MarshalCtrl()
+	case CtrlCmdGetConfig:
+		return (&CtrlGetConfigResponse{}).MarshalCtrl()
+	case CtrlCmdSetBufferSize:
+		return (&CtrlSetBufferSizeResponse{
+			BufferSize: e.BufferSize,
+			MinSize:    e.BufferSize,
+			MaxSize:    e.BufferSize,
+		}).MarshalCtrl()
+	case CtrlCmdInit, CtrlCmdShutdown, CtrlCmdStop, CtrlCmdResetTpmEstablished, CtrlCmdSetDatafd:
+		return (&CtrlResultResponse{}).MarshalCtrl()
+	default:
+		return NewCtrlErrorResponse(req.Cmd, CtrlResultBadOrdinal)
+	}
+}
+
+// CtrlEmulatorForwarderFactory is a ForwarderFactory that creates CtrlEmulators.
+type CtrlEmulatorForwarderFactory struct {
+	// Caps are the capabilities reported by the CtrlEmulators.
+	// If zero, DefaultCtrlEmulatorCaps is used.
+	Caps uint64
+	// BufferSize is the buffer size reported by the CtrlEmulators.
+	// If zero, DefaultCtrlEmulatorBufferSize is used.
+	BufferSize uint32
+}
+
+// NewCtrlEmulatorForwarderFactory creates a new CtrlEmulatorForwarderFactory.
+func NewCtrlEmulatorForwarderFactory() *CtrlEmulatorForwarderFactory {
+	return &CtrlEmulatorForwarderFactory{}
+}
+
+// NewForwarder creates a new CtrlEmulator.
+func (f *CtrlEmulatorForwarderFactory) NewForwarder() (Forwarder, error) {
+	e := NewCtrlEmulator()
+	if f.Caps != 0 {
+		e.Caps = f.Caps
+	}
+	if f.BufferSize != 0 {
+		e.BufferSize = f.BufferSize
+	}
+	return e, nil
+}
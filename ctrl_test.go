@@ -0,0 +1,107 @@
+package tpmproxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestParseCtrlRequest(t *testing.T) {
+	raw, _ := hex.DecodeString("0000000500000003")
+	req, err := ParseCtrlRequest(raw[:5])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Cmd != CtrlCmdSetLocality {
+		t.Errorf("got %v, want %v", req.Cmd, CtrlCmdSetLocality)
+	}
+	p, err := req.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc, ok := p.(*CtrlLocalityRequest)
+	if !ok || loc.Locality != 0 {
+		t.Errorf("unexpected payload %+v", p)
+	}
+
+	loc.Locality = 3
+	if got := MarshalCtrlRequest(req.Cmd, loc); !bytes.Equal(got, []byte{0, 0, 0, 5, 3}) {
+		t.Errorf("got %x", got)
+	}
+
+	if _, err := ParseCtrlRequest([]byte{0, 0}); err == nil {
+		t.Error("expected error for short request")
+	}
+}
+
+func TestParseCtrlResponse(t *testing.T) {
+	caps, _ := hex.DecodeString("0000000000017fff")
+	p, err := ParseCtrlResponse(CtrlCmdGetCapability, caps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.(*CtrlCapabilityResponse).Caps&CtrlCapSetDatafd == 0 {
+		t.Errorf("unexpected caps %+v", p)
+	}
+
+	bufsize, _ := hex.DecodeString("00000000000010000000040000001000")
+	p, err = ParseCtrlResponse(CtrlCmdSetBufferSize, bufsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := p.(*CtrlSetBufferSizeResponse); r.BufferSize != 0x1000 || r.MinSize != 0x400 || r.MaxSize != 0x1000 {
+		t.Errorf("unexpected response %+v", r)
+	}
+	if got := p.MarshalCtrl(); !bytes.Equal(got, bufsize) {
+		t.Errorf("got %x, want %x", got, bufsize)
+	}
+
+	// failing commands only carry the result code
+	p, err = ParseCtrlResponse(CtrlCmdGetStateBlob, []byte{0, 0, 0, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := p.(*CtrlGetStateBlobResponse); r.Result != CtrlResultBadParameter {
+		t.Errorf("unexpected response %+v", r)
+	}
+
+	blob, _ := hex.DecodeString("0000000000000000000000030000000361626364")
+	p, err = ParseCtrlResponse(CtrlCmdGetStateBlob, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := p.(*CtrlGetStateBlobResponse); r.TotalLength != 3 || string(r.Data) != "abc" {
+		t.Errorf("unexpected response %+v", r)
+	}
+}
+
+type blockingCtrlInterceptor struct {
+}
+
+func (it *blockingCtrlInterceptor) HandleCtrlRequest(request *CtrlRequest) []byte {
+	if request.Cmd == CtrlCmdShutdown {
+		return nil
+	}
+	return request.Raw
+}
+
+func (it *blockingCtrlInterceptor) HandleCtrlResponse(request *CtrlRequest, response []byte) []byte {
+	return response
+}
+
+func TestCtrlRequestResponseHandlerBlock(t *testing.T) {
+	f := &CtrlRequestResponseHandlerFactory{Interceptor: &blockingCtrlInterceptor{}}
+
+	h := f.NewRequestResponseHandler()
+	if got := h.HandleRequest([]byte{0, 0, 0, 3}); got != nil {
+		t.Fatalf("request not blocked: %x", got)
+	}
+	if got := h.HandleResponse(nil); !bytes.Equal(got, []byte{0, 0, 0, byte(CtrlResultFail)}) {
+		t.Errorf("got %x", got)
+	}
+
+	h = f.NewRequestResponseHandler()
+	if got := h.HandleRequest([]byte{0, 0, 0, 2, 0, 0, 0, 0}); len(got) != 8 {
+		t.Errorf("got %x", got)
+	}
+}
@@ -0,0 +1,494 @@
+package tpmproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// Opcodes of the FUSE kernel protocol used by CUSE, from linux/fuse.h.
+const (
+	fuseOpen      = 14
+	fuseRead      = 15
+	fuseWrite     = 16
+	fuseRelease   = 18
+	fuseFsync     = 20
+	fuseFlush     = 25
+	fuseInterrupt = 36
+	fuseDestroy   = 38
+	fuseIoctl     = 39
+	fusePoll      = 40
+	cuseInit      = 4096
+)
+
+const (
+	fuseKernelVersion = 7
+	// fuseKernelMinorVersion is the highest minor version spoken.
+	// CUSE requires at least 11.
+	fuseKernelMinorVersion = 31
+	fuseMinMinorVersion    = 11
+
+	fuseInHeaderSize  = 40
+	fuseOutHeaderSize = 16
+
+	// fuseNotifyPoll is FUSE_NOTIFY_POLL, sent in the error field of a
+	// notification.
+	fuseNotifyPoll = 1
+	// fusePollScheduleNotify is FUSE_POLL_SCHEDULE_NOTIFY.
+	fusePollScheduleNotify = 1
+	// fopenDirectIo and fopenNonseekable are FOPEN_DIRECT_IO and FOPEN_NONSEEKABLE.
+	fopenDirectIo    = 1 << 0
+	fopenNonseekable = 1 << 2
+
+	pollIn     = 0x001
+	pollOut    = 0x004
+	pollRdNorm = 0x040
+	pollWrNorm = 0x100
+)
+
+// fuseInHeader is struct fuse_in_header.
+type fuseInHeader struct {
+	Len     uint32
+	Opcode  uint32
+	Unique  uint64
+	NodeId  uint64
+	Uid     uint32
+	Gid     uint32
+	Pid     uint32
+	Padding uint32
+}
+
+// cuseInitIn is struct cuse_init_in.
+type cuseInitIn struct {
+	Major  uint32
+	Minor  uint32
+	Unused uint32
+	Flags  uint32
+}
+
+// cuseInitOut is struct cuse_init_out.
+type cuseInitOut struct {
+	Major    uint32
+	Minor    uint32
+	Unused   uint32
+	Flags    uint32
+	MaxRead  uint32
+	MaxWrite uint32
+	DevMajor uint32
+	DevMinor uint32
+	Spare    [10]uint32
+}
+
+// fuseOpenOut is struct fuse_open_out.
+type fuseOpenOut struct {
+	Fh        uint64
+	OpenFlags uint32
+	Padding   uint32
+}
+
+// fuseReadIn is struct fuse_read_in. fuse_write_in has the same layout.
+type fuseReadIn struct {
+	Fh        uint64
+	Offset    uint64
+	Size      uint32
+	ReadFlags uint32
+	LockOwner uint64
+	Flags     uint32
+	Padding   uint32
+}
+
+// fuseWriteOut is struct fuse_write_out.
+type fuseWriteOut struct {
+	Size    uint32
+	Padding uint32
+}
+
+// fuseReleaseIn is struct fuse_release_in.
+type fuseReleaseIn struct {
+	Fh           uint64
+	Flags        uint32
+	ReleaseFlags uint32
+	LockOwner    uint64
+}
+
+// fuseIoctlIn is struct fuse_ioctl_in.
+type fuseIoctlIn struct {
+	Fh      uint64
+	Flags   uint32
+	Cmd     uint32
+	Arg     uint64
+	InSize  uint32
+	OutSize uint32
+}
+
+// fuseIoctlOut is struct fuse_ioctl_out.
+type fuseIoctlOut struct {
+	Result  int32
+	Flags   uint32
+	InIovs  uint32
+	OutIovs uint32
+}
+
+// fusePollIn is struct fuse_poll_in.
+type fusePollIn struct {
+	Fh     uint64
+	Kh     uint64
+	Flags  uint32
+	Events uint32
+}
+
+// fusePollOut is struct fuse_poll_out.
+type fusePollOut struct {
+	Revents uint32
+	Padding uint32
+}
+
+// fuseNotifyPollWakeupOut is struct fuse_notify_poll_wakeup_out.
+type fuseNotifyPollWakeupOut struct {
+	Kh uint64
+}
+
+// CuseServer is a CUSE character device server that speaks the FUSE kernel
+// protocol on /dev/cuse directly, without cgo or libfuse.
+// Each open of the device gets its own Forwarder from ForwarderFactory,
+// which is closed when the file is released.
+// If CtrlForwarderFactory is set, the device also answers the PTM_* ioctls of
+// swtpm's CUSE interface by translating them to the control channel
+// commands, so that it can replace "swtpm cuse" for QEMU and swtpm_ioctl.
+// CuseServer requires root privilege and the cuse module.
+type CuseServer struct {
+	// DevName is the name of the created device under /dev.
+	DevName string
+	// CusePath is the path of the CUSE control device.
+	CusePath         string
+	ForwarderFactory ForwarderFactory
+	Interceptor      Interceptor
+	// CtrlForwarderFactory creates the connection to the control channel
+	// the PTM_* ioctls are sent to, such as swtpm's or a CtrlEmulator.
+	// If nil, the device has no ioctls.
+	CtrlForwarderFactory ForwarderFactory
+	// CtrlInterceptor intercepts the control channel messages of the ioctls.
+	CtrlInterceptor CtrlInterceptor
+	// MaxMessageSize is the maximum size of a read or write of the device.
+	// If it is not positive, DefaultMaxMessageSize is used.
+	MaxMessageSize int
+
+	sessions *cuseSessionTable
+	ptm      *ptmChannel
+	dev      io.ReadWriteCloser
+	writeMu  sync.Mutex
+}
+
+// NewCuseServer creates a new CuseServer.
+func NewCuseServer(devname string, forwarderFactory ForwarderFactory, interceptor Interceptor) *CuseServer {
+	return &CuseServer{
+		DevName:          devname,
+		CusePath:         "/dev/cuse",
+		ForwarderFactory: forwarderFactory,
+		Interceptor:      interceptor,
+	}
+}
+
+// Serve creates the device and serves it until the device is removed or the
+// server is closed.
+func (s *CuseServer) Serve() error {
+	fd, err := syscall.Open(s.CusePath, syscall.O_RDWR|syscall.O_CLOEXEC|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: s.CusePath, Err: err}
+	}
+	// The file is pollable so that closing it interrupts a pending read.
+	return s.serve(&cuseDevice{os.NewFile(uintptr(fd), s.CusePath)})
+}
+
+// Close removes the device and closes all the opened sessions.
+func (s *CuseServer) Close() error {
+	if s.dev == nil {
+		return nil
+	}
+	return s.dev.Close()
+}
+
+func (s *CuseServer) maxMessageSize() int {
+	if s.MaxMessageSize > 0 {
+		return s.MaxMessageSize
+	}
+	return DefaultMaxMessageSize
+}
+
+// serve serves the requests read from dev. Each read of dev returns a single
+// request and each write to dev is a single reply.
+func (s *CuseServer) serve(dev io.ReadWriteCloser) error {
+	s.dev = dev
+	s.sessions = newCuseSessionTable()
+	defer func() {
+		for _, session := range s.sessions.removeAll() {
+			session.Close()
+		}
+	}()
+	if s.CtrlForwarderFactory != nil {
+		s.ptm = newPtmChannel(s.CtrlForwarderFactory, s.CtrlInterceptor)
+		defer s.ptm.Close()
+	}
+
+	// the buffer must hold a write request of the maximum size
+	bufSize := fuseInHeaderSize + binary.Size(fuseReadIn{}) + s.maxMessageSize()
+	if bufSize < 8192 {
+		bufSize = 8192 // FUSE_MIN_READ_BUFFER
+	}
+	for {
+		buf := make([]byte, bufSize)
+		n, err := dev.Read(buf)
+		if errors.Is(err, syscall.ENODEV) || errors.Is(err, os.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n < fuseInHeaderSize {
+			return fmt.Errorf("short cuse request: %d bytes", n)
+		}
+		var hdr fuseInHeader
+		decodeFuse(buf, &hdr)
+		body := buf[fuseInHeaderSize:n]
+
+		switch hdr.Opcode {
+		case cuseInit:
+			if err := s.init(&hdr, body); err != nil {
+				return err
+			}
+		case fuseDestroy:
+			s.reply(&hdr, 0)
+			return nil
+		case fuseInterrupt:
+			// the requests are not interruptible, and interrupts get no reply
+		default:
+			// requests such as reads block until the response arrives
+			go s.handle(&hdr, body)
+		}
+	}
+}
+
+func (s *CuseServer) init(hdr *fuseInHeader, body []byte) error {
+	var in cuseInitIn
+	decodeFuse(body, &in)
+	if in.Major != fuseKernelVersion || in.Minor < fuseMinMinorVersion {
+		s.reply(hdr, syscall.EPROTO)
+		return fmt.Errorf("unsupported fuse kernel protocol %d.%d", in.Major, in.Minor)
+	}
+	out := cuseInitOut{
+		Major:    fuseKernelVersion,
+		Minor:    min(in.Minor, fuseKernelMinorVersion),
+		MaxRead:  uint32(s.maxMessageSize()),
+		MaxWrite: uint32(s.maxMessageSize()),
+	}
+	devInfo := []byte("DEVNAME=" + s.DevName + "\x00")
+	if err := s.reply(hdr, 0, &out, devInfo); err != nil {
+		return err
+	}
+	log.Printf("cuse device created: /dev/%s\n", s.DevName)
+	return nil
+}
+
+func (s *CuseServer) handle(hdr *fuseInHeader, body []byte) {
+	var err error
+	switch hdr.Opcode {
+	case fuseOpen:
+		err = s.open(hdr)
+	case fuseRead:
+		err = s.read(hdr, body)
+	case fuseWrite:
+		err = s.write(hdr, body)
+	case fuseRelease:
+		var in fuseReleaseIn
+		decodeFuse(body, &in)
+		if session := s.sessions.remove(in.Fh); session != nil {
+			session.Close()
+		}
+		err = s.reply(hdr, 0)
+	case fuseIoctl:
+		err = s.ioctl(hdr, body)
+	case fusePoll:
+		err = s.poll(hdr, body)
+	case fuseFlush, fuseFsync:
+		err = s.reply(hdr, 0)
+	default:
+		err = s.reply(hdr, syscall.ENOSYS)
+	}
+	if err != nil {
+		log.Printf("cuse reply error: %v\n", err)
+	}
+}
+
+func (s *CuseServer) open(hdr *fuseInHeader) error {
+	if s.ForwarderFactory == nil {
+		return s.reply(hdr, syscall.ENODEV)
+	}
+	var locality func() uint8
+	if s.ptm != nil {
+		locality = s.ptm.Locality
+	}
+	session, err := newCuseSession(s.ForwarderFactory, s.Interceptor, locality)
+	if err != nil {
+		log.Printf("cuse open error: %v\n", err)
+		return s.reply(hdr, syscall.EIO)
+	}
+	out := fuseOpenOut{
+		Fh:        s.sessions.add(session),
+		OpenFlags: fopenDirectIo | fopenNonseekable,
+	}
+	return s.reply(hdr, 0, &out)
+}
+
+func (s *CuseServer) read(hdr *fuseInHeader, body []byte) error {
+	var in fuseReadIn
+	decodeFuse(body, &in)
+	session := s.sessions.get(in.Fh)
+	if session == nil {
+		return s.reply(hdr, syscall.EBADF)
+	}
+	if in.Size == 0 {
+		return s.reply(hdr, syscall.EINVAL)
+	}
+	if in.Flags&syscall.O_NONBLOCK != 0 && !session.readable(nil) {
+		return s.reply(hdr, syscall.EAGAIN)
+	}
+
+	buffer := make([]byte, in.Size)
+	n, err := session.Read(buffer)
+	if err != nil || n == 0 {
+		return s.reply(hdr, syscall.EIO)
+	}
+	return s.reply(hdr, 0, buffer[:n])
+}
+
+func (s *CuseServer) write(hdr *fuseInHeader, body []byte) error {
+	var in fuseReadIn
+	size := decodeFuse(body, &in)
+	session := s.sessions.get(in.Fh)
+	if session == nil {
+		return s.reply(hdr, syscall.EBADF)
+	}
+	data := body[size:]
+	if in.Size == 0 || int(in.Size) > len(data) {
+		return s.reply(hdr, syscall.EINVAL)
+	}
+
+	n, err := session.Write(data[:in.Size])
+	if err != nil {
+		return s.reply(hdr, syscall.EIO)
+	}
+	return s.reply(hdr, 0, &fuseWriteOut{Size: uint32(n)})
+}
+
+// ioctl answers the PTM_* ioctls of the device. The ioctls are restricted,
+// so the kernel passes the input and output buffers sized by the ioctl number.
+func (s *CuseServer) ioctl(hdr *fuseInHeader, body []byte) error {
+	var in fuseIoctlIn
+	size := decodeFuse(body, &in)
+	if s.sessions.get(in.Fh) == nil {
+		return s.reply(hdr, syscall.EBADF)
+	}
+	if s.ptm == nil {
+		return s.reply(hdr, syscall.ENOTTY)
+	}
+
+	out, err := s.ptm.ioctl(in.Cmd, truncate(body[size:], int(in.InSize)), in.OutSize)
+	if errno, ok := err.(syscall.Errno); ok {
+		return s.reply(hdr, errno)
+	}
+	return s.reply(hdr, 0, &fuseIoctlOut{}, out)
+}
+
+// poll reports the device always writable and readable once a response is
+// queued. If requested, the kernel is notified when the response arrives.
+func (s *CuseServer) poll(hdr *fuseInHeader, body []byte) error {
+	var in fusePollIn
+	decodeFuse(body, &in)
+	session := s.sessions.get(in.Fh)
+	if session == nil {
+		return s.reply(hdr, syscall.EBADF)
+	}
+
+	var notify func()
+	if in.Flags&fusePollScheduleNotify != 0 {
+		notify = func() {
+			if err := s.notify(fuseNotifyPoll, &fuseNotifyPollWakeupOut{Kh: in.Kh}); err != nil {
+				log.Printf("cuse notify error: %v\n", err)
+			}
+		}
+	}
+	out := fusePollOut{Revents: pollOut | pollWrNorm}
+	if session.readable(notify) {
+		out.Revents |= pollIn | pollRdNorm
+	}
+	return s.reply(hdr, 0, &out)
+}
+
+// reply writes the reply to the request. A non-zero errno replies an error.
+// The values are either byte slices or pointers to fuse structs.
+func (s *CuseServer) reply(hdr *fuseInHeader, errno syscall.Errno, values ...interface{}) error {
+	return s.send(hdr.Unique, -int32(errno), values...)
+}
+
+// notify sends an unsolicited notification to the kernel.
+func (s *CuseServer) notify(code int32, values ...interface{}) error {
+	return s.send(0, code, values...)
+}
+
+func (s *CuseServer) send(unique uint64, errorField int32, values ...interface{}) error {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, fuseOutHeaderSize))
+	for _, v := range values {
+		if b, ok := v.([]byte); ok {
+			buf.Write(b)
+		} else if err := binary.Write(&buf, binary.NativeEndian, v); err != nil {
+			return err
+		}
+	}
+	msg := buf.Bytes()
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(len(msg)))
+	binary.NativeEndian.PutUint32(msg[4:8], uint32(errorField))
+	binary.NativeEndian.PutUint64(msg[8:16], unique)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err := s.dev.Write(msg)
+	if errors.Is(err, syscall.ENOENT) {
+		// the request was interrupted and has been aborted
+		return nil
+	}
+	return err
+}
+
+// decodeFuse decodes the fuse struct v at the beginning of b and returns
+// its size. Missing bytes are left zero.
+func decodeFuse(b []byte, v interface{}) int {
+	size := binary.Size(v)
+	if len(b) < size {
+		b = append(b[:len(b):len(b)], make([]byte, size-len(b))...)
+	}
+	binary.Read(bytes.NewReader(b[:size]), binary.NativeEndian, v)
+	return size
+}
+
+// cuseDevice is the opened CUSE control device.
+type cuseDevice struct {
+	*os.File
+}
+
+// Read reads the next request, skipping the interrupted ones.
+func (d *cuseDevice) Read(p []byte) (int, error) {
+	for {
+		n, err := d.File.Read(p)
+		if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		return n, err
+	}
+}
@@ -0,0 +1,241 @@
+package tpmproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+const (
+	// ptmStateBlobSize is PTM_STATE_BLOB_SIZE, the size of the state blob
+	// data carried by a PTM_GET_STATEBLOB or PTM_SET_STATEBLOB ioctl.
+	ptmStateBlobSize = 3 * 1024
+	// ptmInfoSize is the size of the buffer of PTM_GET_INFO.
+	ptmInfoSize = 3 * 1024
+	// ptmHashDataSize is the size of the data of PTM_HASH_DATA, which follows
+	// its length in struct ptm_hdata.
+	ptmHashDataSize = 4096
+
+	iocWrite = 1
+	iocRead  = 2
+)
+
+// ptmIoctl returns the number of a PTM_* ioctl, _IOC(dir, 'P', nr, size).
+func ptmIoctl(dir, nr, size uint32) uint32 {
+	return dir<<30 | size<<16 | 'P'<<8 | nr
+}
+
+// ptmIoctls maps the PTM_* ioctls of swtpm's CUSE interface to the control
+// channel commands, which are numbered in the same order from one.
+// PTM_SET_DATAFD is left out as it only makes sense on a socket.
+var ptmIoctls = map[uint32]CtrlCmd{
+	ptmIoctl(iocRead, 0, 8):                             CtrlCmdGetCapability,
+	ptmIoctl(iocRead|iocWrite, 1, 4):                    CtrlCmdInit,
+	ptmIoctl(iocRead, 2, 4):                             CtrlCmdShutdown,
+	ptmIoctl(iocRead, 3, 8):                             CtrlCmdGetTpmEstablished,
+	ptmIoctl(iocRead|iocWrite, 4, 4):                    CtrlCmdSetLocality,
+	ptmIoctl(iocRead, 5, 4):                             CtrlCmdHashStart,
+	ptmIoctl(iocRead|iocWrite, 6, 4+ptmHashDataSize):    CtrlCmdHashData,
+	ptmIoctl(iocRead, 7, 4):                             CtrlCmdHashEnd,
+	ptmIoctl(iocRead, 8, 4):                             CtrlCmdCancelTpmCmd,
+	ptmIoctl(iocRead, 9, 4):                             CtrlCmdStoreVolatile,
+	ptmIoctl(iocRead|iocWrite, 10, 4):                   CtrlCmdResetTpmEstablished,
+	ptmIoctl(iocRead|iocWrite, 11, 16+ptmStateBlobSize): CtrlCmdGetStateBlob,
+	ptmIoctl(iocRead|iocWrite, 12, 12+ptmStateBlobSize): CtrlCmdSetStateBlob,
+	ptmIoctl(iocRead, 13, 4):                            CtrlCmdStop,
+	ptmIoctl(iocRead, 14, 8):                            CtrlCmdGetConfig,
+	ptmIoctl(iocRead|iocWrite, 16, 16):                  CtrlCmdSetBufferSize,
+	ptmIoctl(iocRead|iocWrite, 17, 16+ptmInfoSize):      CtrlCmdGetInfo,
+	ptmIoctl(iocRead|iocWrite, 18, 4):                   CtrlCmdLockStorage,
+}
+
+// ptmChannel translates the PTM_* ioctls to control channel commands sent to
+// a backend such as swtpm's control channel or a CtrlEmulator.
+// The ioctl structures are in host byte order while the control channel is
+// big-endian; otherwise their layouts are the same.
+type ptmChannel struct {
+	forwarderFactory ForwarderFactory
+	handlerFactory   RequestResponseHandlerFactory
+
+	mu  sync.Mutex
+	fwd Forwarder
+	// stateBlob accumulates the chunks of a state blob being set.
+	stateBlob *CtrlSetStateBlobRequest
+
+	locality atomic.Uint32
+}
+
+// Locality returns the locality last set by PTM_SET_LOCALITY.
+func (c *ptmChannel) Locality() uint8 {
+	return uint8(c.locality.Load())
+}
+
+func newPtmChannel(forwarderFactory ForwarderFactory, interceptor CtrlInterceptor) *ptmChannel {
+	var handlerFactory RequestResponseHandlerFactory
+	if interceptor != nil {
+		handlerFactory = &CtrlRequestResponseHandlerFactory{
+			Interceptor: interceptor,
+		}
+	} else {
+		handlerFactory = &NopRequestResponseHandlerFactory{}
+	}
+	return &ptmChannel{
+		forwarderFactory: forwarderFactory,
+		handlerFactory:   handlerFactory,
+	}
+}
+
+// ioctl handles the ioctl with the input in and returns its output of outSize
+// bytes. Unknown ioctls fail with ENOTTY.
+func (c *ptmChannel) ioctl(cmd uint32, in []byte, outSize uint32) ([]byte, error) {
+	ctrlCmd, ok := ptmIoctls[cmd]
+	if !ok {
+		return nil, syscall.ENOTTY
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var response []byte
+	if payload := c.request(ctrlCmd, in); payload != nil {
+		var err error
+		if response, err = c.exchange(ctrlCmd, MarshalCtrlRequest(ctrlCmd, payload)); err != nil {
+			log.Printf("ptm %v error: %v\n", ctrlCmd, err)
+			return nil, syscall.EIO
+		}
+	} else {
+		// more chunks of the state blob follow
+		response = (&CtrlResultResponse{}).MarshalCtrl()
+	}
+
+	out, err := ptmOutput(ctrlCmd, response)
+	if err != nil {
+		log.Printf("ptm %v error: %v\n", ctrlCmd, err)
+		return nil, syscall.EIO
+	}
+	if len(out) < int(outSize) {
+		out = append(out, make([]byte, int(outSize)-len(out))...)
+	}
+	return out[:outSize], nil
+}
+
+// request converts the ioctl input to the control channel request payload.
+// For PTM_SET_STATEBLOB, whose blob is sent in chunks until one is shorter
+// than ptmStateBlobSize, it returns nil until the last chunk.
+func (c *ptmChannel) request(cmd CtrlCmd, in []byte) CtrlPayload {
+	switch p := NewCtrlRequestPayload(cmd).(type) {
+	case *CtrlEmpty:
+		return p
+	case *CtrlHashDataRequest:
+		var length uint32
+		size := decodeFuse(in, &length)
+		p.Data = truncate(in[min(size, len(in)):], int(min(length, ptmHashDataSize)))
+		return p
+	case *CtrlSetStateBlobRequest:
+		var fixed [3]uint32
+		size := decodeFuse(in, &fixed)
+		data := truncate(in[min(size, len(in)):], int(fixed[2]))
+		if c.stateBlob == nil {
+			c.stateBlob = &CtrlSetStateBlobRequest{StateFlags: fixed[0], Type: fixed[1]}
+		}
+		c.stateBlob.Data = append(c.stateBlob.Data, data...)
+		if len(data) == ptmStateBlobSize {
+			return nil
+		}
+		p, c.stateBlob = c.stateBlob, nil
+		p.Length = uint32(len(p.Data))
+		return p
+	default:
+		decodeFuse(in, p)
+		return p
+	}
+}
+
+// exchange sends the request to the backend through the ctrl interceptor and
+// returns the response. The connection is reopened after an error.
+func (c *ptmChannel) exchange(cmd CtrlCmd, request []byte) ([]byte, error) {
+	handler := c.handlerFactory.NewRequestResponseHandler()
+	request = handler.HandleRequest(request)
+
+	var response []byte
+	if request != nil {
+		if c.fwd == nil {
+			fwd, err := c.forwarderFactory.NewForwarder()
+			if err != nil {
+				return nil, err
+			}
+			c.fwd = fwd
+		}
+		var err error
+		if response, err = c.forward(cmd, request); err != nil {
+			c.fwd.Close()
+			c.fwd = nil
+			return nil, err
+		}
+		if locality, ok := ctrlSetLocality(request, response); ok {
+			c.locality.Store(uint32(locality))
+		}
+	}
+	return handler.HandleResponse(response), nil
+}
+
+func (c *ptmChannel) forward(cmd CtrlCmd, request []byte) ([]byte, error) {
+	if _, err := c.fwd.Write(request); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, rawMessageBufferSize)
+	n, err := c.fwd.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return ReadCtrlMessage(c.fwd, buf[:n], func(b []byte) int {
+		return CtrlResponseSize(cmd, b)
+	})
+}
+
+// Close closes the connection to the backend.
+func (c *ptmChannel) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fwd == nil {
+		return nil
+	}
+	err := c.fwd.Close()
+	c.fwd = nil
+	return err
+}
+
+// ptmOutput converts the control channel response to the ioctl output.
+func ptmOutput(cmd CtrlCmd, response []byte) ([]byte, error) {
+	payload, err := ParseCtrlResponse(cmd, response)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	switch p := payload.(type) {
+	case *CtrlCapabilityResponse:
+		binary.Write(&buf, binary.NativeEndian, p.Caps&^CtrlCapSetDatafd)
+	case *CtrlGetStateBlobResponse:
+		// the rest of the blob is read with following ioctls at higher offsets
+		data := truncate(p.Data, ptmStateBlobSize)
+		binary.Write(&buf, binary.NativeEndian, []uint32{p.Result, p.StateFlags, p.TotalLength, uint32(len(data))})
+		buf.Write(data)
+	case *CtrlGetInfoResponse:
+		data := truncate(p.Data, ptmInfoSize)
+		binary.Write(&buf, binary.NativeEndian, []uint32{p.Result, p.TotalLength, uint32(len(data))})
+		buf.Write(data)
+	default:
+		binary.Write(&buf, binary.NativeEndian, p)
+	}
+	return buf.Bytes(), nil
+}
+
+func truncate(b []byte, n int) []byte {
+	if len(b) > n {
+		return b[:n]
+	}
+	return b
+}
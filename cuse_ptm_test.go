@@ -0,0 +1,105 @@
+package tpmproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"syscall"
+	"testing"
+)
+
+type recordingCtrlInterceptor struct {
+	requests []*CtrlRequest
+}
+
+func (it *recordingCtrlInterceptor) HandleCtrlRequest(request *CtrlRequest) []byte {
+	it.requests = append(it.requests, request)
+	return request.Raw
+}
+
+func (it *recordingCtrlInterceptor) HandleCtrlResponse(request *CtrlRequest, response []byte) []byte {
+	return response
+}
+
+func TestPtmChannel(t *testing.T) {
+	interceptor := &recordingCtrlInterceptor{}
+	c := newPtmChannel(NewCtrlEmulatorForwarderFactory(), interceptor)
+	defer c.Close()
+
+	// PTM_GET_CAPABILITY
+	out, err := c.ioctl(0x8008_5000, nil, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caps := binary.NativeEndian.Uint64(out); caps != DefaultCtrlEmulatorCaps&^CtrlCapSetDatafd {
+		t.Errorf("capabilities %x", caps)
+	}
+
+	// PTM_SET_LOCALITY
+	out, err = c.ioctl(0xc004_5004, []byte{3, 0, 0, 0}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, []byte{0, 0, 0, 0}) {
+		t.Errorf("set locality: %x", out)
+	}
+	if p, err := interceptor.requests[1].Payload(); err != nil || p.(*CtrlLocalityRequest).Locality != 3 {
+		t.Errorf("set locality request %x", interceptor.requests[1].Raw)
+	}
+
+	// PTM_SET_BUFFERSIZE is converted from and to host byte order
+	out, err = c.ioctl(0xc010_5010, binary.NativeEndian.AppendUint32(nil, 1024), 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bufferSize CtrlSetBufferSizeResponse
+	decodeFuse(out, &bufferSize)
+	if bufferSize.Result != 0 || bufferSize.BufferSize != DefaultCtrlEmulatorBufferSize {
+		t.Errorf("set buffer size: %+v", bufferSize)
+	}
+
+	// PTM_SET_STATEBLOB chunks are sent as a single request
+	n := len(interceptor.requests)
+	blob := bytes.Repeat([]byte{0xaa}, ptmStateBlobSize+10)
+	for _, chunk := range [][]byte{blob[:ptmStateBlobSize], blob[ptmStateBlobSize:]} {
+		in := binary.NativeEndian.AppendUint32(nil, 0)
+		in = binary.NativeEndian.AppendUint32(in, CtrlBlobTypeVolatile)
+		in = binary.NativeEndian.AppendUint32(in, uint32(len(chunk)))
+		in = append(in, chunk...)
+		if _, err := c.ioctl(ptmIoctl(iocRead|iocWrite, 12, 12+ptmStateBlobSize), in, 4); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(interceptor.requests) != n+1 {
+		t.Fatalf("%d state blob requests", len(interceptor.requests)-n)
+	}
+	p, err := interceptor.requests[n].Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setState := p.(*CtrlSetStateBlobRequest); setState.Type != CtrlBlobTypeVolatile ||
+		setState.Length != uint32(len(blob)) || !bytes.Equal(setState.Data, blob) {
+		t.Errorf("set state blob request: type %d, length %d", setState.Type, setState.Length)
+	}
+
+	// PTM_HASH_DATA is _IOWR('P', 6, struct ptm_hdata) of 4100 bytes, whose
+	// data is limited to the 4096 bytes following the length
+	in := binary.NativeEndian.AppendUint32(nil, 5000)
+	in = append(in, bytes.Repeat([]byte{0xbb}, ptmHashDataSize)...)
+	if _, err := c.ioctl(0xd004_5006, in, 4); err != nil {
+		t.Fatal(err)
+	}
+	p, err = interceptor.requests[len(interceptor.requests)-1].Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashData := p.(*CtrlHashDataRequest); len(hashData.Data) != 4096 {
+		t.Errorf("hash data of %d bytes", len(hashData.Data))
+	}
+
+	// PTM_SET_DATAFD and unknown ioctls
+	for _, cmd := range []uint32{0x8004_500f, 0x5401} {
+		if _, err := c.ioctl(cmd, nil, 4); err != syscall.ENOTTY {
+			t.Errorf("ioctl %x: %v", cmd, err)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package tpmproxy
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"sync"
+)
+
+// cuseSession is the state of a single open of a CUSE device.
+// The data written to the device is exchanged in-process with a Forwarder
+// through an Exchanger, and the responses are read back from the device.
+// Writes are serialized so that the commands of an open file stay in order
+// even when the handlers run concurrently. The responses are queued as they
+// arrive, so that a read returns a single response and readiness can be polled.
+type cuseSession struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	responses [][]byte
+	err       error
+	// notify is called once when a response becomes readable.
+	notify func()
+}
+
+// newCuseSession creates a session exchanging with a new Forwarder.
+// If locality is not nil, it returns the locality of the commands.
+func newCuseSession(forwarderFactory ForwarderFactory, interceptor Interceptor, locality func() uint8) (*cuseSession, error) {
+	fwd, err := forwarderFactory.NewForwarder()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, exConn := net.Pipe()
+	go func(exConn net.Conn, fwd Forwarder) {
+		defer fwd.Close()
+		defer exConn.Close()
+
+		handlerFactory := newTpmHandlerFactory(interceptor)
+		setLocalityFunc(handlerFactory, locality)
+		ex := &Exchanger{
+			Src:            exConn,
+			Dst:            fwd,
+			HandlerFactory: handlerFactory,
+			ReaderFactory:  NewTpmMessageReaderFactory(0),
+		}
+		if err := ex.Exchange(); err != nil {
+			log.Printf("cuse exchange error: %v\n", err)
+		}
+	}(exConn, fwd)
+
+	s := &cuseSession{conn: conn}
+	s.cond = sync.NewCond(&s.mu)
+	go s.receive()
+	return s, nil
+}
+
+// receive queues the responses until the exchange ends.
+func (s *cuseSession) receive() {
+	reader := NewTpmMessageReader(s.conn, 0)
+	for {
+		response, err := reader.ReadMessage()
+		s.mu.Lock()
+		if err != nil {
+			s.err = err
+		} else {
+			// the response is only valid until the next ReadMessage
+			s.responses = append(s.responses, bytes.Clone(response))
+		}
+		notify := s.notify
+		s.notify = nil
+		s.cond.Broadcast()
+		s.mu.Unlock()
+
+		if notify != nil {
+			notify()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *cuseSession) Write(p []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.conn.Write(p)
+}
+
+// Read waits for a response and reads it. The rest of the response is
+// discarded if p is too short.
+func (s *cuseSession) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.responses) == 0 && s.err == nil {
+		s.cond.Wait()
+	}
+	if len(s.responses) == 0 {
+		return 0, s.err
+	}
+	n := copy(p, s.responses[0])
+	s.responses = s.responses[1:]
+	return n, nil
+}
+
+// readable reports whether Read would not block.
+// If not, notify is called once the session becomes readable.
+func (s *cuseSession) readable(notify func()) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.responses) > 0 || s.err != nil {
+		return true
+	}
+	if notify != nil {
+		s.notify = notify
+	}
+	return false
+}
+
+// Close ends the session. The Forwarder is closed once the exchange ends.
+func (s *cuseSession) Close() error {
+	return s.conn.Close()
+}
+
+// cuseSessionTable maps the file handles of the opened files to the sessions.
+type cuseSessionTable struct {
+	mu       sync.Mutex
+	nextFh   uint64
+	sessions map[uint64]*cuseSession
+}
+
+func newCuseSessionTable() *cuseSessionTable {
+	return &cuseSessionTable{
+		sessions: make(map[uint64]*cuseSession),
+	}
+}
+
+func (t *cuseSessionTable) add(s *cuseSession) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nextFh++
+	t.sessions[t.nextFh] = s
+	return t.nextFh
+}
+
+func (t *cuseSessionTable) get(fh uint64) *cuseSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sessions[fh]
+}
+
+func (t *cuseSessionTable) remove(fh uint64) *cuseSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.sessions[fh]
+	delete(t.sessions, fh)
+	return s
+}
+
+func (t *cuseSessionTable) removeAll() []*cuseSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var sessions []*cuseSession
+	for fh, s := range t.sessions {
+		sessions = append(sessions, s)
+		delete(t.sessions, fh)
+	}
+	return sessions
+}
@@ -0,0 +1,119 @@
+package tpmproxy
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// echoForwarderFactory creates Forwarders that echo every TPM command back.
+type echoForwarderFactory struct {
+}
+
+func (f *echoForwarderFactory) NewForwarder() (Forwarder, error) {
+	client, server := net.Pipe()
+	go serveEchoTpm(server)
+	return client, nil
+}
+
+type countingInterceptor struct {
+	requests atomic.Int32
+}
+
+func (it *countingInterceptor) HandleRequest(request *Request) []byte {
+	it.requests.Add(1)
+	return request.Raw
+}
+
+func (it *countingInterceptor) HandleResponse(request *Request, response []byte) []byte {
+	return response
+}
+
+func TestCuseSessions(t *testing.T) {
+	tap := NewTcpTapForwarderFactory("127.0.0.1:0", &echoForwarderFactory{})
+	defer tap.Close()
+	interceptor := &countingInterceptor{}
+
+	table := newCuseSessionTable()
+	var fhs []uint64
+	for i := 0; i < 2; i++ {
+		s, err := newCuseSession(tap, interceptor, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fhs = append(fhs, table.add(s))
+	}
+
+	// commands of the two opens do not interleave
+	commands := [][]byte{
+		{0x80, 0x01, 0, 0, 0, 0x0c, 0, 0, 0x01, 0x44, 0, 0},
+		{0x80, 0x01, 0, 0, 0, 0x0c, 0, 0, 0x01, 0x44, 0, 1},
+	}
+	for i, fh := range fhs {
+		s := table.get(fh)
+		if _, err := s.Write(commands[i][:4]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, fh := range fhs {
+		s := table.get(fh)
+		if _, err := s.Write(commands[i][4:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, fh := range fhs {
+		response := make([]byte, 4096)
+		n, err := table.get(fh).Read(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(response[:n], commands[i]) {
+			t.Errorf("open %d: got %x", i, response[:n])
+		}
+	}
+	if n := interceptor.requests.Load(); n != 2 {
+		t.Errorf("intercepted %d requests", n)
+	}
+
+	for _, fh := range fhs {
+		table.remove(fh).Close()
+	}
+	if table.get(fhs[0]) != nil {
+		t.Error("session not removed")
+	}
+}
+
+func TestCuseSessionQueuedResponses(t *testing.T) {
+	s, err := newCuseSession(&echoForwarderFactory{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// both commands are written before the first response is read
+	commands := [][]byte{
+		{0x80, 0x01, 0, 0, 0, 0x0c, 0, 0, 0x01, 0x44, 0, 0},
+		{0x80, 0x01, 0, 0, 0, 0x0c, 0, 0, 0x01, 0x44, 0, 1},
+	}
+	for _, command := range commands {
+		if _, err := s.Write(command); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.mu.Lock()
+	for len(s.responses) < len(commands) {
+		s.cond.Wait()
+	}
+	s.mu.Unlock()
+	for i, command := range commands {
+		response := make([]byte, 4096)
+		n, err := s.Read(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(response[:n], command) {
+			t.Errorf("response %d: got %x", i, response[:n])
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package tpmproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeCuseDevice is a /dev/cuse that passes the requests and replies
+// through channels.
+type fakeCuseDevice struct {
+	requests chan []byte
+	replies  chan []byte
+}
+
+func newFakeCuseDevice() *fakeCuseDevice {
+	return &fakeCuseDevice{
+		requests: make(chan []byte),
+		replies:  make(chan []byte, 16),
+	}
+}
+
+func (d *fakeCuseDevice) Read(p []byte) (int, error) {
+	request, ok := <-d.requests
+	if !ok {
+		return 0, syscall.ENODEV
+	}
+	return copy(p, request), nil
+}
+
+func (d *fakeCuseDevice) Write(p []byte) (int, error) {
+	d.replies <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func (d *fakeCuseDevice) Close() error {
+	close(d.requests)
+	return nil
+}
+
+// call sends a request and waits for its reply, which is returned without
+// the header. Notifications received meanwhile are appended to notified.
+func (d *fakeCuseDevice) call(t *testing.T, unique uint64, opcode uint32, notified *[][]byte, values ...interface{}) (int32, []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.NativeEndian, &fuseInHeader{Opcode: opcode, Unique: unique})
+	for _, v := range values {
+		if b, ok := v.([]byte); ok {
+			buf.Write(b)
+		} else {
+			binary.Write(&buf, binary.NativeEndian, v)
+		}
+	}
+	request := buf.Bytes()
+	binary.NativeEndian.PutUint32(request, uint32(len(request)))
+	d.requests <- request
+
+	for {
+		select {
+		case reply := <-d.replies:
+			if int(binary.NativeEndian.Uint32(reply)) != len(reply) {
+				t.Fatalf("invalid reply length %x", reply)
+			}
+			errorField := int32(binary.NativeEndian.Uint32(reply[4:]))
+			switch binary.NativeEndian.Uint64(reply[8:]) {
+			case unique:
+				return errorField, reply[fuseOutHeaderSize:]
+			case 0:
+				*notified = append(*notified, reply[fuseOutHeaderSize:])
+			default:
+				t.Fatalf("unexpected reply %x", reply)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no reply to opcode %d", opcode)
+		}
+	}
+}
+
+func TestCuseServer(t *testing.T) {
+	dev := newFakeCuseDevice()
+	s := NewCuseServer("ctpm0", &echoForwarderFactory{}, nil)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.serve(dev)
+	}()
+	var notified [][]byte
+
+	errno, out := dev.call(t, 1, cuseInit, &notified, &cuseInitIn{Major: 7, Minor: 38})
+	var initOut cuseInitOut
+	size := decodeFuse(out, &initOut)
+	if errno != 0 || initOut.Major != 7 || initOut.Minor != fuseKernelMinorVersion {
+		t.Fatalf("init: %d %+v", errno, initOut)
+	}
+	if devInfo := string(out[size:]); devInfo != "DEVNAME=ctpm0\x00" {
+		t.Errorf("init: device info %q", devInfo)
+	}
+
+	errno, out = dev.call(t, 2, fuseOpen, &notified, make([]byte, 8))
+	var openOut fuseOpenOut
+	decodeFuse(out, &openOut)
+	if errno != 0 || openOut.Fh == 0 {
+		t.Fatalf("open: %d %+v", errno, openOut)
+	}
+	fh := openOut.Fh
+
+	// not readable until the response arrives
+	errno, out = dev.call(t, 3, fusePoll, &notified, &fusePollIn{Fh: fh, Kh: 42, Flags: fusePollScheduleNotify})
+	var polled fusePollOut
+	decodeFuse(out, &polled)
+	if errno != 0 || polled.Revents != pollOut|pollWrNorm {
+		t.Fatalf("poll: %d %+v", errno, polled)
+	}
+
+	command := []byte{0x80, 0x01, 0, 0, 0, 0x0c, 0, 0, 0x01, 0x44, 0, 0}
+	errno, out = dev.call(t, 4, fuseWrite, &notified, &fuseReadIn{Fh: fh, Size: uint32(len(command))}, command)
+	var writeOut fuseWriteOut
+	decodeFuse(out, &writeOut)
+	if errno != 0 || writeOut.Size != uint32(len(command)) {
+		t.Fatalf("write: %d %+v", errno, writeOut)
+	}
+
+	errno, out = dev.call(t, 5, fuseRead, &notified, &fuseReadIn{Fh: fh, Size: 4096})
+	if errno != 0 || !bytes.Equal(out, command) {
+		t.Fatalf("read: %d %x", errno, out)
+	}
+	if len(notified) != 1 || binary.NativeEndian.Uint64(notified[0]) != 42 {
+		t.Errorf("poll notifications %x", notified)
+	}
+
+	// a TPM has no ioctls
+	errno, _ = dev.call(t, 6, fuseIoctl, &notified, &fuseIoctlIn{Fh: fh, Cmd: 1})
+	if errno != -int32(syscall.ENOTTY) {
+		t.Errorf("ioctl: %d", errno)
+	}
+
+	errno, _ = dev.call(t, 7, fuseRelease, &notified, &fuseReleaseIn{Fh: fh})
+	if errno != 0 {
+		t.Errorf("release: %d", errno)
+	}
+	errno, _ = dev.call(t, 8, fuseRead, &notified, &fuseReadIn{Fh: fh, Size: 4096})
+	if errno != -int32(syscall.EBADF) {
+		t.Errorf("read after release: %d", errno)
+	}
+
+	s.Close()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	if s.sessions.get(fh) != nil {
+		t.Error("session not removed")
+	}
+}
+
+func TestCuseServerLocality(t *testing.T) {
+	dev := newFakeCuseDevice()
+	interceptor := &localityInterceptor{}
+	s := NewCuseServer("ctpm0", &echoForwarderFactory{}, interceptor)
+	s.CtrlForwarderFactory = NewCtrlEmulatorForwarderFactory()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.serve(dev)
+	}()
+	defer func() {
+		s.Close()
+		<-done
+	}()
+	var notified [][]byte
+
+	dev.call(t, 1, cuseInit, &notified, &cuseInitIn{Major: 7, Minor: 38})
+	_, out := dev.call(t, 2, fuseOpen, &notified, make([]byte, 8))
+	var openOut fuseOpenOut
+	decodeFuse(out, &openOut)
+	fh := openOut.Fh
+
+	// PTM_SET_LOCALITY
+	errno, out := dev.call(t, 3, fuseIoctl, &notified,
+		&fuseIoctlIn{Fh: fh, Cmd: 0xc004_5004, InSize: 4, OutSize: 4}, []byte{3, 0, 0, 0})
+	if errno != 0 || !bytes.Equal(out[binary.Size(fuseIoctlOut{}):], []byte{0, 0, 0, 0}) {
+		t.Fatalf("ioctl: %d %x", errno, out)
+	}
+
+	command := []byte{0x80, 0x01, 0, 0, 0, 0x0c, 0, 0, 0x01, 0x44, 0, 0}
+	dev.call(t, 4, fuseWrite, &notified, &fuseReadIn{Fh: fh, Size: uint32(len(command))}, command)
+	if errno, out := dev.call(t, 5, fuseRead, &notified, &fuseReadIn{Fh: fh, Size: 4096}); errno != 0 || !bytes.Equal(out, command) {
+		t.Fatalf("read: %d %x", errno, out)
+	}
+	if locality := interceptor.locality.Load(); locality != 3 {
+		t.Errorf("locality %d", locality)
+	}
+}
@@ -4,45 +4,32 @@ import (
 	"encoding/hex"
 	"flag"
 	"fmt"
-	"net"
-	"time"
 
 	"github.com/CyberDefenseInstitute/tpmproxy"
 	"github.com/google/go-tpm/tpm2"
 )
 
 var (
-	devName   string
-	tpmPath   string
-	relayAddr string
+	devName    string
+	tpmPath    string
+	mirrorAddr string
 )
 
 func main() {
 	flag.StringVar(&devName, "name", "ctpm0", "cuse device name")
 	flag.StringVar(&tpmPath, "tpm", "/dev/tpmrm0", "pass-through tpm device path")
-	flag.StringVar(&relayAddr, "relayaddr", "127.0.0.1:2321", "internal relay address(for packet capture)")
+	flag.StringVar(&mirrorAddr, "mirroraddr", "127.0.0.1:2341", "traffic mirror address(for packet capture, empty to disable)")
 	flag.Parse()
 
 	// log.SetFlags(log.Lmicroseconds)
-	tpmForwarderFactory := tpmproxy.NewIoForwarderFactory(tpmPath)
-	tcpRelay := tpmproxy.NewTcpRelayer(relayAddr, tpmForwarderFactory, &interceptor{})
-	go func() {
-		if err := tcpRelay.Relay(); err != nil {
-			fmt.Printf("tcp relay failed %v\n", err)
-		}
-	}()
-
-	time.Sleep(100 * time.Millisecond) // wait for relay to start
-
-	tcpForwarder, err := net.Dial("tcp", relayAddr)
-	if err != nil {
-		fmt.Printf("tcp forwarder open failed %v\n", err)
-		return
+	var forwarderFactory tpmproxy.ForwarderFactory = tpmproxy.NewIoForwarderFactory(tpmPath)
+	if mirrorAddr != "" {
+		tapForwarderFactory := tpmproxy.NewTcpTapForwarderFactory(mirrorAddr, forwarderFactory)
+		defer tapForwarderFactory.Close()
+		forwarderFactory = tapForwarderFactory
 	}
-	defer tcpForwarder.Close()
 
-	tpmproxy.SetCuseForwarder(tcpForwarder)
-	code := tpmproxy.CuseRelay(devName)
+	code := tpmproxy.CuseRelay(devName, forwarderFactory, &interceptor{})
 
 	fmt.Printf("cuse relay exited: %d\n", code)
 }
@@ -55,56 +42,29 @@ func (it *interceptor) HandleRequest(request *tpmproxy.Request) []byte {
 }
 
 func (it *interceptor) HandleResponse(request *tpmproxy.Request, response []byte) []byte {
-	p := tpmproxy.RoughParser{
-		RawRequest:  request.Raw,
-		RawResponse: response,
+	cmd, rsp, err := tpmproxy.Decode(request.Raw, response)
+	if rc, ok := err.(*tpmproxy.ResponseCode); ok {
+		fmt.Printf("%s: %v\n", tpmproxy.CommandName(request.Hdr.CommandCode), rc)
+	}
+	if err != nil {
+		return response
 	}
-	switch request.Hdr.CommandCode {
-	case tpm2.TPMCCUnseal:
-		cmd := tpm2.Unseal{}
-		resp := tpm2.UnsealResponse{}
-		p.Cmd = &cmd
-		p.Rsp = &resp
-		if err := p.Parse(); err == nil {
-			fmt.Printf("Unseal: %+v\n", cmd)
-			fmt.Printf("UnsealResponse: %s\n", hex.EncodeToString(resp.OutData.Buffer))
-		}
-	case tpm2.TPMCCCreatePrimary:
-		cmd := tpm2.CreatePrimary{}
-		resp := tpm2.CreatePrimaryResponse{}
-		p.Cmd = &cmd
-		p.Rsp = &resp
-		if err := p.Parse(); err == nil {
-			fmt.Printf("CreatePrimary: %+v\n", cmd)
-			fmt.Printf("CreatePrimaryResponse: %+v\n", resp)
-		}
-	case tpm2.TPMCCCreate:
-		cmd := tpm2.Create{}
-		resp := tpm2.CreateResponse{}
-		p.Cmd = &cmd
-		p.Rsp = &resp
-		if err := p.Parse(); err == nil {
-			//fmt.Printf("Create: %+v\n", cmd) // can't parse now
-			fmt.Printf("CreateResponse: %+v\n", resp)
-		}
-	case tpm2.TPMCCNVReadPublic:
-		cmd := tpm2.NVReadPublic{}
-		resp := tpm2.NVReadPublicResponse{}
-		p.Cmd = &cmd
-		p.Rsp = &resp
-		if err := p.Parse(); err == nil {
-			fmt.Printf("NVReadPublic: %+v\n", cmd)
-			fmt.Printf("NVReadPublicResponse: %+v\n", resp)
-		}
-	case tpm2.TPMCCNVRead:
-		cmd := tpm2.NVRead{}
-		resp := tpm2.NVReadResponse{}
-		p.Cmd = &cmd
-		p.Rsp = &resp
-		if err := p.Parse(); err == nil {
-			fmt.Printf("NVRead: %+v\n", cmd)
-			fmt.Printf("NVReadResponse: %s\n", hex.EncodeToString(resp.Data.Buffer))
-		}
+	switch rsp := rsp.(type) {
+	case *tpm2.UnsealResponse:
+		fmt.Printf("Unseal: %+v\n", *cmd.(*tpm2.Unseal))
+		fmt.Printf("UnsealResponse: %s\n", hex.EncodeToString(rsp.OutData.Buffer))
+	case *tpm2.CreatePrimaryResponse:
+		fmt.Printf("CreatePrimary: %+v\n", *cmd.(*tpm2.CreatePrimary))
+		fmt.Printf("CreatePrimaryResponse: %+v\n", *rsp)
+	case *tpm2.CreateResponse:
+		fmt.Printf("Create: %+v\n", *cmd.(*tpm2.Create))
+		fmt.Printf("CreateResponse: %+v\n", *rsp)
+	case *tpm2.NVReadPublicResponse:
+		fmt.Printf("NVReadPublic: %+v\n", *cmd.(*tpm2.NVReadPublic))
+		fmt.Printf("NVReadPublicResponse: %+v\n", *rsp)
+	case *tpm2.NVReadResponse:
+		fmt.Printf("NVRead: %+v\n", *cmd.(*tpm2.NVRead))
+		fmt.Printf("NVReadResponse: %s\n", hex.EncodeToString(rsp.Data.Buffer))
 	}
 	return response
 }
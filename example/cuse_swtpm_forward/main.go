@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/CyberDefenseInstitute/tpmproxy"
+)
+
+var (
+	devName       string
+	swtpmAddr     string
+	swtpmCtrlAddr string
+)
+
+func main() {
+	flag.StringVar(&devName, "name", "vtpm0", "cuse device name")
+	flag.StringVar(&swtpmAddr, "swtpm", "127.0.0.1:2321", "swtpm address")
+	flag.StringVar(&swtpmCtrlAddr, "swtpm-ctrl", "127.0.0.1:2322", "swtpm ctrl address (empty to emulate the ctrl channel)")
+	flag.Parse()
+
+	server := tpmproxy.NewCuseServer(devName, tpmproxy.NewTcpForwarderFactory(swtpmAddr), nil)
+	// the PTM_* ioctls of swtpm's cuse device are sent to the ctrl channel
+	if swtpmCtrlAddr != "" {
+		server.CtrlForwarderFactory = tpmproxy.NewTcpForwarderFactory(swtpmCtrlAddr)
+	} else {
+		server.CtrlForwarderFactory = tpmproxy.NewCtrlEmulatorForwarderFactory()
+	}
+	if err := server.Serve(); err != nil {
+		fmt.Printf("error: %v\n", err)
+	}
+}
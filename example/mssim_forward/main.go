@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/CyberDefenseInstitute/tpmproxy"
+)
+
+var (
+	listenAddr string
+	tpmPath    string
+	swtpmAddr  string
+	traceFile  string
+)
+
+func main() {
+	flag.StringVar(&listenAddr, "listen", "127.0.0.1:2321", "mssim listen address (the platform port follows it)")
+	flag.StringVar(&tpmPath, "tpm", "/dev/tpmrm0", "pass-through tpm device path")
+	flag.StringVar(&swtpmAddr, "swtpm", "", "swtpm address (overrides -tpm)")
+	flag.StringVar(&traceFile, "trace", "", "JSONL file to record the commands and responses to")
+	flag.Parse()
+
+	var forwarderFactory tpmproxy.ForwarderFactory
+	if swtpmAddr != "" {
+		forwarderFactory = tpmproxy.NewTcpForwarderFactory(swtpmAddr)
+	} else {
+		forwarderFactory = tpmproxy.NewIoForwarderFactory(tpmPath)
+	}
+
+	var interceptor tpmproxy.Interceptor
+	if traceFile != "" {
+		f, err := os.Create(traceFile)
+		if err != nil {
+			fmt.Printf("error: %v\n", err)
+			return
+		}
+		defer f.Close()
+		interceptor = tpmproxy.NewTraceRecorder(f, nil)
+	}
+
+	relay := tpmproxy.NewMssimRelayer(listenAddr, "", forwarderFactory, interceptor)
+	if err := relay.Relay(); err != nil {
+		fmt.Printf("error: %v\n", err)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/CyberDefenseInstitute/tpmproxy"
+)
+
+var (
+	listenAddr string
+	traceFile  string
+	mode       string
+)
+
+func main() {
+	flag.StringVar(&listenAddr, "listen", "127.0.0.1:2321", "mssim listen address (the platform port follows it)")
+	flag.StringVar(&traceFile, "trace", "", "JSONL trace file recorded by mssim_forward -trace")
+	flag.StringVar(&mode, "mode", "strict", "matching mode: strict, command or command-code")
+	flag.Parse()
+
+	modes := map[string]tpmproxy.ReplayMode{
+		"strict":       tpmproxy.ReplayStrict,
+		"command":      tpmproxy.ReplayByCommand,
+		"command-code": tpmproxy.ReplayByCommandCode,
+	}
+	replayMode, ok := modes[mode]
+	if !ok {
+		fmt.Printf("error: unknown mode %q\n", mode)
+		return
+	}
+
+	f, err := os.Open(traceFile)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		return
+	}
+	records, err := tpmproxy.ReadTrace(f)
+	f.Close()
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		return
+	}
+	forwarderFactory, err := tpmproxy.NewReplayForwarderFactory(records, replayMode)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		return
+	}
+
+	// a divergence ends the connection and is logged as an exchange error
+	relay := tpmproxy.NewMssimRelayer(listenAddr, "", forwarderFactory, nil)
+	if err := relay.Relay(); err != nil {
+		fmt.Printf("error: %v\n", err)
+	}
+}
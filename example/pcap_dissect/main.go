@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/CyberDefenseInstitute/tpmproxy"
+	"github.com/google/go-tpm/tpm2"
+)
+
+var (
+	pcapFile string
+	ports    string
+)
+
+func main() {
+	flag.StringVar(&pcapFile, "pcap", "", "pcap or pcapng file to read")
+	flag.StringVar(&ports, "ports", "2321", "comma separated TCP ports of the TPM side")
+	flag.Parse()
+
+	f, err := os.Open(pcapFile)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		return
+	}
+	defer f.Close()
+
+	r := tpmproxy.NewPcapReader(f)
+	r.Ports = nil
+	for _, port := range strings.Split(ports, ",") {
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			fmt.Printf("error: invalid port %q\n", port)
+			return
+		}
+		r.Ports = append(r.Ports, uint16(p))
+	}
+
+	exchanges, err := r.ReadExchanges()
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+	}
+	for _, e := range exchanges {
+		if e.Response == nil {
+			continue
+		}
+		hdr, err := tpmproxy.ReqHeader(bytes.NewBuffer(e.Request))
+		if err != nil {
+			continue
+		}
+		fmt.Printf("%s connection %d: %s\n", e.Time.Format("15:04:05.000000"), e.ConnID, tpmproxy.CommandName(hdr.CommandCode))
+		cmd, rsp, err := tpmproxy.Decode(e.Request, e.Response)
+		if rc, ok := err.(*tpmproxy.ResponseCode); ok {
+			fmt.Printf("%v\n", rc)
+		}
+		if err != nil {
+			continue
+		}
+		switch rsp := rsp.(type) {
+		case *tpm2.UnsealResponse:
+			fmt.Printf("UnsealResponse: %s\n", hex.EncodeToString(rsp.OutData.Buffer))
+		case *tpm2.NVReadResponse:
+			fmt.Printf("NVRead: %+v\n", *cmd.(*tpm2.NVRead))
+			fmt.Printf("NVReadResponse: %s\n", hex.EncodeToString(rsp.Data.Buffer))
+		case *tpmproxy.SchemaField:
+			printFields(cmd.(*tpmproxy.SchemaField), "")
+			printFields(rsp, "")
+		}
+	}
+}
+
+func printFields(f *tpmproxy.SchemaField, indent string) {
+	if f.Value != nil {
+		fmt.Printf("%s%s %s: %v\n", indent, f.Type, f.Name, f.Value)
+	} else {
+		fmt.Printf("%s%s %s\n", indent, f.Type, f.Name)
+	}
+	for _, c := range f.Fields {
+		printFields(c, indent+"  ")
+	}
+}
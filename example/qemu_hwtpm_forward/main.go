@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/CyberDefenseInstitute/tpmproxy"
+)
+
+var (
+	sockFile         string
+	tpmPath          string
+	terminateOnClose bool
+)
+
+func main() {
+	flag.StringVar(&sockFile, "fwd-sock", filepath.Join(os.TempDir(), "qemu_swtpm_fwd.sock"), "forwarding unix socket file")
+	flag.StringVar(&tpmPath, "tpm", "/dev/tpmrm0", "pass-through tpm device path")
+	flag.BoolVar(&terminateOnClose, "terminate-on-close", true, "terminate relay on close")
+	flag.Parse()
+
+	relay := tpmproxy.NewQemuCtrlRelayer(sockFile,
+		tpmproxy.NewIoForwarderFactory(tpmPath),
+		tpmproxy.NewCtrlEmulatorForwarderFactory(),
+		terminateOnClose,
+		nil)
+	if err := relay.Relay(); err != nil {
+		fmt.Printf("error: %v\n", err)
+	}
+}
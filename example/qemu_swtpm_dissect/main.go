@@ -15,6 +15,7 @@ var (
 	sockFile         string
 	swtpmAddr        string
 	swtpmCtrlAddr    string
+	traceFile        string
 	terminateOnClose bool
 )
 
@@ -22,77 +23,80 @@ func main() {
 	flag.StringVar(&sockFile, "fwd-sock", filepath.Join(os.TempDir(), "qemu_swtpm_fwd.sock"), "forwarding unix socket file")
 	flag.StringVar(&swtpmAddr, "swtpm", "127.0.0.1:2321", "swtpm address")
 	flag.StringVar(&swtpmCtrlAddr, "swtpm-ctrl", "127.0.0.1:2322", "swtpm ctrl address")
+	flag.StringVar(&traceFile, "trace", "", "JSONL file to record the decoded commands and responses to")
 	flag.BoolVar(&terminateOnClose, "terminate-on-close", true, "terminate relay on close")
 	flag.Parse()
 
+	var interceptor tpmproxy.Interceptor = &dissectInterceptor{}
+	if traceFile != "" {
+		f, err := os.Create(traceFile)
+		if err != nil {
+			fmt.Printf("error: %v\n", err)
+			return
+		}
+		defer f.Close()
+		interceptor = tpmproxy.NewTraceRecorder(f, interceptor)
+	}
+
 	relay := tpmproxy.NewQemuCtrlRelayer(sockFile,
 		tpmproxy.NewTcpForwarderFactory(swtpmAddr),
 		tpmproxy.NewTcpForwarderFactory(swtpmCtrlAddr),
 		terminateOnClose,
-		&interceptor{})
+		interceptor)
+	relay.CtrlInterceptor = &ctrlInterceptor{}
 	if err := relay.Relay(); err != nil {
 		fmt.Printf("error: %v\n", err)
 	}
 }
 
-type interceptor struct {
+type ctrlInterceptor struct {
 }
 
-func (it *interceptor) HandleRequest(request *tpmproxy.Request) []byte {
+func (it *ctrlInterceptor) HandleCtrlRequest(request *tpmproxy.CtrlRequest) []byte {
+	if p, err := request.Payload(); err == nil {
+		fmt.Printf("%v: %+v\n", request.Cmd, p)
+	}
 	return request.Raw
 }
 
-func (it *interceptor) HandleResponse(request *tpmproxy.Request, response []byte) []byte {
-	p := tpmproxy.RoughParser{
-		RawRequest:  request.Raw,
-		RawResponse: response,
+func (it *ctrlInterceptor) HandleCtrlResponse(request *tpmproxy.CtrlRequest, response []byte) []byte {
+	if p, err := tpmproxy.ParseCtrlResponse(request.Cmd, response); err == nil {
+		fmt.Printf("%v response: %+v\n", request.Cmd, p)
 	}
-	switch request.Hdr.CommandCode {
-	case tpm2.TPMCCUnseal:
-		cmd := tpm2.Unseal{}
-		resp := tpm2.UnsealResponse{}
-		p.Cmd = &cmd
-		p.Rsp = &resp
-		if err := p.Parse(); err == nil {
-			fmt.Printf("Unseal: %+v\n", cmd)
-			fmt.Printf("UnsealResponse: %s\n", hex.EncodeToString(resp.OutData.Buffer))
-		}
-	case tpm2.TPMCCCreatePrimary:
-		cmd := tpm2.CreatePrimary{}
-		resp := tpm2.CreatePrimaryResponse{}
-		p.Cmd = &cmd
-		p.Rsp = &resp
-		if err := p.Parse(); err == nil {
-			fmt.Printf("CreatePrimary: %+v\n", cmd)
-			fmt.Printf("CreatePrimaryResponse: %+v\n", resp)
-		}
-	case tpm2.TPMCCCreate:
-		cmd := tpm2.Create{}
-		resp := tpm2.CreateResponse{}
-		p.Cmd = &cmd
-		p.Rsp = &resp
-		if err := p.Parse(); err == nil {
-			//fmt.Printf("Create: %+v\n", cmd) // can't parse now
-			fmt.Printf("CreateResponse: %+v\n", resp)
-		}
-	case tpm2.TPMCCNVReadPublic:
-		cmd := tpm2.NVReadPublic{}
-		resp := tpm2.NVReadPublicResponse{}
-		p.Cmd = &cmd
-		p.Rsp = &resp
-		if err := p.Parse(); err == nil {
-			fmt.Printf("NVReadPublic: %+v\n", cmd)
-			fmt.Printf("NVReadPublicResponse: %+v\n", resp)
-		}
-	case tpm2.TPMCCNVRead:
-		cmd := tpm2.NVRead{}
-		resp := tpm2.NVReadResponse{}
-		p.Cmd = &cmd
-		p.Rsp = &resp
-		if err := p.Parse(); err == nil {
-			fmt.Printf("NVRead: %+v\n", cmd)
-			fmt.Printf("NVReadResponse: %s\n", hex.EncodeToString(resp.Data.Buffer))
-		}
+	return response
+}
+
+type dissectInterceptor struct {
+}
+
+func (it *dissectInterceptor) HandleRequest(request *tpmproxy.Request) []byte {
+	return request.Raw
+}
+
+func (it *dissectInterceptor) HandleResponse(request *tpmproxy.Request, response []byte) []byte {
+	cmd, rsp, err := tpmproxy.Decode(request.Raw, response)
+	if rc, ok := err.(*tpmproxy.ResponseCode); ok {
+		fmt.Printf("%s: %v\n", tpmproxy.CommandName(request.Hdr.CommandCode), rc)
+	}
+	if err != nil {
+		return response
+	}
+	switch rsp := rsp.(type) {
+	case *tpm2.UnsealResponse:
+		fmt.Printf("Unseal: %+v\n", *cmd.(*tpm2.Unseal))
+		fmt.Printf("UnsealResponse: %s\n", hex.EncodeToString(rsp.OutData.Buffer))
+	case *tpm2.CreatePrimaryResponse:
+		fmt.Printf("CreatePrimary: %+v\n", *cmd.(*tpm2.CreatePrimary))
+		fmt.Printf("CreatePrimaryResponse: %+v\n", *rsp)
+	case *tpm2.CreateResponse:
+		fmt.Printf("Create: %+v\n", *cmd.(*tpm2.Create))
+		fmt.Printf("CreateResponse: %+v\n", *rsp)
+	case *tpm2.NVReadPublicResponse:
+		fmt.Printf("NVReadPublic: %+v\n", *cmd.(*tpm2.NVReadPublic))
+		fmt.Printf("NVReadPublicResponse: %+v\n", *rsp)
+	case *tpm2.NVReadResponse:
+		fmt.Printf("NVRead: %+v\n", *cmd.(*tpm2.NVRead))
+		fmt.Printf("NVReadResponse: %s\n", hex.EncodeToString(rsp.Data.Buffer))
 	}
 	return response
 }
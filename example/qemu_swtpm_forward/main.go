@@ -13,6 +13,7 @@ var (
 	sockFile         string
 	swtpmAddr        string
 	swtpmCtrlAddr    string
+	swtpmCtrlSock    string
 	terminateOnClose bool
 )
 
@@ -20,12 +21,22 @@ func main() {
 	flag.StringVar(&sockFile, "fwd-sock", filepath.Join(os.TempDir(), "qemu_swtpm_fwd.sock"), "forwarding unix socket file")
 	flag.StringVar(&swtpmAddr, "swtpm", "127.0.0.1:2321", "swtpm address")
 	flag.StringVar(&swtpmCtrlAddr, "swtpm-ctrl", "127.0.0.1:2322", "swtpm ctrl address")
+	flag.StringVar(&swtpmCtrlSock, "swtpm-ctrl-sock", "", "swtpm unixio ctrl socket file (overrides -swtpm and -swtpm-ctrl)")
 	flag.BoolVar(&terminateOnClose, "terminate-on-close", true, "terminate relay on close")
 	flag.Parse()
 
+	var forwarderFactory, ctrlForwarderFactory tpmproxy.ForwarderFactory
+	if swtpmCtrlSock != "" {
+		// the server channel is passed to swtpm with CMD_SET_DATAFD
+		ctrlForwarderFactory = tpmproxy.NewUnixForwarderFactory(swtpmCtrlSock)
+	} else {
+		forwarderFactory = tpmproxy.NewTcpForwarderFactory(swtpmAddr)
+		ctrlForwarderFactory = tpmproxy.NewTcpForwarderFactory(swtpmCtrlAddr)
+	}
+
 	relay := tpmproxy.NewQemuCtrlRelayer(sockFile,
-		tpmproxy.NewTcpForwarderFactory(swtpmAddr),
-		tpmproxy.NewTcpForwarderFactory(swtpmCtrlAddr),
+		forwarderFactory,
+		ctrlForwarderFactory,
 		terminateOnClose,
 		nil)
 	if err := relay.Relay(); err != nil {
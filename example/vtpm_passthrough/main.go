@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/CyberDefenseInstitute/tpmproxy"
+)
+
+var (
+	tpmPath   string
+	swtpmAddr string
+)
+
+func main() {
+	flag.StringVar(&tpmPath, "tpm", "/dev/tpmrm0", "pass-through tpm device path")
+	flag.StringVar(&swtpmAddr, "swtpm", "", "swtpm address (overrides -tpm)")
+	flag.Parse()
+
+	var forwarderFactory tpmproxy.ForwarderFactory
+	if swtpmAddr != "" {
+		forwarderFactory = tpmproxy.NewTcpForwarderFactory(swtpmAddr)
+	} else {
+		forwarderFactory = tpmproxy.NewIoForwarderFactory(tpmPath)
+	}
+
+	relay := tpmproxy.NewVtpmProxyRelayer(forwarderFactory, nil)
+	if err := relay.Relay(); err != nil {
+		fmt.Printf("error: %v\n", err)
+	}
+}
@@ -14,32 +14,44 @@ type Exchanger struct {
 	Dst io.ReadWriter
 	// HandlerFactory is the factory that creates RequestResponseHandlers.
 	HandlerFactory RequestResponseHandlerFactory
+	// ReaderFactory is the factory that creates MessageReaders for Src and Dst.
+	// Each handler receives exactly one message read by them.
+	// If nil, RawMessageReaderFactory is used.
+	ReaderFactory MessageReaderFactory
 }
 
 // Exchange exchanges data between the source and destination.
+// If a handler returns a nil request, the request is not forwarded and
+// HandleResponse is called with a nil response instead, so that the handler
+// can answer the request by itself.
 func (ex *Exchanger) Exchange() error {
-	reqBuf := make([]byte, 4096)
-	respBuf := make([]byte, 4096)
+	readerFactory := ex.ReaderFactory
+	if readerFactory == nil {
+		readerFactory = &RawMessageReaderFactory{}
+	}
+	srcReader := readerFactory.NewMessageReader(ex.Src)
+	dstReader := readerFactory.NewMessageReader(ex.Dst)
 	for {
 		handler := ex.HandlerFactory.NewRequestResponseHandler()
 
-		requestLen, err := ex.Src.Read(reqBuf)
+		request, err := srcReader.ReadMessage()
 		if err != nil {
 			return FilterClosedErr(err)
 		}
-		request := reqBuf[:requestLen]
 		request = handler.HandleRequest(request)
 		// log.Printf("request: %s\n", hex.EncodeToString(request))
 
-		if _, err := ex.Dst.Write(request); err != nil {
-			return FilterClosedErr(err)
-		}
+		var response []byte
+		if request != nil {
+			if _, err := ex.Dst.Write(request); err != nil {
+				return FilterClosedErr(err)
+			}
 
-		responseLen, err := ex.Dst.Read(respBuf)
-		if err != nil {
-			return FilterClosedErr(err)
+			response, err = dstReader.ReadMessage()
+			if err != nil {
+				return FilterClosedErr(err)
+			}
 		}
-		response := respBuf[:responseLen]
 		response = handler.HandleResponse(response)
 		// log.Printf("response: %s\n", hex.EncodeToString(response))
 
@@ -31,6 +31,23 @@ func (f *TcpForwarderFactory) NewForwarder() (Forwarder, error) {
 	return net.Dial("tcp", f.Addr)
 }
 
+// UnixForwarderFactory is a ForwarderFactory that creates UNIX domain socket Forwarders.
+type UnixForwarderFactory struct {
+	Path string
+}
+
+// NewUnixForwarderFactory creates a new UnixForwarderFactory.
+func NewUnixForwarderFactory(path string) *UnixForwarderFactory {
+	return &UnixForwarderFactory{
+		Path: path,
+	}
+}
+
+// NewForwarder creates a new UNIX domain socket Forwarder.
+func (f *UnixForwarderFactory) NewForwarder() (Forwarder, error) {
+	return net.Dial("unix", f.Path)
+}
+
 // IoForwarderFactory is a ForwarderFactory that creates IO Forwarders.
 type IoForwarderFactory struct {
 	Path string
@@ -0,0 +1,142 @@
+package tpmproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// TpmHeaderSize is the size of the TPM command and response headers
+	// (tag, size and command/response code).
+	TpmHeaderSize = 10
+	// DefaultMaxMessageSize is the default upper bound of a TPM message.
+	// It is large enough for any TPM_PT_MAX_COMMAND_SIZE and
+	// TPM_PT_MAX_RESPONSE_SIZE reported by real and emulated TPMs.
+	DefaultMaxMessageSize = 0x10000
+	// rawMessageBufferSize is the buffer size used by RawMessageReader.
+	rawMessageBufferSize = 4096
+)
+
+// MessageReader is an interface that reads complete messages from a stream.
+type MessageReader interface {
+	// ReadMessage reads exactly one complete message.
+	// The returned slice is only valid until the next call.
+	ReadMessage() ([]byte, error)
+}
+
+// MessageReaderFactory is an interface that creates MessageReaders.
+type MessageReaderFactory interface {
+	// NewMessageReader creates a new MessageReader reading from r.
+	NewMessageReader(r io.Reader) MessageReader
+}
+
+// RawMessageReader is a MessageReader that treats the result of a single
+// Read as one message.
+// It is suitable for transports that preserve message boundaries.
+type RawMessageReader struct {
+	r   io.Reader
+	buf []byte
+}
+
+func (mr *RawMessageReader) ReadMessage() ([]byte, error) {
+	n, err := mr.r.Read(mr.buf)
+	if err != nil {
+		return nil, err
+	}
+	return mr.buf[:n], nil
+}
+
+// RawMessageReaderFactory is a MessageReaderFactory that creates RawMessageReaders.
+type RawMessageReaderFactory struct {
+}
+
+func (f *RawMessageReaderFactory) NewMessageReader(r io.Reader) MessageReader {
+	return &RawMessageReader{
+		r:   r,
+		buf: make([]byte, rawMessageBufferSize),
+	}
+}
+
+// TpmMessageReader is a MessageReader that frames TPM commands and responses
+// by the size field of their header.
+// It reassembles messages delivered in pieces and keeps any bytes beyond
+// the current message for the next call.
+type TpmMessageReader struct {
+	r       io.Reader
+	maxSize int
+	buf     []byte
+	// start and end delimit the buffered bytes that are not yet returned.
+	start int
+	end   int
+}
+
+// NewTpmMessageReader creates a new TpmMessageReader.
+// If maxSize is not positive, DefaultMaxMessageSize is used.
+func NewTpmMessageReader(r io.Reader, maxSize int) *TpmMessageReader {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+	return &TpmMessageReader{
+		r:       r,
+		maxSize: maxSize,
+		buf:     make([]byte, maxSize),
+	}
+}
+
+// fill reads from the stream until at least n bytes are buffered.
+func (mr *TpmMessageReader) fill(n int) error {
+	if mr.start > 0 && mr.start+n > len(mr.buf) {
+		copy(mr.buf, mr.buf[mr.start:mr.end])
+		mr.end -= mr.start
+		mr.start = 0
+	}
+	for mr.end-mr.start < n {
+		nread, err := mr.r.Read(mr.buf[mr.end:])
+		mr.end += nread
+		if err != nil {
+			if err == io.EOF && mr.end-mr.start > 0 {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (mr *TpmMessageReader) ReadMessage() ([]byte, error) {
+	if mr.start == mr.end {
+		mr.start, mr.end = 0, 0
+	}
+	if err := mr.fill(TpmHeaderSize); err != nil {
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint32(mr.buf[mr.start+2 : mr.start+6]))
+	if size < TpmHeaderSize || size > mr.maxSize {
+		return nil, fmt.Errorf("invalid TPM message size %d (allowed %d to %d)", size, TpmHeaderSize, mr.maxSize)
+	}
+	if err := mr.fill(size); err != nil {
+		return nil, err
+	}
+	msg := mr.buf[mr.start : mr.start+size]
+	mr.start += size
+	return msg, nil
+}
+
+// TpmMessageReaderFactory is a MessageReaderFactory that creates TpmMessageReaders.
+type TpmMessageReaderFactory struct {
+	// MaxSize is the maximum message size.
+	// If it is not positive, DefaultMaxMessageSize is used.
+	MaxSize int
+}
+
+// NewTpmMessageReaderFactory creates a new TpmMessageReaderFactory.
+func NewTpmMessageReaderFactory(maxSize int) *TpmMessageReaderFactory {
+	return &TpmMessageReaderFactory{
+		MaxSize: maxSize,
+	}
+}
+
+func (f *TpmMessageReaderFactory) NewMessageReader(r io.Reader) MessageReader {
+	return NewTpmMessageReader(r, f.MaxSize)
+}
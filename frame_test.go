@@ -0,0 +1,163 @@
+package tpmproxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+)
+
+func TestTpmMessageReaderPieces(t *testing.T) {
+	msg1, _ := hex.DecodeString("8001000000160000017a00000006000001000000007f")
+	msg2, _ := hex.DecodeString("80010000000c000001430000")
+
+	var stream bytes.Buffer
+	stream.Write(msg1)
+	stream.Write(msg2)
+
+	mr := NewTpmMessageReader(iotest.OneByteReader(&stream), 0)
+	for _, want := range [][]byte{msg1, msg2} {
+		got, err := mr.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("got %x, want %x", got, want)
+		}
+	}
+	if _, err := mr.ReadMessage(); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+}
+
+func TestTpmMessageReaderCoalesced(t *testing.T) {
+	msg1, _ := hex.DecodeString("8001000000160000017a00000006000001000000007f")
+	msg2, _ := hex.DecodeString("80010000000c000001430000")
+
+	mr := NewTpmMessageReader(bytes.NewReader(append(append([]byte{}, msg1...), msg2...)), 0)
+	for _, want := range [][]byte{msg1, msg2} {
+		got, err := mr.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("got %x, want %x", got, want)
+		}
+	}
+}
+
+func TestTpmMessageReaderLarge(t *testing.T) {
+	msg := make([]byte, 10000)
+	copy(msg, []byte{0x80, 0x01, 0x00, 0x00, 0x27, 0x10, 0x00, 0x00, 0x01, 0x37})
+	for i := TpmHeaderSize; i < len(msg); i++ {
+		msg[i] = byte(i)
+	}
+
+	mr := NewTpmMessageReader(iotest.HalfReader(bytes.NewReader(msg)), 0)
+	got, err := mr.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Error("large message mismatch")
+	}
+}
+
+func TestTpmMessageReaderInvalidSize(t *testing.T) {
+	for _, s := range []string{
+		"800100000004000001430000",
+		"80010001000c000001430000",
+	} {
+		msg, _ := hex.DecodeString(s)
+		mr := NewTpmMessageReader(bytes.NewReader(msg), 0x1000)
+		if _, err := mr.ReadMessage(); err == nil {
+			t.Errorf("%s: expected error", s)
+		}
+	}
+}
+
+func TestTpmMessageReaderTruncated(t *testing.T) {
+	msg, _ := hex.DecodeString("8001000000160000017a0000")
+	mr := NewTpmMessageReader(bytes.NewReader(msg), 0)
+	if _, err := mr.ReadMessage(); err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v, want ErrUnexpectedEOF", err)
+	}
+}
+
+type recordingHandler struct {
+	requests  [][]byte
+	responses [][]byte
+}
+
+func (h *recordingHandler) HandleRequest(request []byte) []byte {
+	h.requests = append(h.requests, append([]byte{}, request...))
+	return request
+}
+
+func (h *recordingHandler) HandleResponse(response []byte) []byte {
+	h.responses = append(h.responses, append([]byte{}, response...))
+	return response
+}
+
+func (h *recordingHandler) NewRequestResponseHandler() RequestResponseHandler {
+	return h
+}
+
+func TestExchangerFraming(t *testing.T) {
+	request, _ := hex.DecodeString("8001000000160000017a00000006000001000000007f")
+	response, _ := hex.DecodeString("80010000000a00000000")
+
+	client, src := net.Pipe()
+	dst, server := net.Pipe()
+	handler := &recordingHandler{}
+	ex := &Exchanger{
+		Src:            src,
+		Dst:            dst,
+		HandlerFactory: handler,
+		ReaderFactory:  NewTpmMessageReaderFactory(0),
+	}
+	done := make(chan error)
+	go func() {
+		done <- ex.Exchange()
+	}()
+
+	go func() {
+		// the server receives the request in one piece and answers in pieces
+		got := make([]byte, len(request))
+		if _, err := io.ReadFull(server, got); err != nil {
+			return
+		}
+		for i := range response {
+			server.Write(response[i : i+1])
+		}
+	}()
+
+	// the client sends the request in pieces
+	go func() {
+		client.Write(request[:3])
+		client.Write(request[3:15])
+		client.Write(request[15:])
+	}()
+	got := make([]byte, len(response))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, response) {
+		t.Errorf("got %x, want %x", got, response)
+	}
+
+	client.Close()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	server.Close()
+
+	if len(handler.requests) != 1 || !bytes.Equal(handler.requests[0], request) {
+		t.Errorf("unexpected requests: %x", handler.requests)
+	}
+	if len(handler.responses) != 1 || !bytes.Equal(handler.responses[0], response) {
+		t.Errorf("unexpected responses: %x", handler.responses)
+	}
+}
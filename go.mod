@@ -2,12 +2,6 @@ module github.com/CyberDefenseInstitute/tpmproxy
 
 go 1.22
 
-require (
-	github.com/google/go-tpm v0.9.1
-	github.com/opencontainers/runc v1.1.14
-)
+require github.com/google/go-tpm v0.9.1
 
-require (
-	github.com/cyphar/filepath-securejoin v0.2.4 // indirect
-	golang.org/x/sys v0.25.0 // indirect
-)
+require golang.org/x/sys v0.25.0 // indirect
@@ -1,6 +1,12 @@
 package tpmproxy
 
-import "bytes"
+import (
+	"bytes"
+	"encoding/binary"
+	"sync/atomic"
+
+	"github.com/google/go-tpm/tpm2"
+)
 
 // RequestResponseHandler is an interface that handles request-response pairs.
 type RequestResponseHandler interface {
@@ -43,11 +49,41 @@ func (f *NopRequestResponseHandlerFactory) NewRequestResponseHandler() RequestRe
 type TpmRequestResponseHandlerFactory struct {
 	// Interceptor is the Interceptor that intercepts requests and responses.
 	Interceptor Interceptor
+	// ConnID is set to the ConnID of the handled requests.
+	ConnID uint64
+	// Locality, if not nil, returns the Locality of each handled request.
+	Locality func() uint8
 }
 
 func (f *TpmRequestResponseHandlerFactory) NewRequestResponseHandler() RequestResponseHandler {
 	return &TpmRequestResponseHandler{
 		Interceptor: f.Interceptor,
+		Request:     Request{ConnID: f.ConnID},
+		Locality:    f.Locality,
+	}
+}
+
+// lastConnID is the last ConnID given to a connection.
+var lastConnID atomic.Uint64
+
+// newTpmHandlerFactory creates the handler factory of a new connection.
+// The requests are passed to interceptor with a new ConnID, or not
+// handled at all if interceptor is nil.
+func newTpmHandlerFactory(interceptor Interceptor) RequestResponseHandlerFactory {
+	if interceptor == nil {
+		return &NopRequestResponseHandlerFactory{}
+	}
+	return &TpmRequestResponseHandlerFactory{
+		Interceptor: interceptor,
+		ConnID:      lastConnID.Add(1),
+	}
+}
+
+// setLocalityFunc makes the requests of handlerFactory carry the locality
+// returned by locality.
+func setLocalityFunc(handlerFactory RequestResponseHandlerFactory, locality func() uint8) {
+	if f, ok := handlerFactory.(*TpmRequestResponseHandlerFactory); ok {
+		f.Locality = locality
 	}
 }
 
@@ -55,12 +91,17 @@ func (f *TpmRequestResponseHandlerFactory) NewRequestResponseHandler() RequestRe
 type TpmRequestResponseHandler struct {
 	Interceptor Interceptor
 	Request     Request
+	// Locality, if not nil, returns the locality of the request.
+	Locality func() uint8
 }
 
 // HandleRequest handles a request and returns a Interceptor-modified request.
 func (h *TpmRequestResponseHandler) HandleRequest(request []byte) []byte {
 	h.Request.Raw = request
-	if len(request) < 10 /* sizeof(TPMCmdHeader) */ {
+	if h.Locality != nil {
+		h.Request.Locality = h.Locality()
+	}
+	if len(request) < TpmHeaderSize {
 		return request
 	}
 
@@ -74,6 +115,66 @@ func (h *TpmRequestResponseHandler) HandleRequest(request []byte) []byte {
 }
 
 // HandleResponse handles a response and returns a Interceptor-modified response.
+// If the request was blocked and the Interceptor does not provide a
+// response, a TPM_RC_FAILURE response is returned.
 func (h *TpmRequestResponseHandler) HandleResponse(response []byte) []byte {
-	return h.Interceptor.HandleResponse(&h.Request, response)
+	blocked := response == nil
+	response = h.Interceptor.HandleResponse(&h.Request, response)
+	if blocked && response == nil {
+		return NewTpmErrorResponse(tpm2.TPMSTNoSessions, tpm2.TPMRCFailure)
+	}
+	return response
+}
+
+// NewTpmErrorResponse builds a response with the tag that only carries the
+// response code. An error response has the tag TPM_ST_NO_SESSIONS.
+func NewTpmErrorResponse(tag tpm2.TPMST, rc tpm2.TPMRC) []byte {
+	response := make([]byte, TpmHeaderSize)
+	binary.BigEndian.PutUint16(response[0:2], uint16(tag))
+	binary.BigEndian.PutUint32(response[2:6], TpmHeaderSize)
+	binary.BigEndian.PutUint32(response[6:10], uint32(rc))
+	return response
+}
+
+// CtrlRequestResponseHandlerFactory is a RequestResponseHandlerFactory that creates CtrlRequestResponseHandlers.
+type CtrlRequestResponseHandlerFactory struct {
+	// Interceptor is the CtrlInterceptor that intercepts requests and responses.
+	Interceptor CtrlInterceptor
+}
+
+func (f *CtrlRequestResponseHandlerFactory) NewRequestResponseHandler() RequestResponseHandler {
+	return &CtrlRequestResponseHandler{
+		Interceptor: f.Interceptor,
+	}
+}
+
+// CtrlRequestResponseHandler is a RequestResponseHandler that handles swtpm
+// control channel request-response pairs.
+type CtrlRequestResponseHandler struct {
+	Interceptor CtrlInterceptor
+	Request     *CtrlRequest
+}
+
+// HandleRequest handles a request and returns a CtrlInterceptor-modified request.
+func (h *CtrlRequestResponseHandler) HandleRequest(request []byte) []byte {
+	var err error
+	if h.Request, err = ParseCtrlRequest(request); err != nil {
+		return request
+	}
+	return h.Interceptor.HandleCtrlRequest(h.Request)
+}
+
+// HandleResponse handles a response and returns a CtrlInterceptor-modified response.
+// If the request was blocked and the CtrlInterceptor does not provide a
+// response, a CtrlResultFail response is returned.
+func (h *CtrlRequestResponseHandler) HandleResponse(response []byte) []byte {
+	if h.Request == nil {
+		return response
+	}
+	blocked := response == nil
+	response = h.Interceptor.HandleCtrlResponse(h.Request, response)
+	if blocked && response == nil {
+		return NewCtrlErrorResponse(h.Request.Cmd, CtrlResultFail)
+	}
+	return response
 }
@@ -0,0 +1,44 @@
+package tpmproxy
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+)
+
+type blockingInterceptor struct {
+}
+
+func (it *blockingInterceptor) HandleRequest(request *Request) []byte {
+	return nil
+}
+
+func (it *blockingInterceptor) HandleResponse(request *Request, response []byte) []byte {
+	return response
+}
+
+func TestTpmRequestResponseHandlerBlock(t *testing.T) {
+	h := (&TpmRequestResponseHandlerFactory{Interceptor: &blockingInterceptor{}}).NewRequestResponseHandler()
+	// GetRandom with a session tag
+	if got := h.HandleRequest([]byte{0x80, 0x02, 0, 0, 0, 0x0c, 0, 0, 0x01, 0x7b, 0, 4}); got != nil {
+		t.Fatalf("request not blocked: %x", got)
+	}
+	want := []byte{0x80, 0x01, 0, 0, 0, 0x0a, 0, 0, 0x01, 0x01}
+	if got := h.HandleResponse(nil); !bytes.Equal(got, want) {
+		t.Errorf("got %x", got)
+	}
+}
+
+// localityInterceptor keeps the locality of the last request.
+type localityInterceptor struct {
+	locality atomic.Uint32
+}
+
+func (it *localityInterceptor) HandleRequest(request *Request) []byte {
+	it.locality.Store(uint32(request.Locality))
+	return request.Raw
+}
+
+func (it *localityInterceptor) HandleResponse(request *Request, response []byte) []byte {
+	return response
+}
@@ -10,11 +10,19 @@ type Request struct {
 	Hdr *tpm2.TPMCmdHeader
 	// Raw is the raw command.
 	Raw []byte
+	// ConnID identifies the connection the command was received on.
+	// It is unique within the process, or zero if unknown.
+	ConnID uint64
+	// Locality is the locality the command was sent with. It is zero if the
+	// relayer does not see the locality.
+	Locality uint8
 }
 
 // Interceptor is an interface that intercepts requests and responses.
 type Interceptor interface {
 	// HandleRequest handles a request and returns a modified request.
+	// Returning nil blocks the request: it is not forwarded and
+	// HandleResponse is called with a nil response.
 	HandleRequest(request *Request) []byte
 	// HandleResponse handles a response and returns a modified response.
 	HandleResponse(request *Request, response []byte) []byte
@@ -0,0 +1,810 @@
+package tpmproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// The go-tpm structures are marshalled here following their gotpm struct
+// tags, as go-tpm does:
+//   - handle: a handle of a command or response structure
+//   - sized, sized8: a structure preceded by its size in 2 or 1 byte
+//   - list: a TPML list preceded by its length in 4 bytes
+//   - tag=Field: a union selected by the numeric Field
+//   - nullable: a zero value marshalled as TPM_ALG_NULL or TPM_RH_NULL
+//   - optional: a nil pointer marshalled as an empty TPM2B
+//   - bit=high:low: a bit field of a TPMA structure
+//   - skip: a field not marshalled
+//
+// The sized buffers (TPM2B) and the unions (TPMU) of go-tpm have unexported
+// fields. They are marshalled by tpm2.Marshal, a union with the structure
+// holding its selector, and built by tpm2.BytesAs2B and the tpm2.NewTPMU*
+// constructors when unmarshalled.
+
+// maxListLength is the maximum length of the lists, as in go-tpm. It must be
+// greater than the size of a context.
+const maxListLength = 4096
+
+var (
+	sensitiveCreateType      = reflect.TypeOf(tpm2.TPM2BSensitiveCreate{})
+	sensitiveCreateUnionType = reflect.TypeOf(tpm2.TPMUSensitiveCreate{})
+)
+
+// unionMember is a member of a go-tpm union.
+type unionMember struct {
+	// typ is the type of the member.
+	typ reflect.Type
+	// union returns the union holding the member v.
+	union func(v reflect.Value) reflect.Value
+}
+
+// unionMembers are the members of the go-tpm unions by selector.
+// TPMU_SENSITIVE_CREATE has no selector: its data is taken as a
+// TPM2B_SENSITIVE_DATA, which a TPM2B_DERIVE is marshalled alike.
+var unionMembers = map[reflect.Type]map[int64]unionMember{}
+
+// tpm2bs build the go-tpm TPM2Bs of their marshalled contents by type.
+var tpm2bs = map[reflect.Type]func(b []byte) reflect.Value{}
+
+func init() {
+	addUnionMember(tpm2.NewTPMUCapabilities[*tpm2.TPMLAlgProperty], tpm2.TPMCapAlgs)
+	addUnionMember(tpm2.NewTPMUCapabilities[*tpm2.TPMLHandle], tpm2.TPMCapHandles)
+	addUnionMember(tpm2.NewTPMUCapabilities[*tpm2.TPMLCCA], tpm2.TPMCapCommands)
+	addUnionMember(tpm2.NewTPMUCapabilities[*tpm2.TPMLCC], tpm2.TPMCapPPCommands)
+	addUnionMember(tpm2.NewTPMUCapabilities[*tpm2.TPMLCC], tpm2.TPMCapAuditCommands)
+	addUnionMember(tpm2.NewTPMUCapabilities[*tpm2.TPMLPCRSelection], tpm2.TPMCapPCRs)
+	addUnionMember(tpm2.NewTPMUCapabilities[*tpm2.TPMLTaggedTPMProperty], tpm2.TPMCapTPMProperties)
+	addUnionMember(tpm2.NewTPMUCapabilities[*tpm2.TPMLTaggedPCRProperty], tpm2.TPMCapPCRProperties)
+	addUnionMember(tpm2.NewTPMUCapabilities[*tpm2.TPMLECCCurve], tpm2.TPMCapECCCurves)
+	addUnionMember(tpm2.NewTPMUCapabilities[*tpm2.TPMLTaggedPolicy], tpm2.TPMCapAuthPolicies)
+	addUnionMember(tpm2.NewTPMUCapabilities[*tpm2.TPMLACTData], tpm2.TPMCapACT)
+
+	addUnionMember(tpm2.NewTPMUAttest[*tpm2.TPMSNVCertifyInfo], tpm2.TPMSTAttestNV)
+	addUnionMember(tpm2.NewTPMUAttest[*tpm2.TPMSCommandAuditInfo], tpm2.TPMSTAttestCommandAudit)
+	addUnionMember(tpm2.NewTPMUAttest[*tpm2.TPMSSessionAuditInfo], tpm2.TPMSTAttestSessionAudit)
+	addUnionMember(tpm2.NewTPMUAttest[*tpm2.TPMSCertifyInfo], tpm2.TPMSTAttestCertify)
+	addUnionMember(tpm2.NewTPMUAttest[*tpm2.TPMSQuoteInfo], tpm2.TPMSTAttestQuote)
+	addUnionMember(tpm2.NewTPMUAttest[*tpm2.TPMSTimeAttestInfo], tpm2.TPMSTAttestTime)
+	addUnionMember(tpm2.NewTPMUAttest[*tpm2.TPMSCreationInfo], tpm2.TPMSTAttestCreation)
+	addUnionMember(tpm2.NewTPMUAttest[*tpm2.TPMSNVDigestCertifyInfo], tpm2.TPMSTAttestNVDigest)
+
+	addUnionMember(tpm2.NewTPMUSymKeyBits[tpm2.TPMKeyBits], tpm2.TPMAlgAES)
+	addUnionMember(tpm2.NewTPMUSymKeyBits[tpm2.TPMAlgID], tpm2.TPMAlgXOR)
+
+	addUnionMember(tpm2.NewTPMUSymMode[tpm2.TPMIAlgSymMode], tpm2.TPMAlgAES)
+	addUnionMember(tpm2.NewTPMUSymMode[tpm2.TPMSEmpty], tpm2.TPMAlgXOR)
+
+	// NewTPMUSymDetails creates a TPMUSymMode. Both members are TPMS_EMPTY,
+	// which the zero TPMUSymDetails is marshalled alike.
+	emptyDetails := func(tpm2.TPMAlgID, tpm2.TPMSEmpty) tpm2.TPMUSymDetails { return tpm2.TPMUSymDetails{} }
+	addUnionMember(emptyDetails, tpm2.TPMAlgAES)
+	addUnionMember(emptyDetails, tpm2.TPMAlgXOR)
+
+	addUnionMember(tpm2.NewTPMUSchemeKeyedHash[*tpm2.TPMSSchemeHMAC], tpm2.TPMAlgHMAC)
+	addUnionMember(tpm2.NewTPMUSchemeKeyedHash[*tpm2.TPMSSchemeXOR], tpm2.TPMAlgXOR)
+
+	addUnionMember(tpm2.NewTPMUSigScheme[*tpm2.TPMSSchemeHMAC], tpm2.TPMAlgHMAC)
+	addUnionMember(tpm2.NewTPMUSigScheme[*tpm2.TPMSSchemeHash], tpm2.TPMAlgRSASSA)
+	addUnionMember(tpm2.NewTPMUSigScheme[*tpm2.TPMSSchemeHash], tpm2.TPMAlgRSAPSS)
+	addUnionMember(tpm2.NewTPMUSigScheme[*tpm2.TPMSSchemeHash], tpm2.TPMAlgECDSA)
+	addUnionMember(tpm2.NewTPMUSigScheme[*tpm2.TPMSSchemeECDAA], tpm2.TPMAlgECDAA)
+
+	addUnionMember(tpm2.NewTPMUKDFScheme[*tpm2.TPMSKDFSchemeMGF1], tpm2.TPMAlgMGF1)
+	addUnionMember(tpm2.NewTPMUKDFScheme[*tpm2.TPMSKDFSchemeECDH], tpm2.TPMAlgECDH)
+	addUnionMember(tpm2.NewTPMUKDFScheme[*tpm2.TPMSKDFSchemeKDF1SP80056A], tpm2.TPMAlgKDF1SP80056A)
+	addUnionMember(tpm2.NewTPMUKDFScheme[*tpm2.TPMSKDFSchemeKDF2], tpm2.TPMAlgKDF2)
+	addUnionMember(tpm2.NewTPMUKDFScheme[*tpm2.TPMSKDFSchemeKDF1SP800108], tpm2.TPMAlgKDF1SP800108)
+
+	addUnionMember(tpm2.NewTPMUAsymScheme[*tpm2.TPMSSigSchemeRSASSA], tpm2.TPMAlgRSASSA)
+	addUnionMember(tpm2.NewTPMUAsymScheme[*tpm2.TPMSEncSchemeRSAES], tpm2.TPMAlgRSAES)
+	addUnionMember(tpm2.NewTPMUAsymScheme[*tpm2.TPMSSigSchemeRSAPSS], tpm2.TPMAlgRSAPSS)
+	addUnionMember(tpm2.NewTPMUAsymScheme[*tpm2.TPMSEncSchemeOAEP], tpm2.TPMAlgOAEP)
+	addUnionMember(tpm2.NewTPMUAsymScheme[*tpm2.TPMSSigSchemeECDSA], tpm2.TPMAlgECDSA)
+	addUnionMember(tpm2.NewTPMUAsymScheme[*tpm2.TPMSKeySchemeECDH], tpm2.TPMAlgECDH)
+	addUnionMember(tpm2.NewTPMUAsymScheme[*tpm2.TPMSSchemeECDAA], tpm2.TPMAlgECDAA)
+
+	addUnionMember(tpm2.NewTPMUSignature[*tpm2.TPMTHA], tpm2.TPMAlgHMAC)
+	addUnionMember(tpm2.NewTPMUSignature[*tpm2.TPMSSignatureRSA], tpm2.TPMAlgRSASSA)
+	addUnionMember(tpm2.NewTPMUSignature[*tpm2.TPMSSignatureRSA], tpm2.TPMAlgRSAPSS)
+	addUnionMember(tpm2.NewTPMUSignature[*tpm2.TPMSSignatureECC], tpm2.TPMAlgECDSA)
+	addUnionMember(tpm2.NewTPMUSignature[*tpm2.TPMSSignatureECC], tpm2.TPMAlgECDAA)
+
+	addUnionMember(tpm2.NewTPMUPublicID[*tpm2.TPM2BDigest], tpm2.TPMAlgKeyedHash)
+	addUnionMember(tpm2.NewTPMUPublicID[*tpm2.TPM2BDigest], tpm2.TPMAlgSymCipher)
+	addUnionMember(tpm2.NewTPMUPublicID[*tpm2.TPM2BPublicKeyRSA], tpm2.TPMAlgRSA)
+	addUnionMember(tpm2.NewTPMUPublicID[*tpm2.TPMSECCPoint], tpm2.TPMAlgECC)
+
+	addUnionMember(tpm2.NewTPMUPublicParms[*tpm2.TPMSKeyedHashParms], tpm2.TPMAlgKeyedHash)
+	addUnionMember(tpm2.NewTPMUPublicParms[*tpm2.TPMSSymCipherParms], tpm2.TPMAlgSymCipher)
+	addUnionMember(tpm2.NewTPMUPublicParms[*tpm2.TPMSRSAParms], tpm2.TPMAlgRSA)
+	addUnionMember(tpm2.NewTPMUPublicParms[*tpm2.TPMSECCParms], tpm2.TPMAlgECC)
+
+	addUnionMember(tpm2.NewTPMUSensitiveComposite[*tpm2.TPM2BPrivateKeyRSA], tpm2.TPMAlgRSA)
+	addUnionMember(tpm2.NewTPMUSensitiveComposite[*tpm2.TPM2BECCParameter], tpm2.TPMAlgECC)
+	addUnionMember(tpm2.NewTPMUSensitiveComposite[*tpm2.TPM2BSensitiveData], tpm2.TPMAlgKeyedHash)
+	addUnionMember(tpm2.NewTPMUSensitiveComposite[*tpm2.TPM2BSymKey], tpm2.TPMAlgSymCipher)
+
+	addUnionMember(func(_ uint16, data *tpm2.TPM2BSensitiveData) tpm2.TPMUSensitiveCreate {
+		return tpm2.NewTPMUSensitiveCreate(data)
+	}, 0)
+
+	addTPM2B[tpm2.TPMSAttest]()
+	addTPM2B[tpm2.TPMSDerive]()
+	addTPM2B[tpm2.TPMSECCPoint]()
+	addTPM2B[tpm2.TPMTPublic]()
+	addTPM2B[tpm2.TPMTSensitive]()
+	addTPM2B[tpm2.TPMSNVPublic]()
+	addTPM2B[tpm2.TPMSCreationData]()
+}
+
+// addUnionMember adds the member of the union created by newUnion for the
+// selector.
+func addUnionMember[S ~uint16 | ~uint32, C, U any](newUnion func(S, C) U, selector S) {
+	union := reflect.TypeOf((*U)(nil)).Elem()
+	if unionMembers[union] == nil {
+		unionMembers[union] = make(map[int64]unionMember)
+	}
+	unionMembers[union][int64(selector)] = unionMember{
+		typ: reflect.TypeOf((*C)(nil)).Elem(),
+		union: func(v reflect.Value) reflect.Value {
+			return reflect.ValueOf(newUnion(selector, v.Interface().(C)))
+		},
+	}
+}
+
+// addTPM2B adds the go-tpm TPM2B of the contents T.
+func addTPM2B[T tpm2.Marshallable, P interface {
+	*T
+	tpm2.Unmarshallable
+}]() {
+	tpm2bs[reflect.TypeOf(tpm2.TPM2B[T, P]{})] = func(b []byte) reflect.Value {
+		return reflect.ValueOf(tpm2.BytesAs2B[T, P](b))
+	}
+}
+
+// isOpaque reports whether t is a go-tpm structure with unexported fields,
+// such as a TPM2B or a union, which is not marshalled field by field.
+func isOpaque(t reflect.Type) bool {
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); !f.IsExported() && !f.Anonymous {
+			return true
+		}
+	}
+	return false
+}
+
+// hasUnion reports whether the struct t has a union field.
+func hasUnion(t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		if _, ok := tagValue(t.Field(i), "tag"); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// goTPMMarshal marshals v by tpm2.Marshal, whose panic is returned as an
+// error.
+func goTPMMarshal(buf *bytes.Buffer, v reflect.Value) (err error) {
+	m, ok := v.Interface().(tpm2.Marshallable)
+	if !ok {
+		return fmt.Errorf("%v is not marshallable by go-tpm", v.Type())
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("marshalling %v: %v", v.Type(), r)
+		}
+	}()
+	buf.Write(tpm2.Marshal(m))
+	return nil
+}
+
+func tagValue(t reflect.StructField, query string) (string, bool) {
+	tags, ok := t.Tag.Lookup("gotpm")
+	if !ok {
+		return "", false
+	}
+	for _, tag := range strings.Split(tags, ",") {
+		if tag == query {
+			return "", true
+		}
+		if value, ok := strings.CutPrefix(tag, query+"="); ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+func hasTag(t reflect.StructField, query string) bool {
+	_, ok := tagValue(t, query)
+	return ok
+}
+
+// bitRange returns the range of the bit tag of t.
+func bitRange(t reflect.StructField) (high, low int, err error) {
+	value, _ := tagValue(t, "bit")
+	bits := strings.Split(value, ":")
+	if high, err = strconv.Atoi(bits[0]); err != nil {
+		return 0, 0, fmt.Errorf("invalid bit tag of %s: %q", t.Name, value)
+	}
+	low = high
+	if len(bits) > 1 {
+		if low, err = strconv.Atoi(bits[1]); err != nil {
+			return 0, 0, fmt.Errorf("invalid bit tag of %s: %q", t.Name, value)
+		}
+	}
+	if low > high {
+		low, high = high, low
+	}
+	return high, low, nil
+}
+
+func taggedMembers(v reflect.Value, tag string, invert bool) []reflect.Value {
+	var members []reflect.Value
+	for i := 0; i < v.NumField(); i++ {
+		if hasTag(v.Type().Field(i), tag) != invert {
+			members = append(members, v.Field(i))
+		}
+	}
+	return members
+}
+
+func isMarshalledByReflection(v reflect.Value) bool {
+	t := v.Type()
+	if t == sensitiveCreateType || isOpaque(t) {
+		return false
+	}
+	switch v.Kind() {
+	case reflect.Bool, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Array, reflect.Slice, reflect.Ptr, reflect.Struct:
+		return true
+	}
+	return false
+}
+
+// isBitwise reports whether the struct t is a TPMA structure, whose exported
+// fields are bit fields.
+func isBitwise(t reflect.Type) (bool, error) {
+	bitwise, exported := 0, 0
+	for i := 0; i < t.NumField(); i++ {
+		if !t.Field(i).IsExported() {
+			continue
+		}
+		exported++
+		if hasTag(t.Field(i), "bit") {
+			bitwise++
+		}
+	}
+	if bitwise != 0 && bitwise != exported {
+		return false, fmt.Errorf("%v has both bit fields and other fields", t)
+	}
+	return bitwise > 0, nil
+}
+
+// unionSelector returns the value of the selector field of the struct s.
+// A zero nullable selector is TPM_ALG_NULL.
+func unionSelector(s reflect.Value, name string) (int64, error) {
+	field, ok := s.Type().FieldByName(name)
+	if !ok {
+		return 0, fmt.Errorf("%v has no selector %s", s.Type(), name)
+	}
+	v := s.FieldByIndex(field.Index)
+	if v.IsZero() && hasTag(field, "nullable") {
+		return int64(tpm2.TPMAlgNull), nil
+	}
+	switch v.Kind() {
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.Uint() <= math.MaxInt64 {
+			return int64(v.Uint()), nil
+		}
+	}
+	return 0, fmt.Errorf("selector %s of %v is not a valid number", name, s.Type())
+}
+
+// sizeLength returns the length of the size preceding the field, or 0 if it
+// is not sized.
+func sizeLength(t reflect.StructField) int {
+	switch {
+	case hasTag(t, "sized"):
+		return 2
+	case hasTag(t, "sized8"):
+		return 1
+	}
+	return 0
+}
+
+func marshal(buf *bytes.Buffer, v reflect.Value) error {
+	switch t := v.Type(); {
+	case t == sensitiveCreateType:
+		// a nil TPMS_SENSITIVE_CREATE is marshalled as the zero value
+		return marshalSized(buf, 2, v.Field(0))
+	case unionMembers[t] != nil && t != sensitiveCreateUnionType:
+		return fmt.Errorf("union %v without a selector", t)
+	case isOpaque(t):
+		return goTPMMarshal(buf, v)
+	}
+
+	switch v.Kind() {
+	case reflect.Bool, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return marshalNumeric(buf, v)
+	case reflect.Array, reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			buf.Write(b)
+			return nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := marshal(buf, v.Index(i)); err != nil {
+				return fmt.Errorf("marshalling element %d of %v: %w", i, v.Type(), err)
+			}
+		}
+		return nil
+	case reflect.Struct:
+		bitwise, err := isBitwise(v.Type())
+		if err != nil {
+			return err
+		}
+		if bitwise {
+			return marshalBitwise(buf, v)
+		}
+		if hasUnion(v.Type()) {
+			// the union is marshalled with its selector by go-tpm
+			return goTPMMarshal(buf, v)
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if !v.Type().Field(i).IsExported() {
+				continue
+			}
+			if err := marshalField(buf, v, i); err != nil {
+				return fmt.Errorf("marshalling %s of %v: %w", v.Type().Field(i).Name, v.Type(), err)
+			}
+		}
+		return nil
+	case reflect.Ptr:
+		if v.IsNil() {
+			return marshal(buf, reflect.Zero(v.Type().Elem()))
+		}
+		return marshal(buf, v.Elem())
+	case reflect.Interface:
+		if v.IsNil() {
+			return fmt.Errorf("missing %v value", v.Type())
+		}
+		return marshal(buf, v.Elem())
+	}
+	return fmt.Errorf("%v is not marshallable", v.Type())
+}
+
+// marshalField marshals the i-th field of the struct s following its tags.
+func marshalField(buf *bytes.Buffer, s reflect.Value, i int) error {
+	field, v := s.Type().Field(i), s.Field(i)
+	if hasTag(field, "skip") {
+		return nil
+	}
+	if name, ok := tagValue(field, "tag"); ok {
+		selector, err := unionSelector(s, name)
+		if err != nil {
+			return err
+		}
+		if selector == int64(tpm2.TPMAlgNull) {
+			return nil
+		}
+		return fmt.Errorf("union %s of %v is marshalled only by go-tpm", field.Name, s.Type())
+	}
+
+	var b bytes.Buffer
+	if hasTag(field, "list") {
+		if v.Kind() != reflect.Slice {
+			return fmt.Errorf("list %s is not a slice", field.Name)
+		}
+		binary.Write(&b, binary.BigEndian, uint32(v.Len()))
+	}
+	var err error
+	switch {
+	case hasTag(field, "optional") && v.Kind() == reflect.Ptr && v.IsNil():
+		b.Write([]byte{0, 0})
+	case v.IsZero() && v.Kind() == reflect.Uint32 && hasTag(field, "nullable"):
+		err = marshalNumeric(&b, reflect.ValueOf(tpm2.TPMRHNull))
+	case v.IsZero() && v.Kind() == reflect.Uint16 && hasTag(field, "nullable"):
+		err = marshalNumeric(&b, reflect.ValueOf(tpm2.TPMAlgNull))
+	default:
+		err = marshal(&b, v)
+	}
+	if err != nil {
+		return err
+	}
+	return writeSized(buf, sizeLength(field), b.Bytes())
+}
+
+func marshalNumeric(buf *bytes.Buffer, v reflect.Value) error {
+	var n uint64
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			n = 1
+		}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n = uint64(v.Int())
+	default:
+		n = v.Uint()
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], n)
+	buf.Write(b[8-v.Type().Size():])
+	return nil
+}
+
+// writeSized writes b preceded by its size in sizeLength bytes.
+func writeSized(buf *bytes.Buffer, sizeLength int, b []byte) error {
+	switch sizeLength {
+	case 1:
+		if len(b) > math.MaxUint8 {
+			return fmt.Errorf("size %d overflows its 1-byte size", len(b))
+		}
+		buf.WriteByte(uint8(len(b)))
+	case 2:
+		if len(b) > math.MaxUint16 {
+			return fmt.Errorf("size %d overflows its 2-byte size", len(b))
+		}
+		binary.Write(buf, binary.BigEndian, uint16(len(b)))
+	}
+	buf.Write(b)
+	return nil
+}
+
+// marshalSized marshals v preceded by its size in sizeLength bytes.
+func marshalSized(buf *bytes.Buffer, sizeLength int, v reflect.Value) error {
+	var b bytes.Buffer
+	if err := marshal(&b, v); err != nil {
+		return err
+	}
+	return writeSized(buf, sizeLength, b.Bytes())
+}
+
+func marshalBitwise(buf *bytes.Buffer, v reflect.Value) error {
+	bg, ok := v.Interface().(tpm2.BitGetter)
+	if !ok {
+		return fmt.Errorf("%v is not a BitGetter", v.Type())
+	}
+	var bits uint64
+	for i := 0; i < bg.Length(); i++ {
+		if bg.GetReservedBit(i) {
+			bits |= 1 << i
+		}
+	}
+	for i := 0; i < v.NumField(); i++ {
+		if !v.Type().Field(i).IsExported() {
+			continue
+		}
+		high, low, err := bitRange(v.Type().Field(i))
+		if err != nil {
+			return err
+		}
+		var value uint64
+		if f := v.Field(i); f.Kind() == reflect.Bool {
+			if f.Bool() {
+				value = 1
+			}
+		} else {
+			value = f.Uint()
+		}
+		bits |= (value & (1<<(high-low+1) - 1)) << low
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], bits)
+	buf.Write(b[8-bg.Length()/8:])
+	return nil
+}
+
+func unmarshal(buf *bytes.Buffer, v reflect.Value) error {
+	switch t := v.Type(); {
+	case t == sensitiveCreateType:
+		return unmarshalSized(buf, 2, v.Field(0))
+	case tpm2bs[t] != nil:
+		return unmarshalTPM2B(buf, v)
+	case t == sensitiveCreateUnionType:
+		return unmarshalUnion(buf, v, 0)
+	case unionMembers[t] != nil:
+		return fmt.Errorf("union %v without a selector", t)
+	case isOpaque(t):
+		return fmt.Errorf("%v is not unmarshallable", t)
+	}
+
+	switch v.Kind() {
+	case reflect.Bool, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return unmarshalNumeric(buf, v)
+	case reflect.Slice:
+		// a byte slice is the rest of the buffer
+		length := uint32(buf.Len())
+		if v.Type().Elem().Kind() != reflect.Uint8 {
+			if err := binary.Read(buf, binary.BigEndian, &length); err != nil {
+				return fmt.Errorf("unmarshalling length of %v: %w", v.Type(), err)
+			}
+			if length > maxListLength {
+				return fmt.Errorf("invalid length %d of %v", length, v.Type())
+			}
+		}
+		s := reflect.MakeSlice(v.Type(), int(length), int(length))
+		if err := unmarshalElements(buf, s); err != nil {
+			return err
+		}
+		v.Set(s)
+		return nil
+	case reflect.Array:
+		return unmarshalElements(buf, v)
+	case reflect.Struct:
+		bitwise, err := isBitwise(v.Type())
+		if err != nil {
+			return err
+		}
+		if bitwise {
+			return unmarshalBitwise(buf, v)
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if !v.Type().Field(i).IsExported() {
+				continue
+			}
+			if err := unmarshalField(buf, v, i); err != nil {
+				return fmt.Errorf("unmarshalling %s of %v: %w", v.Type().Field(i).Name, v.Type(), err)
+			}
+		}
+		return nil
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return unmarshal(buf, v.Elem())
+	}
+	return fmt.Errorf("%v is not unmarshallable", v.Type())
+}
+
+// unmarshalField unmarshals the i-th field of the struct s following its
+// tags.
+func unmarshalField(buf *bytes.Buffer, s reflect.Value, i int) error {
+	field, v := s.Type().Field(i), s.Field(i)
+	if hasTag(field, "skip") {
+		return nil
+	}
+	if name, ok := tagValue(field, "tag"); ok {
+		selector, err := unionSelector(s, name)
+		if err != nil {
+			return err
+		}
+		if selector == int64(tpm2.TPMAlgNull) {
+			return nil
+		}
+		return unmarshalUnion(buf, v, selector)
+	}
+	list := hasTag(field, "list")
+	if list && v.Kind() != reflect.Slice {
+		return fmt.Errorf("list %s is not a slice", field.Name)
+	}
+	if !list && v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 {
+		return fmt.Errorf("slice %s is not a list", field.Name)
+	}
+	if hasTag(field, "optional") && v.Kind() == reflect.Ptr {
+		if buf.Len() < 2 {
+			return io.ErrUnexpectedEOF
+		}
+		if binary.BigEndian.Uint16(buf.Bytes()) == 0 {
+			buf.Next(2)
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+	}
+	if n := sizeLength(field); n > 0 {
+		return unmarshalSized(buf, n, v)
+	}
+	return unmarshal(buf, v)
+}
+
+func unmarshalNumeric(buf *bytes.Buffer, v reflect.Value) error {
+	var b [8]byte
+	if _, err := io.ReadFull(buf, b[8-v.Type().Size():]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint64(b[:])
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(n != 0)
+	case reflect.Int8:
+		v.SetInt(int64(int8(n)))
+	case reflect.Int16:
+		v.SetInt(int64(int16(n)))
+	case reflect.Int32:
+		v.SetInt(int64(int32(n)))
+	case reflect.Int64:
+		v.SetInt(int64(n))
+	default:
+		v.SetUint(n)
+	}
+	return nil
+}
+
+func unmarshalElements(buf *bytes.Buffer, v reflect.Value) error {
+	if v.Type().Elem().Kind() == reflect.Uint8 {
+		if buf.Len() < v.Len() {
+			return io.ErrUnexpectedEOF
+		}
+		reflect.Copy(v, reflect.ValueOf(buf.Next(v.Len())))
+		return nil
+	}
+	for i := 0; i < v.Len(); i++ {
+		if err := unmarshal(buf, v.Index(i)); err != nil {
+			return fmt.Errorf("unmarshalling element %d of %v: %w", i, v.Type(), err)
+		}
+	}
+	return nil
+}
+
+// readSized reads the bytes preceded by their size in sizeLength bytes.
+func readSized(buf *bytes.Buffer, sizeLength int) ([]byte, error) {
+	var b [2]byte
+	if _, err := io.ReadFull(buf, b[2-sizeLength:]); err != nil {
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint16(b[:]))
+	if size > buf.Len() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return bytes.Clone(buf.Next(size)), nil
+}
+
+// unmarshalSized unmarshals v preceded by its size in sizeLength bytes. v
+// must fill the size.
+func unmarshalSized(buf *bytes.Buffer, sizeLength int, v reflect.Value) error {
+	b, err := readSized(buf, sizeLength)
+	if err != nil {
+		return err
+	}
+	sized := bytes.NewBuffer(b)
+	if err := unmarshal(sized, v); err != nil {
+		return err
+	}
+	if sized.Len() > 0 {
+		return fmt.Errorf("%d bytes left in the sized %v", sized.Len(), v.Type())
+	}
+	return nil
+}
+
+// unmarshalTPM2B unmarshals the buffer of the TPM2B. The contents are
+// unmarshalled by its Contents method.
+func unmarshalTPM2B(buf *bytes.Buffer, v reflect.Value) error {
+	b, err := readSized(buf, 2)
+	if err != nil {
+		return err
+	}
+	v.Set(tpm2bs[v.Type()](b))
+	return nil
+}
+
+// unmarshalUnion unmarshals the member of the union for the selector.
+func unmarshalUnion(buf *bytes.Buffer, v reflect.Value, selector int64) error {
+	member, ok := unionMembers[v.Type()][selector]
+	if !ok {
+		return fmt.Errorf("%v has no member for selector 0x%x", v.Type(), selector)
+	}
+	contents := reflect.New(member.typ).Elem()
+	if err := unmarshal(buf, contents); err != nil {
+		return err
+	}
+	v.Set(member.union(contents))
+	return nil
+}
+
+func unmarshalBitwise(buf *bytes.Buffer, v reflect.Value) error {
+	bs, ok := v.Addr().Interface().(tpm2.BitSetter)
+	if !ok {
+		return fmt.Errorf("%v is not a BitSetter", v.Type())
+	}
+	var b [8]byte
+	if _, err := io.ReadFull(buf, b[8-bs.Length()/8:]); err != nil {
+		return err
+	}
+	bits := binary.BigEndian.Uint64(b[:])
+	for i := 0; i < v.NumField(); i++ {
+		if !v.Type().Field(i).IsExported() {
+			continue
+		}
+		high, low, err := bitRange(v.Type().Field(i))
+		if err != nil {
+			return err
+		}
+		mask := uint64(1<<(high-low+1)-1) << low
+		value := (bits & mask) >> low
+		bits &^= mask
+		if f := v.Field(i); f.Kind() == reflect.Bool {
+			f.SetBool(value != 0)
+		} else {
+			f.SetUint(value)
+		}
+	}
+	// the bits left are reserved
+	for i := 0; i < bs.Length(); i++ {
+		bs.SetReservedBit(i, bits&(1<<i) != 0)
+	}
+	return nil
+}
+
+func rspHeader(rsp *bytes.Buffer) error {
+	var hdr tpm2.TPMRspHeader
+	if err := unmarshal(rsp, reflect.ValueOf(&hdr).Elem()); err != nil {
+		return fmt.Errorf("unmarshalling TPM response: %w", err)
+	}
+	if hdr.ResponseCode != tpm2.TPMRCSuccess {
+		return hdr.ResponseCode
+	}
+	return nil
+}
+
+func rspHandles(rsp *bytes.Buffer, rspStruct any) error {
+	for i, handle := range taggedMembers(reflect.ValueOf(rspStruct).Elem(), "handle", false) {
+		if err := unmarshal(rsp, handle); err != nil {
+			return fmt.Errorf("unmarshalling handle %v: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func rspParametersArea(hasSessions bool, rsp *bytes.Buffer) ([]byte, error) {
+	length := uint32(rsp.Len())
+	if hasSessions {
+		if err := binary.Read(rsp, binary.BigEndian, &length); err != nil {
+			return nil, fmt.Errorf("reading length of parameter area: %w", err)
+		}
+	}
+	if int64(length) > int64(rsp.Len()) {
+		return nil, fmt.Errorf("response indicated %d bytes of parameters but there "+
+			"were only %d more bytes of response", length, rsp.Len())
+	}
+	return bytes.Clone(rsp.Next(int(length))), nil
+}
+
+func rspSessions(rsp *bytes.Buffer, rc tpm2.TPMRC, cc tpm2.TPMCC, names []tpm2.TPM2BName, parms []byte, sess []tpm2.Session) error {
+	for i, s := range sess {
+		var auth tpm2.TPMSAuthResponse
+		if err := unmarshal(rsp, reflect.ValueOf(&auth).Elem()); err != nil {
+			return fmt.Errorf("reading auth session %d: %w", i, err)
+		}
+		if err := s.Validate(rc, cc, parms, names, i, &auth); err != nil {
+			return fmt.Errorf("validating auth session %d: %w", i, err)
+		}
+	}
+	if rsp.Len() != 0 {
+		return fmt.Errorf("%d unaccounted-for bytes at the end of the TPM response", rsp.Len())
+	}
+	return nil
+}
+
+func rspParameters(parms []byte, sess []tpm2.Session, rspStruct any) error {
+	if len(parms) >= 2 {
+		length := int(binary.BigEndian.Uint16(parms))
+		if length+2 <= len(parms) {
+			for i, s := range sess {
+				if !s.IsEncryption() {
+					continue
+				}
+				if err := s.Decrypt(parms[2 : 2+length]); err != nil {
+					return fmt.Errorf("decrypting first parameter with session %d: %w", i, err)
+				}
+			}
+		}
+	}
+	return unmarshalParameters(bytes.NewBuffer(parms), rspStruct, false)
+}
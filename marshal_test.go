@@ -0,0 +1,143 @@
+package tpmproxy
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+func TestMarshalCompatibility(t *testing.T) {
+	values := []tpm2.Marshallable{
+		tpm2.RSASRKTemplate,
+		tpm2.ECCSRKTemplate,
+		tpm2.New2B(tpm2.RSASRKTemplate),
+		tpm2.TPMTPublic{
+			Type:    tpm2.TPMAlgKeyedHash,
+			NameAlg: tpm2.TPMAlgSHA256,
+			Parameters: tpm2.NewTPMUPublicParms(tpm2.TPMAlgKeyedHash, &tpm2.TPMSKeyedHashParms{
+				Scheme: tpm2.TPMTKeyedHashScheme{
+					Scheme: tpm2.TPMAlgHMAC,
+					Details: tpm2.NewTPMUSchemeKeyedHash(tpm2.TPMAlgHMAC, &tpm2.TPMSSchemeHMAC{
+						HashAlg: tpm2.TPMAlgSHA256,
+					}),
+				},
+			}),
+			Unique: tpm2.NewTPMUPublicID(tpm2.TPMAlgKeyedHash, &tpm2.TPM2BDigest{Buffer: []byte{1, 2, 3}}),
+		},
+		tpm2.TPMSCapabilityData{
+			Capability: tpm2.TPMCapTPMProperties,
+			Data: tpm2.NewTPMUCapabilities(tpm2.TPMCapTPMProperties, &tpm2.TPMLTaggedTPMProperty{
+				TPMProperty: []tpm2.TPMSTaggedProperty{{Property: tpm2.TPMPTManufacturer, Value: 0x49424d00}},
+			}),
+		},
+		tpm2.TPMSAttest{
+			Magic:           tpm2.TPMGeneratedValue,
+			Type:            tpm2.TPMSTAttestQuote,
+			QualifiedSigner: tpm2.TPM2BName{Buffer: []byte{0, 0x0b}},
+			Attested: tpm2.NewTPMUAttest(tpm2.TPMSTAttestQuote, &tpm2.TPMSQuoteInfo{
+				PCRSelect: tpm2.TPMLPCRSelection{PCRSelections: []tpm2.TPMSPCRSelection{
+					{Hash: tpm2.TPMAlgSHA256, PCRSelect: []byte{1, 0, 0x80}},
+				}},
+				PCRDigest: tpm2.TPM2BDigest{Buffer: []byte{4, 5}},
+			}),
+		},
+		tpm2.TPMTSignature{
+			SigAlg: tpm2.TPMAlgECDSA,
+			Signature: tpm2.NewTPMUSignature(tpm2.TPMAlgECDSA, &tpm2.TPMSSignatureECC{
+				Hash:       tpm2.TPMAlgSHA256,
+				SignatureR: tpm2.TPM2BECCParameter{Buffer: []byte{6}},
+				SignatureS: tpm2.TPM2BECCParameter{Buffer: []byte{7}},
+			}),
+		},
+		tpm2.New2B(tpm2.TPMSNVPublic{
+			NVIndex:    0x01c00002,
+			NameAlg:    tpm2.TPMAlgSHA256,
+			Attributes: tpm2.TPMANV{OwnerWrite: true, AuthRead: true, NT: tpm2.TPMNTOrdinary, Written: true},
+			DataSize:   1024,
+		}),
+		tpm2.TPM2BSensitiveCreate{},
+		tpm2.TPM2BSensitiveCreate{Sensitive: &tpm2.TPMSSensitiveCreate{
+			UserAuth: tpm2.TPM2BAuth{Buffer: []byte("auth")},
+			Data:     tpm2.NewTPMUSensitiveCreate(&tpm2.TPM2BSensitiveData{Buffer: []byte("secret")}),
+		}},
+	}
+	for _, value := range values {
+		want := tpm2.Marshal(value)
+		var buf bytes.Buffer
+		if err := Marshal(&buf, reflect.ValueOf(value)); err != nil {
+			t.Errorf("Marshal(%T): %v", value, err)
+			continue
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("Marshal(%T) = %x, want %x", value, buf.Bytes(), want)
+			continue
+		}
+
+		// the unmarshalled value must be marshalled back alike by go-tpm
+		v := reflect.New(reflect.TypeOf(value))
+		if err := Unmarshal(&buf, v.Elem()); err != nil {
+			t.Errorf("Unmarshal(%T): %v", value, err)
+			continue
+		}
+		if buf.Len() > 0 {
+			t.Errorf("Unmarshal(%T) left %d bytes", value, buf.Len())
+		}
+		if got := tpm2.Marshal(v.Elem().Interface().(tpm2.Marshallable)); !bytes.Equal(got, want) {
+			t.Errorf("unmarshalled %T = %x, want %x", value, got, want)
+		}
+	}
+}
+
+func TestUnmarshalReservedBits(t *testing.T) {
+	want := []byte{0xff, 0xff, 0xff, 0xff}
+	var attrs tpm2.TPMANV
+	if err := Unmarshal(bytes.NewBuffer(want), reflect.ValueOf(&attrs).Elem()); err != nil {
+		t.Fatal(err)
+	}
+	if !attrs.PPWrite || !attrs.PlatformCreate || attrs.NT != 0xf {
+		t.Errorf("got %+v", attrs)
+	}
+	var buf bytes.Buffer
+	if err := Marshal(&buf, reflect.ValueOf(attrs)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) || !bytes.Equal(tpm2.Marshal(attrs), want) {
+		t.Errorf("got %x and %x, want %x", buf.Bytes(), tpm2.Marshal(attrs), want)
+	}
+}
+
+func TestUnmarshalTruncated(t *testing.T) {
+	b := tpm2.Marshal(tpm2.New2B(tpm2.ECCSRKTemplate))
+	for n := 0; n < len(b); n++ {
+		var public tpm2.TPM2BPublic
+		if err := Unmarshal(bytes.NewBuffer(b[:n]), reflect.ValueOf(&public).Elem()); err == nil {
+			t.Errorf("Unmarshal(%x) succeeded", b[:n])
+		}
+	}
+	var public tpm2.TPMTPublic
+	if err := Unmarshal(bytes.NewBuffer(b[2:len(b)-1]), reflect.ValueOf(&public).Elem()); err == nil {
+		t.Errorf("Unmarshal(%x) succeeded", b[2:len(b)-1])
+	}
+}
+
+func TestMarshalGoTPMErrors(t *testing.T) {
+	// a union of another selector, which tpm2.Marshal panics on
+	public := tpm2.TPMTPublic{
+		Type:       tpm2.TPMAlgRSA,
+		Parameters: tpm2.NewTPMUPublicParms(tpm2.TPMAlgECC, &tpm2.TPMSECCParms{}),
+	}
+	var buf bytes.Buffer
+	if err := Marshal(&buf, reflect.ValueOf(public)); err == nil {
+		t.Errorf("Marshal(%+v) succeeded", public)
+	}
+	if err := Marshal(&buf, reflect.ValueOf(tpm2.New2B(public))); err == nil {
+		t.Errorf("Marshal(TPM2B of %+v) succeeded", public)
+	}
+
+	// a union without its structure
+	if err := Unmarshal(bytes.NewBuffer([]byte{0, 0}), reflect.ValueOf(&public.Unique).Elem()); err == nil {
+		t.Error("Unmarshal(TPMUPublicID) succeeded")
+	}
+}
@@ -0,0 +1,257 @@
+package tpmproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Commands of the Microsoft/IBM TPM simulator (mssim) protocol.
+// TPM commands are sent on the TPM port with MssimSendCommand, and the
+// platform signals are sent on the platform port.
+const (
+	MssimSignalPowerOn        uint32 = 1
+	MssimSignalPowerOff       uint32 = 2
+	MssimSignalPhysPresOn     uint32 = 3
+	MssimSignalPhysPresOff    uint32 = 4
+	MssimSignalHashStart      uint32 = 5
+	MssimSignalHashData       uint32 = 6
+	MssimSignalHashEnd        uint32 = 7
+	MssimSendCommand          uint32 = 8
+	MssimSignalCancelOn       uint32 = 9
+	MssimSignalCancelOff      uint32 = 10
+	MssimSignalNvOn           uint32 = 11
+	MssimSignalNvOff          uint32 = 12
+	MssimSignalKeyCacheOn     uint32 = 13
+	MssimSignalKeyCacheOff    uint32 = 14
+	MssimRemoteHandshake      uint32 = 15
+	MssimSetAlternativeResult uint32 = 16
+	MssimSessionEnd           uint32 = 20
+	MssimStop                 uint32 = 21
+	MssimTestFailureMode      uint32 = 30
+)
+
+// mssimPlatformAddr returns the conventional platform port address,
+// which is the port following the TPM port.
+func mssimPlatformAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return "", fmt.Errorf("invalid port %q: %w", port, err)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p+1)), nil
+}
+
+func readUint32(r io.Reader) (uint32, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
+
+// MssimPlatform is a client of the platform port of a TPM simulator.
+type MssimPlatform struct {
+	Addr string
+}
+
+// NewMssimPlatform creates a new MssimPlatform.
+func NewMssimPlatform(addr string) *MssimPlatform {
+	return &MssimPlatform{
+		Addr: addr,
+	}
+}
+
+// Signal sends the platform signals in order and waits for each acknowledgement.
+func (p *MssimPlatform) Signal(signals ...uint32) error {
+	conn, err := net.Dial("tcp", p.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, signal := range signals {
+		if _, err := conn.Write(binary.BigEndian.AppendUint32(nil, signal)); err != nil {
+			return err
+		}
+		ack, err := readUint32(conn)
+		if err != nil {
+			return fmt.Errorf("reading acknowledgement of platform signal %d: %w", signal, err)
+		}
+		if ack != 0 {
+			return fmt.Errorf("platform signal %d failed: %d", signal, ack)
+		}
+	}
+	_, err = conn.Write(binary.BigEndian.AppendUint32(nil, MssimSessionEnd))
+	return err
+}
+
+// PowerOn powers on the simulator and enables its NV memory.
+func (p *MssimPlatform) PowerOn() error {
+	return p.Signal(MssimSignalPowerOn, MssimSignalNvOn)
+}
+
+// PowerCycle powers off the simulator, then powers it on and enables its NV memory.
+func (p *MssimPlatform) PowerCycle() error {
+	return p.Signal(MssimSignalPowerOff, MssimSignalPowerOn, MssimSignalNvOn)
+}
+
+// MssimForwarder is a Forwarder that wraps raw TPM commands in the mssim
+// protocol and unwraps the responses.
+type MssimForwarder struct {
+	conn     net.Conn
+	locality uint8
+
+	// request holds the bytes of an incomplete command.
+	request []byte
+	// response holds the bytes of the response not yet read.
+	response []byte
+}
+
+// NewMssimForwarder creates a new MssimForwarder on the TPM port connection.
+func NewMssimForwarder(conn net.Conn, locality uint8) *MssimForwarder {
+	return &MssimForwarder{
+		conn:     conn,
+		locality: locality,
+	}
+}
+
+// Write sends each complete TPM command in p with MssimSendCommand.
+func (f *MssimForwarder) Write(p []byte) (int, error) {
+	f.request = append(f.request, p...)
+	for len(f.request) >= TpmHeaderSize {
+		size := int(binary.BigEndian.Uint32(f.request[2:6]))
+		if size < TpmHeaderSize {
+			f.request = nil
+			return 0, fmt.Errorf("invalid TPM command size %d", size)
+		}
+		if len(f.request) < size {
+			break
+		}
+		frame := binary.BigEndian.AppendUint32(nil, MssimSendCommand)
+		frame = append(frame, f.locality)
+		frame = binary.BigEndian.AppendUint32(frame, uint32(size))
+		frame = append(frame, f.request[:size]...)
+		if _, err := f.conn.Write(frame); err != nil {
+			return 0, err
+		}
+		f.request = f.request[size:]
+	}
+	return len(p), nil
+}
+
+// Read reads the unwrapped TPM response.
+func (f *MssimForwarder) Read(p []byte) (int, error) {
+	if len(f.response) == 0 {
+		length, err := readUint32(f.conn)
+		if err != nil {
+			return 0, err
+		}
+		if length > DefaultMaxMessageSize {
+			return 0, fmt.Errorf("invalid mssim response length %d", length)
+		}
+		response := make([]byte, length)
+		if _, err := io.ReadFull(f.conn, response); err != nil {
+			return 0, err
+		}
+		if _, err := readUint32(f.conn); err != nil {
+			return 0, fmt.Errorf("reading mssim acknowledgement: %w", err)
+		}
+		f.response = response
+	}
+	n := copy(p, f.response)
+	f.response = f.response[n:]
+	return n, nil
+}
+
+// Close ends the mssim session and closes the connection.
+func (f *MssimForwarder) Close() error {
+	f.conn.Write(binary.BigEndian.AppendUint32(nil, MssimSessionEnd))
+	return f.conn.Close()
+}
+
+// MssimForwarderFactory is a ForwarderFactory that creates MssimForwarders.
+type MssimForwarderFactory struct {
+	// Addr is the address of the TPM port.
+	Addr string
+	// PlatformAddr is the address of the platform port.
+	// If empty, the port following the TPM port is used.
+	PlatformAddr string
+	// Locality is the locality the commands are sent with.
+	Locality uint8
+	// PowerOn powers on the simulator before the first forwarder is created.
+	PowerOn bool
+	// PowerCycle power cycles the simulator before every forwarder is
+	// created, as a reboot of the TPM's host would.
+	PowerCycle bool
+
+	powerMu sync.Mutex
+	// powered is set once PowerOn has succeeded.
+	powered bool
+}
+
+// NewMssimForwarderFactory creates a new MssimForwarderFactory that powers on
+// the simulator on first use.
+func NewMssimForwarderFactory(addr string) *MssimForwarderFactory {
+	return &MssimForwarderFactory{
+		Addr:    addr,
+		PowerOn: true,
+	}
+}
+
+// Platform returns the client of the simulator's platform port.
+func (f *MssimForwarderFactory) Platform() (*MssimPlatform, error) {
+	if f.PlatformAddr != "" {
+		return NewMssimPlatform(f.PlatformAddr), nil
+	}
+	addr, err := mssimPlatformAddr(f.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewMssimPlatform(addr), nil
+}
+
+// powerOn powers on the simulator unless it has been powered on by the
+// factory. A failed power on is retried by the next forwarder.
+func (f *MssimForwarderFactory) powerOn(platform *MssimPlatform) error {
+	f.powerMu.Lock()
+	defer f.powerMu.Unlock()
+	if f.powered {
+		return nil
+	}
+	if err := platform.PowerOn(); err != nil {
+		return err
+	}
+	f.powered = true
+	return nil
+}
+
+// NewForwarder creates a new mssim Forwarder.
+func (f *MssimForwarderFactory) NewForwarder() (Forwarder, error) {
+	if f.PowerCycle || f.PowerOn {
+		platform, err := f.Platform()
+		if err != nil {
+			return nil, err
+		}
+		if f.PowerCycle {
+			err = platform.PowerCycle()
+		} else {
+			err = f.powerOn(platform)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("mssim platform: %w", err)
+		}
+	}
+
+	conn, err := net.Dial("tcp", f.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewMssimForwarder(conn, f.Locality), nil
+}
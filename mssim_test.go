@@ -0,0 +1,289 @@
+package tpmproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// fakeMssim is a TPM simulator that echoes every command back as its response.
+type fakeMssim struct {
+	tpmLn      net.Listener
+	platformLn net.Listener
+
+	mu         sync.Mutex
+	signals    []uint32
+	localities []uint8
+}
+
+func newFakeMssim(t *testing.T) *fakeMssim {
+	t.Helper()
+	var s fakeMssim
+	// the platform port must follow the TPM port
+	for i := 0; i < 10; i++ {
+		tpmLn, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := tpmLn.Addr().(*net.TCPAddr).Port
+		platformLn, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port+1)))
+		if err != nil {
+			tpmLn.Close()
+			continue
+		}
+		s.tpmLn, s.platformLn = tpmLn, platformLn
+		break
+	}
+	if s.tpmLn == nil {
+		t.Skip("no consecutive ports available")
+	}
+	go s.serve(s.tpmLn, s.handleTpm)
+	go s.serve(s.platformLn, s.handlePlatform)
+	return &s
+}
+
+func (s *fakeMssim) serve(ln net.Listener, handle func(net.Conn) error) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			handle(conn)
+		}()
+	}
+}
+
+func (s *fakeMssim) handleTpm(conn net.Conn) error {
+	for {
+		cmd, err := readUint32(conn)
+		if err != nil || cmd == MssimSessionEnd {
+			return err
+		}
+		var locality [1]byte
+		if _, err := io.ReadFull(conn, locality[:]); err != nil {
+			return err
+		}
+		length, err := readUint32(conn)
+		if err != nil {
+			return err
+		}
+		command := make([]byte, length)
+		if _, err := io.ReadFull(conn, command); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.localities = append(s.localities, locality[0])
+		s.mu.Unlock()
+
+		frame := binary.BigEndian.AppendUint32(nil, length)
+		frame = append(frame, command...)
+		frame = binary.BigEndian.AppendUint32(frame, 0)
+		if _, err := conn.Write(frame); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *fakeMssim) handlePlatform(conn net.Conn) error {
+	for {
+		signal, err := readUint32(conn)
+		if err != nil || signal == MssimSessionEnd {
+			return err
+		}
+		s.mu.Lock()
+		s.signals = append(s.signals, signal)
+		s.mu.Unlock()
+		if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *fakeMssim) Close() {
+	s.tpmLn.Close()
+	s.platformLn.Close()
+}
+
+func TestMssimForwarder(t *testing.T) {
+	sim := newFakeMssim(t)
+	defer sim.Close()
+
+	f := NewMssimForwarderFactory(sim.tpmLn.Addr().String())
+	f.Locality = 3
+	for i := 0; i < 2; i++ {
+		fwd, err := f.NewForwarder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		command := []byte{0x80, 0x01, 0, 0, 0, 0x0c, 0, 0, 0x01, 0x44, 0, 0}
+		// commands written in pieces are sent as a whole
+		if _, err := fwd.Write(command[:5]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fwd.Write(command[5:]); err != nil {
+			t.Fatal(err)
+		}
+		response, err := NewTpmMessageReader(fwd, 0).ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(response, command) {
+			t.Errorf("got %x", response)
+		}
+		fwd.Close()
+	}
+
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	// powered on only once
+	if len(sim.signals) != 2 || sim.signals[0] != MssimSignalPowerOn || sim.signals[1] != MssimSignalNvOn {
+		t.Errorf("unexpected platform signals %v", sim.signals)
+	}
+	if len(sim.localities) != 2 || sim.localities[0] != 3 {
+		t.Errorf("unexpected localities %v", sim.localities)
+	}
+}
+
+func TestMssimForwarderPowerOnRetry(t *testing.T) {
+	sim := newFakeMssim(t)
+	defer sim.Close()
+
+	// a platform port refusing connections
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+
+	f := NewMssimForwarderFactory(sim.tpmLn.Addr().String())
+	f.PlatformAddr = ln.Addr().String()
+	if _, err := f.NewForwarder(); err == nil {
+		t.Fatal("power on did not fail")
+	}
+	f.PlatformAddr = sim.platformLn.Addr().String()
+	fwd, err := f.NewForwarder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fwd.Close()
+
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	if len(sim.signals) != 2 || sim.signals[0] != MssimSignalPowerOn {
+		t.Errorf("unexpected platform signals %v", sim.signals)
+	}
+}
+
+func TestMssimPlatformPowerCycle(t *testing.T) {
+	sim := newFakeMssim(t)
+	defer sim.Close()
+
+	platform := NewMssimPlatform(sim.platformLn.Addr().String())
+	if err := platform.PowerCycle(); err != nil {
+		t.Fatal(err)
+	}
+
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	want := []uint32{MssimSignalPowerOff, MssimSignalPowerOn, MssimSignalNvOn}
+	if len(sim.signals) != len(want) {
+		t.Fatalf("got %v, want %v", sim.signals, want)
+	}
+	for i := range want {
+		if sim.signals[i] != want[i] {
+			t.Errorf("got %v, want %v", sim.signals, want)
+		}
+	}
+}
+
+func TestMssimRelayer(t *testing.T) {
+	sim := newFakeMssim(t)
+	defer sim.Close()
+
+	backend := NewMssimForwarderFactory(sim.tpmLn.Addr().String())
+	backend.PowerOn = false
+	r := NewMssimRelayer("", "", backend, nil)
+	r.Platform = NewMssimPlatform(sim.platformLn.Addr().String())
+
+	// platform signals are passed to the simulator
+	platformClient, platformServer := net.Pipe()
+	go r.HandlePlatformConn(platformServer)
+	for _, signal := range []uint32{MssimSignalPowerOn, MssimSignalNvOn} {
+		platformClient.Write(binary.BigEndian.AppendUint32(nil, signal))
+		if ack, err := readUint32(platformClient); err != nil || ack != 0 {
+			t.Fatalf("signal %d: ack %d, %v", signal, ack, err)
+		}
+	}
+	platformClient.Write(binary.BigEndian.AppendUint32(nil, MssimSessionEnd))
+	platformClient.Close()
+
+	client, server := net.Pipe()
+	if err := r.HandleConnLoop(server); err != nil {
+		t.Fatal(err)
+	}
+	fwd := NewMssimForwarder(client, 2)
+	defer fwd.Close()
+
+	command := []byte{0x80, 0x01, 0, 0, 0, 0x0c, 0, 0, 0x01, 0x44, 0, 0}
+	if _, err := fwd.Write(command); err != nil {
+		t.Fatal(err)
+	}
+	response, err := NewTpmMessageReader(fwd, 0).ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response, command) {
+		t.Errorf("got %x", response)
+	}
+
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	if len(sim.signals) != 2 || sim.signals[0] != MssimSignalPowerOn {
+		t.Errorf("unexpected platform signals %v", sim.signals)
+	}
+}
+
+func TestMssimServerConnShortCommand(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := NewMssimServerConn(server)
+
+	command := []byte{0x80, 0x01, 0, 0, 0, 0x0c, 0, 0, 0x01, 0x44, 0, 0}
+	errc := make(chan error, 1)
+	go func() {
+		// a command shorter than a TPM header is answered with an error
+		frame := binary.BigEndian.AppendUint32(nil, MssimSendCommand)
+		frame = append(frame, 0)
+		frame = binary.BigEndian.AppendUint32(frame, 0)
+		client.Write(frame)
+		reply := make([]byte, 4+TpmHeaderSize+4)
+		if _, err := io.ReadFull(client, reply); err != nil {
+			errc <- err
+			return
+		}
+		if rc := binary.BigEndian.Uint32(reply[10:14]); rc != 0x142 {
+			t.Errorf("reply %x", reply)
+		}
+		frame = binary.BigEndian.AppendUint32(nil, MssimSendCommand)
+		frame = append(frame, 0)
+		frame = binary.BigEndian.AppendUint32(frame, uint32(len(command)))
+		client.Write(append(frame, command...))
+		errc <- nil
+	}()
+	got := make([]byte, len(command))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, command) {
+		t.Errorf("got %x", got)
+	}
+}
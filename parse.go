@@ -5,67 +5,61 @@ import (
 	"encoding/binary"
 	"fmt"
 	"reflect"
-	_ "unsafe"
 
 	"github.com/google/go-tpm/tpm2"
 )
 
-//go:linkname rspHeader github.com/google/go-tpm/tpm2.rspHeader
-func rspHeader(rsp *bytes.Buffer) error
+// RspHeader unmarshals the response header and returns its response code as
+// a tpm2.TPMRC if it is not TPM_RC_SUCCESS.
 func RspHeader(rsp *bytes.Buffer) error {
 	return rspHeader(rsp)
 }
 
-//go:linkname rspHandles github.com/google/go-tpm/tpm2.rspHandles
-func rspHandles(rsp *bytes.Buffer, rspStruct any) error
+// RspHandles unmarshals the handles of the response structure.
 func RspHandles(rsp *bytes.Buffer, rspStruct any) error {
 	return rspHandles(rsp, rspStruct)
 }
 
-//go:linkname rspParametersArea github.com/google/go-tpm/tpm2.rspParametersArea
-func rspParametersArea(hasSessions bool, rsp *bytes.Buffer) ([]byte, error)
+// RspParametersArea returns the response parameter area.
 func RspParametersArea(hasSessions bool, rsp *bytes.Buffer) ([]byte, error) {
 	return rspParametersArea(hasSessions, rsp)
 }
 
-//go:linkname rspSessions github.com/google/go-tpm/tpm2.rspSessions
-func rspSessions(rsp *bytes.Buffer, rc tpm2.TPMRC, cc tpm2.TPMCC, names []tpm2.TPM2BName, parms []byte, sess []tpm2.Session) error
+// RspSessions unmarshals the response authorization area and validates it
+// with the sessions.
 func RspSessions(rsp *bytes.Buffer, rc tpm2.TPMRC, cc tpm2.TPMCC, names []tpm2.TPM2BName, parms []byte, sess []tpm2.Session) error {
 	return rspSessions(rsp, rc, cc, names, parms, sess)
 }
 
-//go:linkname rspParameters github.com/google/go-tpm/tpm2.rspParameters
-func rspParameters(parms []byte, sess []tpm2.Session, rspStruct any) error
+// RspParameters decrypts the response parameters with the sessions and
+// unmarshals them into the response structure.
 func RspParameters(parms []byte, sess []tpm2.Session, rspStruct any) error {
 	return rspParameters(parms, sess, rspStruct)
 }
 
-//go:linkname taggedMembers github.com/google/go-tpm/tpm2.taggedMembers
-func taggedMembers(v reflect.Value, tag string, invert bool) []reflect.Value
+// TaggedMembers returns the fields of the struct v with the gotpm tag, or
+// without it if invert is true.
 func TaggedMembers(v reflect.Value, tag string, invert bool) []reflect.Value {
 	return taggedMembers(v, tag, invert)
 }
 
-//go:linkname unmarshal github.com/google/go-tpm/tpm2.unmarshal
-func unmarshal(buf *bytes.Buffer, v reflect.Value) error
+// Unmarshal unmarshals v from buf following the gotpm struct tags.
 func Unmarshal(buf *bytes.Buffer, v reflect.Value) error {
 	return unmarshal(buf, v)
 }
 
-//go:linkname hasTag github.com/google/go-tpm/tpm2.hasTag
-func hasTag(t reflect.StructField, query string) bool
+// HasTag reports whether the field has the gotpm tag.
 func HasTag(t reflect.StructField, query string) bool {
 	return hasTag(t, query)
 }
 
-//go:linkname isMarshalledByReflection github.com/google/go-tpm/tpm2.isMarshalledByReflection
-func isMarshalledByReflection(v reflect.Value) bool
+// IsMarshalledByReflection reports whether v is marshalled field by field
+// rather than as a sized buffer or a union.
 func IsMarshalledByReflection(v reflect.Value) bool {
 	return isMarshalledByReflection(v)
 }
 
-//go:linkname marshal github.com/google/go-tpm/tpm2.marshal
-func marshal(buf *bytes.Buffer, v reflect.Value) error
+// Marshal marshals v into buf following the gotpm struct tags.
 func Marshal(buf *bytes.Buffer, v reflect.Value) error {
 	return marshal(buf, v)
 }
@@ -90,37 +84,94 @@ func ReqHandles(req *bytes.Buffer, cmd any) error {
 			if err := binary.Read(req, binary.BigEndian, &h); err != nil {
 				return fmt.Errorf("unmarshalling handle %v: %w", i, err)
 			}
-			v.Field(i).Set(reflect.ValueOf(h))
+			if err := setHandle(v.Field(i), h); err != nil {
+				return fmt.Errorf("unmarshalling handle %v: %w", i, err)
+			}
 		}
 	}
 
 	return nil
 }
 
+// setHandle sets the handle field v to h according to its type: the handle
+// interface, a structure with a Handle field such as tpm2.AuthHandle, or a
+// handle type such as tpm2.TPMIDHObject.
+func setHandle(v reflect.Value, h tpm2.TPMHandle) error {
+	hv := reflect.ValueOf(h)
+	switch {
+	case hv.Type().AssignableTo(v.Type()):
+		v.Set(hv)
+	case v.Kind() == reflect.Struct && v.FieldByName("Handle").IsValid():
+		return setHandle(v.FieldByName("Handle"), h)
+	case v.Kind() == reflect.Uint32:
+		v.Set(hv.Convert(v.Type()))
+	default:
+		return fmt.Errorf("unsupported handle type %v", v.Type())
+	}
+	return nil
+}
+
+// ParameterError is the error unmarshalling a parameter of a command or
+// response structure.
+type ParameterError struct {
+	// Field is the name of the structure field of the parameter.
+	Field string
+	// Offset is the offset of the parameter in the parameter area.
+	Offset int
+	// Err is the error unmarshalling the parameter.
+	Err error
+}
+
+func (e *ParameterError) Error() string {
+	return fmt.Sprintf("unmarshalling %s at parameter offset %d: %v", e.Field, e.Offset, e.Err)
+}
+
+func (e *ParameterError) Unwrap() error {
+	return e.Err
+}
+
+// ReqParameters unmarshals the command parameters in req into cmd.
+// The parameters must fill req. The error of a parameter is a
+// *ParameterError. The first parameter is encrypted if a session in sess
+// is a decryption session.
 func ReqParameters(req *bytes.Buffer, sess []tpm2.Session, cmd any, rh *tpm2.TPMCmdHeader) error {
-	if req.Len() == 0 {
-		return nil
+	encrypted := false
+	for _, s := range sess {
+		encrypted = encrypted || s.IsDecryption()
 	}
+	return unmarshalParameters(req, cmd, encrypted)
+}
 
-	switch rh.CommandCode {
-	default:
-		numHandles := len(taggedMembers(reflect.ValueOf(cmd).Elem(), "handle", false))
-		for i := numHandles; i < reflect.TypeOf(cmd).Elem().NumField(); i++ {
-			parmsField := reflect.ValueOf(cmd).Elem().Field(i)
-			if parmsField.Kind() == reflect.Ptr && hasTag(reflect.TypeOf(cmd).Elem().Field(i), "optional") {
-				if binary.BigEndian.Uint16(req.Bytes()) == 0 {
-					req.Next(2)
-					continue
-				}
-			}
-			if isMarshalledByReflection(parmsField) {
-				if err := unmarshal(req, parmsField); err != nil {
-					return err
-				}
-			}
+// unmarshalParameters unmarshals the fields of the structure pointed to by v
+// that are not handles from buf, which they must fill.
+// If the first parameter is encrypted by a session, only the buffer of the
+// TPM2B is encrypted: the buffer is kept as it is, and a
+// TPM2BSensitiveCreate, whose contents cannot be unmarshalled, is left zero.
+func unmarshalParameters(buf *bytes.Buffer, v any, encrypted bool) error {
+	size := buf.Len()
+	s := reflect.ValueOf(v).Elem()
+	first := true
+	for i := 0; i < s.NumField(); i++ {
+		field := s.Type().Field(i)
+		if hasTag(field, "handle") {
+			continue
 		}
+		offset := size - buf.Len()
+		var err error
+		if first && encrypted && field.Type == sensitiveCreateType {
+			_, err = readSized(buf, 2)
+			s.Field(i).Set(reflect.Zero(field.Type))
+		} else {
+			err = unmarshalField(buf, s, i)
+		}
+		if err != nil {
+			return &ParameterError{Field: field.Name, Offset: offset, Err: err}
+		}
+		first = false
+	}
+	if buf.Len() > 0 {
+		return fmt.Errorf("%d bytes left after the parameters", buf.Len())
 	}
-
 	return nil
 }
 
@@ -147,51 +198,109 @@ type RoughParser struct {
 	CmdParameterOffset int
 	// RspParameterOffset is the offset of the response parameters
 	RspParameterOffset int
+
+	// CmdAuths are the sessions of the command authorization area, or nil
+	// if the command has no sessions.
+	CmdAuths []tpm2.TPMSAuthCommand
+	// CmdAuthOffsets are the offsets of CmdAuths in RawRequest.
+	CmdAuthOffsets []int
+	// RspAuths are the sessions of the response authorization area, or nil
+	// if the response has no sessions.
+	RspAuths []tpm2.TPMSAuthResponse
+	// RspAuthOffsets are the offsets of RspAuths in RawResponse.
+	RspAuthOffsets []int
+	// CmdParameterEncrypted reports whether the first command parameter is
+	// encrypted by a session with the decrypt attribute. The buffer of the
+	// parameter is the ciphertext, and a TPM2BSensitiveCreate is left zero.
+	CmdParameterEncrypted bool
+	// RspParameterEncrypted reports whether the first response parameter is
+	// encrypted by a session with the encrypt attribute. The buffer of the
+	// parameter is the ciphertext.
+	RspParameterEncrypted bool
+	// RspCode is the response code of RawResponse, or nil if the response
+	// has not been parsed.
+	RspCode *ResponseCode
 }
 
+// Parse parses RawRequest into Cmd and RawResponse into Rsp.
+// If the response is an error, Cmd is still parsed and the *ResponseCode is
+// returned.
 func (p *RoughParser) Parse() error {
+	if err := p.ParseCommand(); err != nil {
+		return err
+	}
+	return p.ParseResponse()
+}
+
+// ParseCommand parses RawRequest into Cmd. RawResponse and Rsp are not used,
+// so that a command can be parsed before it is forwarded.
+func (p *RoughParser) ParseCommand() error {
 	reqBuf := bytes.NewBuffer(p.RawRequest)
 	rh, err := ReqHeader(reqBuf)
 	if err != nil {
 		return err
 	}
 	p.CmdHdr = rh
-
-	hasSessions := false
-	sess := []tpm2.Session{}
-
-	switch rh.Tag {
-	case tpm2.TPMSTSessions:
-		hasSessions = true
-	case tpm2.TPMSTNoSessions:
-	}
+	p.CmdAuths, p.CmdAuthOffsets = nil, nil
 
 	if err := ReqHandles(reqBuf, p.Cmd); err != nil {
 		return err
 	}
 
-	if hasSessions {
+	if rh.Tag == tpm2.TPMSTSessions {
 		var authAreaSize uint32
 		if err := binary.Read(reqBuf, binary.BigEndian, &authAreaSize); err != nil {
 			return fmt.Errorf("unmarshalling auth area size: %w", err)
 		}
-		auth := make([]byte, authAreaSize)
-		if err := binary.Read(reqBuf, binary.BigEndian, auth); err != nil {
-			return fmt.Errorf("unmarshalling auth area: %w", err)
+		if int64(authAreaSize) > int64(reqBuf.Len()) {
+			return fmt.Errorf("unmarshalling auth area: invalid size %d", authAreaSize)
 		}
+		offset := len(p.RawRequest) - reqBuf.Len()
+		authBuf := bytes.NewBuffer(reqBuf.Next(int(authAreaSize)))
+		for i := 0; authBuf.Len() > 0; i++ {
+			p.CmdAuthOffsets = append(p.CmdAuthOffsets, offset+int(authAreaSize)-authBuf.Len())
+			var auth tpm2.TPMSAuthCommand
+			if err := unmarshal(authBuf, reflect.ValueOf(&auth).Elem()); err != nil {
+				return fmt.Errorf("unmarshalling auth %d: %w", i, err)
+			}
+			p.CmdAuths = append(p.CmdAuths, auth)
+		}
+	}
+
+	p.CmdParameterEncrypted = false
+	for _, auth := range p.CmdAuths {
+		p.CmdParameterEncrypted = p.CmdParameterEncrypted || auth.Attributes.Decrypt
 	}
 
 	p.CmdParameterOffset = len(p.RawRequest) - reqBuf.Len()
-	if err := ReqParameters(reqBuf, sess, p.Cmd, rh); err != nil {
-		// ignore the error for now
-		// return err
+	return unmarshalParameters(reqBuf, p.Cmd, p.CmdParameterEncrypted)
+}
+
+// ParseResponse parses RawResponse into Rsp. It parses the command first
+// unless ParseCommand has been called.
+// If the response is an error, which has only the header, RspCode is set and
+// returned as the error.
+func (p *RoughParser) ParseResponse() error {
+	if p.CmdHdr == nil {
+		if err := p.ParseCommand(); err != nil {
+			return err
+		}
 	}
+	hasSessions := p.CmdHdr.Tag == tpm2.TPMSTSessions
+	p.RspAuths, p.RspAuthOffsets = nil, nil
+	p.RspParameterEncrypted = false
 
 	rspBuf := bytes.NewBuffer(p.RawResponse)
+	p.RspCode = nil
 	if err := rspHeader(rspBuf); err != nil {
+		if rc, ok := err.(tpm2.TPMRC); ok {
+			p.RspCode = DecodeResponseCode(rc)
+			return p.RspCode
+		}
 		return err
 	}
-	if err = rspHandles(rspBuf, p.Rsp); err != nil {
+	p.RspCode = DecodeResponseCode(tpm2.TPMRCSuccess)
+	if err := rspHandles(rspBuf, p.Rsp); err != nil {
 		return err
 	}
 
@@ -200,6 +309,17 @@ func (p *RoughParser) Parse() error {
 	if err != nil {
 		return err
 	}
+	if hasSessions {
+		for i := 0; rspBuf.Len() > 0; i++ {
+			p.RspAuthOffsets = append(p.RspAuthOffsets, len(p.RawResponse)-rspBuf.Len())
+			var auth tpm2.TPMSAuthResponse
+			if err := unmarshal(rspBuf, reflect.ValueOf(&auth).Elem()); err != nil {
+				return fmt.Errorf("unmarshalling response auth %d: %w", i, err)
+			}
+			p.RspAuths = append(p.RspAuths, auth)
+			p.RspParameterEncrypted = p.RspParameterEncrypted || auth.Attributes.Encrypt
+		}
+	}
 	// if hasSessions {
 	// 	// We don't need the TPM RC here because we would have errored
 	// 	// out from rspHeader
@@ -209,9 +329,102 @@ func (p *RoughParser) Parse() error {
 	// 		return err
 	// 	}
 	// }
-	if err := rspParameters(rspParms, sess, p.Rsp); err != nil {
-		return err
+	// the parameters encrypted by sessions are left as they are
+	return unmarshalParameters(bytes.NewBuffer(rspParms), p.Rsp, p.RspParameterEncrypted)
+}
+
+// RebuildCommand marshals Cmd into a command with the header of RawRequest
+// and CmdAuths. The command size is that of the rebuilt command.
+// A modified command protected by an HMAC session fails its authorization
+// unless the HMAC in CmdAuths is recomputed.
+// An encrypted TPM2BSensitiveCreate left zero is rebuilt from RawRequest.
+func (p *RoughParser) RebuildCommand() ([]byte, error) {
+	if len(p.RawRequest) < TpmHeaderSize {
+		return nil, fmt.Errorf("invalid TPM command size %d", len(p.RawRequest))
+	}
+	var handles, parms bytes.Buffer
+	v := reflect.ValueOf(p.Cmd).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field, parm := v.Type().Field(i), v.Field(i)
+		if hasTag(field, "handle") {
+			h, ok := parm.Interface().(interface{ HandleValue() uint32 })
+			if !ok {
+				return nil, fmt.Errorf("handle %s is not set", field.Name)
+			}
+			binary.Write(&handles, binary.BigEndian, h.HandleValue())
+			continue
+		}
+		if p.CmdParameterEncrypted && field.Type == sensitiveCreateType && parm.IsZero() {
+			b, err := readSized(bytes.NewBuffer(p.RawRequest[min(p.CmdParameterOffset, len(p.RawRequest)):]), 2)
+			if err != nil {
+				return nil, fmt.Errorf("reading encrypted %s: %w", field.Name, err)
+			}
+			writeSized(&parms, 2, b)
+			continue
+		}
+		if err := marshalField(&parms, v, i); err != nil {
+			return nil, fmt.Errorf("marshalling %s: %w", field.Name, err)
+		}
 	}
 
-	return nil
+	var b bytes.Buffer
+	b.Write(p.RawRequest[:TpmHeaderSize])
+	b.Write(handles.Bytes())
+	if tpm2.TPMST(binary.BigEndian.Uint16(p.RawRequest)) == tpm2.TPMSTSessions {
+		var auths bytes.Buffer
+		for i := range p.CmdAuths {
+			if err := marshal(&auths, reflect.ValueOf(&p.CmdAuths[i]).Elem()); err != nil {
+				return nil, fmt.Errorf("marshalling auth %d: %w", i, err)
+			}
+		}
+		binary.Write(&b, binary.BigEndian, uint32(auths.Len()))
+		b.Write(auths.Bytes())
+	}
+	b.Write(parms.Bytes())
+	return setMessageSize(b.Bytes()), nil
+}
+
+// RebuildResponse marshals Rsp into a response with the header of
+// RawResponse and RspAuths. The response size and the parameter size are
+// those of the rebuilt response.
+// A modified response protected by an HMAC session fails its verification
+// unless the HMAC in RspAuths is recomputed.
+func (p *RoughParser) RebuildResponse() ([]byte, error) {
+	if len(p.RawResponse) < TpmHeaderSize {
+		return nil, fmt.Errorf("invalid TPM response size %d", len(p.RawResponse))
+	}
+	var handles, parms bytes.Buffer
+	v := reflect.ValueOf(p.Rsp).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		buf := &parms
+		if hasTag(field, "handle") {
+			buf = &handles
+		}
+		if err := marshalField(buf, v, i); err != nil {
+			return nil, fmt.Errorf("marshalling %s: %w", field.Name, err)
+		}
+	}
+
+	var b bytes.Buffer
+	b.Write(p.RawResponse[:TpmHeaderSize])
+	b.Write(handles.Bytes())
+	if tpm2.TPMST(binary.BigEndian.Uint16(p.RawResponse)) == tpm2.TPMSTSessions {
+		binary.Write(&b, binary.BigEndian, uint32(parms.Len()))
+		b.Write(parms.Bytes())
+		for i := range p.RspAuths {
+			if err := marshal(&b, reflect.ValueOf(&p.RspAuths[i]).Elem()); err != nil {
+				return nil, fmt.Errorf("marshalling response auth %d: %w", i, err)
+			}
+		}
+	} else {
+		b.Write(parms.Bytes())
+	}
+	return setMessageSize(b.Bytes()), nil
+}
+
+// setMessageSize sets the size in the header of the TPM message.
+func setMessageSize(b []byte) []byte {
+	binary.BigEndian.PutUint32(b[2:6], uint32(len(b)))
+	return b
 }
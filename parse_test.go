@@ -3,6 +3,7 @@ package tpmproxy
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"reflect"
 	"testing"
@@ -72,3 +73,223 @@ func TestGetCapability(t *testing.T) {
 		t.Logf("%x", buf2.Bytes())
 	}
 }
+
+func TestRoughParserRebuild(t *testing.T) {
+	// Unseal with a password session
+	rawReq, _ := hex.DecodeString("80020000001b0000015e8000000100000009400000090000010000")
+	rawResp, _ := hex.DecodeString("80020000001700000000000000040002aabb0000010000")
+	cmd := tpm2.Unseal{}
+	resp := tpm2.UnsealResponse{}
+	p := RoughParser{
+		RawRequest:  rawReq,
+		RawResponse: rawResp,
+		Cmd:         &cmd,
+		Rsp:         &resp,
+	}
+	if err := p.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := p.RebuildCommand(); err != nil || !bytes.Equal(b, rawReq) {
+		t.Errorf("unmodified command: %x, %v", b, err)
+	}
+	if b, err := p.RebuildResponse(); err != nil || !bytes.Equal(b, rawResp) {
+		t.Errorf("unmodified response: %x, %v", b, err)
+	}
+
+	if len(p.CmdAuths) != 1 || p.CmdAuths[0].Handle != tpm2.TPMRSPW || p.CmdAuthOffsets[0] != 18 ||
+		len(p.RspAuths) != 1 || !p.RspAuths[0].Attributes.ContinueSession || p.RspAuthOffsets[0] != 18 {
+		t.Errorf("unexpected auths %+v at %d, %+v at %d", p.CmdAuths, p.CmdAuthOffsets, p.RspAuths, p.RspAuthOffsets)
+	}
+
+	// a longer password and output
+	p.CmdAuths[0].Authorization.Buffer = []byte("pw")
+	resp.OutData.Buffer = []byte("hello")
+	want, _ := hex.DecodeString("80020000001d0000015e800000010000000b4000000900000100027077")
+	if b, err := p.RebuildCommand(); err != nil || !bytes.Equal(b, want) {
+		t.Errorf("modified command: %x, %v", b, err)
+	}
+	want, _ = hex.DecodeString("80020000001a00000000000000070005" + hex.EncodeToString([]byte("hello")) + "0000010000")
+	if b, err := p.RebuildResponse(); err != nil || !bytes.Equal(b, want) {
+		t.Errorf("modified response: %x, %v", b, err)
+	}
+}
+
+func TestRoughParserParseCommand(t *testing.T) {
+	rawReq, _ := hex.DecodeString("8001000000160000014e400000018100000100040000")
+	cmd := tpm2.NVRead{}
+	resp := tpm2.NVReadResponse{}
+	p := RoughParser{
+		RawRequest: rawReq,
+		Cmd:        &cmd,
+		Rsp:        &resp,
+	}
+	// before the response
+	if err := p.ParseCommand(); err != nil {
+		t.Fatal(err)
+	}
+	if cmd.NVIndex.HandleValue() != 0x81000001 || cmd.Size != 4 || cmd.Offset != 0 {
+		t.Errorf("unexpected command %+v", cmd)
+	}
+
+	p.RawResponse, _ = hex.DecodeString("80010000001000000000000401020304")
+	if err := p.ParseResponse(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp.Data.Buffer, []byte{1, 2, 3, 4}) {
+		t.Errorf("unexpected response %+v", resp)
+	}
+}
+
+func TestReqParametersSizedStructures(t *testing.T) {
+	sensitive := tpm2.TPM2BSensitiveCreate{
+		Sensitive: &tpm2.TPMSSensitiveCreate{
+			UserAuth: tpm2.TPM2BAuth{Buffer: []byte("pw")},
+			Data:     tpm2.NewTPMUSensitiveCreate(&tpm2.TPM2BSensitiveData{Buffer: []byte("secret")}),
+		},
+	}
+	commands := []any{
+		&tpm2.Create{
+			ParentHandle: tpm2.TPMHandle(0x81000001),
+			InSensitive:  sensitive,
+			InPublic:     tpm2.New2B(tpm2.RSASRKTemplate),
+			CreationPCR: tpm2.TPMLPCRSelection{PCRSelections: []tpm2.TPMSPCRSelection{
+				{Hash: tpm2.TPMAlgSHA256, PCRSelect: []byte{1, 0, 0}},
+			}},
+		},
+		&tpm2.CreatePrimary{
+			PrimaryHandle: tpm2.TPMRHOwner,
+			InPublic:      tpm2.New2B(tpm2.ECCSRKTemplate),
+			OutsideInfo:   tpm2.TPM2BData{Buffer: []byte{1, 2}},
+		},
+		&tpm2.CreateLoaded{
+			ParentHandle: tpm2.TPMRHOwner,
+			InSensitive:  sensitive,
+			InPublic:     tpm2.New2BTemplate(&tpm2.RSASRKTemplate),
+		},
+		&tpm2.LoadExternal{
+			InPublic:  tpm2.New2B(tpm2.ECCSRKTemplate),
+			Hierarchy: tpm2.TPMRHOwner,
+		},
+		&tpm2.PolicySigned{
+			AuthObject:    tpm2.TPMHandle(0x80000001),
+			PolicySession: tpm2.TPMHandle(0x03000000),
+			NonceTPM:      tpm2.TPM2BNonce{Buffer: []byte{1, 2, 3, 4}},
+			Expiration:    -1,
+			Auth: tpm2.TPMTSignature{
+				SigAlg: tpm2.TPMAlgRSASSA,
+				Signature: tpm2.NewTPMUSignature(tpm2.TPMAlgRSASSA, &tpm2.TPMSSignatureRSA{
+					Hash: tpm2.TPMAlgSHA256,
+					Sig:  tpm2.TPM2BPublicKeyRSA{Buffer: bytes.Repeat([]byte{0xaa}, 256)},
+				}),
+			},
+		},
+	}
+	for _, c := range commands {
+		cc := c.(interface{ Command() tpm2.TPMCC }).Command()
+		header := []byte{0x80, 0x01, 0, 0, 0, 0, 0, 0, byte(cc >> 8), byte(cc)}
+		raw, err := (&RoughParser{RawRequest: header, Cmd: c}).RebuildCommand()
+		if err != nil {
+			t.Fatalf("%s: %v", CommandName(cc), err)
+		}
+
+		p := RoughParser{RawRequest: raw, Cmd: LookupCommand(cc).NewCommand()}
+		if err := p.ParseCommand(); err != nil {
+			t.Errorf("%s: %v", CommandName(cc), err)
+			continue
+		}
+		if b, err := p.RebuildCommand(); err != nil || !bytes.Equal(b, raw) {
+			t.Errorf("%s: %x, want %x", CommandName(cc), b, raw)
+		}
+		if create, ok := p.Cmd.(*tpm2.Create); ok {
+			public, err := create.InPublic.Contents()
+			if err != nil || public.Type != tpm2.TPMAlgRSA ||
+				!bytes.Equal(create.InSensitive.Sensitive.UserAuth.Buffer, []byte("pw")) {
+				t.Errorf("Create: %+v", create)
+			}
+		}
+
+		// truncated in the last parameter
+		p = RoughParser{RawRequest: raw[:len(raw)-1], Cmd: LookupCommand(cc).NewCommand()}
+		var perr *ParameterError
+		if err := p.ParseCommand(); !errors.As(err, &perr) {
+			t.Errorf("%s truncated: %v", CommandName(cc), err)
+		}
+	}
+
+	// the failing field and its offset
+	raw, _ := hex.DecodeString("80010000001a0000015381000001000400000000" + "0010ffff")
+	p := RoughParser{RawRequest: raw, Cmd: &tpm2.Create{}}
+	var perr *ParameterError
+	if err := p.ParseCommand(); !errors.As(err, &perr) || perr.Field != "InPublic" || perr.Offset != 6 {
+		t.Errorf("invalid Create: %v", err)
+	}
+}
+
+func TestRoughParserEncryptedParameters(t *testing.T) {
+	// CreatePrimary with a decrypt session
+	p := RoughParser{
+		RawRequest: []byte{0x80, 0x02, 0, 0, 0, 0, 0, 0, 0x01, 0x31},
+		Cmd: &tpm2.CreatePrimary{
+			PrimaryHandle: tpm2.TPMRHOwner,
+			InPublic:      tpm2.New2B(tpm2.ECCSRKTemplate),
+		},
+		CmdAuths: []tpm2.TPMSAuthCommand{{
+			Handle:     0x02000000,
+			Attributes: tpm2.TPMASession{ContinueSession: true, Decrypt: true},
+		}},
+	}
+	raw, err := p.RebuildCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the encrypted TPMS_SENSITIVE_CREATE
+	copy(raw[29:33], []byte{0xff, 0xff, 0xff, 0xff})
+
+	cmd := tpm2.CreatePrimary{}
+	p = RoughParser{RawRequest: raw, Cmd: &cmd}
+	if err := p.ParseCommand(); err != nil {
+		t.Fatal(err)
+	}
+	if !p.CmdParameterEncrypted || cmd.InSensitive.Sensitive != nil {
+		t.Errorf("unexpected sensitive %+v", cmd.InSensitive)
+	}
+	if public, err := cmd.InPublic.Contents(); err != nil || public.Type != tpm2.TPMAlgECC {
+		t.Errorf("unexpected public %+v, %v", public, err)
+	}
+	if b, err := p.RebuildCommand(); err != nil || !bytes.Equal(b, raw) {
+		t.Errorf("rebuilt %x, %v, want %x", b, err, raw)
+	}
+
+	// without the decrypt attribute
+	raw[24] &^= 0x20
+	var perr *ParameterError
+	if err := (&RoughParser{RawRequest: raw, Cmd: &tpm2.CreatePrimary{}}).ParseCommand(); !errors.As(err, &perr) || perr.Field != "InSensitive" {
+		t.Errorf("decrypt not set: %v", err)
+	}
+
+	// GetRandom with an encrypt session
+	rawReq, _ := hex.DecodeString("800200000019" + "0000017b" + "00000009020000000000410000" + "0004")
+	rsp := tpm2.GetRandomResponse{}
+	p = RoughParser{RawRequest: rawReq, Cmd: &tpm2.GetRandom{}, Rsp: &rsp}
+	p.RawResponse, _ = hex.DecodeString("800200000019" + "00000000" + "000000060004aabbccdd" + "0000410000")
+	if err := p.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if p.CmdParameterEncrypted || !p.RspParameterEncrypted || !bytes.Equal(rsp.RandomBytes.Buffer, []byte{0xaa, 0xbb, 0xcc, 0xdd}) {
+		t.Errorf("unexpected response %+v", rsp)
+	}
+	if b, err := p.RebuildResponse(); err != nil || !bytes.Equal(b, p.RawResponse) {
+		t.Errorf("rebuilt %x, %v", b, err)
+	}
+
+	// the parser reused for a command without sessions
+	p.RawRequest, _ = hex.DecodeString("80010000000c0000017b0004")
+	p.RawResponse, _ = hex.DecodeString("80010000001000000000" + "0004aabbccdd")
+	if err := p.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if p.CmdAuths != nil || p.CmdAuthOffsets != nil || p.RspAuths != nil || p.RspAuthOffsets != nil ||
+		p.CmdParameterEncrypted || p.RspParameterEncrypted {
+		t.Errorf("sessions left %+v, %+v", p.CmdAuths, p.RspAuths)
+	}
+}
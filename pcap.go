@@ -0,0 +1,302 @@
+package tpmproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// pcapng block types and options.
+const (
+	pcapngSectionHeaderBlock        = 0x0a0d0d0a
+	pcapngInterfaceDescriptionBlock = 1
+	pcapngEnhancedPacketBlock       = 6
+	pcapngByteOrderMagic            = 0x1a2b3c4d
+	pcapngOptEndOfOpt               = 0
+	pcapngOptComment                = 1
+	// linkTypeRaw is LINKTYPE_RAW, packets beginning with the IP header.
+	linkTypeRaw = 101
+)
+
+const (
+	// PcapServerPort is the default TCP port of the TPM side of the recorded
+	// connections. It is swtpm's port, which Wireshark dissects as TPM 2.0.
+	PcapServerPort = 2321
+	// pcapClientPortBase is the client port of connection zero.
+	pcapClientPortBase = 49152
+
+	tcpFlagSyn = 0x02
+	tcpFlagPsh = 0x08
+	tcpFlagAck = 0x10
+
+	ipv4HeaderSize = 20
+	tcpHeaderSize  = 20
+	// maxTcpPayloadSize keeps the synthesized packets within the IPv4 size limit.
+	maxTcpPayloadSize = 0xffff - ipv4HeaderSize - tcpHeaderSize
+)
+
+// PcapRecorder is an Interceptor that records the TPM commands and responses
+// in pcapng format. Attach it to a relayer as its Interceptor.
+// Each ConnID is recorded as a TCP connection between 127.0.0.1 ports, with
+// the TPM on ServerPort. The recorded commands are those sent to the TPM and
+// the recorded responses those returned to the client, that is, after
+// Interceptor. The packets tampered or blocked by Interceptor are annotated
+// with packet comments holding the original bytes, and the error responses
+// with the decoded response code.
+type PcapRecorder struct {
+	// Interceptor is the wrapped Interceptor. It may be nil.
+	Interceptor Interceptor
+	// ServerPort is the TCP port of the TPM side.
+	ServerPort uint16
+
+	mu      sync.Mutex
+	w       io.Writer
+	streams map[uint64]*pcapStream
+	err     error
+}
+
+// pcapStream is the state of the synthesized TCP connection of a ConnID.
+type pcapStream struct {
+	clientPort uint16
+	clientSeq  uint32
+	serverSeq  uint32
+}
+
+// NewPcapRecorder creates a new PcapRecorder writing to w and writes the
+// pcapng headers.
+func NewPcapRecorder(w io.Writer, interceptor Interceptor) (*PcapRecorder, error) {
+	r := &PcapRecorder{
+		Interceptor: interceptor,
+		ServerPort:  PcapServerPort,
+		w:           w,
+		streams:     make(map[uint64]*pcapStream),
+	}
+
+	shb := binary.LittleEndian.AppendUint32(nil, pcapngByteOrderMagic)
+	shb = binary.LittleEndian.AppendUint16(shb, 1) // major version
+	shb = binary.LittleEndian.AppendUint16(shb, 0) // minor version
+	shb = binary.LittleEndian.AppendUint64(shb, 0xffffffffffffffff)
+	if err := r.writeBlock(pcapngSectionHeaderBlock, shb); err != nil {
+		return nil, err
+	}
+	idb := binary.LittleEndian.AppendUint16(nil, linkTypeRaw)
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, 0) // no snapshot length limit
+	if err := r.writeBlock(pcapngInterfaceDescriptionBlock, idb); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Err returns the first error writing the capture.
+// Once writing fails, nothing is recorded anymore.
+func (r *PcapRecorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *PcapRecorder) HandleRequest(request *Request) []byte {
+	original := bytes.Clone(request.Raw)
+	modified := request.Raw
+	if r.Interceptor != nil {
+		modified = r.Interceptor.HandleRequest(request)
+	}
+	switch {
+	case modified == nil:
+		r.record(request.ConnID, true, original, "blocked by interceptor")
+	case !bytes.Equal(modified, original):
+		r.record(request.ConnID, true, modified, "tampered by interceptor, original: "+hex.EncodeToString(original))
+	default:
+		r.record(request.ConnID, true, modified, "")
+	}
+	return modified
+}
+
+func (r *PcapRecorder) HandleResponse(request *Request, response []byte) []byte {
+	original := bytes.Clone(response)
+	modified := response
+	if r.Interceptor != nil {
+		modified = r.Interceptor.HandleResponse(request, response)
+	}
+	sent := modified
+	if modified == nil && response == nil {
+		// the TpmRequestResponseHandler answers the blocked command
+		sent = NewTpmErrorResponse(tpm2.TPMSTNoSessions, tpm2.TPMRCFailure)
+	}
+	var rc string
+	if len(sent) >= TpmHeaderSize {
+		if code := tpm2.TPMRC(binary.BigEndian.Uint32(sent[6:10])); code != tpm2.TPMRCSuccess {
+			rc = DecodeResponseCode(code).String()
+		}
+	}
+	switch {
+	case modified == nil && response == nil:
+		r.record(request.ConnID, false, sent, joinComments("blocked by interceptor", rc))
+	case modified == nil:
+	case response == nil:
+		r.record(request.ConnID, false, modified, joinComments("generated by interceptor", rc))
+	case !bytes.Equal(modified, original):
+		r.record(request.ConnID, false, modified, joinComments("tampered by interceptor, original: "+hex.EncodeToString(original), rc))
+	default:
+		r.record(request.ConnID, false, modified, rc)
+	}
+	return modified
+}
+
+// joinComments joins the non-empty comments of a packet.
+func joinComments(comments ...string) string {
+	var nonEmpty []string
+	for _, c := range comments {
+		if c != "" {
+			nonEmpty = append(nonEmpty, c)
+		}
+	}
+	return strings.Join(nonEmpty, "; ")
+}
+
+// record writes the message as TCP segments of the connection of connID.
+// The first segment carries the comment, if any.
+func (r *PcapRecorder) record(connID uint64, fromClient bool, msg []byte, comment string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+
+	s, ok := r.streams[connID]
+	if !ok {
+		s = &pcapStream{clientPort: uint16(pcapClientPortBase + connID%(0x10000-pcapClientPortBase))}
+		r.streams[connID] = s
+		// the three-way handshake, so that the connection looks complete
+		for _, p := range []struct {
+			fromClient bool
+			flags      uint8
+		}{{true, tcpFlagSyn}, {false, tcpFlagSyn | tcpFlagAck}, {true, tcpFlagAck}} {
+			if r.err = r.writePacket(s.packet(r.ServerPort, p.fromClient, p.flags, nil), ""); r.err != nil {
+				return
+			}
+			if p.flags&tcpFlagSyn != 0 {
+				s.advance(p.fromClient, 1)
+			}
+		}
+	}
+
+	for len(msg) > 0 || comment != "" {
+		segment := msg[:min(len(msg), maxTcpPayloadSize)]
+		msg = msg[len(segment):]
+		if r.err = r.writePacket(s.packet(r.ServerPort, fromClient, tcpFlagPsh|tcpFlagAck, segment), comment); r.err != nil {
+			return
+		}
+		s.advance(fromClient, uint32(len(segment)))
+		comment = ""
+	}
+}
+
+func (s *pcapStream) advance(fromClient bool, n uint32) {
+	if fromClient {
+		s.clientSeq += n
+	} else {
+		s.serverSeq += n
+	}
+}
+
+// packet builds an IPv4 packet of a TCP segment of the connection.
+func (s *pcapStream) packet(serverPort uint16, fromClient bool, flags uint8, payload []byte) []byte {
+	srcPort, dstPort := s.clientPort, serverPort
+	seq, ack := s.clientSeq, s.serverSeq
+	if !fromClient {
+		srcPort, dstPort = dstPort, srcPort
+		seq, ack = ack, seq
+	}
+	if flags == tcpFlagSyn {
+		ack = 0
+	}
+
+	pkt := make([]byte, ipv4HeaderSize+tcpHeaderSize+len(payload))
+	ip := pkt[:ipv4HeaderSize]
+	ip[0] = 0x45 // version 4, 5 words header
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(pkt)))
+	ip[6] = 0x40 // don't fragment
+	ip[8] = 64   // TTL
+	ip[9] = 6    // TCP
+	copy(ip[12:], []byte{127, 0, 0, 1})
+	copy(ip[16:], []byte{127, 0, 0, 1})
+	binary.BigEndian.PutUint16(ip[10:], internetChecksum(0, ip))
+
+	tcp := pkt[ipv4HeaderSize:]
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = tcpHeaderSize / 4 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 0xffff) // window
+	copy(tcp[tcpHeaderSize:], payload)
+	// the pseudo header holds the addresses, the protocol and the TCP length
+	pseudo := internetChecksumSum(0, ip[12:20]) + 6 + uint32(len(tcp))
+	binary.BigEndian.PutUint16(tcp[16:], internetChecksum(pseudo, tcp))
+	return pkt
+}
+
+// internetChecksumSum adds the 16-bit words of b to sum.
+func internetChecksumSum(sum uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+// internetChecksum returns the checksum of RFC 1071 of b with the initial sum.
+func internetChecksum(sum uint32, b []byte) uint16 {
+	sum = internetChecksumSum(sum, b)
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// writePacket writes an enhanced packet block of the packet timestamped now.
+func (r *PcapRecorder) writePacket(pkt []byte, comment string) error {
+	ts := uint64(time.Now().UnixMicro())
+	body := binary.LittleEndian.AppendUint32(nil, 0) // interface
+	body = binary.LittleEndian.AppendUint32(body, uint32(ts>>32))
+	body = binary.LittleEndian.AppendUint32(body, uint32(ts))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(pkt)))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(pkt)))
+	body = appendPadded(body, pkt)
+	if comment != "" {
+		body = binary.LittleEndian.AppendUint16(body, pcapngOptComment)
+		body = binary.LittleEndian.AppendUint16(body, uint16(min(len(comment), 0xffff)))
+		body = appendPadded(body, []byte(comment[:min(len(comment), 0xffff)]))
+		body = binary.LittleEndian.AppendUint32(body, pcapngOptEndOfOpt)
+	}
+	return r.writeBlock(pcapngEnhancedPacketBlock, body)
+}
+
+// writeBlock writes a pcapng block with the body padded to 32 bits.
+func (r *PcapRecorder) writeBlock(blockType uint32, body []byte) error {
+	total := uint32(12 + len(body))
+	block := binary.LittleEndian.AppendUint32(nil, blockType)
+	block = binary.LittleEndian.AppendUint32(block, total)
+	block = append(block, body...)
+	block = binary.LittleEndian.AppendUint32(block, total)
+	_, err := r.w.Write(block)
+	return err
+}
+
+// appendPadded appends b to buf padded to 32 bits.
+func appendPadded(buf []byte, b []byte) []byte {
+	buf = append(buf, b...)
+	return append(buf, make([]byte, -len(b)&3)...)
+}
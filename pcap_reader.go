@@ -0,0 +1,559 @@
+package tpmproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// Magic numbers of the classic pcap format.
+const (
+	pcapMagicMicroseconds = 0xa1b2c3d4
+	pcapMagicNanoseconds  = 0xa1b23c4d
+
+	pcapngSimplePacketBlock = 3
+	pcapngOptIfTsresol      = 9
+	// pcapngMaxBlockSize bounds the blocks read from a capture.
+	pcapngMaxBlockSize = 64 << 20
+)
+
+// Link types of the captures that can be read.
+const (
+	linkTypeNull      = 0
+	linkTypeEthernet  = 1
+	linkTypeLinuxSll  = 113
+	linkTypeIpv4      = 228
+	linkTypeIpv6      = 229
+	linkTypeLinuxSll2 = 276
+)
+
+// PcapExchange is a TPM command and its response read from a capture.
+type PcapExchange struct {
+	// ConnID numbers the TCP connections in order of appearance, from one.
+	ConnID uint64
+	// Time is when the response was captured, or the command if there is
+	// no response.
+	Time time.Time
+	// Request is the raw command.
+	Request []byte
+	// Response is the raw response, or nil if the capture ends before it.
+	Response []byte
+}
+
+// PcapReader reads the TPM command/response pairs of TCP connections from a
+// pcap or pcapng capture, such as one taken by Wireshark or PcapRecorder.
+// The TCP streams are reassembled and split into TPM messages by the size
+// in their headers, so only raw TPM framing such as swtpm's server port is
+// supported.
+type PcapReader struct {
+	// Ports are the TCP ports of the TPM side of the connections.
+	Ports []uint16
+	// MaxMessageSize is the maximum TPM message size.
+	// If it is not positive, DefaultMaxMessageSize is used.
+	// A stream whose message header is invalid is resynchronized at the
+	// next segment.
+	MaxMessageSize int
+
+	r io.Reader
+}
+
+// NewPcapReader creates a new PcapReader reading the capture from r with
+// PcapServerPort as the TPM port.
+func NewPcapReader(r io.Reader) *PcapReader {
+	return &PcapReader{
+		Ports: []uint16{PcapServerPort},
+		r:     r,
+	}
+}
+
+// ReadExchanges reads the whole capture and returns the exchanges in the
+// order their responses were captured, followed by the unanswered commands.
+func (r *PcapReader) ReadExchanges() ([]*PcapExchange, error) {
+	src, err := newPcapSource(r.r)
+	if err != nil {
+		return nil, err
+	}
+	maxSize := r.MaxMessageSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+
+	var exchanges []*PcapExchange
+	flows := make(map[pcapFlowKey]*pcapFlow)
+	var order []*pcapFlow
+	for {
+		pkt, err := src.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return exchanges, err
+		}
+		seg := parseTcpSegment(pkt.linkType, pkt.data)
+		if seg == nil {
+			continue
+		}
+		var key pcapFlowKey
+		var fromClient bool
+		switch {
+		case slices.Contains(r.Ports, seg.dst.Port()):
+			key, fromClient = pcapFlowKey{client: seg.src, server: seg.dst}, true
+		case slices.Contains(r.Ports, seg.src.Port()):
+			key, fromClient = pcapFlowKey{client: seg.dst, server: seg.src}, false
+		default:
+			continue
+		}
+
+		flow, ok := flows[key]
+		// a new connection on the same ports gets a new ConnID
+		if !ok || (seg.syn && !seg.ack && fromClient && flow.dirs[0].started) {
+			flow = &pcapFlow{connID: uint64(len(order) + 1)}
+			flows[key] = flow
+			order = append(order, flow)
+		}
+
+		if fromClient {
+			for _, msg := range flow.dirs[0].add(seg, maxSize) {
+				flow.pending = append(flow.pending, &PcapExchange{
+					ConnID:  flow.connID,
+					Time:    pkt.time,
+					Request: msg,
+				})
+			}
+		} else {
+			for _, msg := range flow.dirs[1].add(seg, maxSize) {
+				// a response without a captured command cannot be paired
+				if len(flow.pending) == 0 {
+					continue
+				}
+				e := flow.pending[0]
+				flow.pending = flow.pending[1:]
+				e.Time, e.Response = pkt.time, msg
+				exchanges = append(exchanges, e)
+			}
+		}
+	}
+	for _, flow := range order {
+		exchanges = append(exchanges, flow.pending...)
+	}
+	return exchanges, nil
+}
+
+// Replay reads the whole capture and passes the exchanges to interceptor as
+// a relayer would. The modified messages are discarded. The commands without
+// a captured response, such as the last one of a truncated capture, are
+// skipped.
+func (r *PcapReader) Replay(interceptor Interceptor) error {
+	exchanges, err := r.ReadExchanges()
+	for _, e := range exchanges {
+		if e.Response == nil {
+			continue
+		}
+		handlerFactory := &TpmRequestResponseHandlerFactory{
+			Interceptor: interceptor,
+			ConnID:      e.ConnID,
+		}
+		h := handlerFactory.NewRequestResponseHandler()
+		h.HandleRequest(e.Request)
+		h.HandleResponse(e.Response)
+	}
+	return err
+}
+
+// pcapFlowKey identifies a TCP connection by its endpoints.
+type pcapFlowKey struct {
+	client netip.AddrPort
+	server netip.AddrPort
+}
+
+// pcapFlow is the state of a TCP connection being reassembled.
+type pcapFlow struct {
+	connID uint64
+	// dirs are the client to server and server to client directions.
+	dirs [2]pcapFlowDir
+	// pending are the commands waiting for their responses.
+	pending []*PcapExchange
+}
+
+// pcapFlowDir reassembles one direction of a TCP connection.
+type pcapFlowDir struct {
+	started bool
+	next    uint32
+	// segments are the segments received ahead of next.
+	segments map[uint32][]byte
+	// buf holds the bytes of an incomplete message.
+	buf []byte
+}
+
+// add adds the segment and returns the TPM messages it completes.
+func (d *pcapFlowDir) add(seg *tcpSegment, maxSize int) [][]byte {
+	seq, payload := seg.seq, seg.payload
+	if seg.syn {
+		d.started, d.next, d.buf = true, seq+1, nil
+		seq++
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+	if !d.started {
+		d.started, d.next = true, seq
+	}
+
+	// drop what was already received
+	if diff := int32(d.next - seq); diff > 0 {
+		if int(diff) >= len(payload) {
+			return nil
+		}
+		payload, seq = payload[diff:], d.next
+	}
+	if seq != d.next {
+		if d.segments == nil {
+			d.segments = make(map[uint32][]byte)
+		}
+		if len(payload) > len(d.segments[seq]) {
+			d.segments[seq] = bytes.Clone(payload)
+		}
+		return nil
+	}
+	d.buf = append(d.buf, payload...)
+	d.next += uint32(len(payload))
+
+	// append the segments received ahead that are now in order
+	for found := true; found; {
+		found = false
+		for s, p := range d.segments {
+			diff := int32(d.next - s)
+			if diff < 0 {
+				continue
+			}
+			delete(d.segments, s)
+			if int(diff) < len(p) {
+				d.buf = append(d.buf, p[diff:]...)
+				d.next += uint32(len(p) - int(diff))
+			}
+			found = true
+		}
+	}
+
+	var msgs [][]byte
+	for len(d.buf) >= TpmHeaderSize {
+		size := binary.BigEndian.Uint32(d.buf[2:6])
+		if size < TpmHeaderSize || size > uint32(maxSize) {
+			d.buf = nil
+			break
+		}
+		if len(d.buf) < int(size) {
+			break
+		}
+		msgs = append(msgs, bytes.Clone(d.buf[:size]))
+		d.buf = d.buf[size:]
+	}
+	return msgs
+}
+
+// tcpSegment is a TCP segment of a captured packet.
+type tcpSegment struct {
+	src     netip.AddrPort
+	dst     netip.AddrPort
+	seq     uint32
+	syn     bool
+	ack     bool
+	payload []byte
+}
+
+// parseTcpSegment returns the TCP segment of the frame of the link type, or
+// nil if the frame is not an unfragmented TCP packet.
+func parseTcpSegment(linkType uint32, frame []byte) *tcpSegment {
+	var ip []byte
+	switch linkType {
+	case linkTypeNull:
+		if len(frame) >= 4 {
+			ip = frame[4:]
+		}
+	case linkTypeEthernet:
+		if len(frame) < 14 {
+			return nil
+		}
+		etherType, rest := binary.BigEndian.Uint16(frame[12:]), frame[14:]
+		for (etherType == 0x8100 || etherType == 0x88a8) && len(rest) >= 4 {
+			etherType, rest = binary.BigEndian.Uint16(rest[2:]), rest[4:]
+		}
+		if etherType == 0x0800 || etherType == 0x86dd {
+			ip = rest
+		}
+	case linkTypeLinuxSll:
+		if len(frame) >= 16 {
+			ip = frame[16:]
+		}
+	case linkTypeLinuxSll2:
+		if len(frame) >= 20 {
+			ip = frame[20:]
+		}
+	case linkTypeRaw, linkTypeIpv4, linkTypeIpv6:
+		ip = frame
+	}
+	if len(ip) == 0 {
+		return nil
+	}
+
+	var src, dst netip.Addr
+	var tcp []byte
+	switch ip[0] >> 4 {
+	case 4:
+		headerSize := int(ip[0]&0x0f) * 4
+		if len(ip) < ipv4HeaderSize || headerSize < ipv4HeaderSize || len(ip) < headerSize || ip[9] != 6 {
+			return nil
+		}
+		// fragments are not reassembled
+		if binary.BigEndian.Uint16(ip[6:])&0x3fff != 0 {
+			return nil
+		}
+		if total := int(binary.BigEndian.Uint16(ip[2:])); total >= headerSize && total < len(ip) {
+			ip = ip[:total]
+		}
+		src = netip.AddrFrom4([4]byte(ip[12:16]))
+		dst = netip.AddrFrom4([4]byte(ip[16:20]))
+		tcp = ip[headerSize:]
+	case 6:
+		// extension headers are not followed
+		if len(ip) < 40 || ip[6] != 6 {
+			return nil
+		}
+		if payloadLength := int(binary.BigEndian.Uint16(ip[4:])); 40+payloadLength < len(ip) {
+			ip = ip[:40+payloadLength]
+		}
+		src = netip.AddrFrom16([16]byte(ip[8:24]))
+		dst = netip.AddrFrom16([16]byte(ip[24:40]))
+		tcp = ip[40:]
+	default:
+		return nil
+	}
+
+	if len(tcp) < tcpHeaderSize {
+		return nil
+	}
+	headerSize := int(tcp[12]>>4) * 4
+	if headerSize < tcpHeaderSize || len(tcp) < headerSize {
+		return nil
+	}
+	return &tcpSegment{
+		src:     netip.AddrPortFrom(src, binary.BigEndian.Uint16(tcp[0:])),
+		dst:     netip.AddrPortFrom(dst, binary.BigEndian.Uint16(tcp[2:])),
+		seq:     binary.BigEndian.Uint32(tcp[4:]),
+		syn:     tcp[13]&tcpFlagSyn != 0,
+		ack:     tcp[13]&tcpFlagAck != 0,
+		payload: tcp[headerSize:],
+	}
+}
+
+// pcapPacket is a captured packet.
+type pcapPacket struct {
+	linkType uint32
+	time     time.Time
+	data     []byte
+}
+
+// pcapInterface is an interface of a pcapng section.
+type pcapInterface struct {
+	linkType uint32
+	// unitsPerSecond is the timestamp resolution.
+	unitsPerSecond uint64
+}
+
+// pcapSource reads the packets of a pcap or pcapng capture.
+type pcapSource struct {
+	r     *bufio.Reader
+	ng    bool
+	order binary.ByteOrder
+	// interfaces are the pcapng interfaces of the current section, or the
+	// single interface of a pcap capture.
+	interfaces []pcapInterface
+}
+
+func newPcapSource(r io.Reader) (*pcapSource, error) {
+	s := &pcapSource{r: bufio.NewReader(r)}
+	magic, err := s.r.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("reading capture magic: %w", err)
+	}
+	if binary.LittleEndian.Uint32(magic) == pcapngSectionHeaderBlock {
+		s.ng = true
+		return s, nil
+	}
+
+	var hdr [24]byte
+	if _, err := io.ReadFull(s.r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("reading pcap header: %w", err)
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		var unitsPerSecond uint64
+		switch order.Uint32(hdr[:]) {
+		case pcapMagicMicroseconds:
+			unitsPerSecond = 1e6
+		case pcapMagicNanoseconds:
+			unitsPerSecond = 1e9
+		default:
+			continue
+		}
+		s.order = order
+		s.interfaces = []pcapInterface{{
+			// the upper bits hold the FCS length
+			linkType:       order.Uint32(hdr[20:]) & 0x03ffffff,
+			unitsPerSecond: unitsPerSecond,
+		}}
+		return s, nil
+	}
+	return nil, fmt.Errorf("unknown capture magic %x", magic)
+}
+
+// next returns the next packet, or io.EOF at the end of the capture.
+func (s *pcapSource) next() (*pcapPacket, error) {
+	if !s.ng {
+		var hdr [16]byte
+		if _, err := io.ReadFull(s.r, hdr[:]); err != nil {
+			return nil, err
+		}
+		length := s.order.Uint32(hdr[8:])
+		if length > pcapngMaxBlockSize {
+			return nil, fmt.Errorf("invalid pcap record length %d", length)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(s.r, data); err != nil {
+			return nil, noEOF(err)
+		}
+		iface := s.interfaces[0]
+		return &pcapPacket{
+			linkType: iface.linkType,
+			time:     pcapTime(uint64(s.order.Uint32(hdr[0:]))*iface.unitsPerSecond+uint64(s.order.Uint32(hdr[4:])), iface.unitsPerSecond),
+			data:     data,
+		}, nil
+	}
+
+	for {
+		blockType, body, err := s.nextBlock()
+		if err != nil {
+			return nil, err
+		}
+		switch blockType {
+		case pcapngInterfaceDescriptionBlock:
+			if len(body) < 8 {
+				return nil, errors.New("pcapng interface description block too short")
+			}
+			iface := pcapInterface{linkType: uint32(s.order.Uint16(body)), unitsPerSecond: 1e6}
+			if resol := pcapngOption(s.order, body[8:], pcapngOptIfTsresol); len(resol) > 0 {
+				// a power of two if the most significant bit is set, otherwise of ten
+				if resol[0]&0x80 != 0 {
+					iface.unitsPerSecond = 1 << min(resol[0]&0x7f, 63)
+				} else {
+					iface.unitsPerSecond = 1
+					for i := byte(0); i < min(resol[0], 19); i++ {
+						iface.unitsPerSecond *= 10
+					}
+				}
+			}
+			s.interfaces = append(s.interfaces, iface)
+		case pcapngEnhancedPacketBlock:
+			if len(body) < 20 {
+				return nil, errors.New("pcapng enhanced packet block too short")
+			}
+			id, length := s.order.Uint32(body), s.order.Uint32(body[12:])
+			if int(id) >= len(s.interfaces) || uint64(length) > uint64(len(body)-20) {
+				return nil, fmt.Errorf("invalid pcapng enhanced packet block: interface %d, length %d", id, length)
+			}
+			iface := s.interfaces[id]
+			ts := uint64(s.order.Uint32(body[4:]))<<32 | uint64(s.order.Uint32(body[8:]))
+			return &pcapPacket{
+				linkType: iface.linkType,
+				time:     pcapTime(ts, iface.unitsPerSecond),
+				data:     body[20 : 20+length],
+			}, nil
+		case pcapngSimplePacketBlock:
+			if len(s.interfaces) == 0 || len(body) < 4 {
+				return nil, errors.New("invalid pcapng simple packet block")
+			}
+			length := min(uint64(s.order.Uint32(body)), uint64(len(body)-4))
+			return &pcapPacket{
+				linkType: s.interfaces[0].linkType,
+				data:     body[4 : 4+length],
+			}, nil
+		}
+	}
+}
+
+// nextBlock reads the next pcapng block. A section header block sets the
+// byte order of the section and starts over its interfaces.
+func (s *pcapSource) nextBlock() (uint32, []byte, error) {
+	var hdr [12]byte
+	if _, err := io.ReadFull(s.r, hdr[:8]); err != nil {
+		return 0, nil, err
+	}
+	if binary.LittleEndian.Uint32(hdr[:]) == pcapngSectionHeaderBlock {
+		if _, err := io.ReadFull(s.r, hdr[8:]); err != nil {
+			return 0, nil, noEOF(err)
+		}
+		switch {
+		case binary.LittleEndian.Uint32(hdr[8:]) == pcapngByteOrderMagic:
+			s.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(hdr[8:]) == pcapngByteOrderMagic:
+			s.order = binary.BigEndian
+		default:
+			return 0, nil, fmt.Errorf("invalid pcapng byte order magic %x", hdr[8:])
+		}
+		s.interfaces = nil
+	} else if s.order == nil {
+		return 0, nil, errors.New("pcapng capture does not begin with a section header block")
+	}
+
+	blockType, total := s.order.Uint32(hdr[:]), s.order.Uint32(hdr[4:])
+	read := 8
+	if blockType == pcapngSectionHeaderBlock {
+		read = 12
+	}
+	if total%4 != 0 || total < uint32(read)+4 || total > pcapngMaxBlockSize {
+		return 0, nil, fmt.Errorf("invalid pcapng block length %d", total)
+	}
+	block := make([]byte, total)
+	copy(block, hdr[:read])
+	if _, err := io.ReadFull(s.r, block[read:]); err != nil {
+		return 0, nil, noEOF(err)
+	}
+	return blockType, block[8 : total-4], nil
+}
+
+// pcapngOption returns the value of the first option of the code in the
+// options of a block, or nil.
+func pcapngOption(order binary.ByteOrder, b []byte, code uint16) []byte {
+	for len(b) >= 4 {
+		c, length := order.Uint16(b), int(order.Uint16(b[2:]))
+		if c == pcapngOptEndOfOpt || 4+length > len(b) {
+			return nil
+		}
+		if c == code {
+			return b[4 : 4+length]
+		}
+		b = b[min(4+(length+3)&^3, len(b)):]
+	}
+	return nil
+}
+
+// pcapTime converts a timestamp in units of the resolution to time.
+func pcapTime(ts uint64, unitsPerSecond uint64) time.Time {
+	hi, lo := bits.Mul64(ts%unitsPerSecond, 1e9)
+	nsec, _ := bits.Div64(hi, lo, unitsPerSecond)
+	return time.Unix(int64(ts/unitsPerSecond), int64(nsec))
+}
+
+// noEOF turns io.EOF in the middle of a record into io.ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
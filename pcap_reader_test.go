@@ -0,0 +1,118 @@
+package tpmproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+type recordingInterceptor struct {
+	requests []*Request
+}
+
+func (it *recordingInterceptor) HandleRequest(request *Request) []byte {
+	r := *request
+	it.requests = append(it.requests, &r)
+	return request.Raw
+}
+
+func (it *recordingInterceptor) HandleResponse(request *Request, response []byte) []byte {
+	return response
+}
+
+func TestPcapReaderRecorded(t *testing.T) {
+	var buf bytes.Buffer
+	r, err := NewPcapRecorder(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a message larger than a segment
+	large := make([]byte, DefaultMaxMessageSize)
+	copy(large, []byte{0x80, 0x01, 0, 1, 0, 0, 0, 0, 0x01, 0x44})
+	commands := [][]byte{
+		{0x80, 0x01, 0, 0, 0, 0x0c, 0, 0, 0x01, 0x44, 0, 0},
+		large,
+		{0x80, 0x01, 0, 0, 0, 0x0c, 0, 0, 0x01, 0x44, 0, 1},
+	}
+	response := []byte{0x80, 0x01, 0, 0, 0, 0x0a, 0, 0, 0, 0}
+	for i, command := range commands {
+		h := (&TpmRequestResponseHandlerFactory{Interceptor: r, ConnID: uint64(10 + i%2)}).NewRequestResponseHandler()
+		h.HandleRequest(command)
+		h.HandleResponse(response)
+	}
+	// unanswered
+	h := (&TpmRequestResponseHandlerFactory{Interceptor: r, ConnID: 10}).NewRequestResponseHandler()
+	h.HandleRequest(commands[0])
+
+	exchanges, err := NewPcapReader(bytes.NewReader(buf.Bytes())).ReadExchanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exchanges) != 4 {
+		t.Fatalf("%d exchanges", len(exchanges))
+	}
+	for i, e := range exchanges[:3] {
+		if !bytes.Equal(e.Request, commands[i]) || !bytes.Equal(e.Response, response) {
+			t.Errorf("exchange %d: %x, %x", i, e.Request[:TpmHeaderSize], e.Response)
+		}
+		if e.ConnID != uint64(1+i%2) {
+			t.Errorf("exchange %d: connection %d", i, e.ConnID)
+		}
+	}
+	if e := exchanges[3]; e.Response != nil || e.ConnID != 1 {
+		t.Errorf("unanswered exchange: connection %d, response %x", e.ConnID, e.Response)
+	}
+
+	interceptor := &recordingInterceptor{}
+	if err := NewPcapReader(bytes.NewReader(buf.Bytes())).Replay(interceptor); err != nil {
+		t.Fatal(err)
+	}
+	// the unanswered command is not replayed
+	if len(interceptor.requests) != 3 || interceptor.requests[1].ConnID != 2 ||
+		interceptor.requests[1].Hdr.CommandCode != 0x144 {
+		t.Errorf("unexpected replayed requests")
+	}
+}
+
+func TestPcapReaderReassembly(t *testing.T) {
+	command := []byte{0x80, 0x01, 0, 0, 0, 0x0c, 0, 0, 0x01, 0x44, 0, 0}
+	response := []byte{0x80, 0x01, 0, 0, 0, 0x0a, 0, 0, 0, 0}
+
+	// a classic pcap of ethernet frames, big-endian
+	var buf bytes.Buffer
+	hdr := []uint32{pcapMagicMicroseconds, 2<<16 | 4, 0, 0, 0xffff, linkTypeEthernet}
+	binary.Write(&buf, binary.BigEndian, hdr)
+	s := &pcapStream{clientPort: 50000, clientSeq: 1000, serverSeq: 5000}
+	frame := func(fromClient bool, flags uint8, seq uint32, payload []byte) {
+		if fromClient {
+			s.clientSeq = seq
+		} else {
+			s.serverSeq = seq
+		}
+		pkt := s.packet(2322, fromClient, flags, payload)
+		eth := append(make([]byte, 12), 0x08, 0x00)
+		eth = append(eth, pkt...)
+		binary.Write(&buf, binary.BigEndian, []uint32{1, 0, uint32(len(eth)), uint32(len(eth))})
+		buf.Write(eth)
+	}
+	frame(true, tcpFlagSyn, 999, nil)
+	frame(false, tcpFlagSyn|tcpFlagAck, 4999, nil)
+	// out of order, then retransmitted with overlap
+	frame(true, tcpFlagPsh|tcpFlagAck, 1004, command[4:])
+	frame(true, tcpFlagPsh|tcpFlagAck, 1000, command[:6])
+	frame(true, tcpFlagPsh|tcpFlagAck, 1000, command[:6])
+	frame(false, tcpFlagPsh|tcpFlagAck, 5000, response)
+
+	pr := NewPcapReader(&buf)
+	pr.Ports = []uint16{2322}
+	exchanges, err := pr.ReadExchanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exchanges) != 1 || !bytes.Equal(exchanges[0].Request, command) || !bytes.Equal(exchanges[0].Response, response) {
+		t.Fatalf("unexpected exchanges %+v", exchanges)
+	}
+	if exchanges[0].Time.Unix() != 1 {
+		t.Errorf("time %v", exchanges[0].Time)
+	}
+}
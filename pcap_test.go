@@ -0,0 +1,137 @@
+package tpmproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+type tamperingInterceptor struct {
+}
+
+func (it *tamperingInterceptor) HandleRequest(request *Request) []byte {
+	return request.Raw
+}
+
+func (it *tamperingInterceptor) HandleResponse(request *Request, response []byte) []byte {
+	tampered := bytes.Clone(response)
+	tampered[len(tampered)-1] ^= 0xff
+	return tampered
+}
+
+type pcapngBlock struct {
+	blockType uint32
+	body      []byte
+}
+
+func splitPcapngBlocks(t *testing.T, b []byte) []pcapngBlock {
+	t.Helper()
+	var blocks []pcapngBlock
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("truncated block %x", b)
+		}
+		total := binary.LittleEndian.Uint32(b[4:])
+		if total%4 != 0 || int(total) > len(b) || binary.LittleEndian.Uint32(b[total-4:]) != total {
+			t.Fatalf("invalid block length %d", total)
+		}
+		blocks = append(blocks, pcapngBlock{binary.LittleEndian.Uint32(b), b[8 : total-4]})
+		b = b[total:]
+	}
+	return blocks
+}
+
+func TestPcapRecorder(t *testing.T) {
+	var buf bytes.Buffer
+	r, err := NewPcapRecorder(&buf, &tamperingInterceptor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	command := []byte{0x80, 0x01, 0, 0, 0, 0x0c, 0, 0, 0x01, 0x44, 0, 0}
+	response := []byte{0x80, 0x01, 0, 0, 0, 0x0a, 0, 0, 0, 0}
+	h := (&TpmRequestResponseHandlerFactory{Interceptor: r, ConnID: 1}).NewRequestResponseHandler()
+	h.HandleRequest(command)
+	h.HandleResponse(response)
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := splitPcapngBlocks(t, buf.Bytes())
+	if len(blocks) != 2+3+2 {
+		t.Fatalf("%d blocks", len(blocks))
+	}
+	if blocks[0].blockType != pcapngSectionHeaderBlock || blocks[1].blockType != pcapngInterfaceDescriptionBlock {
+		t.Fatalf("unexpected header blocks %x %x", blocks[0].blockType, blocks[1].blockType)
+	}
+
+	var payloads [][]byte
+	var comments []string
+	var lastSeq [2]uint32
+	for _, block := range blocks[2:] {
+		if block.blockType != pcapngEnhancedPacketBlock {
+			t.Fatalf("unexpected block %x", block.blockType)
+		}
+		length := binary.LittleEndian.Uint32(block.body[12:])
+		pkt := block.body[20 : 20+length]
+		if internetChecksum(0, pkt[:ipv4HeaderSize]) != 0 {
+			t.Errorf("invalid IP checksum %x", pkt)
+		}
+		tcp := pkt[ipv4HeaderSize:]
+		pseudo := internetChecksumSum(0, pkt[12:20]) + 6 + uint32(len(tcp))
+		if internetChecksum(pseudo, tcp) != 0 {
+			t.Errorf("invalid TCP checksum %x", pkt)
+		}
+		fromClient := binary.BigEndian.Uint16(tcp[2:]) == PcapServerPort
+		dir := 0
+		if !fromClient {
+			dir = 1
+		}
+		seq := binary.BigEndian.Uint32(tcp[4:])
+		if seq < lastSeq[dir] {
+			t.Errorf("sequence number went back: %d", seq)
+		}
+		lastSeq[dir] = seq
+
+		if payload := tcp[tcpHeaderSize:]; len(payload) > 0 {
+			payloads = append(payloads, payload)
+			options := block.body[20+(length+3)&^3:]
+			comment := ""
+			if len(options) >= 4 && binary.LittleEndian.Uint16(options) == pcapngOptComment {
+				comment = string(options[4 : 4+binary.LittleEndian.Uint16(options[2:])])
+			}
+			comments = append(comments, comment)
+		}
+	}
+
+	if len(payloads) != 2 || !bytes.Equal(payloads[0], command) || payloads[1][9] != 0xff {
+		t.Fatalf("unexpected payloads %x", payloads)
+	}
+	if comments[0] != "" || comments[1] != "tampered by interceptor, original: "+hex.EncodeToString(response)+"; "+DecodeResponseCode(0xff).String() {
+		t.Errorf("unexpected comments %q", comments)
+	}
+}
+
+func TestPcapRecorderBlocked(t *testing.T) {
+	var buf bytes.Buffer
+	r, err := NewPcapRecorder(&buf, &blockingInterceptor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	command := []byte{0x80, 0x01, 0, 0, 0, 0x0c, 0, 0, 0x01, 0x7b, 0, 4}
+	h := (&TpmRequestResponseHandlerFactory{Interceptor: r}).NewRequestResponseHandler()
+	h.HandleRequest(command)
+	sent := h.HandleResponse(nil)
+
+	// the reply to the blocked command is recorded
+	exchanges, err := NewPcapReader(bytes.NewReader(buf.Bytes())).ReadExchanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exchanges) != 1 || !bytes.Equal(exchanges[0].Request, command) || !bytes.Equal(exchanges[0].Response, sent) {
+		t.Errorf("unexpected exchanges %+v", exchanges)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("blocked by interceptor; TPM_RC_FAILURE")) {
+		t.Error("no comment on the reply")
+	}
+}
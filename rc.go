@@ -0,0 +1,281 @@
+package tpmproxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// ResponseCode is a response code (TPM_RC) decoded by its format in TPM 2.0
+// Part 2: Structures. As an error, it unwraps to its tpm2.TPMRC, so that
+// errors.Is(err, tpm2.TPMRCHandle) holds for any handle error.
+type ResponseCode struct {
+	// Code is the response code.
+	Code tpm2.TPMRC `json:"code"`
+	// Name is the name of the response code, such as "TPM_RC_HANDLE", or
+	// the number of the error in hex if it is unknown.
+	Name string `json:"name"`
+	// Message is the description of the response code.
+	Message string `json:"message"`
+	// Layer is the TSS layer of the response code in bits 23:16, or 0 if it
+	// comes from the TPM.
+	Layer uint8 `json:"layer,omitempty"`
+	// FormatOne reports whether the response code has format one, with the
+	// parameter, handle or session in error.
+	FormatOne bool `json:"format_one,omitempty"`
+	// Warning reports whether the response code is a warning, and the
+	// command may succeed if it is retried.
+	Warning bool `json:"warning,omitempty"`
+	// Vendor reports whether the response code is defined by the vendor.
+	Vendor bool `json:"vendor,omitempty"`
+	// TPM12 reports whether the response code is a TPM 1.2 response code.
+	TPM12 bool `json:"tpm12,omitempty"`
+	// Parameter is the number of the parameter in error, from 1.
+	Parameter int `json:"parameter,omitempty"`
+	// Handle is the number of the handle in error, from 1.
+	Handle int `json:"handle,omitempty"`
+	// Session is the number of the session in error, from 1.
+	Session int `json:"session,omitempty"`
+}
+
+const (
+	rcVer1   = 0x100
+	rcFmt1   = 0x080
+	rcVendor = 0x400
+	rcP      = 0x040
+	rcS      = 0x800
+	rcLayer  = 0xff0000
+)
+
+type rcDesc struct {
+	name, message string
+}
+
+// rcFmt0Descs are the format-zero errors by their numbers after RC_VER1.
+var rcFmt0Descs = map[uint32]rcDesc{
+	0x000: {"TPM_RC_INITIALIZE", "TPM not initialized by TPM2_Startup or already initialized"},
+	0x001: {"TPM_RC_FAILURE", "commands not being accepted because of a TPM failure"},
+	0x003: {"TPM_RC_SEQUENCE", "improper use of a sequence handle"},
+	0x00B: {"TPM_RC_PRIVATE", "not currently used"},
+	0x019: {"TPM_RC_HMAC", "not currently used"},
+	0x020: {"TPM_RC_DISABLED", "the command is disabled"},
+	0x021: {"TPM_RC_EXCLUSIVE", "command failed because audit sequence required exclusivity"},
+	0x024: {"TPM_RC_AUTH_TYPE", "authorization handle is not correct for command"},
+	0x025: {"TPM_RC_AUTH_MISSING", "command requires an authorization session for handle and it is not present"},
+	0x026: {"TPM_RC_POLICY", "policy failure in math operation or an invalid authPolicy value"},
+	0x027: {"TPM_RC_PCR", "PCR check fail"},
+	0x028: {"TPM_RC_PCR_CHANGED", "PCR have changed since checked"},
+	0x02D: {"TPM_RC_UPGRADE", "the TPM is in field upgrade mode, or not in it for TPM2_FieldUpgradeData"},
+	0x02E: {"TPM_RC_TOO_MANY_CONTEXTS", "context ID counter is at maximum"},
+	0x02F: {"TPM_RC_AUTH_UNAVAILABLE", "authValue or authPolicy is not available for selected entity"},
+	0x030: {"TPM_RC_REBOOT", "a _TPM_Init and Startup(CLEAR) is required before the TPM can resume operation"},
+	0x031: {"TPM_RC_UNBALANCED", "the protection algorithms (hash and symmetric) are not reasonably balanced"},
+	0x042: {"TPM_RC_COMMAND_SIZE", "command commandSize value is inconsistent with contents of the command buffer"},
+	0x043: {"TPM_RC_COMMAND_CODE", "command code not supported"},
+	0x044: {"TPM_RC_AUTHSIZE", "the value of authorizationSize is out of range or the number of octets in the Authorization Area is greater than required"},
+	0x045: {"TPM_RC_AUTH_CONTEXT", "use of an authorization session with a context command or another command that cannot have an authorization session"},
+	0x046: {"TPM_RC_NV_RANGE", "NV offset+size is out of range"},
+	0x047: {"TPM_RC_NV_SIZE", "Requested allocation size is larger than allowed"},
+	0x048: {"TPM_RC_NV_LOCKED", "NV access locked"},
+	0x049: {"TPM_RC_NV_AUTHORIZATION", "NV access authorization fails in command actions"},
+	0x04A: {"TPM_RC_NV_UNINITIALIZED", "an NV Index is used before being initialized or the state saved by TPM2_Shutdown(STATE) could not be restored"},
+	0x04B: {"TPM_RC_NV_SPACE", "insufficient space for NV allocation"},
+	0x04C: {"TPM_RC_NV_DEFINED", "NV Index or persistent object already defined"},
+	0x050: {"TPM_RC_BAD_CONTEXT", "context in TPM2_ContextLoad() is not valid"},
+	0x051: {"TPM_RC_CPHASH", "cpHash value already set or not correct for use"},
+	0x052: {"TPM_RC_PARENT", "handle for parent is not a valid parent"},
+	0x053: {"TPM_RC_NEEDS_TEST", "some function needs testing"},
+	0x054: {"TPM_RC_NO_RESULT", "returned when an internal function cannot process a request due to an unspecified problem"},
+	0x055: {"TPM_RC_SENSITIVE", "the sensitive area did not unmarshal correctly after decryption"},
+}
+
+// rcFmt1Descs are the format-one errors by their numbers.
+var rcFmt1Descs = map[uint32]rcDesc{
+	0x001: {"TPM_RC_ASYMMETRIC", "asymmetric algorithm not supported or not correct"},
+	0x002: {"TPM_RC_ATTRIBUTES", "inconsistent attributes"},
+	0x003: {"TPM_RC_HASH", "hash algorithm not supported or not appropriate"},
+	0x004: {"TPM_RC_VALUE", "value is out of range or is not correct for the context"},
+	0x005: {"TPM_RC_HIERARCHY", "hierarchy is not enabled or is not correct for the use"},
+	0x007: {"TPM_RC_KEY_SIZE", "key size is not supported"},
+	0x008: {"TPM_RC_MGF", "mask generation function not supported"},
+	0x009: {"TPM_RC_MODE", "mode of operation not supported"},
+	0x00A: {"TPM_RC_TYPE", "the type of the value is not appropriate for the use"},
+	0x00B: {"TPM_RC_HANDLE", "the handle is not correct for the use"},
+	0x00C: {"TPM_RC_KDF", "unsupported key derivation function or function not appropriate for use"},
+	0x00D: {"TPM_RC_RANGE", "value was out of allowed range"},
+	0x00E: {"TPM_RC_AUTH_FAIL", "the authorization HMAC check failed and DA counter incremented"},
+	0x00F: {"TPM_RC_NONCE", "invalid nonce size or nonce value mismatch"},
+	0x010: {"TPM_RC_PP", "authorization requires assertion of PP"},
+	0x012: {"TPM_RC_SCHEME", "unsupported or incompatible scheme"},
+	0x015: {"TPM_RC_SIZE", "structure is the wrong size"},
+	0x016: {"TPM_RC_SYMMETRIC", "unsupported symmetric algorithm or key size, or not appropriate for instance"},
+	0x017: {"TPM_RC_TAG", "incorrect structure tag"},
+	0x018: {"TPM_RC_SELECTOR", "union selector is incorrect"},
+	0x01A: {"TPM_RC_INSUFFICIENT", "the TPM was unable to unmarshal a value because there were not enough octets in the input buffer"},
+	0x01B: {"TPM_RC_SIGNATURE", "the signature is not valid"},
+	0x01C: {"TPM_RC_KEY", "key fields are not compatible with the selected use"},
+	0x01D: {"TPM_RC_POLICY_FAIL", "a policy check failed"},
+	0x01F: {"TPM_RC_INTEGRITY", "integrity check failed"},
+	0x020: {"TPM_RC_TICKET", "invalid ticket"},
+	0x021: {"TPM_RC_RESERVED_BITS", "reserved bits not set to zero as required"},
+	0x022: {"TPM_RC_BAD_AUTH", "authorization failure without DA implications"},
+	0x023: {"TPM_RC_EXPIRED", "the policy has expired"},
+	0x024: {"TPM_RC_POLICY_CC", "the commandCode in the policy is not the commandCode of the command or the command code in a policy command references a command that is not implemented"},
+	0x025: {"TPM_RC_BINDING", "public and sensitive portions of an object are not cryptographically bound"},
+	0x026: {"TPM_RC_CURVE", "curve not supported"},
+	0x027: {"TPM_RC_ECC_POINT", "point is not on the required curve"},
+	0x028: {"TPM_RC_FW_LIMITED", "the hierarchy is firmware-limited but the Firmware Secret is unavailable"},
+	0x029: {"TPM_RC_SVN_LIMITED", "the hierarchy is SVN-limited but the Firmware SVN Secret associated with the given SVN is unavailable"},
+}
+
+// rcWarnDescs are the warnings by their numbers after RC_WARN.
+var rcWarnDescs = map[uint32]rcDesc{
+	0x001: {"TPM_RC_CONTEXT_GAP", "gap for context ID is too large"},
+	0x002: {"TPM_RC_OBJECT_MEMORY", "out of memory for object contexts"},
+	0x003: {"TPM_RC_SESSION_MEMORY", "out of memory for session contexts"},
+	0x004: {"TPM_RC_MEMORY", "out of shared object/session memory or need space for internal operations"},
+	0x005: {"TPM_RC_SESSION_HANDLES", "out of session handles; a session must be flushed before a new session may be created"},
+	0x006: {"TPM_RC_OBJECT_HANDLES", "out of object handles; the handle space for objects is depleted and a reboot is required"},
+	0x007: {"TPM_RC_LOCALITY", "bad locality"},
+	0x008: {"TPM_RC_YIELDED", "the TPM has suspended operation on the command; forward progress was made and the command may be retried"},
+	0x009: {"TPM_RC_CANCELED", "the command was canceled"},
+	0x00A: {"TPM_RC_TESTING", "TPM is performing self-tests"},
+	0x010: {"TPM_RC_REFERENCE_H0", "the 1st handle in the handle area references a transient object or session that is not loaded"},
+	0x011: {"TPM_RC_REFERENCE_H1", "the 2nd handle in the handle area references a transient object or session that is not loaded"},
+	0x012: {"TPM_RC_REFERENCE_H2", "the 3rd handle in the handle area references a transient object or session that is not loaded"},
+	0x013: {"TPM_RC_REFERENCE_H3", "the 4th handle in the handle area references a transient object or session that is not loaded"},
+	0x014: {"TPM_RC_REFERENCE_H4", "the 5th handle in the handle area references a transient object or session that is not loaded"},
+	0x015: {"TPM_RC_REFERENCE_H5", "the 6th handle in the handle area references a transient object or session that is not loaded"},
+	0x016: {"TPM_RC_REFERENCE_H6", "the 7th handle in the handle area references a transient object or session that is not loaded"},
+	0x018: {"TPM_RC_REFERENCE_S0", "the 1st authorization session handle references a session that is not loaded"},
+	0x019: {"TPM_RC_REFERENCE_S1", "the 2nd authorization session handle references a session that is not loaded"},
+	0x01A: {"TPM_RC_REFERENCE_S2", "the 3rd authorization session handle references a session that is not loaded"},
+	0x01B: {"TPM_RC_REFERENCE_S3", "the 4th authorization session handle references a session that is not loaded"},
+	0x01C: {"TPM_RC_REFERENCE_S4", "the 5th authorization session handle references a session that is not loaded"},
+	0x01D: {"TPM_RC_REFERENCE_S5", "the 6th authorization session handle references a session that is not loaded"},
+	0x01E: {"TPM_RC_REFERENCE_S6", "the 7th authorization session handle references a session that is not loaded"},
+	0x020: {"TPM_RC_NV_RATE", "the TPM is rate-limiting accesses to prevent wearout of NV"},
+	0x021: {"TPM_RC_LOCKOUT", "authorizations for objects subject to DA protection are not allowed at this time because the TPM is in DA lockout mode"},
+	0x022: {"TPM_RC_RETRY", "the TPM was not able to start the command"},
+	0x023: {"TPM_RC_NV_UNAVAILABLE", "the command may require writing of NV and NV is not current accessible"},
+	0x07F: {"TPM_RC_NOT_USED", "this value is reserved and shall not be returned by the TPM"},
+}
+
+// rcTPM12Descs are the TPM 1.2 errors, which a TPM 2.0 may return for TPM 1.2
+// commands, by their numbers.
+var rcTPM12Descs = map[uint32]rcDesc{
+	0x001: {"TPM_AUTHFAIL", "authentication failed"},
+	0x002: {"TPM_BADINDEX", "the index to a PCR, DIR or other register is incorrect"},
+	0x003: {"TPM_BAD_PARAMETER", "one or more parameter is bad"},
+	0x004: {"TPM_AUDITFAILURE", "an operation completed successfully but the auditing of that operation failed"},
+	0x005: {"TPM_CLEAR_DISABLED", "the clear disable flag is set and all clear operations now require physical access"},
+	0x006: {"TPM_DEACTIVATED", "the TPM is deactivated"},
+	0x007: {"TPM_DISABLED", "the TPM is disabled"},
+	0x008: {"TPM_DISABLED_CMD", "the target command has been disabled"},
+	0x009: {"TPM_FAIL", "the operation failed"},
+	0x00A: {"TPM_BAD_ORDINAL", "the ordinal was unknown or inconsistent"},
+	0x01E: {"TPM_RC_BAD_TAG", "the tag of the command is not a TPM 2.0 tag, so the TPM 2.0 answers as a TPM 1.2"},
+}
+
+// DecodeResponseCode decodes the response code into its format and fields.
+func DecodeResponseCode(rc tpm2.TPMRC) *ResponseCode {
+	c := &ResponseCode{Code: rc}
+	code := uint32(rc)
+	if layer := code & rcLayer; layer != 0 {
+		c.Layer = uint8(layer >> 16)
+		code &^= rcLayer
+	}
+	var desc rcDesc
+	var number uint32
+	switch {
+	case code == 0:
+		desc = rcDesc{"TPM_RC_SUCCESS", "success"}
+	case code&rcFmt1 != 0:
+		c.FormatOne = true
+		number = code & 0x3f
+		desc = rcFmt1Descs[number]
+		n := int(code>>8) & 0xf
+		switch {
+		case code&rcP != 0:
+			c.Parameter = n
+		case n < 8:
+			c.Handle = n
+		default:
+			c.Session = n - 8
+		}
+	case code&rcVer1 == 0:
+		c.TPM12 = true
+		c.Vendor = code&rcVendor != 0
+		c.Warning = code&rcS != 0
+		number = code &^ (rcVendor | rcS)
+		if !c.Vendor && !c.Warning {
+			desc = rcTPM12Descs[number]
+		}
+	case code&rcVendor != 0:
+		c.Vendor = true
+		c.Warning = code&rcS != 0
+		number = code & 0x7f
+	case code&rcS != 0:
+		c.Warning = true
+		number = code & 0x7f
+		desc = rcWarnDescs[number]
+	default:
+		number = code & 0x7f
+		desc = rcFmt0Descs[number]
+	}
+	c.Name, c.Message = desc.name, desc.message
+	if c.Name == "" {
+		c.Name = fmt.Sprintf("0x%03x", number)
+		switch {
+		case c.Vendor:
+			c.Message = "vendor defined"
+		case c.TPM12:
+			c.Message = "TPM 1.2 error"
+		default:
+			c.Message = "unknown"
+		}
+	}
+	return c
+}
+
+// String returns the readable message of the response code, such as
+// "TPM_RC_HANDLE (0x0000018b): the handle is not correct for the use, handle 1".
+func (c *ResponseCode) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s (0x%08x)", c.Name, uint32(c.Code))
+	if c.Layer != 0 {
+		fmt.Fprintf(&b, " from TSS layer %d", c.Layer)
+	}
+	var kinds []string
+	if c.TPM12 {
+		kinds = append(kinds, "TPM 1.2")
+	}
+	if c.Vendor {
+		kinds = append(kinds, "vendor")
+	}
+	if c.Warning {
+		kinds = append(kinds, "warning")
+	}
+	if len(kinds) > 0 {
+		fmt.Fprintf(&b, " [%s]", strings.Join(kinds, ", "))
+	}
+	fmt.Fprintf(&b, ": %s", c.Message)
+	switch {
+	case c.Parameter != 0:
+		fmt.Fprintf(&b, ", parameter %d", c.Parameter)
+	case c.Handle != 0:
+		fmt.Fprintf(&b, ", handle %d", c.Handle)
+	case c.Session != 0:
+		fmt.Fprintf(&b, ", session %d", c.Session)
+	}
+	return b.String()
+}
+
+func (c *ResponseCode) Error() string {
+	return c.String()
+}
+
+func (c *ResponseCode) Unwrap() error {
+	return c.Code
+}
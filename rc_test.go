@@ -0,0 +1,72 @@
+package tpmproxy
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+func TestDecodeResponseCode(t *testing.T) {
+	for _, tt := range []struct {
+		rc   tpm2.TPMRC
+		want ResponseCode
+		str  string
+	}{
+		{0x000, ResponseCode{Name: "TPM_RC_SUCCESS"}, "TPM_RC_SUCCESS (0x00000000): success"},
+		{0x101, ResponseCode{Name: "TPM_RC_FAILURE"}, ""},
+		{0x18b, ResponseCode{Name: "TPM_RC_HANDLE", FormatOne: true, Handle: 1},
+			"TPM_RC_HANDLE (0x0000018b): the handle is not correct for the use, handle 1"},
+		{0x1c4, ResponseCode{Name: "TPM_RC_VALUE", FormatOne: true, Parameter: 1}, ""},
+		{0x9a2, ResponseCode{Name: "TPM_RC_BAD_AUTH", FormatOne: true, Session: 1}, ""},
+		{0x908, ResponseCode{Name: "TPM_RC_YIELDED", Warning: true}, ""},
+		{0x01e, ResponseCode{Name: "TPM_RC_BAD_TAG", TPM12: true}, ""},
+		{0x501, ResponseCode{Name: "0x001", Message: "vendor defined", Vendor: true},
+			"0x001 (0x00000501) [vendor]: vendor defined"},
+		{0x000b018b, ResponseCode{Name: "TPM_RC_HANDLE", Layer: 11, FormatOne: true, Handle: 1}, ""},
+	} {
+		c := DecodeResponseCode(tt.rc)
+		if c.Code != tt.rc || c.Name != tt.want.Name || c.Message == "" ||
+			(tt.want.Message != "" && c.Message != tt.want.Message) ||
+			c.Layer != tt.want.Layer || c.FormatOne != tt.want.FormatOne || c.Warning != tt.want.Warning ||
+			c.Vendor != tt.want.Vendor || c.TPM12 != tt.want.TPM12 ||
+			c.Parameter != tt.want.Parameter || c.Handle != tt.want.Handle || c.Session != tt.want.Session {
+			t.Errorf("0x%08x: unexpected %+v", uint32(tt.rc), *c)
+		}
+		if tt.str != "" && c.String() != tt.str {
+			t.Errorf("0x%08x: %q", uint32(tt.rc), c.String())
+		}
+	}
+	if err := error(DecodeResponseCode(0x18b)); !errors.Is(err, tpm2.TPMRCHandle) {
+		t.Errorf("%v is not TPM_RC_HANDLE", err)
+	}
+}
+
+func TestDecodeErrorResponse(t *testing.T) {
+	// the command of an error response is still decoded
+	command := []byte{0x80, 0x01, 0, 0, 0, 0x0e, 0, 0, 0x01, 0x65, 0x80, 0, 0, 1}
+	response := []byte{0x80, 0x01, 0, 0, 0, 0x0a, 0, 0, 0x01, 0x8b}
+	cmd, rsp, err := Decode(command, response)
+	var rc *ResponseCode
+	if !errors.As(err, &rc) || rc.Code != 0x18b || rsp != nil {
+		t.Fatalf("unexpected %v, %v", rsp, err)
+	}
+	if c, ok := cmd.(*tpm2.FlushContext); !ok || c.FlushHandle != tpm2.TPMHandle(0x80000001) {
+		t.Errorf("unexpected command %#v", cmd)
+	}
+
+	var flush tpm2.FlushContext
+	p := RoughParser{RawRequest: command, RawResponse: response, Cmd: &flush, Rsp: &tpm2.FlushContextResponse{}}
+	if err := p.Parse(); p.RspCode == nil || p.RspCode.Name != "TPM_RC_HANDLE" || err != error(p.RspCode) {
+		t.Errorf("unexpected %+v, %v", p.RspCode, err)
+	}
+	if flush.FlushHandle != tpm2.TPMHandle(0x80000001) {
+		t.Errorf("command not parsed %+v", flush)
+	}
+
+	// RspHeader returns the response code as go-tpm does
+	if err := RspHeader(bytes.NewBuffer(response)); err != tpm2.TPMRC(0x18b) {
+		t.Errorf("RspHeader: %#v", err)
+	}
+}
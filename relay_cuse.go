@@ -1,3 +1,5 @@
+//go:build libfuse
+
 package tpmproxy
 
 /*
@@ -14,11 +16,13 @@ typedef const char cchar_t;
 extern void CuseTpmOpen(fuse_req_t req, struct fuse_file_info *fi);
 extern void CuseTpmRead(fuse_req_t req, size_t size, off_t off, struct fuse_file_info *fi);
 extern void CuseTpmWrite(fuse_req_t req, cchar_t *buf, size_t size, off_t off, struct fuse_file_info *fi);
+extern void CuseTpmRelease(fuse_req_t req, struct fuse_file_info *fi);
 
 static const struct cuse_lowlevel_ops operations = {
-	.open  = CuseTpmOpen,
-	.read  = CuseTpmRead,
-	.write = CuseTpmWrite,
+	.open    = CuseTpmOpen,
+	.read    = CuseTpmRead,
+	.write   = CuseTpmWrite,
+	.release = CuseTpmRelease,
 };
 
 static int cuse_main(int argc, char **argv, const CUSE_INFO ci) {
@@ -31,28 +35,49 @@ import (
 )
 
 var (
-	CuseForwarder Forwarder
+	cuseForwarderFactory ForwarderFactory
+	cuseInterceptor      Interceptor
+	cuseSessions         = newCuseSessionTable()
 )
 
-func SetCuseForwarder(forwarder Forwarder) {
-	CuseForwarder = forwarder
-}
-
 //export CuseTpmOpen
 func CuseTpmOpen(req C.fuse_req_t, fi *C.FUSE_FILE_INFO) {
+	if cuseForwarderFactory == nil {
+		C.fuse_reply_err(req, C.ENODEV)
+		return
+	}
+	s, err := newCuseSession(cuseForwarderFactory, cuseInterceptor, nil)
+	if err != nil {
+		C.fuse_reply_err(req, C.EIO)
+		return
+	}
+	fi.fh = C.uint64_t(cuseSessions.add(s))
 	C.fuse_reply_open(req, fi)
 }
 
+//export CuseTpmRelease
+func CuseTpmRelease(req C.fuse_req_t, fi *C.FUSE_FILE_INFO) {
+	if s := cuseSessions.remove(uint64(fi.fh)); s != nil {
+		s.Close()
+	}
+	C.fuse_reply_err(req, 0)
+}
+
 //export CuseTpmRead
 func CuseTpmRead(req C.fuse_req_t, size C.size_t, off C.off_t, fi *C.FUSE_FILE_INFO) {
 	if size == 0 {
 		C.fuse_reply_err(req, C.EINVAL)
 		return
 	}
+	s := cuseSessions.get(uint64(fi.fh))
+	if s == nil {
+		C.fuse_reply_err(req, C.EBADF)
+		return
+	}
 
 	buffer := make([]byte, size)
-	nread, err := CuseForwarder.Read(buffer)
-	if err != nil {
+	nread, err := s.Read(buffer)
+	if err != nil || nread == 0 {
 		C.fuse_reply_err(req, C.EIO)
 		return
 	}
@@ -69,10 +94,15 @@ func CuseTpmWrite(req C.fuse_req_t, buf *C.cchar_t, size C.size_t, off C.off_t,
 		C.fuse_reply_err(req, C.EINVAL)
 		return
 	}
+	s := cuseSessions.get(uint64(fi.fh))
+	if s == nil {
+		C.fuse_reply_err(req, C.EBADF)
+		return
+	}
 
 	buffer := make([]byte, size)
 	copy(buffer, C.GoBytes(unsafe.Pointer(buf), C.int(size)))
-	nwrite, err := CuseForwarder.Write(buffer)
+	nwrite, err := s.Write(buffer)
 	if err != nil {
 		C.fuse_reply_err(req, C.EIO)
 		return
@@ -83,12 +113,21 @@ func CuseTpmWrite(req C.fuse_req_t, buf *C.cchar_t, size C.size_t, off C.off_t,
 
 // CuseRelay is a special relayer function that uses CUSE to relay TPM commands
 // and responses.
+// This version uses libfuse through cgo and is built with the libfuse build
+// tag. By default, the pure Go CuseServer is used instead.
+// Each open of the device gets its own Forwarder from forwarderFactory,
+// which is closed when the file is released.
+// The commands and responses are passed to interceptor in-process; it may be
+// nil. To capture the traffic, wrap forwarderFactory in a TcpTapForwarderFactory.
 // CuseRelay requires root privilege to run.
 // It is a blocking function that will return when the relay is done.
 // The devname is the device name that will be used to create the relay device.
 // The devname must be a valid device name that can be used in the filesystem.
 // The function will return the exit code of the relay.
-func CuseRelay(devname string) int {
+func CuseRelay(devname string, forwarderFactory ForwarderFactory, interceptor Interceptor) int {
+	cuseForwarderFactory = forwarderFactory
+	cuseInterceptor = interceptor
+
 	argv := []*C.char{C.CString(""), C.CString("-f")} // foreground
 	argc := C.int(len(argv))
 
@@ -0,0 +1,28 @@
+//go:build !libfuse
+
+package tpmproxy
+
+import (
+	"log"
+)
+
+// CuseRelay is a special relayer function that uses CUSE to relay TPM commands
+// and responses.
+// Each open of the device gets its own Forwarder from forwarderFactory,
+// which is closed when the file is released.
+// The commands and responses are passed to interceptor in-process; it may be
+// nil. To capture the traffic, wrap forwarderFactory in a TcpTapForwarderFactory.
+// CuseRelay requires root privilege to run.
+// It is a blocking function that will return when the relay is done.
+// The devname is the device name that will be used to create the relay device.
+// The function will return the exit code of the relay.
+// This version is a CuseServer and needs neither cgo nor libfuse. Build with
+// the libfuse build tag to use libfuse instead.
+func CuseRelay(devname string, forwarderFactory ForwarderFactory, interceptor Interceptor) int {
+	s := NewCuseServer(devname, forwarderFactory, interceptor)
+	if err := s.Serve(); err != nil {
+		log.Printf("cuse relay error: %v\n", err)
+		return 1
+	}
+	return 0
+}
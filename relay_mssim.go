@@ -0,0 +1,294 @@
+package tpmproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+const (
+	// mssimServerVersion is the version answered to MssimRemoteHandshake.
+	mssimServerVersion = 1
+	// mssimServerFlags are the flags answered to MssimRemoteHandshake:
+	// platform available, raw mode and physical presence support.
+	mssimServerFlags = 0x01 | 0x04 | 0x08
+)
+
+// MssimRelayer is a relayer for the Microsoft/IBM TPM simulator (mssim) protocol.
+// It accepts connections from mssim clients such as tpm2-tools and tpm2-tss
+// (TCTI "mssim"), unwraps the TPM commands and relays them to the forwarders.
+// Platform signals received on the platform port are sent to Platform, or
+// acknowledged locally if Platform is nil.
+type MssimRelayer struct {
+	Addr             string
+	PlatformAddr     string
+	ForwarderFactory ForwarderFactory
+	TerminateOnClose bool
+	Interceptor      Interceptor
+	Terminate        chan interface{}
+	// Platform receives the platform signals, if not nil.
+	Platform *MssimPlatform
+	// MaxMessageSize is the maximum TPM message size.
+	// If it is not positive, DefaultMaxMessageSize is used.
+	MaxMessageSize int
+}
+
+// NewMssimRelayer creates a new MssimRelayer.
+// If platformAddr is empty, the port following addr is used.
+func NewMssimRelayer(addr string, platformAddr string, forwarderFactory ForwarderFactory, interceptor Interceptor) *MssimRelayer {
+	return &MssimRelayer{
+		Addr:             addr,
+		PlatformAddr:     platformAddr,
+		ForwarderFactory: forwarderFactory,
+		Interceptor:      interceptor,
+		Terminate:        make(chan interface{}),
+	}
+}
+
+func (r *MssimRelayer) Relay() error {
+	platformAddr := r.PlatformAddr
+	if platformAddr == "" {
+		var err error
+		if platformAddr, err = mssimPlatformAddr(r.Addr); err != nil {
+			return err
+		}
+	}
+
+	listener, err := net.Listen("tcp", r.Addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	platformListener, err := net.Listen("tcp", platformAddr)
+	if err != nil {
+		return err
+	}
+	defer platformListener.Close()
+
+	go func() {
+		for {
+			conn, err := platformListener.Accept()
+			if err != nil {
+				return
+			}
+			go r.HandlePlatformConn(conn)
+		}
+	}()
+
+	newConns := make(chan net.Conn)
+	go func() {
+		for {
+			newConn, err := listener.Accept()
+			if err != nil {
+				newConns <- nil
+				return
+			}
+			newConns <- newConn
+		}
+	}()
+
+	for {
+		select {
+		case conn := <-newConns:
+			if conn == nil {
+				return nil
+			}
+			if err := r.HandleConnLoop(conn); err != nil {
+				log.Printf("mssim relay error: %v\n", err)
+				conn.Close()
+			}
+		case <-r.Terminate:
+			return nil
+		}
+	}
+}
+
+// HandlePlatformConn handles the platform signals of a connection until the
+// session ends.
+func (r *MssimRelayer) HandlePlatformConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		signal, err := readUint32(conn)
+		if err != nil || signal == MssimSessionEnd {
+			return
+		}
+		var ack uint32
+		if r.Platform != nil {
+			if err := r.Platform.Signal(signal); err != nil {
+				log.Printf("mssim platform signal %d: %v\n", signal, err)
+				ack = 1
+			}
+		}
+		if _, err := conn.Write(binary.BigEndian.AppendUint32(nil, ack)); err != nil {
+			return
+		}
+	}
+}
+
+func (r *MssimRelayer) HandleConnLoop(conn net.Conn) error {
+	fwd, err := r.ForwarderFactory.NewForwarder()
+	if err != nil {
+		return err
+	}
+
+	go func(conn net.Conn, fwd Forwarder) {
+		defer fwd.Close()
+		defer conn.Close()
+
+		src := NewMssimServerConn(conn)
+		handlerFactory := newTpmHandlerFactory(r.Interceptor)
+		setLocalityFunc(handlerFactory, src.Locality)
+		ex := &Exchanger{
+			Src:            src,
+			Dst:            fwd,
+			HandlerFactory: handlerFactory,
+			ReaderFactory:  NewTpmMessageReaderFactory(r.MaxMessageSize),
+		}
+		if err := ex.Exchange(); err != nil {
+			log.Printf("exchange error: %v\n", err)
+		}
+
+		if r.TerminateOnClose {
+			r.Terminate <- nil
+		}
+	}(conn, fwd)
+	return nil
+}
+
+// MssimServerConn is the server side of an mssim TPM port connection.
+// Read returns the unwrapped TPM commands and Write wraps the TPM responses.
+// Other mssim commands on the TPM port are answered internally.
+type MssimServerConn struct {
+	conn net.Conn
+	// locality is the locality of the last command.
+	locality uint8
+	// command holds the bytes of the command not yet read.
+	command []byte
+	// response holds the bytes of an incomplete response.
+	response []byte
+}
+
+// NewMssimServerConn creates a new MssimServerConn on the TPM port connection.
+func NewMssimServerConn(conn net.Conn) *MssimServerConn {
+	return &MssimServerConn{
+		conn: conn,
+	}
+}
+
+// Locality returns the locality of the last command read.
+func (c *MssimServerConn) Locality() uint8 {
+	return c.locality
+}
+
+func (c *MssimServerConn) ack() error {
+	_, err := c.conn.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// Read reads the unwrapped TPM commands.
+// It returns io.EOF when the client ends the session.
+// A command shorter than a TPM header is answered with TPM_RC_COMMAND_SIZE.
+func (c *MssimServerConn) Read(p []byte) (int, error) {
+	for len(c.command) == 0 {
+		cmd, err := readUint32(c.conn)
+		if err != nil {
+			return 0, err
+		}
+		switch cmd {
+		case MssimSendCommand:
+			var locality [1]byte
+			if _, err := io.ReadFull(c.conn, locality[:]); err != nil {
+				return 0, err
+			}
+			length, err := readUint32(c.conn)
+			if err != nil {
+				return 0, err
+			}
+			if length > DefaultMaxMessageSize {
+				return 0, fmt.Errorf("invalid mssim command length %d", length)
+			}
+			command := make([]byte, length)
+			if _, err := io.ReadFull(c.conn, command); err != nil {
+				return 0, err
+			}
+			if length < TpmHeaderSize {
+				// not a TPM command, which is answered here
+				if _, err := c.Write(NewTpmErrorResponse(tpm2.TPMSTNoSessions, tpm2.TPMRCCommandSize)); err != nil {
+					return 0, err
+				}
+				continue
+			}
+			c.locality = locality[0]
+			c.command = command
+		case MssimRemoteHandshake:
+			if _, err := readUint32(c.conn); err != nil {
+				return 0, err
+			}
+			reply := binary.BigEndian.AppendUint32(nil, mssimServerVersion)
+			reply = binary.BigEndian.AppendUint32(reply, mssimServerFlags)
+			if _, err := c.conn.Write(reply); err != nil {
+				return 0, err
+			}
+			if err := c.ack(); err != nil {
+				return 0, err
+			}
+		case MssimSignalHashData:
+			length, err := readUint32(c.conn)
+			if err != nil {
+				return 0, err
+			}
+			if _, err := io.CopyN(io.Discard, c.conn, int64(length)); err != nil {
+				return 0, err
+			}
+			if err := c.ack(); err != nil {
+				return 0, err
+			}
+		case MssimSetAlternativeResult:
+			if _, err := readUint32(c.conn); err != nil {
+				return 0, err
+			}
+			if err := c.ack(); err != nil {
+				return 0, err
+			}
+		case MssimSignalHashStart, MssimSignalHashEnd:
+			if err := c.ack(); err != nil {
+				return 0, err
+			}
+		case MssimSessionEnd, MssimStop:
+			return 0, io.EOF
+		default:
+			return 0, fmt.Errorf("unsupported mssim command %d", cmd)
+		}
+	}
+	n := copy(p, c.command)
+	c.command = c.command[n:]
+	return n, nil
+}
+
+// Write sends each complete TPM response in p wrapped in the mssim protocol.
+func (c *MssimServerConn) Write(p []byte) (int, error) {
+	c.response = append(c.response, p...)
+	for len(c.response) >= TpmHeaderSize {
+		size := int(binary.BigEndian.Uint32(c.response[2:6]))
+		if size < TpmHeaderSize {
+			c.response = nil
+			return 0, fmt.Errorf("invalid TPM response size %d", size)
+		}
+		if len(c.response) < size {
+			break
+		}
+		frame := binary.BigEndian.AppendUint32(nil, uint32(size))
+		frame = append(frame, c.response[:size]...)
+		frame = binary.BigEndian.AppendUint32(frame, 0)
+		if _, err := c.conn.Write(frame); err != nil {
+			return 0, err
+		}
+		c.response = c.response[size:]
+	}
+	return len(p), nil
+}
@@ -1,22 +1,28 @@
 package tpmproxy
 
 import (
+	"encoding/binary"
 	"errors"
+	"io"
 	"log"
 	"net"
 	"os"
-
-	"github.com/opencontainers/runc/libcontainer/utils"
+	"sync"
+	"sync/atomic"
+	"syscall"
 )
 
 // QemuCtrlRelayer is a relayer for the UNIXIO control channel of QEMU.
 // It listens on a UNIX domain socket for incoming connections from QEMU.
-// Upon receiving a connection, it creates a pair of forwarders for the
-// control channel and the server channel, and starts exchanging messages
-// between the two channels.
+// Upon receiving a connection, it creates a forwarder for the control
+// channel and relays the control commands. When QEMU passes the server
+// channel with CMD_SET_DATAFD, it creates a forwarder for the server channel
+// and starts exchanging messages on it. A later CMD_SET_DATAFD on the same
+// connection, as sent on QEMU reconnects, replaces the server channel.
 // The relayer can be configured to terminate upon closing of either channel.
 // The relayer can also be configured with an interceptor to intercept and
-// modify messages.
+// modify messages, and with a ctrl interceptor to intercept and modify
+// control channel messages.
 type QemuCtrlRelayer struct {
 	CtrlSockFile         string
 	ForwarderFactory     ForwarderFactory
@@ -24,6 +30,11 @@ type QemuCtrlRelayer struct {
 	TerminateOnClose     bool
 	Interceptor          Interceptor
 	Terminate            chan interface{}
+	// CtrlInterceptor intercepts the control channel messages.
+	CtrlInterceptor CtrlInterceptor
+	// MaxMessageSize is the maximum TPM message size on the server channel.
+	// If it is not positive, DefaultMaxMessageSize is used.
+	MaxMessageSize int
 }
 
 func NewQemuCtrlRelayer(ctrlSockFile string,
@@ -44,73 +55,281 @@ func (r *QemuCtrlRelayer) HandleConnLoop(qemuCtrlConn net.Conn) error {
 	if !ok {
 		return errors.New("not a unix conn")
 	}
-	qemuCtrlUnixFile, err := qemuCtrlUnixConn.File()
+
+	ctrlFwd, err := r.CtrlForwarderFactory.NewForwarder()
 	if err != nil {
 		return err
 	}
 
-	qemuServerFd, err := utils.RecvFd(qemuCtrlUnixFile)
-	if err != nil {
-		return err
+	go func(qemuCtrlConn *net.UnixConn, ctrlFwd Forwarder) {
+		defer ctrlFwd.Close()
+		defer qemuCtrlConn.Close()
+
+		s := &qemuCtrlSession{
+			relayer: r,
+			conn:    qemuCtrlConn,
+			ctrlFwd: ctrlFwd,
+		}
+		if err := s.exchange(); err != nil {
+			log.Printf("ctrl exchange error: %v\n", err)
+		}
+		s.closeServer()
+		s.terminate()
+	}(qemuCtrlUnixConn, ctrlFwd)
+
+	return nil
+}
+
+// qemuCtrlSession holds the state of a single QEMU control channel connection
+// and the server channel it has set up with CMD_SET_DATAFD.
+type qemuCtrlSession struct {
+	relayer *QemuCtrlRelayer
+	conn    *net.UnixConn
+	ctrlFwd Forwarder
+
+	mu sync.Mutex
+	// server is the currently active server channel.
+	server *qemuServerChannel
+
+	terminateOnce sync.Once
+
+	locality atomic.Uint32
+}
+
+// Locality returns the locality last set by CMD_SET_LOCALITY.
+func (s *qemuCtrlSession) Locality() uint8 {
+	return uint8(s.locality.Load())
+}
+
+// qemuServerChannel is a server channel between QEMU and the forwarder.
+type qemuServerChannel struct {
+	conn net.Conn
+	fwd  Forwarder
+	// replaced is set when the channel is closed by the session.
+	replaced bool
+}
+
+func (s *qemuCtrlSession) terminate() {
+	if !s.relayer.TerminateOnClose {
+		return
 	}
+	s.terminateOnce.Do(func() {
+		s.relayer.Terminate <- nil
+	})
+}
 
-	if _, err := qemuCtrlConn.Write([]byte{0x00, 0x00, 0x00, 0x00}); err != nil {
-		return err
+// exchange relays control channel messages until either side is closed.
+// CMD_SET_DATAFD is handled by the session itself; other commands are
+// forwarded to the control forwarder. The commands are dispatched as
+// rewritten by the ctrl interceptor, so that rewriting CMD_SET_DATAFD to
+// another command or blocking it leaves the server channel as it is.
+func (s *qemuCtrlSession) exchange() error {
+	var handlerFactory RequestResponseHandlerFactory
+	if s.relayer.CtrlInterceptor != nil {
+		handlerFactory = &CtrlRequestResponseHandlerFactory{
+			Interceptor: s.relayer.CtrlInterceptor,
+		}
+	} else {
+		handlerFactory = &NopRequestResponseHandlerFactory{}
 	}
 
-	fwd, err := r.ForwarderFactory.NewForwarder()
-	if err != nil {
-		return err
+	buf := make([]byte, rawMessageBufferSize)
+	oob := make([]byte, syscall.CmsgSpace(4*4))
+	respBuf := make([]byte, rawMessageBufferSize)
+	for {
+		n, oobn, _, _, err := s.conn.ReadMsgUnix(buf, oob)
+		if err != nil {
+			return FilterClosedErr(err)
+		}
+		if n == 0 {
+			return nil
+		}
+		fds := parseUnixRights(oob[:oobn])
+
+		request, err := ReadCtrlMessage(s.conn, buf[:n], CtrlRequestSize)
+		if err != nil {
+			closeFds(fds)
+			return FilterClosedErr(err)
+		}
+		req, err := ParseCtrlRequest(request)
+		if err != nil {
+			closeFds(fds)
+			return err
+		}
+
+		handler := handlerFactory.NewRequestResponseHandler()
+		request = handler.HandleRequest(request)
+
+		// the request rewritten by the interceptor is the one carried out
+		cmd := req.Cmd
+		if request != nil {
+			if r, err := ParseCtrlRequest(request); err == nil {
+				cmd = r.Cmd
+			}
+		}
+		if request == nil || cmd != CtrlCmdSetDatafd {
+			closeFds(fds)
+			fds = nil
+		}
+
+		var response []byte
+		switch {
+		case request == nil:
+		case cmd == CtrlCmdSetDatafd:
+			result := s.setServerFd(fds)
+			response = (&CtrlResultResponse{Result: result}).MarshalCtrl()
+		default:
+			if _, err := s.ctrlFwd.Write(request); err != nil {
+				return FilterClosedErr(err)
+			}
+			n, err := s.ctrlFwd.Read(respBuf)
+			if err != nil {
+				return FilterClosedErr(err)
+			}
+			response, err = ReadCtrlMessage(s.ctrlFwd, respBuf[:n], func(b []byte) int {
+				return CtrlResponseSize(cmd, b)
+			})
+			if err != nil {
+				return FilterClosedErr(err)
+			}
+			if locality, ok := ctrlSetLocality(request, response); ok {
+				s.locality.Store(uint32(locality))
+			}
+		}
+		response = handler.HandleResponse(response)
+
+		if _, err := s.conn.Write(response); err != nil {
+			return FilterClosedErr(err)
+		}
 	}
+}
 
-	ctrlFwd, err := r.CtrlForwarderFactory.NewForwarder()
+// setServerFd replaces the server channel with the one passed by QEMU and
+// returns the result code for CMD_SET_DATAFD.
+func (s *qemuCtrlSession) setServerFd(fds []int) uint32 {
+	if len(fds) != 1 {
+		closeFds(fds)
+		return CtrlResultBadParameter
+	}
+	qemuServerFile := os.NewFile(uintptr(fds[0]), "qemu-server")
+	qemuServerConn, err := net.FileConn(qemuServerFile)
+	qemuServerFile.Close()
 	if err != nil {
-		return err
+		log.Printf("server channel error: %v\n", err)
+		return CtrlResultFail
 	}
 
-	go func(qemuServerFd *os.File, fwd Forwarder) {
-		defer fwd.Close()
-		defer qemuServerFd.Close()
+	fwd, result := s.newServerForwarder()
+	if result != CtrlResultSuccess {
+		qemuServerConn.Close()
+		return result
+	}
 
-		var handlerFactory RequestResponseHandlerFactory
-		if r.Interceptor != nil {
-			handlerFactory = &TpmRequestResponseHandlerFactory{
-				Interceptor: r.Interceptor,
-			}
-		} else {
-			handlerFactory = &NopRequestResponseHandlerFactory{}
-		}
+	s.closeServer()
+	ch := &qemuServerChannel{
+		conn: qemuServerConn,
+		fwd:  fwd,
+	}
+	s.mu.Lock()
+	s.server = ch
+	s.mu.Unlock()
+
+	go func(ch *qemuServerChannel) {
+		defer ch.fwd.Close()
+		defer ch.conn.Close()
+
+		handlerFactory := newTpmHandlerFactory(s.relayer.Interceptor)
+		setLocalityFunc(handlerFactory, s.Locality)
 
 		ex := &Exchanger{
-			Src:            qemuServerFd,
-			Dst:            fwd,
+			Src:            ch.conn,
+			Dst:            ch.fwd,
 			HandlerFactory: handlerFactory,
+			ReaderFactory:  NewTpmMessageReaderFactory(s.relayer.MaxMessageSize),
 		}
-		if err := ex.Exchange(); err != nil {
-			log.Printf("server exchange error: %v\n", err)
-		}
-		if r.TerminateOnClose {
-			r.Terminate <- nil
-		}
-	}(qemuServerFd, fwd)
+		err := ex.Exchange()
 
-	go func(qemuCtrlConn net.Conn, ctrlFwd Forwarder) {
-		defer ctrlFwd.Close()
-		defer qemuCtrlConn.Close()
-		ex := &Exchanger{
-			Src:            qemuCtrlConn,
-			Dst:            ctrlFwd,
-			HandlerFactory: &NopRequestResponseHandlerFactory{},
+		s.mu.Lock()
+		replaced := ch.replaced
+		s.mu.Unlock()
+		if replaced {
+			return
 		}
-		if err := ex.Exchange(); err != nil {
-			log.Printf("ctrl exchange error: %v\n", err)
+		if err != nil {
+			log.Printf("server exchange error: %v\n", err)
 		}
-		if r.TerminateOnClose {
-			r.Terminate <- nil
+		s.terminate()
+	}(ch)
+
+	return CtrlResultSuccess
+}
+
+// newServerForwarder creates the forwarder for a new server channel.
+// Without a ForwarderFactory, a socket pair is created and one end is passed
+// to the backend with CMD_SET_DATAFD, which requires the control forwarder to
+// be a UNIX domain socket. The backend's result code is returned in that case.
+func (s *qemuCtrlSession) newServerForwarder() (Forwarder, uint32) {
+	if s.relayer.ForwarderFactory != nil {
+		fwd, err := s.relayer.ForwarderFactory.NewForwarder()
+		if err != nil {
+			log.Printf("server forwarder error: %v\n", err)
+			return nil, CtrlResultIoError
 		}
-	}(qemuCtrlConn, ctrlFwd)
+		return fwd, CtrlResultSuccess
+	}
 
-	return nil
+	ctrlUnixConn, ok := s.ctrlFwd.(*net.UnixConn)
+	if !ok {
+		log.Printf("server forwarder error: no forwarder factory and ctrl forwarder is not a unix conn\n")
+		return nil, CtrlResultFail
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		log.Printf("server forwarder error: %v\n", err)
+		return nil, CtrlResultFail
+	}
+	defer syscall.Close(fds[1])
+	localFile := os.NewFile(uintptr(fds[0]), "swtpm-server")
+	fwd, err := net.FileConn(localFile)
+	localFile.Close()
+	if err != nil {
+		log.Printf("server forwarder error: %v\n", err)
+		return nil, CtrlResultFail
+	}
+
+	request := MarshalCtrlRequest(CtrlCmdSetDatafd, nil)
+	if _, _, err := ctrlUnixConn.WriteMsgUnix(request, syscall.UnixRights(fds[1]), nil); err != nil {
+		fwd.Close()
+		log.Printf("server forwarder error: %v\n", err)
+		return nil, CtrlResultIoError
+	}
+	response := make([]byte, 4)
+	if _, err := io.ReadFull(ctrlUnixConn, response); err != nil {
+		fwd.Close()
+		log.Printf("server forwarder error: %v\n", err)
+		return nil, CtrlResultIoError
+	}
+	result := binary.BigEndian.Uint32(response)
+	if result != CtrlResultSuccess {
+		fwd.Close()
+		return nil, result
+	}
+	return fwd, CtrlResultSuccess
+}
+
+// closeServer closes the current server channel, if any.
+func (s *qemuCtrlSession) closeServer() {
+	s.mu.Lock()
+	ch := s.server
+	s.server = nil
+	if ch != nil {
+		ch.replaced = true
+	}
+	s.mu.Unlock()
+	if ch != nil {
+		ch.conn.Close()
+		ch.fwd.Close()
+	}
 }
 
 func (r *QemuCtrlRelayer) Relay() error {
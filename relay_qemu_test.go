@@ -0,0 +1,317 @@
+package tpmproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// unixConnPair returns a connected pair of UNIX domain socket connections.
+func unixConnPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	t.Helper()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns [2]*net.UnixConn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = c.(*net.UnixConn)
+	}
+	return conns[0], conns[1]
+}
+
+// fakeSwtpm answers every TPM command with a success response and every
+// control command with a fixed result.
+type fakeSwtpm struct {
+	dataLn net.Listener
+	ctrlLn net.Listener
+}
+
+func newFakeSwtpm(t *testing.T) *fakeSwtpm {
+	t.Helper()
+	dataLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrlLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSwtpm{dataLn: dataLn, ctrlLn: ctrlLn}
+	go s.serve(dataLn, func(conn net.Conn) error {
+		mr := NewTpmMessageReader(conn, 0)
+		for {
+			if _, err := mr.ReadMessage(); err != nil {
+				return err
+			}
+			if _, err := conn.Write([]byte{0x80, 0x01, 0, 0, 0, 0x0a, 0, 0, 0, 0}); err != nil {
+				return err
+			}
+		}
+	})
+	go s.serve(ctrlLn, func(conn net.Conn) error {
+		buf := make([]byte, 64)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return err
+			}
+			switch CtrlCmd(binary.BigEndian.Uint32(buf[:n])) {
+			case CtrlCmdGetCapability:
+				conn.Write((&CtrlCapabilityResponse{Caps: CtrlCapInit}).MarshalCtrl())
+			default:
+				conn.Write((&CtrlResultResponse{Result: 0x42}).MarshalCtrl())
+			}
+		}
+	})
+	return s
+}
+
+func (s *fakeSwtpm) serve(ln net.Listener, handle func(net.Conn) error) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			handle(conn)
+		}()
+	}
+}
+
+func (s *fakeSwtpm) Close() {
+	s.dataLn.Close()
+	s.ctrlLn.Close()
+}
+
+func setDatafd(t *testing.T, ctrl *net.UnixConn) *net.UnixConn {
+	t.Helper()
+	qemuEnd, relayEnd := unixConnPair(t)
+	f, err := relayEnd.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	relayEnd.Close()
+
+	request := MarshalCtrlRequest(CtrlCmdSetDatafd, nil)
+	if _, _, err := ctrl.WriteMsgUnix(request, syscall.UnixRights(int(f.Fd())), nil); err != nil {
+		t.Fatal(err)
+	}
+	response := make([]byte, 4)
+	if _, err := io.ReadFull(ctrl, response); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response, []byte{0, 0, 0, 0}) {
+		t.Fatalf("CMD_SET_DATAFD failed: %x", response)
+	}
+	return qemuEnd
+}
+
+func exchangeTpm(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte{0x80, 0x01, 0, 0, 0, 0x0c, 0, 0, 0x01, 0x44, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	response := make([]byte, 10)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQemuCtrlRelayerSetDatafd(t *testing.T) {
+	swtpm := newFakeSwtpm(t)
+	defer swtpm.Close()
+
+	r := NewQemuCtrlRelayer("",
+		NewTcpForwarderFactory(swtpm.dataLn.Addr().String()),
+		NewTcpForwarderFactory(swtpm.ctrlLn.Addr().String()),
+		false, nil)
+
+	qemuCtrl, relayCtrl := unixConnPair(t)
+	defer qemuCtrl.Close()
+	qemuCtrl.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := r.HandleConnLoop(relayCtrl); err != nil {
+		t.Fatal(err)
+	}
+
+	server := setDatafd(t, qemuCtrl)
+	exchangeTpm(t, server)
+
+	// other commands are forwarded with the backend's result
+	if _, err := qemuCtrl.Write(MarshalCtrlRequest(CtrlCmdInit, &CtrlInitRequest{})); err != nil {
+		t.Fatal(err)
+	}
+	response := make([]byte, 4)
+	if _, err := io.ReadFull(qemuCtrl, response); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response, []byte{0, 0, 0, 0x42}) {
+		t.Errorf("got %x", response)
+	}
+
+	// a new server channel replaces the previous one
+	server2 := setDatafd(t, qemuCtrl)
+	exchangeTpm(t, server2)
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := server.Read(make([]byte, 1)); err == nil {
+		t.Error("previous server channel is still open")
+	}
+	server.Close()
+	server2.Close()
+}
+
+func ctrlCommand(t *testing.T, conn net.Conn, cmd CtrlCmd, payload CtrlPayload) CtrlPayload {
+	t.Helper()
+	if _, err := conn.Write(MarshalCtrlRequest(cmd, payload)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := ReadCtrlMessage(conn, buf[:n], func(b []byte) int {
+		return CtrlResponseSize(cmd, b)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ParseCtrlResponse(cmd, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestQemuCtrlRelayerCtrlEmulator(t *testing.T) {
+	// A FIFO opened for reading and writing echoes every command back,
+	// which is enough of a TPM device for relaying.
+	tpmPath := filepath.Join(t.TempDir(), "tpm")
+	if err := syscall.Mkfifo(tpmPath, 0600); err != nil {
+		t.Skip(err)
+	}
+
+	interceptor := &localityInterceptor{}
+	r := NewQemuCtrlRelayer("",
+		NewIoForwarderFactory(tpmPath),
+		NewCtrlEmulatorForwarderFactory(),
+		false, interceptor)
+
+	qemuCtrl, relayCtrl := unixConnPair(t)
+	defer qemuCtrl.Close()
+	qemuCtrl.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := r.HandleConnLoop(relayCtrl); err != nil {
+		t.Fatal(err)
+	}
+
+	caps := ctrlCommand(t, qemuCtrl, CtrlCmdGetCapability, nil).(*CtrlCapabilityResponse)
+	if caps.Caps != DefaultCtrlEmulatorCaps {
+		t.Errorf("unexpected caps %x", caps.Caps)
+	}
+	server := setDatafd(t, qemuCtrl)
+	defer server.Close()
+	if res := ctrlCommand(t, qemuCtrl, CtrlCmdInit, &CtrlInitRequest{}).(*CtrlResultResponse); res.Result != CtrlResultSuccess {
+		t.Errorf("CMD_INIT failed: %x", res.Result)
+	}
+	if res := ctrlCommand(t, qemuCtrl, CtrlCmdSetLocality, &CtrlLocalityRequest{Locality: 3}).(*CtrlResultResponse); res.Result != CtrlResultSuccess {
+		t.Errorf("CMD_SET_LOCALITY failed: %x", res.Result)
+	}
+	if res := ctrlCommand(t, qemuCtrl, CtrlCmdGetTpmEstablished, nil).(*CtrlEstablishedResponse); res.Result != CtrlResultSuccess {
+		t.Errorf("CMD_GET_TPMESTABLISHED failed: %x", res.Result)
+	}
+	if res := ctrlCommand(t, qemuCtrl, CtrlCmdHashStart, nil).(*CtrlResultResponse); res.Result != CtrlResultBadOrdinal {
+		t.Errorf("CMD_HASH_START: got %x", res.Result)
+	}
+
+	command := []byte{0x80, 0x01, 0, 0, 0, 0x0c, 0, 0, 0x01, 0x44, 0, 0}
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := server.Write(command); err != nil {
+		t.Fatal(err)
+	}
+	response := make([]byte, len(command))
+	if _, err := io.ReadFull(server, response); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response, command) {
+		t.Errorf("got %x", response)
+	}
+	// the command is sent with the locality set by CMD_SET_LOCALITY
+	if locality := interceptor.locality.Load(); locality != 3 {
+		t.Errorf("locality %d", locality)
+	}
+}
+
+// rewritingCtrlInterceptor rewrites CMD_SET_DATAFD to CMD_INIT.
+type rewritingCtrlInterceptor struct {
+}
+
+func (it *rewritingCtrlInterceptor) HandleCtrlRequest(request *CtrlRequest) []byte {
+	if request.Cmd == CtrlCmdSetDatafd {
+		return MarshalCtrlRequest(CtrlCmdInit, &CtrlInitRequest{})
+	}
+	return request.Raw
+}
+
+func (it *rewritingCtrlInterceptor) HandleCtrlResponse(request *CtrlRequest, response []byte) []byte {
+	return response
+}
+
+func TestQemuCtrlRelayerSetDatafdRewritten(t *testing.T) {
+	swtpm := newFakeSwtpm(t)
+	defer swtpm.Close()
+
+	r := NewQemuCtrlRelayer("",
+		NewTcpForwarderFactory(swtpm.dataLn.Addr().String()),
+		NewTcpForwarderFactory(swtpm.ctrlLn.Addr().String()),
+		false, nil)
+	r.CtrlInterceptor = &rewritingCtrlInterceptor{}
+
+	qemuCtrl, relayCtrl := unixConnPair(t)
+	defer qemuCtrl.Close()
+	qemuCtrl.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := r.HandleConnLoop(relayCtrl); err != nil {
+		t.Fatal(err)
+	}
+
+	qemuEnd, relayEnd := unixConnPair(t)
+	defer qemuEnd.Close()
+	f, err := relayEnd.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayEnd.Close()
+	request := MarshalCtrlRequest(CtrlCmdSetDatafd, nil)
+	_, _, err = qemuCtrl.WriteMsgUnix(request, syscall.UnixRights(int(f.Fd())), nil)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the backend answers the rewritten CMD_INIT and the fd is not installed
+	response := make([]byte, 4)
+	if _, err := io.ReadFull(qemuCtrl, response); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response, []byte{0, 0, 0, 0x42}) {
+		t.Errorf("got %x", response)
+	}
+	qemuEnd.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := qemuEnd.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("server channel is installed: %v", err)
+	}
+}
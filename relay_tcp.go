@@ -13,6 +13,9 @@ type TcpRelayer struct {
 	TerminateOnClose bool
 	Interceptor      Interceptor
 	Terminate        chan interface{}
+	// MaxMessageSize is the maximum TPM message size.
+	// If it is not positive, DefaultMaxMessageSize is used.
+	MaxMessageSize int
 }
 
 func NewTcpRelayer(addr string, forwarderFactory ForwarderFactory, interceptor Interceptor) *TcpRelayer {
@@ -63,18 +66,12 @@ func (r *TcpRelayer) HandleConnLoop(conn net.Conn) error {
 		defer fwd.Close()
 		defer conn.Close()
 
-		var handlerFactory RequestResponseHandlerFactory
-		if r.Interceptor != nil {
-			handlerFactory = &TpmRequestResponseHandlerFactory{
-				Interceptor: r.Interceptor,
-			}
-		} else {
-			handlerFactory = &NopRequestResponseHandlerFactory{}
-		}
+		handlerFactory := newTpmHandlerFactory(r.Interceptor)
 		ex := &Exchanger{
 			Src:            conn,
 			Dst:            fwd,
 			HandlerFactory: handlerFactory,
+			ReaderFactory:  NewTpmMessageReaderFactory(r.MaxMessageSize),
 		}
 		if err := ex.Exchange(); err != nil {
 			fmt.Printf("exchange error: %v\n", err)
@@ -0,0 +1,93 @@
+package tpmproxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// UnixRelayer is a relayer for UNIX domain socket connections.
+// UnixRelayer is the counterpart of TcpRelayer for hosts where TCP ports
+// should not be exposed, such as swtpm's unixio server mode.
+type UnixRelayer struct {
+	SockFile         string
+	ForwarderFactory ForwarderFactory
+	TerminateOnClose bool
+	Interceptor      Interceptor
+	Terminate        chan interface{}
+	// MaxMessageSize is the maximum TPM message size.
+	// If it is not positive, DefaultMaxMessageSize is used.
+	MaxMessageSize int
+}
+
+func NewUnixRelayer(sockFile string, forwarderFactory ForwarderFactory, interceptor Interceptor) *UnixRelayer {
+	return &UnixRelayer{
+		SockFile:         sockFile,
+		ForwarderFactory: forwarderFactory,
+		Interceptor:      interceptor,
+		Terminate:        make(chan interface{}),
+	}
+}
+
+func (r *UnixRelayer) Relay() error {
+	os.Remove(r.SockFile)
+
+	listener, err := net.Listen("unix", r.SockFile)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	newConns := make(chan net.Conn)
+	go func() {
+		for {
+			newConn, err := listener.Accept()
+			if err != nil {
+				newConns <- nil
+				return
+			}
+			newConns <- newConn
+		}
+	}()
+
+	for {
+		select {
+		case conn := <-newConns:
+			if conn == nil {
+				return nil
+			}
+			r.HandleConnLoop(conn)
+		case <-r.Terminate:
+			return nil
+		}
+	}
+}
+
+func (r *UnixRelayer) HandleConnLoop(conn net.Conn) error {
+	fwd, err := r.ForwarderFactory.NewForwarder()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	go func(conn net.Conn, fwd Forwarder) {
+		defer fwd.Close()
+		defer conn.Close()
+
+		handlerFactory := newTpmHandlerFactory(r.Interceptor)
+		ex := &Exchanger{
+			Src:            conn,
+			Dst:            fwd,
+			HandlerFactory: handlerFactory,
+			ReaderFactory:  NewTpmMessageReaderFactory(r.MaxMessageSize),
+		}
+		if err := ex.Exchange(); err != nil {
+			fmt.Printf("exchange error: %v\n", err)
+		}
+
+		if r.TerminateOnClose {
+			r.Terminate <- nil
+		}
+	}(conn, fwd)
+	return nil
+}
@@ -0,0 +1,141 @@
+package tpmproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// serveEchoTpm echoes every TPM command on conn back as its response.
+func serveEchoTpm(conn net.Conn) {
+	defer conn.Close()
+	mr := NewTpmMessageReader(conn, 0)
+	for {
+		msg, err := mr.ReadMessage()
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(msg); err != nil {
+			return
+		}
+	}
+}
+
+func TestUnixRelayer(t *testing.T) {
+	dir := t.TempDir()
+	backendSock := filepath.Join(dir, "backend.sock")
+	ln, err := net.Listen("unix", backendSock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveEchoTpm(conn)
+		}
+	}()
+
+	relaySock := filepath.Join(dir, "relay.sock")
+	r := NewUnixRelayer(relaySock, NewUnixForwarderFactory(backendSock), nil)
+	r.TerminateOnClose = true
+	done := make(chan error)
+	go func() {
+		done <- r.Relay()
+	}()
+
+	var conn net.Conn
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("unix", relaySock); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	command := []byte{0x80, 0x01, 0, 0, 0, 0x0c, 0, 0, 0x01, 0x44, 0, 0}
+	if _, err := conn.Write(command); err != nil {
+		t.Fatal(err)
+	}
+	response := make([]byte, len(command))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response, command) {
+		t.Errorf("got %x", response)
+	}
+	conn.Close()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("relay did not terminate on close")
+	}
+}
+
+// TestQemuCtrlRelayerUnixCtrl checks that the server channel is passed to a
+// unixio control channel backend with CMD_SET_DATAFD.
+func TestQemuCtrlRelayerUnixCtrl(t *testing.T) {
+	ctrlSock := filepath.Join(t.TempDir(), "ctrl.sock")
+	ln, err := net.Listen("unix", ctrlSock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn := c.(*net.UnixConn)
+		defer conn.Close()
+		buf := make([]byte, 64)
+		oob := make([]byte, syscall.CmsgSpace(4))
+		for {
+			n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+			if err != nil || n < 4 {
+				return
+			}
+			if CtrlCmd(binary.BigEndian.Uint32(buf)) == CtrlCmdSetDatafd {
+				fds := parseUnixRights(oob[:oobn])
+				if len(fds) != 1 {
+					conn.Write([]byte{0, 0, 0, byte(CtrlResultBadParameter)})
+					continue
+				}
+				f := os.NewFile(uintptr(fds[0]), "data")
+				data, _ := net.FileConn(f)
+				f.Close()
+				go serveEchoTpm(data)
+			}
+			conn.Write([]byte{0, 0, 0, 0})
+		}
+	}()
+
+	r := NewQemuCtrlRelayer("", nil, NewUnixForwarderFactory(ctrlSock), false, nil)
+
+	qemuCtrl, relayCtrl := unixConnPair(t)
+	defer qemuCtrl.Close()
+	qemuCtrl.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := r.HandleConnLoop(relayCtrl); err != nil {
+		t.Fatal(err)
+	}
+
+	server := setDatafd(t, qemuCtrl)
+	defer server.Close()
+	exchangeTpm(t, server)
+}
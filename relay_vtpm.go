@@ -0,0 +1,170 @@
+package tpmproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+const (
+	// vtpmProxyIocNewDev is VTPM_PROXY_IOC_NEW_DEV, _IOWR(0xa1, 0x00, struct vtpm_proxy_new_dev).
+	vtpmProxyIocNewDev = 0xc014a100
+	// vtpmProxyFlagTpm2 is VTPM_PROXY_FLAG_TPM2.
+	vtpmProxyFlagTpm2 = 1
+	// TpmCCVtpmSetLocality is the vendor command the kernel sends to a TPM 2.0
+	// vTPM proxy to change the locality of the following commands.
+	TpmCCVtpmSetLocality tpm2.TPMCC = 0x20001000
+)
+
+// vtpmProxyNewDev is struct vtpm_proxy_new_dev of linux/vtpm_proxy.h.
+type vtpmProxyNewDev struct {
+	Flags  uint32
+	TpmNum uint32
+	Fd     uint32
+	Major  uint32
+	Minor  uint32
+}
+
+// VtpmProxyRelayer is a relayer for a Linux vTPM proxy device.
+// It creates /dev/tpmN and /dev/tpmrmN through /dev/vtpmx and relays the
+// commands sent to them, including those of the in-kernel resource manager.
+// VtpmProxyRelayer requires root privilege and the tpm_vtpm_proxy module.
+type VtpmProxyRelayer struct {
+	// VtpmxPath is the path of the vTPM proxy control device.
+	VtpmxPath        string
+	ForwarderFactory ForwarderFactory
+	Interceptor      Interceptor
+	Terminate        chan interface{}
+	// MaxMessageSize is the maximum TPM message size.
+	// If it is not positive, DefaultMaxMessageSize is used.
+	MaxMessageSize int
+	// TpmNum is the number N of the created /dev/tpmN and /dev/tpmrmN.
+	// It is set by Relay once the device is created.
+	TpmNum uint32
+
+	locality atomic.Uint32
+}
+
+func NewVtpmProxyRelayer(forwarderFactory ForwarderFactory, interceptor Interceptor) *VtpmProxyRelayer {
+	return &VtpmProxyRelayer{
+		VtpmxPath:        "/dev/vtpmx",
+		ForwarderFactory: forwarderFactory,
+		Interceptor:      interceptor,
+		Terminate:        make(chan interface{}),
+	}
+}
+
+// Locality returns the locality last requested by the kernel.
+func (r *VtpmProxyRelayer) Locality() uint8 {
+	return uint8(r.locality.Load())
+}
+
+// newDevice creates a TPM 2.0 vTPM proxy device and returns its server side.
+func (r *VtpmProxyRelayer) newDevice() (*os.File, error) {
+	vtpmx, err := os.OpenFile(r.VtpmxPath, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer vtpmx.Close()
+
+	dev := vtpmProxyNewDev{Flags: vtpmProxyFlagTpm2}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, vtpmx.Fd(),
+		vtpmProxyIocNewDev, uintptr(unsafe.Pointer(&dev))); errno != 0 {
+		return nil, fmt.Errorf("VTPM_PROXY_IOC_NEW_DEV: %w", errno)
+	}
+	r.TpmNum = dev.TpmNum
+
+	// Make the file pollable so that closing it interrupts a pending read.
+	fd := int(dev.Fd)
+	syscall.CloseOnExec(fd)
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), fmt.Sprintf("vtpm%d", dev.TpmNum)), nil
+}
+
+// Relay creates the device and relays its commands until the device is
+// closed or the relayer is terminated.
+// Closing the server side removes the device.
+func (r *VtpmProxyRelayer) Relay() error {
+	fwd, err := r.ForwarderFactory.NewForwarder()
+	if err != nil {
+		return err
+	}
+	defer fwd.Close()
+
+	server, err := r.newDevice()
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+	log.Printf("vtpm proxy device created: /dev/tpm%d, /dev/tpmrm%d\n", r.TpmNum, r.TpmNum)
+
+	handlerFactory := newTpmHandlerFactory(r.Interceptor)
+	setLocalityFunc(handlerFactory, r.Locality)
+
+	done := make(chan error, 1)
+	go func() {
+		ex := &Exchanger{
+			Src: server,
+			Dst: fwd,
+			HandlerFactory: &vtpmProxyHandlerFactory{
+				relayer: r,
+				inner:   handlerFactory,
+			},
+			ReaderFactory: NewTpmMessageReaderFactory(r.MaxMessageSize),
+		}
+		done <- ex.Exchange()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-r.Terminate:
+		return nil
+	}
+}
+
+// vtpmProxyHandlerFactory answers TpmCCVtpmSetLocality locally and passes
+// other commands to the inner handlers.
+type vtpmProxyHandlerFactory struct {
+	relayer *VtpmProxyRelayer
+	inner   RequestResponseHandlerFactory
+}
+
+func (f *vtpmProxyHandlerFactory) NewRequestResponseHandler() RequestResponseHandler {
+	return &vtpmProxyHandler{
+		relayer: f.relayer,
+		inner:   f.inner.NewRequestResponseHandler(),
+	}
+}
+
+type vtpmProxyHandler struct {
+	relayer     *VtpmProxyRelayer
+	inner       RequestResponseHandler
+	setLocality bool
+}
+
+func (h *vtpmProxyHandler) HandleRequest(request []byte) []byte {
+	if len(request) == TpmHeaderSize+1 &&
+		tpm2.TPMCC(binary.BigEndian.Uint32(request[6:10])) == TpmCCVtpmSetLocality {
+		h.setLocality = true
+		h.relayer.locality.Store(uint32(request[TpmHeaderSize]))
+		return nil
+	}
+	return h.inner.HandleRequest(request)
+}
+
+func (h *vtpmProxyHandler) HandleResponse(response []byte) []byte {
+	if h.setLocality {
+		return []byte{0x80, 0x01, 0x00, 0x00, 0x00, 0x0a, 0x00, 0x00, 0x00, 0x00}
+	}
+	return h.inner.HandleResponse(response)
+}
@@ -0,0 +1,270 @@
+package tpmproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// ReplayMode selects how ReplayForwarderFactory matches the commands to the
+// recorded ones.
+type ReplayMode int
+
+const (
+	// ReplayStrict expects the recorded commands in the recorded order,
+	// byte for byte.
+	ReplayStrict ReplayMode = iota
+	// ReplayByCommand answers a command with the first recorded exchange
+	// not replayed yet whose command is the same, byte for byte.
+	ReplayByCommand
+	// ReplayByCommandCode answers a command with the first recorded exchange
+	// not replayed yet whose command has the same command code and handles.
+	// The parameters and the authorization area, which hold nonces, are not
+	// compared.
+	ReplayByCommandCode
+)
+
+func (m ReplayMode) String() string {
+	switch m {
+	case ReplayStrict:
+		return "strict"
+	case ReplayByCommand:
+		return "by command"
+	case ReplayByCommandCode:
+		return "by command code"
+	}
+	return fmt.Sprintf("ReplayMode(%d)", int(m))
+}
+
+// ReplayDivergenceError is the error returned when a command does not match
+// the recording.
+type ReplayDivergenceError struct {
+	// Mode is the matching mode.
+	Mode ReplayMode
+	// Index is the number of commands replayed before the command.
+	Index int
+	// Command is the diverging command.
+	Command []byte
+	// Expected is the first recorded exchange not replayed yet, or nil if
+	// all have been replayed.
+	Expected *TraceRecord
+}
+
+func (e *ReplayDivergenceError) Error() string {
+	name := "malformed command"
+	if len(e.Command) >= TpmHeaderSize {
+		name = CommandName(tpm2.TPMCC(binary.BigEndian.Uint32(e.Command[6:10])))
+	}
+	if e.Expected == nil {
+		return fmt.Sprintf("replay diverged at command %d (%v): got %s %x after the end of the recording",
+			e.Index, e.Mode, name, e.Command)
+	}
+	return fmt.Sprintf("replay diverged at command %d (%v): got %s %x, expected %s %s",
+		e.Index, e.Mode, name, e.Command, e.Expected.CommandName, e.Expected.Request)
+}
+
+// replayExchange is a recorded command and the response of the TPM.
+type replayExchange struct {
+	record   *TraceRecord
+	command  []byte
+	response []byte
+	replayed bool
+}
+
+// ReplayForwarderFactory is a ForwarderFactory that creates ReplayForwarders
+// answering the commands with the responses recorded by TraceRecorder,
+// without a TPM.
+// The commands are matched to the Request of the records, which is the
+// command after Interceptor of the recording, as sent to the TPM. They are
+// answered with the responses of the TPM: the OriginalResponse of the records
+// modified by Interceptor, the Response of the others.
+// The blocked commands are not replayed, and the other records must have a
+// response.
+// The forwarders share the recording: each recorded exchange is replayed
+// once, whichever connection the command comes from.
+type ReplayForwarderFactory struct {
+	// Mode is the matching mode.
+	Mode ReplayMode
+
+	mu        sync.Mutex
+	exchanges []*replayExchange
+	replayed  int
+	err       error
+}
+
+// NewReplayForwarderFactory creates a new ReplayForwarderFactory replaying
+// the records.
+func NewReplayForwarderFactory(records []*TraceRecord, mode ReplayMode) (*ReplayForwarderFactory, error) {
+	f := &ReplayForwarderFactory{Mode: mode}
+	for i, rec := range records {
+		if rec.Blocked {
+			continue
+		}
+		command, err := hex.DecodeString(rec.Request)
+		if err != nil {
+			return nil, fmt.Errorf("record %d: request: %w", i, err)
+		}
+		response := rec.Response
+		if rec.OriginalResponse != "" {
+			response = rec.OriginalResponse
+		}
+		ex := &replayExchange{record: rec, command: command}
+		if ex.response, err = hex.DecodeString(response); err != nil {
+			return nil, fmt.Errorf("record %d: response: %w", i, err)
+		}
+		// an empty response would never be read
+		if len(ex.response) < TpmHeaderSize {
+			return nil, fmt.Errorf("record %d: response of %d bytes", i, len(ex.response))
+		}
+		f.exchanges = append(f.exchanges, ex)
+	}
+	return f, nil
+}
+
+// Err returns the first divergence from the recording.
+func (f *ReplayForwarderFactory) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// Remaining returns the number of recorded exchanges not replayed yet.
+func (f *ReplayForwarderFactory) Remaining() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.exchanges) - f.replayed
+}
+
+// NewForwarder creates a new ReplayForwarder.
+func (f *ReplayForwarderFactory) NewForwarder() (Forwarder, error) {
+	r := &ReplayForwarder{factory: f}
+	r.cond = sync.NewCond(&r.mu)
+	return r, nil
+}
+
+// replay returns the recorded response to the command.
+func (f *ReplayForwarderFactory) replay(command []byte) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var next *replayExchange
+	for _, ex := range f.exchanges {
+		if !ex.replayed {
+			next = ex
+			break
+		}
+	}
+	match := next
+	switch f.Mode {
+	case ReplayStrict:
+		if next != nil && !bytes.Equal(next.command, command) {
+			match = nil
+		}
+	default:
+		match = nil
+		for _, ex := range f.exchanges {
+			if !ex.replayed && f.matches(ex.command, command) {
+				match = ex
+				break
+			}
+		}
+	}
+
+	if match == nil {
+		err := &ReplayDivergenceError{
+			Mode:    f.Mode,
+			Index:   f.replayed,
+			Command: bytes.Clone(command),
+		}
+		if next != nil {
+			err.Expected = next.record
+		}
+		if f.err == nil {
+			f.err = err
+		}
+		return nil, err
+	}
+	match.replayed = true
+	f.replayed++
+	return match.response, nil
+}
+
+// matches reports whether the command matches the recorded one.
+func (f *ReplayForwarderFactory) matches(recorded, command []byte) bool {
+	if f.Mode == ReplayByCommand {
+		return bytes.Equal(recorded, command)
+	}
+	if len(recorded) < TpmHeaderSize || len(command) < TpmHeaderSize ||
+		!bytes.Equal(recorded[6:10], command[6:10]) {
+		return false
+	}
+	n := TpmHeaderSize
+	cc := tpm2.TPMCC(binary.BigEndian.Uint32(command[6:10]))
+	if t := LookupCommand(cc); t != nil {
+		n += 4 * commandHandles(t.NewCommand())
+	} else if handles := schemaHandles(cc); handles > 0 {
+		n += 4 * handles
+	}
+	if len(recorded) < n || len(command) < n {
+		return len(recorded) == len(command)
+	}
+	return bytes.Equal(recorded[TpmHeaderSize:n], command[TpmHeaderSize:n])
+}
+
+// ReplayForwarder is a Forwarder that answers the commands with the recorded
+// responses of its ReplayForwarderFactory.
+// Writing a command that diverges from the recording fails with a
+// *ReplayDivergenceError, which ends the exchange.
+type ReplayForwarder struct {
+	factory *ReplayForwarderFactory
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []byte
+	closed  bool
+}
+
+// Write handles a complete TPM command.
+func (r *ReplayForwarder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, net.ErrClosed
+	}
+	response, err := r.factory.replay(p)
+	if err != nil {
+		return 0, err
+	}
+	r.pending = append(r.pending, response...)
+	r.cond.Broadcast()
+	return len(p), nil
+}
+
+// Read reads the responses of the commands written so far.
+func (r *ReplayForwarder) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for len(r.pending) == 0 && !r.closed {
+		r.cond.Wait()
+	}
+	if len(r.pending) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *ReplayForwarder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	r.cond.Broadcast()
+	return nil
+}
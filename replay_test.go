@@ -0,0 +1,99 @@
+package tpmproxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestReplayForwarder(t *testing.T) {
+	getRandom := []byte{0x80, 0x01, 0, 0, 0, 0x0c, 0, 0, 0x01, 0x7b, 0, 4}
+	randomResponse := []byte{0x80, 0x01, 0, 0, 0, 0x10, 0, 0, 0, 0, 0, 4, 1, 2, 3, 4}
+	flush := []byte{0x80, 0x01, 0, 0, 0, 0x0e, 0, 0, 0x01, 0x65, 0x80, 0, 0, 1}
+	flushResponse := []byte{0x80, 0x01, 0, 0, 0, 0x0a, 0, 0, 0, 0}
+
+	var buf bytes.Buffer
+	recorder := NewTraceRecorder(&buf, &tamperingInterceptor{})
+	for _, ex := range [][2][]byte{{getRandom, randomResponse}, {flush, flushResponse}} {
+		h := (&TpmRequestResponseHandlerFactory{Interceptor: recorder}).NewRequestResponseHandler()
+		h.HandleRequest(ex[0])
+		h.HandleResponse(ex[1])
+	}
+	records, err := ReadTrace(&buf)
+	if err != nil || len(records) != 2 {
+		t.Fatalf("%d records: %v", len(records), err)
+	}
+
+	exchange := func(fwd Forwarder, command []byte) ([]byte, error) {
+		if _, err := fwd.Write(command); err != nil {
+			return nil, err
+		}
+		return NewTpmMessageReader(fwd, 0).ReadMessage()
+	}
+	otherFlush := bytes.Clone(flush)
+	otherFlush[13] = 2
+	otherRandom := bytes.Clone(getRandom)
+	otherRandom[11] = 8
+
+	for _, test := range []struct {
+		mode     ReplayMode
+		commands [][]byte
+		diverge  int
+	}{
+		{ReplayStrict, [][]byte{getRandom, flush}, -1},
+		{ReplayStrict, [][]byte{flush}, 0},
+		{ReplayByCommand, [][]byte{flush, getRandom}, -1},
+		{ReplayByCommand, [][]byte{otherRandom}, 0},
+		{ReplayByCommandCode, [][]byte{flush, otherRandom}, -1},
+		{ReplayByCommandCode, [][]byte{getRandom, otherFlush}, 1},
+		{ReplayByCommandCode, [][]byte{getRandom, flush, getRandom}, 2},
+	} {
+		f, err := NewReplayForwarderFactory(records, test.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fwd, _ := f.NewForwarder()
+		for i, command := range test.commands {
+			response, err := exchange(fwd, command)
+			if i == test.diverge {
+				var divergence *ReplayDivergenceError
+				if !errors.As(err, &divergence) || divergence.Index != i || f.Err() != err {
+					t.Errorf("%v, command %d: %v", test.mode, i, err)
+				}
+				break
+			}
+			if err != nil {
+				t.Fatalf("%v, command %d: %v", test.mode, i, err)
+			}
+			// the responses of the TPM are replayed, not the tampered ones
+			want := randomResponse
+			if command[9] == flush[9] {
+				want = flushResponse
+			}
+			if !bytes.Equal(response, want) {
+				t.Errorf("%v, command %d: response %x", test.mode, i, response)
+			}
+		}
+		if test.diverge < 0 && f.Remaining() != 0 {
+			t.Errorf("%v: %d remaining", test.mode, f.Remaining())
+		}
+		fwd.Close()
+		if _, err := fwd.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("read after close: %v", err)
+		}
+	}
+}
+
+func TestReplayForwarderFactoryNoResponse(t *testing.T) {
+	records := []*TraceRecord{
+		{Request: "80010000000c0000017b0004", Response: "", Blocked: true},
+		{Request: "80010000000c0000017b0004", Response: ""},
+	}
+	if _, err := NewReplayForwarderFactory(records, ReplayStrict); err == nil {
+		t.Error("record without a response accepted")
+	}
+	if _, err := NewReplayForwarderFactory(records[:1], ReplayStrict); err != nil {
+		t.Errorf("blocked record: %v", err)
+	}
+}
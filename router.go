@@ -0,0 +1,120 @@
+package tpmproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// Router is an Interceptor that passes the decoded commands and responses to
+// the handlers registered with OnRequest and OnResponse for their command
+// code. The messages are rebuilt from the structures modified by the handlers
+// with RoughParser.RebuildCommand and RebuildResponse.
+type Router struct {
+	mu        sync.RWMutex
+	requests  map[tpm2.TPMCC]func(raw []byte) ([]byte, error)
+	responses map[tpm2.TPMCC]func(request *Request, response []byte) ([]byte, error)
+}
+
+// NewRouter creates a new Router without handlers.
+func NewRouter() *Router {
+	return &Router{
+		requests:  make(map[tpm2.TPMCC]func(raw []byte) ([]byte, error)),
+		responses: make(map[tpm2.TPMCC]func(request *Request, response []byte) ([]byte, error)),
+	}
+}
+
+// OnRequest registers the handler of the commands C, replacing the one
+// registered before. The handler may modify the command.
+// If it returns an error, the command is forwarded unmodified.
+func OnRequest[C tpm2.Command[R, *R], R any](r *Router, handler func(cmd *C) error) {
+	var c C
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests[c.Command()] = func(raw []byte) ([]byte, error) {
+		cmd := new(C)
+		p := RoughParser{RawRequest: raw, Cmd: cmd}
+		if err := p.ParseCommand(); err != nil {
+			return nil, err
+		}
+		if err := checkRoundTrip(raw, p.RebuildCommand); err != nil {
+			return nil, err
+		}
+		if err := handler(cmd); err != nil {
+			return nil, err
+		}
+		return p.RebuildCommand()
+	}
+}
+
+// OnResponse registers the handler of the responses to the commands C,
+// replacing the one registered before. The handler receives the command as
+// received and may modify the response. It is not called for error
+// responses.
+// If it returns an error, the response is returned unmodified.
+func OnResponse[C tpm2.Command[R, *R], R any](r *Router, handler func(cmd *C, rsp *R) error) {
+	var c C
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.responses[c.Command()] = func(request *Request, response []byte) ([]byte, error) {
+		cmd, rsp := new(C), new(R)
+		p := RoughParser{RawRequest: request.Raw, RawResponse: response, Cmd: cmd, Rsp: rsp}
+		if err := p.Parse(); err != nil {
+			return nil, err
+		}
+		if err := checkRoundTrip(response, p.RebuildResponse); err != nil {
+			return nil, err
+		}
+		if err := handler(cmd, rsp); err != nil {
+			return nil, err
+		}
+		return p.RebuildResponse()
+	}
+}
+
+func (r *Router) HandleRequest(request *Request) []byte {
+	r.mu.RLock()
+	handler := r.requests[request.Hdr.CommandCode]
+	r.mu.RUnlock()
+	if handler == nil {
+		return request.Raw
+	}
+	modified, err := handler(request.Raw)
+	if err != nil {
+		log.Printf("%s request handler: %v\n", CommandName(request.Hdr.CommandCode), err)
+		return request.Raw
+	}
+	return modified
+}
+
+func (r *Router) HandleResponse(request *Request, response []byte) []byte {
+	r.mu.RLock()
+	handler := r.responses[request.Hdr.CommandCode]
+	r.mu.RUnlock()
+	if handler == nil || len(response) < TpmHeaderSize ||
+		binary.BigEndian.Uint32(response[6:10]) != uint32(tpm2.TPMRCSuccess) {
+		return response
+	}
+	modified, err := handler(request, response)
+	if err != nil {
+		log.Printf("%s response handler: %v\n", CommandName(request.Hdr.CommandCode), err)
+		return response
+	}
+	return modified
+}
+
+// checkRoundTrip checks that rebuilding the parsed message gives it back, so that the parts not parsed are not lost.
+func checkRoundTrip(raw []byte, rebuild func() ([]byte, error)) error {
+	b, err := rebuild()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(b, raw) {
+		return fmt.Errorf("the message is not parsed completely")
+	}
+	return nil
+}
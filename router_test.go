@@ -0,0 +1,80 @@
+package tpmproxy
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+func TestRouter(t *testing.T) {
+	router := NewRouter()
+	OnRequest(router, func(cmd *tpm2.GetRandom) error {
+		cmd.BytesRequested = 8
+		return nil
+	})
+	OnResponse(router, func(cmd *tpm2.GetCapability, rsp *tpm2.GetCapabilityResponse) error {
+		props, err := rsp.CapabilityData.Data.TPMProperties()
+		if err != nil {
+			return err
+		}
+		props.TPMProperty = append(props.TPMProperty, tpm2.TPMSTaggedProperty{
+			Property: tpm2.TPMPTVendorString1,
+			Value:    0x41424344,
+		})
+		return nil
+	})
+	OnResponse(router, func(cmd *tpm2.Unseal, rsp *tpm2.UnsealResponse) error {
+		rsp.OutData.Buffer = []byte("hello")
+		return nil
+	})
+	exchange := func(command, response []byte) ([]byte, []byte) {
+		h := (&TpmRequestResponseHandlerFactory{Interceptor: router}).NewRequestResponseHandler()
+		return h.HandleRequest(command), h.HandleResponse(response)
+	}
+
+	// a modified command
+	command, _ := exchange([]byte{0x80, 0x01, 0, 0, 0, 0x0c, 0, 0, 0x01, 0x7b, 0, 4}, nil)
+	if !bytes.Equal(command, []byte{0x80, 0x01, 0, 0, 0, 0x0c, 0, 0, 0x01, 0x7b, 0, 8}) {
+		t.Errorf("GetRandom: %x", command)
+	}
+
+	// a response growing
+	command = []byte{0x80, 0x01, 0, 0, 0, 0x16, 0, 0, 0x01, 0x7a, 0, 0, 0, 6, 0, 0, 1, 5, 0, 0, 0, 1}
+	var parms bytes.Buffer
+	Marshal(&parms, reflect.ValueOf(tpm2.TPMIYesNo(false)))
+	Marshal(&parms, reflect.ValueOf(tpm2.TPMSCapabilityData{
+		Capability: tpm2.TPMCapTPMProperties,
+		Data: tpm2.NewTPMUCapabilities(tpm2.TPMCapTPMProperties, &tpm2.TPMLTaggedTPMProperty{
+			TPMProperty: []tpm2.TPMSTaggedProperty{{Property: tpm2.TPMPTManufacturer, Value: 0x49424d00}},
+		}),
+	}))
+	response := append([]byte{0x80, 0x01, 0, 0, 0, 0, 0, 0, 0, 0}, parms.Bytes()...)
+	_, response = exchange(command, setMessageSize(response))
+	_, rsp, err := Decode(command, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	props, _ := rsp.(*tpm2.GetCapabilityResponse).CapabilityData.Data.TPMProperties()
+	if len(props.TPMProperty) != 2 || props.TPMProperty[1].Value != 0x41424344 {
+		t.Errorf("GetCapability: %x", response)
+	}
+
+	// a response with sessions, whose auth area is kept
+	command = []byte{0x80, 0x02, 0, 0, 0, 0x1b, 0, 0, 0x01, 0x5e, 0x80, 0, 0, 1,
+		0, 0, 0, 9, 0x40, 0, 0, 9, 0, 0, 1, 0, 0}
+	response = []byte{0x80, 0x02, 0, 0, 0, 0x17, 0, 0, 0, 0, 0, 0, 0, 4, 0, 2, 0xaa, 0xbb, 0, 0, 1, 0, 0}
+	_, response = exchange(command, response)
+	want := append([]byte{0x80, 0x02, 0, 0, 0, 0x1a, 0, 0, 0, 0, 0, 0, 0, 7, 0, 5}, []byte("hello")...)
+	want = append(want, 0, 0, 1, 0, 0)
+	if !bytes.Equal(response, want) {
+		t.Errorf("Unseal: %x", response)
+	}
+
+	// error responses are not handled
+	errorResponse := []byte{0x80, 0x01, 0, 0, 0, 0x0a, 0, 0, 0x01, 0x01}
+	if _, response = exchange(command, errorResponse); !bytes.Equal(response, errorResponse) {
+		t.Errorf("error response: %x", response)
+	}
+}
@@ -0,0 +1,543 @@
+package tpmproxy
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// SchemaField is a field of a command or response decoded by the layouts of
+// TPM 2.0 Part 3: Commands, for the commands without registered structures.
+// The fields of structures, sized structures, lists and unions are in Fields,
+// and those of the other types have Value: an integer, or a hex string for
+// handles and byte strings.
+type SchemaField struct {
+	// Name is the name of the field in the specification, such as
+	// "pcrAllocation", or "[0]" for the elements of a list.
+	Name string `json:"name"`
+	// Type is the TPM type of the field, such as "TPML_PCR_SELECTION".
+	Type string `json:"type"`
+	// Offset is the offset of the field in the command or response.
+	Offset int `json:"offset"`
+	// Length is the length of the field in bytes.
+	Length int `json:"length"`
+	// Value is the value of the field.
+	Value any `json:"value,omitempty"`
+	// Fields are the fields of the field.
+	Fields []*SchemaField `json:"fields,omitempty"`
+}
+
+// Field returns the field of the name, or nil if there is none.
+func (f *SchemaField) Field(name string) *SchemaField {
+	for _, c := range f.Fields {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// commandSchema is the layout of a command and its response.
+type commandSchema struct {
+	name               string
+	handles            schemaStruct
+	parameters         schemaStruct
+	responseHandles    schemaStruct
+	responseParameters schemaStruct
+}
+
+func schema(name, handles, parameters, responseHandles, responseParameters string) *commandSchema {
+	return &commandSchema{
+		name:               name,
+		handles:            members(handles),
+		parameters:         members(parameters),
+		responseHandles:    members(responseHandles),
+		responseParameters: members(responseParameters),
+	}
+}
+
+const (
+	authHandles = "authHandle:TPMI_RH_NV_AUTH nvIndex:TPMI_RH_NV_INDEX"
+	create      = "inSensitive:TPM2B_SENSITIVE_CREATE inPublic:TPM2B_PUBLIC outsideInfo:TPM2B_DATA creationPCR:TPML_PCR_SELECTION"
+	created     = "outPublic:TPM2B_PUBLIC creationData:TPM2B_CREATION_DATA creationHash:TPM2B_DIGEST creationTicket:TPMT_TK_CREATION"
+	attest      = "qualifyingData:TPM2B_DATA inScheme:TPMT_SIG_SCHEME"
+	policy      = "policySession:TPMI_SH_POLICY"
+	policyTimer = "timeout:TPM2B_TIMEOUT policyTicket:TPMT_TK_AUTH"
+)
+
+// commandSchemas are the layouts of the commands of TPM 2.0 Part 3: Commands.
+var commandSchemas = map[tpm2.TPMCC]*commandSchema{
+	tpm2.TPMCCNVUndefineSpaceSpecial:     schema("NV_UndefineSpaceSpecial", "nvIndex:TPMI_RH_NV_INDEX platform:TPMI_RH_PLATFORM", "", "", ""),
+	tpm2.TPMCCEvictControl:               schema("EvictControl", "auth:TPMI_RH_PROVISION objectHandle:TPMI_DH_OBJECT", "persistentHandle:TPMI_DH_PERSISTENT", "", ""),
+	tpm2.TPMCCHierarchyControl:           schema("HierarchyControl", "authHandle:TPMI_RH_HIERARCHY", "enable:TPMI_RH_ENABLES state:TPMI_YES_NO", "", ""),
+	tpm2.TPMCCNVUndefineSpace:            schema("NV_UndefineSpace", "authHandle:TPMI_RH_PROVISION nvIndex:TPMI_RH_NV_INDEX", "", "", ""),
+	tpm2.TPMCCChangeEPS:                  schema("ChangeEPS", "authHandle:TPMI_RH_PLATFORM", "", "", ""),
+	tpm2.TPMCCChangePPS:                  schema("ChangePPS", "authHandle:TPMI_RH_PLATFORM", "", "", ""),
+	tpm2.TPMCCClear:                      schema("Clear", "authHandle:TPMI_RH_CLEAR", "", "", ""),
+	tpm2.TPMCCClearControl:               schema("ClearControl", "auth:TPMI_RH_CLEAR", "disable:TPMI_YES_NO", "", ""),
+	tpm2.TPMCCClockSet:                   schema("ClockSet", "auth:TPMI_RH_PROVISION", "newTime:UINT64", "", ""),
+	tpm2.TPMCCHierarchyChanegAuth:        schema("HierarchyChangeAuth", "authHandle:TPMI_RH_HIERARCHY_AUTH", "newAuth:TPM2B_AUTH", "", ""),
+	tpm2.TPMCCNVDefineSpace:              schema("NV_DefineSpace", "authHandle:TPMI_RH_PROVISION", "auth:TPM2B_AUTH publicInfo:TPM2B_NV_PUBLIC", "", ""),
+	tpm2.TPMCCPCRAllocate:                schema("PCR_Allocate", "authHandle:TPMI_RH_PLATFORM", "pcrAllocation:TPML_PCR_SELECTION", "", "allocationSuccess:TPMI_YES_NO maxPCR:UINT32 sizeNeeded:UINT32 sizeAvailable:UINT32"),
+	tpm2.TPMCCPCRSetAuthPolicy:           schema("PCR_SetAuthPolicy", "authHandle:TPMI_RH_PLATFORM", "authPolicy:TPM2B_DIGEST hashAlg:TPMI_ALG_HASH pcrNum:TPMI_DH_PCR", "", ""),
+	tpm2.TPMCCPPCommands:                 schema("PP_Commands", "auth:TPMI_RH_PLATFORM", "setList:TPML_CC clearList:TPML_CC", "", ""),
+	tpm2.TPMCCSetPrimaryPolicy:           schema("SetPrimaryPolicy", "authHandle:TPMI_RH_HIERARCHY_POLICY", "authPolicy:TPM2B_DIGEST hashAlg:TPMI_ALG_HASH", "", ""),
+	tpm2.TPMCCFieldUpgradeStart:          schema("FieldUpgradeStart", "authorization:TPMI_RH_PLATFORM keyHandle:TPMI_DH_OBJECT", "fuDigest:TPM2B_DIGEST manifestSignature:TPMT_SIGNATURE", "", ""),
+	tpm2.TPMCCClockRateAdjust:            schema("ClockRateAdjust", "auth:TPMI_RH_PROVISION", "rateAdjust:TPM_CLOCK_ADJUST", "", ""),
+	tpm2.TPMCCCreatePrimary:              schema("CreatePrimary", "primaryHandle:TPMI_RH_HIERARCHY", create, "objectHandle:TPM_HANDLE", created+" name:TPM2B_NAME"),
+	tpm2.TPMCCNVGlobalWriteLock:          schema("NV_GlobalWriteLock", "authHandle:TPMI_RH_PROVISION", "", "", ""),
+	tpm2.TPMCCGetCommandAuditDigest:      schema("GetCommandAuditDigest", "privacyHandle:TPMI_RH_ENDORSEMENT signHandle:TPMI_DH_OBJECT", attest, "", "auditInfo:TPM2B_ATTEST signature:TPMT_SIGNATURE"),
+	tpm2.TPMCCNVIncrement:                schema("NV_Increment", authHandles, "", "", ""),
+	tpm2.TPMCCNVSetBits:                  schema("NV_SetBits", authHandles, "bits:UINT64", "", ""),
+	tpm2.TPMCCNVExtend:                   schema("NV_Extend", authHandles, "data:TPM2B_MAX_NV_BUFFER", "", ""),
+	tpm2.TPMCCNVWrite:                    schema("NV_Write", authHandles, "data:TPM2B_MAX_NV_BUFFER offset:UINT16", "", ""),
+	tpm2.TPMCCNVWriteLock:                schema("NV_WriteLock", authHandles, "", "", ""),
+	tpm2.TPMCCDictionaryAttackLockReset:  schema("DictionaryAttackLockReset", "lockHandle:TPMI_RH_LOCKOUT", "", "", ""),
+	tpm2.TPMCCDictionaryAttackParameters: schema("DictionaryAttackParameters", "lockHandle:TPMI_RH_LOCKOUT", "newMaxTries:UINT32 newRecoveryTime:UINT32 lockoutRecovery:UINT32", "", ""),
+	tpm2.TPMCCNVChangeAuth:               schema("NV_ChangeAuth", "nvIndex:TPMI_RH_NV_INDEX", "newAuth:TPM2B_AUTH", "", ""),
+	tpm2.TPMCCPCREvent:                   schema("PCR_Event", "pcrHandle:TPMI_DH_PCR", "eventData:TPM2B_EVENT", "", "digests:TPML_DIGEST_VALUES"),
+	tpm2.TPMCCPCRReset:                   schema("PCR_Reset", "pcrHandle:TPMI_DH_PCR", "", "", ""),
+	tpm2.TPMCCSequenceComplete:           schema("SequenceComplete", "sequenceHandle:TPMI_DH_OBJECT", "buffer:TPM2B_MAX_BUFFER hierarchy:TPMI_RH_HIERARCHY", "", "result:TPM2B_DIGEST validation:TPMT_TK_HASHCHECK"),
+	tpm2.TPMCCSetAlgorithmSet:            schema("SetAlgorithmSet", "authHandle:TPMI_RH_PLATFORM", "algorithmSet:UINT32", "", ""),
+	tpm2.TPMCCSetCommandCodeAuditStatus:  schema("SetCommandCodeAuditStatus", "auth:TPMI_RH_PROVISION", "auditAlg:TPMI_ALG_HASH setList:TPML_CC clearList:TPML_CC", "", ""),
+	tpm2.TPMCCFieldUpgradeData:           schema("FieldUpgradeData", "", "fuData:TPM2B_MAX_BUFFER", "", "nextDigest:TPMT_HA firstDigest:TPMT_HA"),
+	tpm2.TPMCCIncrementalSelfTest:        schema("IncrementalSelfTest", "", "toTest:TPML_ALG", "", "toDoList:TPML_ALG"),
+	tpm2.TPMCCSelfTest:                   schema("SelfTest", "", "fullTest:TPMI_YES_NO", "", ""),
+	tpm2.TPMCCStartup:                    schema("Startup", "", "startupType:TPM_SU", "", ""),
+	tpm2.TPMCCShutdown:                   schema("Shutdown", "", "shutdownType:TPM_SU", "", ""),
+	tpm2.TPMCCStirRandom:                 schema("StirRandom", "", "inData:TPM2B_SENSITIVE_DATA", "", ""),
+	tpm2.TPMCCActivateCredential:         schema("ActivateCredential", "activateHandle:TPMI_DH_OBJECT keyHandle:TPMI_DH_OBJECT", "credentialBlob:TPM2B_ID_OBJECT secret:TPM2B_ENCRYPTED_SECRET", "", "certInfo:TPM2B_DIGEST"),
+	tpm2.TPMCCCertify:                    schema("Certify", "objectHandle:TPMI_DH_OBJECT signHandle:TPMI_DH_OBJECT", attest, "", "certifyInfo:TPM2B_ATTEST signature:TPMT_SIGNATURE"),
+	tpm2.TPMCCPolicyNV:                   schema("PolicyNV", authHandles+" "+policy, "operandB:TPM2B_OPERAND offset:UINT16 operation:TPM_EO", "", ""),
+	tpm2.TPMCCCertifyCreation:            schema("CertifyCreation", "signHandle:TPMI_DH_OBJECT objectHandle:TPMI_DH_OBJECT", "qualifyingData:TPM2B_DATA creationHash:TPM2B_DIGEST inScheme:TPMT_SIG_SCHEME creationTicket:TPMT_TK_CREATION", "", "certifyInfo:TPM2B_ATTEST signature:TPMT_SIGNATURE"),
+	tpm2.TPMCCDuplicate:                  schema("Duplicate", "objectHandle:TPMI_DH_OBJECT newParentHandle:TPMI_DH_OBJECT", "encryptionKeyIn:TPM2B_DATA symmetricAlg:TPMT_SYM_DEF_OBJECT", "", "encryptionKeyOut:TPM2B_DATA duplicate:TPM2B_PRIVATE outSymSeed:TPM2B_ENCRYPTED_SECRET"),
+	tpm2.TPMCCGetTime:                    schema("GetTime", "privacyAdminHandle:TPMI_RH_ENDORSEMENT signHandle:TPMI_DH_OBJECT", attest, "", "timeInfo:TPM2B_ATTEST signature:TPMT_SIGNATURE"),
+	tpm2.TPMCCGetSessionAuditDigest:      schema("GetSessionAuditDigest", "privacyAdminHandle:TPMI_RH_ENDORSEMENT signHandle:TPMI_DH_OBJECT sessionHandle:TPMI_SH_HMAC", attest, "", "auditInfo:TPM2B_ATTEST signature:TPMT_SIGNATURE"),
+	tpm2.TPMCCNVRead:                     schema("NV_Read", authHandles, "size:UINT16 offset:UINT16", "", "data:TPM2B_MAX_NV_BUFFER"),
+	tpm2.TPMCCNVReadLock:                 schema("NV_ReadLock", authHandles, "", "", ""),
+	tpm2.TPMCCObjectChangeAuth:           schema("ObjectChangeAuth", "objectHandle:TPMI_DH_OBJECT parentHandle:TPMI_DH_OBJECT", "newAuth:TPM2B_AUTH", "", "outPrivate:TPM2B_PRIVATE"),
+	tpm2.TPMCCPolicySecret:               schema("PolicySecret", "authHandle:TPMI_DH_ENTITY "+policy, "nonceTPM:TPM2B_NONCE cpHashA:TPM2B_DIGEST policyRef:TPM2B_NONCE expiration:INT32", "", policyTimer),
+	tpm2.TPMCCRewrap:                     schema("Rewrap", "oldParent:TPMI_DH_OBJECT newParent:TPMI_DH_OBJECT", "inDuplicate:TPM2B_PRIVATE name:TPM2B_NAME inSymSeed:TPM2B_ENCRYPTED_SECRET", "", "outDuplicate:TPM2B_PRIVATE outSymSeed:TPM2B_ENCRYPTED_SECRET"),
+	tpm2.TPMCCCreate:                     schema("Create", "parentHandle:TPMI_DH_OBJECT", create, "", "outPrivate:TPM2B_PRIVATE "+created),
+	tpm2.TPMCCECDHZGen:                   schema("ECDH_ZGen", "keyHandle:TPMI_DH_OBJECT", "inPoint:TPM2B_ECC_POINT", "", "outPoint:TPM2B_ECC_POINT"),
+	tpm2.TPMCCMAC:                        schema("HMAC", "handle:TPMI_DH_OBJECT", "buffer:TPM2B_MAX_BUFFER hashAlg:TPMI_ALG_HASH", "", "outHMAC:TPM2B_DIGEST"),
+	tpm2.TPMCCImport:                     schema("Import", "parentHandle:TPMI_DH_OBJECT", "encryptionKey:TPM2B_DATA objectPublic:TPM2B_PUBLIC duplicate:TPM2B_PRIVATE inSymSeed:TPM2B_ENCRYPTED_SECRET symmetricAlg:TPMT_SYM_DEF_OBJECT", "", "outPrivate:TPM2B_PRIVATE"),
+	tpm2.TPMCCLoad:                       schema("Load", "parentHandle:TPMI_DH_OBJECT", "inPrivate:TPM2B_PRIVATE inPublic:TPM2B_PUBLIC", "objectHandle:TPM_HANDLE", "name:TPM2B_NAME"),
+	tpm2.TPMCCQuote:                      schema("Quote", "signHandle:TPMI_DH_OBJECT", attest+" PCRselect:TPML_PCR_SELECTION", "", "quoted:TPM2B_ATTEST signature:TPMT_SIGNATURE"),
+	tpm2.TPMCCRSADecrypt:                 schema("RSA_Decrypt", "keyHandle:TPMI_DH_OBJECT", "cipherText:TPM2B_PUBLIC_KEY_RSA inScheme:TPMT_RSA_DECRYPT label:TPM2B_DATA", "", "message:TPM2B_PUBLIC_KEY_RSA"),
+	tpm2.TPMCCMACStart:                   schema("HMAC_Start", "handle:TPMI_DH_OBJECT", "auth:TPM2B_AUTH hashAlg:TPMI_ALG_HASH", "sequenceHandle:TPMI_DH_OBJECT", ""),
+	tpm2.TPMCCSequenceUpdate:             schema("SequenceUpdate", "sequenceHandle:TPMI_DH_OBJECT", "buffer:TPM2B_MAX_BUFFER", "", ""),
+	tpm2.TPMCCSign:                       schema("Sign", "keyHandle:TPMI_DH_OBJECT", "digest:TPM2B_DIGEST inScheme:TPMT_SIG_SCHEME validation:TPMT_TK_HASHCHECK", "", "signature:TPMT_SIGNATURE"),
+	tpm2.TPMCCUnseal:                     schema("Unseal", "itemHandle:TPMI_DH_OBJECT", "", "", "outData:TPM2B_SENSITIVE_DATA"),
+	tpm2.TPMCCPolicySigned:               schema("PolicySigned", "authObject:TPMI_DH_OBJECT "+policy, "nonceTPM:TPM2B_NONCE cpHashA:TPM2B_DIGEST policyRef:TPM2B_NONCE expiration:INT32 auth:TPMT_SIGNATURE", "", policyTimer),
+	tpm2.TPMCCContextLoad:                schema("ContextLoad", "", "context:TPMS_CONTEXT", "loadedHandle:TPMI_DH_CONTEXT", ""),
+	tpm2.TPMCCContextSave:                schema("ContextSave", "saveHandle:TPMI_DH_CONTEXT", "", "", "context:TPMS_CONTEXT"),
+	tpm2.TPMCCECDHKeyGen:                 schema("ECDH_KeyGen", "keyHandle:TPMI_DH_OBJECT", "", "", "zPoint:TPM2B_ECC_POINT pubPoint:TPM2B_ECC_POINT"),
+	tpm2.TPMCCEncryptDecrypt:             schema("EncryptDecrypt", "keyHandle:TPMI_DH_OBJECT", "decrypt:TPMI_YES_NO mode:TPMI_ALG_CIPHER_MODE ivIn:TPM2B_IV inData:TPM2B_MAX_BUFFER", "", "outData:TPM2B_MAX_BUFFER ivOut:TPM2B_IV"),
+	tpm2.TPMCCFlushContext:               schema("FlushContext", "", "flushHandle:TPMI_DH_CONTEXT", "", ""),
+	tpm2.TPMCCLoadExternal:               schema("LoadExternal", "", "inPrivate:TPM2B_SENSITIVE inPublic:TPM2B_PUBLIC hierarchy:TPMI_RH_HIERARCHY", "objectHandle:TPM_HANDLE", "name:TPM2B_NAME"),
+	tpm2.TPMCCMakeCredential:             schema("MakeCredential", "handle:TPMI_DH_OBJECT", "credential:TPM2B_DIGEST objectName:TPM2B_NAME", "", "credentialBlob:TPM2B_ID_OBJECT secret:TPM2B_ENCRYPTED_SECRET"),
+	tpm2.TPMCCNVReadPublic:               schema("NV_ReadPublic", "nvIndex:TPMI_RH_NV_INDEX", "", "", "nvPublic:TPM2B_NV_PUBLIC nvName:TPM2B_NAME"),
+	tpm2.TPMCCPolicyAuthorize:            schema("PolicyAuthorize", policy, "approvedPolicy:TPM2B_DIGEST policyRef:TPM2B_NONCE keySign:TPM2B_NAME checkTicket:TPMT_TK_VERIFIED", "", ""),
+	tpm2.TPMCCPolicyAuthValue:            schema("PolicyAuthValue", policy, "", "", ""),
+	tpm2.TPMCCPolicyCommandCode:          schema("PolicyCommandCode", policy, "code:TPM_CC", "", ""),
+	tpm2.TPMCCPolicyCounterTimer:         schema("PolicyCounterTimer", policy, "operandB:TPM2B_OPERAND offset:UINT16 operation:TPM_EO", "", ""),
+	tpm2.TPMCCPolicyCpHash:               schema("PolicyCpHash", policy, "cpHashA:TPM2B_DIGEST", "", ""),
+	tpm2.TPMCCPolicyLocality:             schema("PolicyLocality", policy, "locality:TPMA_LOCALITY", "", ""),
+	tpm2.TPMCCPolicyNameHash:             schema("PolicyNameHash", policy, "nameHash:TPM2B_DIGEST", "", ""),
+	tpm2.TPMCCPolicyOR:                   schema("PolicyOR", policy, "pHashList:TPML_DIGEST", "", ""),
+	tpm2.TPMCCPolicyTicket:               schema("PolicyTicket", policy, "timeout:TPM2B_TIMEOUT cpHashA:TPM2B_DIGEST policyRef:TPM2B_NONCE authName:TPM2B_NAME ticket:TPMT_TK_AUTH", "", ""),
+	tpm2.TPMCCReadPublic:                 schema("ReadPublic", "objectHandle:TPMI_DH_OBJECT", "", "", "outPublic:TPM2B_PUBLIC name:TPM2B_NAME qualifiedName:TPM2B_NAME"),
+	tpm2.TPMCCRSAEncrypt:                 schema("RSA_Encrypt", "keyHandle:TPMI_DH_OBJECT", "message:TPM2B_PUBLIC_KEY_RSA inScheme:TPMT_RSA_DECRYPT label:TPM2B_DATA", "", "outData:TPM2B_PUBLIC_KEY_RSA"),
+	tpm2.TPMCCStartAuthSession:           schema("StartAuthSession", "tpmKey:TPMI_DH_OBJECT bind:TPMI_DH_ENTITY", "nonceCaller:TPM2B_NONCE encryptedSalt:TPM2B_ENCRYPTED_SECRET sessionType:TPM_SE symmetric:TPMT_SYM_DEF authHash:TPMI_ALG_HASH", "sessionHandle:TPMI_SH_AUTH_SESSION", "nonceTPM:TPM2B_NONCE"),
+	tpm2.TPMCCVerifySignature:            schema("VerifySignature", "keyHandle:TPMI_DH_OBJECT", "digest:TPM2B_DIGEST signature:TPMT_SIGNATURE", "", "validation:TPMT_TK_VERIFIED"),
+	tpm2.TPMCCECCParameters:              schema("ECC_Parameters", "", "curveID:TPMI_ECC_CURVE", "", "parameters:TPMS_ALGORITHM_DETAIL_ECC"),
+	tpm2.TPMCCFirmwareRead:               schema("FirmwareRead", "", "sequenceNumber:UINT32", "", "fuData:TPM2B_MAX_BUFFER"),
+	tpm2.TPMCCGetCapability:              schema("GetCapability", "", "capability:TPM_CAP property:UINT32 propertyCount:UINT32", "", "moreData:TPMI_YES_NO capabilityData:TPMS_CAPABILITY_DATA"),
+	tpm2.TPMCCGetRandom:                  schema("GetRandom", "", "bytesRequested:UINT16", "", "randomBytes:TPM2B_DIGEST"),
+	tpm2.TPMCCGetTestResult:              schema("GetTestResult", "", "", "", "outData:TPM2B_MAX_BUFFER testResult:TPM_RC"),
+	tpm2.TPMCCHash:                       schema("Hash", "", "data:TPM2B_MAX_BUFFER hashAlg:TPMI_ALG_HASH hierarchy:TPMI_RH_HIERARCHY", "", "outHash:TPM2B_DIGEST validation:TPMT_TK_HASHCHECK"),
+	tpm2.TPMCCPCRRead:                    schema("PCR_Read", "", "pcrSelectionIn:TPML_PCR_SELECTION", "", "pcrUpdateCounter:UINT32 pcrSelectionOut:TPML_PCR_SELECTION pcrValues:TPML_DIGEST"),
+	tpm2.TPMCCPolicyPCR:                  schema("PolicyPCR", policy, "pcrDigest:TPM2B_DIGEST pcrs:TPML_PCR_SELECTION", "", ""),
+	tpm2.TPMCCPolicyRestart:              schema("PolicyRestart", "sessionHandle:TPMI_SH_POLICY", "", "", ""),
+	tpm2.TPMCCReadClock:                  schema("ReadClock", "", "", "", "currentTime:TPMS_TIME_INFO"),
+	tpm2.TPMCCPCRExtend:                  schema("PCR_Extend", "pcrHandle:TPMI_DH_PCR", "digests:TPML_DIGEST_VALUES", "", ""),
+	tpm2.TPMCCPCRSetAuthValue:            schema("PCR_SetAuthValue", "pcrHandle:TPMI_DH_PCR", "auth:TPM2B_DIGEST", "", ""),
+	tpm2.TPMCCNVCertify:                  schema("NV_Certify", "signHandle:TPMI_DH_OBJECT "+authHandles, attest+" size:UINT16 offset:UINT16", "", "certifyInfo:TPM2B_ATTEST signature:TPMT_SIGNATURE"),
+	tpm2.TPMCCEventSequenceComplete:      schema("EventSequenceComplete", "pcrHandle:TPMI_DH_PCR sequenceHandle:TPMI_DH_OBJECT", "buffer:TPM2B_MAX_BUFFER", "", "results:TPML_DIGEST_VALUES"),
+	tpm2.TPMCCHashSequenceStart:          schema("HashSequenceStart", "", "auth:TPM2B_AUTH hashAlg:TPMI_ALG_HASH", "sequenceHandle:TPMI_DH_OBJECT", ""),
+	tpm2.TPMCCPolicyPhysicalPresence:     schema("PolicyPhysicalPresence", policy, "", "", ""),
+	tpm2.TPMCCPolicyDuplicationSelect:    schema("PolicyDuplicationSelect", policy, "objectName:TPM2B_NAME newParentName:TPM2B_NAME includeObject:TPMI_YES_NO", "", ""),
+	tpm2.TPMCCPolicyGetDigest:            schema("PolicyGetDigest", policy, "", "", "policyDigest:TPM2B_DIGEST"),
+	tpm2.TPMCCTestParms:                  schema("TestParms", "", "parameters:TPMT_PUBLIC_PARMS", "", ""),
+	tpm2.TPMCCCommit:                     schema("Commit", "signHandle:TPMI_DH_OBJECT", "P1:TPM2B_ECC_POINT s2:TPM2B_SENSITIVE_DATA y2:TPM2B_ECC_PARAMETER", "", "K:TPM2B_ECC_POINT L:TPM2B_ECC_POINT E:TPM2B_ECC_POINT counter:UINT16"),
+	tpm2.TPMCCPolicyPassword:             schema("PolicyPassword", policy, "", "", ""),
+	tpm2.TPMCCZGen2Phase:                 schema("ZGen_2Phase", "keyA:TPMI_DH_OBJECT", "inQsB:TPM2B_ECC_POINT inQeB:TPM2B_ECC_POINT inScheme:TPMI_ECC_KEY_EXCHANGE counter:UINT16", "", "outZ1:TPM2B_ECC_POINT outZ2:TPM2B_ECC_POINT"),
+	tpm2.TPMCCECEphemeral:                schema("EC_Ephemeral", "", "curveID:TPMI_ECC_CURVE", "", "Q:TPM2B_ECC_POINT counter:UINT16"),
+	tpm2.TPMCCPolicyNvWritten:            schema("PolicyNvWritten", policy, "writtenSet:TPMI_YES_NO", "", ""),
+	tpm2.TPMCCPolicyTemplate:             schema("PolicyTemplate", policy, "templateHash:TPM2B_DIGEST", "", ""),
+	tpm2.TPMCCCreateLoaded:               schema("CreateLoaded", "parentHandle:TPMI_DH_PARENT", "inSensitive:TPM2B_SENSITIVE_CREATE inPublic:TPM2B_TEMPLATE", "objectHandle:TPM_HANDLE", "outPrivate:TPM2B_PRIVATE outPublic:TPM2B_PUBLIC name:TPM2B_NAME"),
+	tpm2.TPMCCPolicyAuthorizeNV:          schema("PolicyAuthorizeNV", authHandles+" "+policy, "", "", ""),
+	tpm2.TPMCCEncryptDecrypt2:            schema("EncryptDecrypt2", "keyHandle:TPMI_DH_OBJECT", "inData:TPM2B_MAX_BUFFER decrypt:TPMI_YES_NO mode:TPMI_ALG_CIPHER_MODE ivIn:TPM2B_IV", "", "outData:TPM2B_MAX_BUFFER ivOut:TPM2B_IV"),
+	tpm2.TPMCCACGetCapability:            schema("AC_GetCapability", "ac:TPMI_RH_AC", "capability:TPM_AT count:UINT32", "", "moreData:TPMI_YES_NO capabilitiesData:TPML_AC_CAPABILITIES"),
+	tpm2.TPMCCACSend:                     schema("AC_Send", "sendObject:TPMI_DH_OBJECT authHandle:TPMI_RH_NV_AUTH ac:TPMI_RH_AC", "acDataIn:TPM2B_MAX_BUFFER", "", "acDataOut:TPMS_AC_OUTPUT"),
+	tpm2.TPMCCPolicyACSendSelect:         schema("Policy_AC_SendSelect", policy, "objectName:TPM2B_NAME authHandleName:TPM2B_NAME acName:TPM2B_NAME includeObject:TPMI_YES_NO", "", ""),
+	tpm2.TPMCCCertifyX509:                schema("CertifyX509", "objectHandle:TPMI_DH_OBJECT signHandle:TPMI_DH_OBJECT", "reserved:TPM2B_DATA inScheme:TPMT_SIG_SCHEME partialCertificate:TPM2B_MAX_BUFFER", "", "addedToCertificate:TPM2B_MAX_BUFFER tbsDigest:TPM2B_DIGEST signature:TPMT_SIGNATURE"),
+	tpm2.TPMCCACTSetTimeout:              schema("ACT_SetTimeout", "actHandle:TPMI_RH_ACT", "startTimeout:UINT32", "", ""),
+	// ECC_Encrypt, ECC_Decrypt and Vendor_TCG_Test are not defined by go-tpm.
+	0x00000199: schema("ECC_Encrypt", "keyHandle:TPMI_DH_OBJECT", "plainText:TPM2B_MAX_BUFFER inScheme:TPMT_KDF_SCHEME", "", "C1:TPM2B_ECC_POINT C2:TPM2B_MAX_BUFFER C3:TPM2B_DIGEST"),
+	0x0000019A: schema("ECC_Decrypt", "keyHandle:TPMI_DH_OBJECT", "C1:TPM2B_ECC_POINT C2:TPM2B_MAX_BUFFER C3:TPM2B_DIGEST inScheme:TPMT_KDF_SCHEME", "", "plainText:TPM2B_MAX_BUFFER"),
+	0x20000000: schema("Vendor_TCG_Test", "", "inputData:TPM2B_DATA", "", "outputData:TPM2B_DATA"),
+}
+
+// schemaHandles returns the number of handles of the command in TPM 2.0
+// Part 3, or -1 if it is not there.
+func schemaHandles(cc tpm2.TPMCC) int {
+	if s := commandSchemas[cc]; s != nil {
+		return len(s.handles)
+	}
+	return -1
+}
+
+// DecodeCommandSchema decodes the command by its layout in TPM 2.0 Part 3
+// into a tree of fields named after the command. The command header is
+// decoded even if the command code is unknown, and the rest is then left
+// as a field of bytes.
+// On error, the fields decoded so far are returned with the error.
+func DecodeCommandSchema(command []byte) (*SchemaField, error) {
+	d := &schemaDecoder{b: command}
+	root := &SchemaField{Type: "command", Length: len(command)}
+	tag, err := d.append(root, "tag", "TPMI_ST_COMMAND_TAG")
+	if err != nil {
+		return root, err
+	}
+	if _, err := d.append(root, "commandSize", "UINT32"); err != nil {
+		return root, err
+	}
+	code, err := d.append(root, "commandCode", "TPM_CC")
+	if err != nil {
+		return root, err
+	}
+	cc := tpm2.TPMCC(code.Value.(uint64))
+	root.Name = CommandName(cc)
+	s := commandSchemas[cc]
+	if s == nil {
+		d.rest(root)
+		return root, nil
+	}
+	if _, err := d.group(root, "handles", s.handles); err != nil {
+		return root, err
+	}
+	if tag.Value == uint64(tpm2.TPMSTSessions) {
+		size, err := d.append(root, "authorizationSize", "UINT32")
+		if err != nil {
+			return root, err
+		}
+		if err := d.authorizations(root, int(size.Value.(uint64)), "TPMS_AUTH_COMMAND"); err != nil {
+			return root, err
+		}
+	}
+	if _, err := d.group(root, "parameters", s.parameters); err != nil {
+		return root, err
+	}
+	return root, d.end()
+}
+
+// DecodeResponseSchema decodes the response to the command by its layout in
+// TPM 2.0 Part 3 into a tree of fields named after the command. Only the
+// header of an error response is decoded.
+// On error, the fields decoded so far are returned with the error.
+func DecodeResponseSchema(command, response []byte) (*SchemaField, error) {
+	if len(command) < TpmHeaderSize {
+		return nil, fmt.Errorf("invalid TPM command size %d", len(command))
+	}
+	cc := tpm2.TPMCC(binary.BigEndian.Uint32(command[6:10]))
+	d := &schemaDecoder{b: response}
+	root := &SchemaField{Name: CommandName(cc), Type: "response", Length: len(response)}
+	tag, err := d.append(root, "tag", "TPM_ST")
+	if err != nil {
+		return root, err
+	}
+	if _, err := d.append(root, "responseSize", "UINT32"); err != nil {
+		return root, err
+	}
+	rc, err := d.append(root, "responseCode", "TPM_RC")
+	if err != nil {
+		return root, err
+	}
+	if rc.Value != uint64(tpm2.TPMRCSuccess) {
+		return root, d.end()
+	}
+	s := commandSchemas[cc]
+	if s == nil {
+		d.rest(root)
+		return root, nil
+	}
+	if _, err := d.group(root, "handles", s.responseHandles); err != nil {
+		return root, err
+	}
+	if tag.Value != uint64(tpm2.TPMSTSessions) {
+		if _, err := d.group(root, "parameters", s.responseParameters); err != nil {
+			return root, err
+		}
+		return root, d.end()
+	}
+	size, err := d.append(root, "parameterSize", "UINT32")
+	if err != nil {
+		return root, err
+	}
+	end := d.off + int(size.Value.(uint64))
+	if end > len(d.b) {
+		return root, fmt.Errorf("parameterSize: %w", io.ErrUnexpectedEOF)
+	}
+	p := &schemaDecoder{b: d.b[:end], off: d.off}
+	_, err = p.group(root, "parameters", s.responseParameters)
+	d.off = end
+	if err != nil {
+		return root, err
+	}
+	if err := p.end(); err != nil {
+		return root, fmt.Errorf("parameters: %w", err)
+	}
+	if err := d.authorizations(root, len(d.b)-d.off, "TPMS_AUTH_RESPONSE"); err != nil {
+		return root, err
+	}
+	return root, nil
+}
+
+// schemaDecoder decodes the fields from the offset of a command or response.
+type schemaDecoder struct {
+	b   []byte
+	off int
+}
+
+func (d *schemaDecoder) read(n int) ([]byte, error) {
+	if len(d.b)-d.off < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := d.b[d.off : d.off+n]
+	d.off += n
+	return b, nil
+}
+
+// end returns an error if there are bytes left.
+func (d *schemaDecoder) end() error {
+	if n := len(d.b) - d.off; n > 0 {
+		return fmt.Errorf("%d bytes left at offset %d", n, d.off)
+	}
+	return nil
+}
+
+// rest appends the bytes left to the parent.
+func (d *schemaDecoder) rest(parent *SchemaField) {
+	if d.off < len(d.b) {
+		parent.Fields = append(parent.Fields, &SchemaField{
+			Name:   "rest",
+			Type:   "BYTE[]",
+			Offset: d.off,
+			Length: len(d.b) - d.off,
+			Value:  hex.EncodeToString(d.b[d.off:]),
+		})
+		d.off = len(d.b)
+	}
+}
+
+// append decodes a field of the type and appends it to the parent, even if
+// decoding it fails.
+func (d *schemaDecoder) append(parent *SchemaField, name, typ string) (*SchemaField, error) {
+	f, err := d.field(name, typ)
+	parent.Fields = append(parent.Fields, f)
+	return f, err
+}
+
+// group decodes the members into a field of the name appended to the parent.
+func (d *schemaDecoder) group(parent *SchemaField, name string, members schemaStruct) (*SchemaField, error) {
+	f := &SchemaField{Name: name, Offset: d.off}
+	parent.Fields = append(parent.Fields, f)
+	err := d.decodeStruct(f, members)
+	f.Length = d.off - f.Offset
+	if err != nil {
+		return f, fmt.Errorf("%s: %w", name, err)
+	}
+	return f, nil
+}
+
+// authorizations decodes the authorization area of the size into sessions of
+// the type.
+func (d *schemaDecoder) authorizations(parent *SchemaField, size int, typ string) error {
+	end := d.off + size
+	if end > len(d.b) {
+		return fmt.Errorf("authorizationArea: %w", io.ErrUnexpectedEOF)
+	}
+	f := &SchemaField{Name: "authorizationArea", Offset: d.off, Length: size}
+	parent.Fields = append(parent.Fields, f)
+	a := &schemaDecoder{b: d.b[:end], off: d.off}
+	for i := 0; a.off < end; i++ {
+		if _, err := a.append(f, fmt.Sprintf("[%d]", i), typ); err != nil {
+			return fmt.Errorf("authorizationArea: %w", err)
+		}
+	}
+	d.off = end
+	return nil
+}
+
+func (d *schemaDecoder) field(name, typ string) (*SchemaField, error) {
+	f := &SchemaField{Name: name, Type: typ, Offset: d.off}
+	err := d.decode(f, typ)
+	f.Length = d.off - f.Offset
+	if err != nil {
+		return f, fmt.Errorf("%s: %w", name, err)
+	}
+	return f, nil
+}
+
+func (d *schemaDecoder) decode(f *SchemaField, typ string) error {
+	switch t := schemaTypes[typ].(type) {
+	case schemaUint:
+		b, err := d.read(int(t))
+		if err != nil {
+			return err
+		}
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		f.Value = v
+	case schemaInt:
+		b, err := d.read(int(t))
+		if err != nil {
+			return err
+		}
+		v := int64(int8(b[0]))
+		for _, c := range b[1:] {
+			v = v<<8 | int64(c)
+		}
+		f.Value = v
+	case schemaHandle:
+		b, err := d.read(4)
+		if err != nil {
+			return err
+		}
+		f.Value = fmt.Sprintf("0x%08x", binary.BigEndian.Uint32(b))
+	case schemaBytes:
+		b, err := d.read(int(t))
+		if err != nil {
+			return err
+		}
+		f.Value = hex.EncodeToString(b)
+	case schemaSized:
+		return d.decodeSized(f, t)
+	case schemaList:
+		count, err := d.append(f, "count", "UINT32")
+		if err != nil {
+			return err
+		}
+		n := count.Value.(uint64)
+		if n > maxListLength {
+			return fmt.Errorf("too many elements %d", n)
+		}
+		for i := 0; i < int(n); i++ {
+			if _, err := d.append(f, fmt.Sprintf("[%d]", i), string(t)); err != nil {
+				return err
+			}
+		}
+	case schemaStruct:
+		return d.decodeStruct(f, t)
+	default:
+		return fmt.Errorf("unknown type %s", typ)
+	}
+	return nil
+}
+
+// decodeSized decodes a sized buffer as a hex string, or a sized structure
+// into its size and contents.
+func (d *schemaDecoder) decodeSized(f *SchemaField, t schemaSized) error {
+	b, err := d.read(t.sizeLength)
+	if err != nil {
+		return err
+	}
+	size := int(b[0])
+	if t.sizeLength == 2 {
+		size = int(binary.BigEndian.Uint16(b))
+	}
+	if t.contents == "" {
+		b, err := d.read(size)
+		if err != nil {
+			return err
+		}
+		f.Value = hex.EncodeToString(b)
+		return nil
+	}
+	f.Fields = append(f.Fields, &SchemaField{Name: "size", Type: "UINT16", Offset: f.Offset, Length: 2, Value: uint64(size)})
+	if size == 0 {
+		return nil
+	}
+	end := d.off + size
+	if end > len(d.b) {
+		return io.ErrUnexpectedEOF
+	}
+	c := &schemaDecoder{b: d.b[:end], off: d.off}
+	_, err = c.append(f, "contents", t.contents)
+	d.off = end
+	if err != nil {
+		return err
+	}
+	return c.end()
+}
+
+// decodeStruct decodes the members of a structure, selecting the members of
+// the unions by the integer members decoded before.
+func (d *schemaDecoder) decodeStruct(f *SchemaField, members schemaStruct) error {
+	for _, m := range members {
+		typ := m.typ
+		if m.selector != "" {
+			selector := f.Field(m.selector)
+			if selector == nil {
+				return fmt.Errorf("%s: no selector %s", m.name, m.selector)
+			}
+			sel, _ := selector.Value.(uint64)
+			member, ok := schemaTypes[typ].(schemaUnion)[sel]
+			if !ok && sel != uint64(tpm2.TPMAlgNull) {
+				return fmt.Errorf("%s: invalid selector 0x%x of %s", m.name, sel, typ)
+			}
+			if member == "" {
+				f.Fields = append(f.Fields, &SchemaField{Name: m.name, Type: typ, Offset: d.off})
+				continue
+			}
+			typ = member
+		}
+		if _, err := d.append(f, m.name, typ); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeSchema decodes the command and, unless response is nil, the response
+// by the layouts of TPM 2.0 Part 3 for Decode. It returns
+// ErrUnsupportedCommand if the command is not there, and the *ResponseCode
+// with the command if the response is an error.
+func decodeSchema(request, response []byte) (cmd, rsp any, err error) {
+	cc := tpm2.TPMCC(binary.BigEndian.Uint32(request[6:10]))
+	if commandSchemas[cc] == nil {
+		return nil, nil, fmt.Errorf("%w %s", ErrUnsupportedCommand, CommandName(cc))
+	}
+	c, err := DecodeCommandSchema(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	if response == nil {
+		return c, nil, nil
+	}
+	r, err := DecodeResponseSchema(request, response)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rc := r.Field("responseCode"); rc.Value != uint64(tpm2.TPMRCSuccess) {
+		return c, nil, DecodeResponseCode(tpm2.TPMRC(rc.Value.(uint64)))
+	}
+	return c, r, nil
+}
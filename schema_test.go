@@ -0,0 +1,211 @@
+package tpmproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+func TestSchemaTypes(t *testing.T) {
+	check := func(where string, members schemaStruct) {
+		for _, m := range members {
+			if _, ok := schemaTypes[m.typ]; !ok {
+				t.Errorf("%s: unknown type %s of %s", where, m.typ, m.name)
+			}
+		}
+	}
+	for name, typ := range schemaTypes {
+		switch typ := typ.(type) {
+		case schemaStruct:
+			check(name, typ)
+		case schemaList:
+			check(name, members("element:"+string(typ)))
+		case schemaSized:
+			if typ.contents != "" {
+				check(name, members("contents:"+typ.contents))
+			}
+		case schemaUnion:
+			for _, member := range typ {
+				if member != "" {
+					check(name, members("member:"+member))
+				}
+			}
+		}
+	}
+	for cc, s := range commandSchemas {
+		for _, members := range []schemaStruct{s.handles, s.parameters, s.responseHandles, s.responseParameters} {
+			check(s.name, members)
+		}
+		if cc < 0x20000000 {
+			for _, m := range append(s.handles, s.responseHandles...) {
+				if _, ok := schemaTypes[m.typ].(schemaHandle); !ok {
+					t.Errorf("%s: handle %s of type %s", s.name, m.name, m.typ)
+				}
+			}
+		}
+	}
+}
+
+// schemaCommand builds a command with a password session if sessions is set.
+func schemaCommand(cc tpm2.TPMCC, sessions bool, handles []uint32, parameters ...tpm2.Marshallable) []byte {
+	var b bytes.Buffer
+	tag := tpm2.TPMSTNoSessions
+	if sessions {
+		tag = tpm2.TPMSTSessions
+	}
+	binary.Write(&b, binary.BigEndian, tag)
+	binary.Write(&b, binary.BigEndian, uint32(0))
+	binary.Write(&b, binary.BigEndian, cc)
+	for _, h := range handles {
+		binary.Write(&b, binary.BigEndian, h)
+	}
+	if sessions {
+		binary.Write(&b, binary.BigEndian, uint32(9))
+		b.Write([]byte{0x40, 0, 0, 0x09, 0, 0, 0, 0, 0})
+	}
+	for _, p := range parameters {
+		b.Write(tpm2.Marshal(p))
+	}
+	command := b.Bytes()
+	binary.BigEndian.PutUint32(command[2:], uint32(len(command)))
+	return command
+}
+
+func TestDecodeCommandSchema(t *testing.T) {
+	// PolicyTemplate is not modeled by go-tpm
+	command := schemaCommand(tpm2.TPMCCPolicyTemplate, false, []uint32{0x03000000},
+		tpm2.TPM2BDigest{Buffer: []byte{1, 2, 3}})
+	f, err := DecodeCommandSchema(command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Name != "PolicyTemplate" || f.Type != "command" || f.Length != len(command) {
+		t.Errorf("unexpected root %+v", f)
+	}
+	session := f.Field("handles").Field("policySession")
+	if session == nil || session.Value != "0x03000000" || session.Offset != 10 || session.Length != 4 {
+		t.Errorf("unexpected handle %+v", session)
+	}
+	hash := f.Field("parameters").Field("templateHash")
+	if hash == nil || hash.Type != "TPM2B_DIGEST" || hash.Value != "010203" || hash.Offset != 14 || hash.Length != 5 {
+		t.Errorf("unexpected parameter %+v", hash)
+	}
+
+	// PCR_Allocate with a password session
+	command = schemaCommand(tpm2.TPMCCPCRAllocate, true, []uint32{uint32(tpm2.TPMRHPlatform)},
+		tpm2.TPMLPCRSelection{PCRSelections: []tpm2.TPMSPCRSelection{
+			{Hash: tpm2.TPMAlgSHA256, PCRSelect: []byte{0xff, 0xff, 0xff}},
+		}})
+	f, err = DecodeCommandSchema(command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth := f.Field("authorizationArea"); auth == nil || len(auth.Fields) != 1 ||
+		auth.Fields[0].Field("sessionHandle").Value != "0x40000009" {
+		t.Errorf("unexpected authorization area %+v", auth)
+	}
+	allocation := f.Field("parameters").Field("pcrAllocation")
+	if allocation == nil || allocation.Offset != 27 || allocation.Length != 10 ||
+		allocation.Field("count").Value != uint64(1) {
+		t.Fatalf("unexpected parameter %+v", allocation)
+	}
+	selection := allocation.Field("[0]")
+	if selection.Field("hash").Value != uint64(tpm2.TPMAlgSHA256) || selection.Field("pcrSelect").Value != "ffffff" {
+		t.Errorf("unexpected selection %+v", selection)
+	}
+
+	response := []byte{0x80, 0x02, 0, 0, 0, 0x20, 0, 0, 0, 0, 0, 0, 0, 0x0d,
+		1, 0, 0, 0, 0x18, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 1, 0, 0}
+	r, err := DecodeResponseSchema(command, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := r.Field("parameters"); p.Field("allocationSuccess").Value != uint64(1) ||
+		p.Field("maxPCR").Value != uint64(24) || p.Offset != 14 || p.Length != 13 {
+		t.Errorf("unexpected response parameters %+v", p)
+	}
+	if auth := r.Field("authorizationArea"); auth == nil || len(auth.Fields) != 1 ||
+		auth.Fields[0].Field("sessionAttributes").Value != uint64(1) {
+		t.Errorf("unexpected authorization area %+v", auth)
+	}
+
+	// an error response has only the header
+	r, err = DecodeResponseSchema(command, []byte{0x80, 0x01, 0, 0, 0, 0x0a, 0, 0, 0x01, 0x84})
+	if err != nil || len(r.Fields) != 3 || r.Field("responseCode").Value != uint64(0x184) {
+		t.Errorf("unexpected error response %+v: %v", r, err)
+	}
+
+	// truncated commands fail at the field
+	for n := TpmHeaderSize; n < len(command); n++ {
+		if _, err := DecodeCommandSchema(command[:n]); err == nil {
+			t.Errorf("truncated at %d: no error", n)
+		}
+	}
+}
+
+func TestDecodeCommandSchemaModeled(t *testing.T) {
+	// the layouts of the commands go-tpm models agree with go-tpm
+	command := schemaCommand(tpm2.TPMCCCreatePrimary, true, []uint32{uint32(tpm2.TPMRHOwner)},
+		tpm2.TPM2BSensitiveCreate{Sensitive: &tpm2.TPMSSensitiveCreate{
+			UserAuth: tpm2.TPM2BAuth{Buffer: []byte("auth")},
+		}},
+		tpm2.New2B(tpm2.ECCSRKTemplate),
+		tpm2.TPM2BData{},
+		tpm2.TPMLPCRSelection{})
+	f, err := DecodeCommandSchema(command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := f.Field("parameters").Field("inPublic").Field("contents")
+	if public.Field("type").Value != uint64(tpm2.TPMAlgECC) ||
+		public.Field("parameters").Type != "TPMS_ECC_PARMS" ||
+		public.Field("parameters").Field("curveID").Value != uint64(tpm2.TPMECCNistP256) {
+		t.Errorf("unexpected public area %+v", public)
+	}
+	var cmd tpm2.CreatePrimary
+	p := RoughParser{RawRequest: command, Cmd: &cmd}
+	if err := p.ParseCommand(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecodeSchemaFallback(t *testing.T) {
+	command := schemaCommand(tpm2.TPMCCPolicyTemplate, false, []uint32{0x03000000},
+		tpm2.TPM2BDigest{Buffer: []byte{1, 2, 3}})
+	response := []byte{0x80, 0x01, 0, 0, 0, 0x0a, 0, 0, 0, 0}
+	cmd, rsp, err := Decode(command, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := cmd.(*SchemaField); !ok || c.Name != "PolicyTemplate" {
+		t.Errorf("unexpected command %#v", cmd)
+	}
+	if r, ok := rsp.(*SchemaField); !ok || r.Type != "response" {
+		t.Errorf("unexpected response %#v", rsp)
+	}
+	if _, rsp, err := Decode(command, nil); err != nil || rsp != nil {
+		t.Errorf("command only: %v, %v", rsp, err)
+	}
+	if name := CommandName(tpm2.TPMCCPolicyTemplate); name != "PolicyTemplate" {
+		t.Errorf("name %q", name)
+	}
+
+	var buf bytes.Buffer
+	h := (&TpmRequestResponseHandlerFactory{Interceptor: NewTraceRecorder(&buf, nil)}).NewRequestResponseHandler()
+	h.HandleRequest(command)
+	h.HandleResponse(response)
+	var rec map[string]any
+	if err := json.NewDecoder(&buf).Decode(&rec); err != nil {
+		t.Fatal(err)
+	}
+	handles, _ := rec["handles"].([]any)
+	decoded, _ := rec["decoded_command"].(map[string]any)
+	if rec["command_name"] != "PolicyTemplate" || len(handles) != 1 || handles[0] != "0x03000000" ||
+		decoded["name"] != "PolicyTemplate" || rec["decoded_response"] == nil || rec["decode_error"] != nil {
+		t.Errorf("unexpected record %v", rec)
+	}
+}
@@ -0,0 +1,355 @@
+package tpmproxy
+
+import (
+	"strings"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// The layouts of the TPM types of TPM 2.0 Part 2: Structures used by the
+// commands of commandSchemas.
+
+// schemaUint is an unsigned integer of the size in bytes.
+type schemaUint int
+
+// schemaInt is a signed integer of the size in bytes.
+type schemaInt int
+
+// schemaHandle is a handle.
+type schemaHandle struct{}
+
+// schemaBytes is a byte array of the size.
+type schemaBytes int
+
+// schemaSized is a sized buffer (TPM2B) with a size of sizeLength bytes.
+// Its contents are the named type, or bytes if contents is empty.
+type schemaSized struct {
+	sizeLength int
+	contents   string
+}
+
+// schemaList is a list (TPML) of the named type, preceded by its count.
+type schemaList string
+
+// schemaStruct is a structure.
+type schemaStruct []schemaMember
+
+// schemaUnion is a union of the named types by selector. An empty name is an
+// empty member. A union selected by TPM_ALG_NULL is empty.
+type schemaUnion map[uint64]string
+
+// schemaMember is a member of a structure. A union member names the member
+// selecting it.
+type schemaMember struct {
+	name, typ, selector string
+}
+
+// members parses the members of a structure from "name:TYPE" separated by
+// spaces. A union member is "name:TYPE(selector)".
+func members(s string) schemaStruct {
+	var members schemaStruct
+	for _, m := range strings.Fields(s) {
+		name, typ, _ := strings.Cut(m, ":")
+		typ, selector, _ := strings.Cut(strings.TrimSuffix(typ, ")"), "(")
+		members = append(members, schemaMember{name, typ, selector})
+	}
+	return members
+}
+
+func algs(members map[tpm2.TPMAlgID]string) schemaUnion {
+	u := make(schemaUnion)
+	for alg, typ := range members {
+		u[uint64(alg)] = typ
+	}
+	return u
+}
+
+var (
+	bytes2B  = schemaSized{sizeLength: 2}
+	scheme   = "hashAlg:TPMI_ALG_HASH"
+	ticket   = members("tag:TPM_ST hierarchy:TPMI_RH_HIERARCHY digest:TPM2B_DIGEST")
+	symDef   = members("algorithm:TPMI_ALG_SYM keyBits:TPMU_SYM_KEY_BITS(algorithm) mode:TPMU_SYM_MODE(algorithm)")
+	asymDefs = map[tpm2.TPMAlgID]string{
+		tpm2.TPMAlgECDH:      "TPMS_SCHEME_HASH",
+		tpm2.TPMAlgECMQV:     "TPMS_SCHEME_HASH",
+		tpm2.TPMAlgRSASSA:    "TPMS_SCHEME_HASH",
+		tpm2.TPMAlgRSAPSS:    "TPMS_SCHEME_HASH",
+		tpm2.TPMAlgECDSA:     "TPMS_SCHEME_HASH",
+		tpm2.TPMAlgECDAA:     "TPMS_SCHEME_ECDAA",
+		tpm2.TPMAlgSM2:       "TPMS_SCHEME_HASH",
+		tpm2.TPMAlgECSchnorr: "TPMS_SCHEME_HASH",
+		tpm2.TPMAlgRSAES:     "",
+		tpm2.TPMAlgOAEP:      "TPMS_SCHEME_HASH",
+	}
+)
+
+// schemaTypes are the layouts of the TPM types by name.
+var schemaTypes = map[string]any{
+	"UINT8":  schemaUint(1),
+	"UINT16": schemaUint(2),
+	"UINT32": schemaUint(4),
+	"UINT64": schemaUint(8),
+	"INT8":   schemaInt(1),
+	"INT32":  schemaInt(4),
+
+	"TPM_ALG_ID":                schemaUint(2),
+	"TPM_AT":                    schemaUint(4),
+	"TPM_CAP":                   schemaUint(4),
+	"TPM_CC":                    schemaUint(4),
+	"TPM_CLOCK_ADJUST":          schemaInt(1),
+	"TPM_ECC_CURVE":             schemaUint(2),
+	"TPM_EO":                    schemaUint(2),
+	"TPM_GENERATED":             schemaUint(4),
+	"TPM_KEY_BITS":              schemaUint(2),
+	"TPM_PT":                    schemaUint(4),
+	"TPM_PT_PCR":                schemaUint(4),
+	"TPM_RC":                    schemaUint(4),
+	"TPM_SE":                    schemaUint(1),
+	"TPM_ST":                    schemaUint(2),
+	"TPM_SU":                    schemaUint(2),
+	"TPMA_ACT":                  schemaUint(4),
+	"TPMA_ALGORITHM":            schemaUint(4),
+	"TPMA_CC":                   schemaUint(4),
+	"TPMA_LOCALITY":             schemaUint(1),
+	"TPMA_NV":                   schemaUint(4),
+	"TPMA_OBJECT":               schemaUint(4),
+	"TPMA_SESSION":              schemaUint(1),
+	"TPMI_ALG_ASYM_SCHEME":      schemaUint(2),
+	"TPMI_ALG_CIPHER_MODE":      schemaUint(2),
+	"TPMI_ALG_HASH":             schemaUint(2),
+	"TPMI_ALG_KDF":              schemaUint(2),
+	"TPMI_ALG_KEYEDHASH_SCHEME": schemaUint(2),
+	"TPMI_ALG_PUBLIC":           schemaUint(2),
+	"TPMI_ALG_RSA_DECRYPT":      schemaUint(2),
+	"TPMI_ALG_SIG_SCHEME":       schemaUint(2),
+	"TPMI_ALG_SYM":              schemaUint(2),
+	"TPMI_ECC_CURVE":            schemaUint(2),
+	"TPMI_ECC_KEY_EXCHANGE":     schemaUint(2),
+	"TPMI_RSA_KEY_BITS":         schemaUint(2),
+	"TPMI_ST_ATTEST":            schemaUint(2),
+	"TPMI_ST_COMMAND_TAG":       schemaUint(2),
+	"TPMI_YES_NO":               schemaUint(1),
+
+	"TPM_HANDLE":               schemaHandle{},
+	"TPMI_DH_CONTEXT":          schemaHandle{},
+	"TPMI_DH_ENTITY":           schemaHandle{},
+	"TPMI_DH_OBJECT":           schemaHandle{},
+	"TPMI_DH_PARENT":           schemaHandle{},
+	"TPMI_DH_PCR":              schemaHandle{},
+	"TPMI_DH_PERSISTENT":       schemaHandle{},
+	"TPMI_DH_SAVED":            schemaHandle{},
+	"TPMI_RH_AC":               schemaHandle{},
+	"TPMI_RH_ACT":              schemaHandle{},
+	"TPMI_RH_CLEAR":            schemaHandle{},
+	"TPMI_RH_ENABLES":          schemaHandle{},
+	"TPMI_RH_ENDORSEMENT":      schemaHandle{},
+	"TPMI_RH_HIERARCHY":        schemaHandle{},
+	"TPMI_RH_HIERARCHY_AUTH":   schemaHandle{},
+	"TPMI_RH_HIERARCHY_POLICY": schemaHandle{},
+	"TPMI_RH_LOCKOUT":          schemaHandle{},
+	"TPMI_RH_NV_AUTH":          schemaHandle{},
+	"TPMI_RH_NV_INDEX":         schemaHandle{},
+	"TPMI_RH_PLATFORM":         schemaHandle{},
+	"TPMI_RH_PROVISION":        schemaHandle{},
+	"TPMI_SH_AUTH_SESSION":     schemaHandle{},
+	"TPMI_SH_HMAC":             schemaHandle{},
+	"TPMI_SH_POLICY":           schemaHandle{},
+
+	"TPM2B_AUTH":             bytes2B,
+	"TPM2B_CONTEXT_DATA":     bytes2B,
+	"TPM2B_DATA":             bytes2B,
+	"TPM2B_DIGEST":           bytes2B,
+	"TPM2B_ECC_PARAMETER":    bytes2B,
+	"TPM2B_ENCRYPTED_SECRET": bytes2B,
+	"TPM2B_EVENT":            bytes2B,
+	"TPM2B_ID_OBJECT":        bytes2B,
+	"TPM2B_IV":               bytes2B,
+	"TPM2B_MAX_BUFFER":       bytes2B,
+	"TPM2B_MAX_NV_BUFFER":    bytes2B,
+	"TPM2B_NAME":             bytes2B,
+	"TPM2B_NONCE":            bytes2B,
+	"TPM2B_OPERAND":          bytes2B,
+	"TPM2B_PRIVATE":          bytes2B,
+	"TPM2B_PRIVATE_KEY_RSA":  bytes2B,
+	"TPM2B_PUBLIC_KEY_RSA":   bytes2B,
+	"TPM2B_SENSITIVE_DATA":   bytes2B,
+	"TPM2B_SYM_KEY":          bytes2B,
+	"TPM2B_TEMPLATE":         bytes2B,
+	"TPM2B_TIMEOUT":          bytes2B,
+
+	"TPM2B_ATTEST":           schemaSized{2, "TPMS_ATTEST"},
+	"TPM2B_CREATION_DATA":    schemaSized{2, "TPMS_CREATION_DATA"},
+	"TPM2B_ECC_POINT":        schemaSized{2, "TPMS_ECC_POINT"},
+	"TPM2B_NV_PUBLIC":        schemaSized{2, "TPMS_NV_PUBLIC"},
+	"TPM2B_PUBLIC":           schemaSized{2, "TPMT_PUBLIC"},
+	"TPM2B_SENSITIVE":        schemaSized{2, "TPMT_SENSITIVE"},
+	"TPM2B_SENSITIVE_CREATE": schemaSized{2, "TPMS_SENSITIVE_CREATE"},
+	"TPMS_PCR_SELECT":        schemaSized{sizeLength: 1},
+
+	"TPML_AC_CAPABILITIES":     schemaList("TPMS_AC_OUTPUT"),
+	"TPML_ACT_DATA":            schemaList("TPMS_ACT_DATA"),
+	"TPML_ALG":                 schemaList("TPM_ALG_ID"),
+	"TPML_ALG_PROPERTY":        schemaList("TPMS_ALG_PROPERTY"),
+	"TPML_CC":                  schemaList("TPM_CC"),
+	"TPML_CCA":                 schemaList("TPMA_CC"),
+	"TPML_DIGEST":              schemaList("TPM2B_DIGEST"),
+	"TPML_DIGEST_VALUES":       schemaList("TPMT_HA"),
+	"TPML_ECC_CURVE":           schemaList("TPM_ECC_CURVE"),
+	"TPML_HANDLE":              schemaList("TPM_HANDLE"),
+	"TPML_PCR_SELECTION":       schemaList("TPMS_PCR_SELECTION"),
+	"TPML_TAGGED_PCR_PROPERTY": schemaList("TPMS_TAGGED_PCR_SELECT"),
+	"TPML_TAGGED_POLICY":       schemaList("TPMS_TAGGED_POLICY"),
+	"TPML_TAGGED_TPM_PROPERTY": schemaList("TPMS_TAGGED_PROPERTY"),
+
+	"TPMS_AC_OUTPUT":              members("tag:TPM_AT data:UINT32"),
+	"TPMS_ACT_DATA":               members("handle:TPM_HANDLE timeout:UINT32 attributes:TPMA_ACT"),
+	"TPMS_ALG_PROPERTY":           members("alg:TPM_ALG_ID algProperties:TPMA_ALGORITHM"),
+	"TPMS_ALGORITHM_DETAIL_ECC":   members("curveID:TPM_ECC_CURVE keySize:UINT16 kdf:TPMT_KDF_SCHEME sign:TPMT_ECC_SCHEME p:TPM2B_ECC_PARAMETER a:TPM2B_ECC_PARAMETER b:TPM2B_ECC_PARAMETER gX:TPM2B_ECC_PARAMETER gY:TPM2B_ECC_PARAMETER n:TPM2B_ECC_PARAMETER h:TPM2B_ECC_PARAMETER"),
+	"TPMS_ATTEST":                 members("magic:TPM_GENERATED type:TPMI_ST_ATTEST qualifiedSigner:TPM2B_NAME extraData:TPM2B_DATA clockInfo:TPMS_CLOCK_INFO firmwareVersion:UINT64 attested:TPMU_ATTEST(type)"),
+	"TPMS_AUTH_COMMAND":           members("sessionHandle:TPMI_SH_AUTH_SESSION nonce:TPM2B_NONCE sessionAttributes:TPMA_SESSION hmac:TPM2B_AUTH"),
+	"TPMS_AUTH_RESPONSE":          members("nonce:TPM2B_NONCE sessionAttributes:TPMA_SESSION hmac:TPM2B_AUTH"),
+	"TPMS_CAPABILITY_DATA":        members("capability:TPM_CAP data:TPMU_CAPABILITIES(capability)"),
+	"TPMS_CERTIFY_INFO":           members("name:TPM2B_NAME qualifiedName:TPM2B_NAME"),
+	"TPMS_CLOCK_INFO":             members("clock:UINT64 resetCount:UINT32 restartCount:UINT32 safe:TPMI_YES_NO"),
+	"TPMS_COMMAND_AUDIT_INFO":     members("auditCounter:UINT64 digestAlg:TPM_ALG_ID auditDigest:TPM2B_DIGEST commandDigest:TPM2B_DIGEST"),
+	"TPMS_CONTEXT":                members("sequence:UINT64 savedHandle:TPMI_DH_SAVED hierarchy:TPMI_RH_HIERARCHY contextBlob:TPM2B_CONTEXT_DATA"),
+	"TPMS_CREATION_DATA":          members("pcrSelect:TPML_PCR_SELECTION pcrDigest:TPM2B_DIGEST locality:TPMA_LOCALITY parentNameAlg:TPM_ALG_ID parentName:TPM2B_NAME parentQualifiedName:TPM2B_NAME outsideInfo:TPM2B_DATA"),
+	"TPMS_CREATION_INFO":          members("objectName:TPM2B_NAME creationHash:TPM2B_DIGEST"),
+	"TPMS_ECC_PARMS":              members("symmetric:TPMT_SYM_DEF_OBJECT scheme:TPMT_ECC_SCHEME curveID:TPMI_ECC_CURVE kdf:TPMT_KDF_SCHEME"),
+	"TPMS_ECC_POINT":              members("x:TPM2B_ECC_PARAMETER y:TPM2B_ECC_PARAMETER"),
+	"TPMS_KEYEDHASH_PARMS":        members("scheme:TPMT_KEYEDHASH_SCHEME"),
+	"TPMS_NV_CERTIFY_INFO":        members("indexName:TPM2B_NAME offset:UINT16 nvContents:TPM2B_MAX_NV_BUFFER"),
+	"TPMS_NV_DIGEST_CERTIFY_INFO": members("indexName:TPM2B_NAME nvDigest:TPM2B_DIGEST"),
+	"TPMS_NV_PUBLIC":              members("nvIndex:TPMI_RH_NV_INDEX nameAlg:TPMI_ALG_HASH attributes:TPMA_NV authPolicy:TPM2B_DIGEST dataSize:UINT16"),
+	"TPMS_PCR_SELECTION":          members("hash:TPMI_ALG_HASH pcrSelect:TPMS_PCR_SELECT"),
+	"TPMS_QUOTE_INFO":             members("pcrSelect:TPML_PCR_SELECTION pcrDigest:TPM2B_DIGEST"),
+	"TPMS_RSA_PARMS":              members("symmetric:TPMT_SYM_DEF_OBJECT scheme:TPMT_RSA_SCHEME keyBits:TPMI_RSA_KEY_BITS exponent:UINT32"),
+	"TPMS_SCHEME_ECDAA":           members(scheme + " count:UINT16"),
+	"TPMS_SCHEME_HASH":            members(scheme),
+	"TPMS_SCHEME_XOR":             members(scheme + " kdf:TPMI_ALG_KDF"),
+	"TPMS_SENSITIVE_CREATE":       members("userAuth:TPM2B_AUTH data:TPM2B_SENSITIVE_DATA"),
+	"TPMS_SESSION_AUDIT_INFO":     members("exclusiveSession:TPMI_YES_NO sessionDigest:TPM2B_DIGEST"),
+	"TPMS_SIGNATURE_ECC":          members("hash:TPMI_ALG_HASH signatureR:TPM2B_ECC_PARAMETER signatureS:TPM2B_ECC_PARAMETER"),
+	"TPMS_SIGNATURE_RSA":          members("hash:TPMI_ALG_HASH sig:TPM2B_PUBLIC_KEY_RSA"),
+	"TPMS_SYMCIPHER_PARMS":        members("sym:TPMT_SYM_DEF_OBJECT"),
+	"TPMS_TAGGED_PCR_SELECT":      members("tag:TPM_PT_PCR pcrSelect:TPMS_PCR_SELECT"),
+	"TPMS_TAGGED_POLICY":          members("handle:TPM_HANDLE policyHash:TPMT_HA"),
+	"TPMS_TAGGED_PROPERTY":        members("property:TPM_PT value:UINT32"),
+	"TPMS_TIME_ATTEST_INFO":       members("time:TPMS_TIME_INFO firmwareVersion:UINT64"),
+	"TPMS_TIME_INFO":              members("time:UINT64 clockInfo:TPMS_CLOCK_INFO"),
+
+	"TPMT_ECC_SCHEME":       members("scheme:TPMI_ALG_ASYM_SCHEME details:TPMU_ASYM_SCHEME(scheme)"),
+	"TPMT_HA":               members("hashAlg:TPMI_ALG_HASH digest:TPMU_HA(hashAlg)"),
+	"TPMT_KDF_SCHEME":       members("scheme:TPMI_ALG_KDF details:TPMU_KDF_SCHEME(scheme)"),
+	"TPMT_KEYEDHASH_SCHEME": members("scheme:TPMI_ALG_KEYEDHASH_SCHEME details:TPMU_SCHEME_KEYEDHASH(scheme)"),
+	"TPMT_PUBLIC":           members("type:TPMI_ALG_PUBLIC nameAlg:TPMI_ALG_HASH objectAttributes:TPMA_OBJECT authPolicy:TPM2B_DIGEST parameters:TPMU_PUBLIC_PARMS(type) unique:TPMU_PUBLIC_ID(type)"),
+	"TPMT_PUBLIC_PARMS":     members("type:TPMI_ALG_PUBLIC parameters:TPMU_PUBLIC_PARMS(type)"),
+	"TPMT_RSA_DECRYPT":      members("scheme:TPMI_ALG_RSA_DECRYPT details:TPMU_ASYM_SCHEME(scheme)"),
+	"TPMT_RSA_SCHEME":       members("scheme:TPMI_ALG_ASYM_SCHEME details:TPMU_ASYM_SCHEME(scheme)"),
+	"TPMT_SENSITIVE":        members("sensitiveType:TPMI_ALG_PUBLIC authValue:TPM2B_AUTH seedValue:TPM2B_DIGEST sensitive:TPMU_SENSITIVE_COMPOSITE(sensitiveType)"),
+	"TPMT_SIG_SCHEME":       members("scheme:TPMI_ALG_SIG_SCHEME details:TPMU_SIG_SCHEME(scheme)"),
+	"TPMT_SIGNATURE":        members("sigAlg:TPMI_ALG_SIG_SCHEME signature:TPMU_SIGNATURE(sigAlg)"),
+	"TPMT_SYM_DEF":          symDef,
+	"TPMT_SYM_DEF_OBJECT":   symDef,
+	"TPMT_TK_AUTH":          ticket,
+	"TPMT_TK_CREATION":      ticket,
+	"TPMT_TK_HASHCHECK":     ticket,
+	"TPMT_TK_VERIFIED":      ticket,
+
+	"TPMU_ASYM_SCHEME": algs(asymDefs),
+	"TPMU_ATTEST": schemaUnion{
+		uint64(tpm2.TPMSTAttestCertify):      "TPMS_CERTIFY_INFO",
+		uint64(tpm2.TPMSTAttestCreation):     "TPMS_CREATION_INFO",
+		uint64(tpm2.TPMSTAttestQuote):        "TPMS_QUOTE_INFO",
+		uint64(tpm2.TPMSTAttestCommandAudit): "TPMS_COMMAND_AUDIT_INFO",
+		uint64(tpm2.TPMSTAttestSessionAudit): "TPMS_SESSION_AUDIT_INFO",
+		uint64(tpm2.TPMSTAttestTime):         "TPMS_TIME_ATTEST_INFO",
+		uint64(tpm2.TPMSTAttestNV):           "TPMS_NV_CERTIFY_INFO",
+		uint64(tpm2.TPMSTAttestNVDigest):     "TPMS_NV_DIGEST_CERTIFY_INFO",
+	},
+	"TPMU_CAPABILITIES": schemaUnion{
+		uint64(tpm2.TPMCapAlgs):          "TPML_ALG_PROPERTY",
+		uint64(tpm2.TPMCapHandles):       "TPML_HANDLE",
+		uint64(tpm2.TPMCapCommands):      "TPML_CCA",
+		uint64(tpm2.TPMCapPPCommands):    "TPML_CC",
+		uint64(tpm2.TPMCapAuditCommands): "TPML_CC",
+		uint64(tpm2.TPMCapPCRs):          "TPML_PCR_SELECTION",
+		uint64(tpm2.TPMCapTPMProperties): "TPML_TAGGED_TPM_PROPERTY",
+		uint64(tpm2.TPMCapPCRProperties): "TPML_TAGGED_PCR_PROPERTY",
+		uint64(tpm2.TPMCapECCCurves):     "TPML_ECC_CURVE",
+		uint64(tpm2.TPMCapAuthPolicies):  "TPML_TAGGED_POLICY",
+		uint64(tpm2.TPMCapACT):           "TPML_ACT_DATA",
+	},
+	"TPMU_HA": algs(map[tpm2.TPMAlgID]string{
+		tpm2.TPMAlgSHA1:    "BYTE[20]",
+		tpm2.TPMAlgSHA256:  "BYTE[32]",
+		tpm2.TPMAlgSHA384:  "BYTE[48]",
+		tpm2.TPMAlgSHA512:  "BYTE[64]",
+		tpm2.TPMAlgSM3256:  "BYTE[32]",
+		tpm2.TPMAlgSHA3256: "BYTE[32]",
+		tpm2.TPMAlgSHA3384: "BYTE[48]",
+		tpm2.TPMAlgSHA3512: "BYTE[64]",
+	}),
+	"BYTE[20]": schemaBytes(20),
+	"BYTE[32]": schemaBytes(32),
+	"BYTE[48]": schemaBytes(48),
+	"BYTE[64]": schemaBytes(64),
+	"TPMU_KDF_SCHEME": algs(map[tpm2.TPMAlgID]string{
+		tpm2.TPMAlgMGF1:         "TPMS_SCHEME_HASH",
+		tpm2.TPMAlgKDF1SP80056A: "TPMS_SCHEME_HASH",
+		tpm2.TPMAlgKDF2:         "TPMS_SCHEME_HASH",
+		tpm2.TPMAlgKDF1SP800108: "TPMS_SCHEME_HASH",
+	}),
+	"TPMU_PUBLIC_ID": algs(map[tpm2.TPMAlgID]string{
+		tpm2.TPMAlgKeyedHash: "TPM2B_DIGEST",
+		tpm2.TPMAlgSymCipher: "TPM2B_DIGEST",
+		tpm2.TPMAlgRSA:       "TPM2B_PUBLIC_KEY_RSA",
+		tpm2.TPMAlgECC:       "TPMS_ECC_POINT",
+	}),
+	"TPMU_PUBLIC_PARMS": algs(map[tpm2.TPMAlgID]string{
+		tpm2.TPMAlgKeyedHash: "TPMS_KEYEDHASH_PARMS",
+		tpm2.TPMAlgSymCipher: "TPMS_SYMCIPHER_PARMS",
+		tpm2.TPMAlgRSA:       "TPMS_RSA_PARMS",
+		tpm2.TPMAlgECC:       "TPMS_ECC_PARMS",
+	}),
+	"TPMU_SCHEME_KEYEDHASH": algs(map[tpm2.TPMAlgID]string{
+		tpm2.TPMAlgHMAC: "TPMS_SCHEME_HASH",
+		tpm2.TPMAlgXOR:  "TPMS_SCHEME_XOR",
+	}),
+	"TPMU_SENSITIVE_COMPOSITE": algs(map[tpm2.TPMAlgID]string{
+		tpm2.TPMAlgRSA:       "TPM2B_PRIVATE_KEY_RSA",
+		tpm2.TPMAlgECC:       "TPM2B_ECC_PARAMETER",
+		tpm2.TPMAlgKeyedHash: "TPM2B_SENSITIVE_DATA",
+		tpm2.TPMAlgSymCipher: "TPM2B_SYM_KEY",
+	}),
+	"TPMU_SIG_SCHEME": algs(map[tpm2.TPMAlgID]string{
+		tpm2.TPMAlgHMAC:      "TPMS_SCHEME_HASH",
+		tpm2.TPMAlgRSASSA:    "TPMS_SCHEME_HASH",
+		tpm2.TPMAlgRSAPSS:    "TPMS_SCHEME_HASH",
+		tpm2.TPMAlgECDSA:     "TPMS_SCHEME_HASH",
+		tpm2.TPMAlgECDAA:     "TPMS_SCHEME_ECDAA",
+		tpm2.TPMAlgSM2:       "TPMS_SCHEME_HASH",
+		tpm2.TPMAlgECSchnorr: "TPMS_SCHEME_HASH",
+	}),
+	"TPMU_SIGNATURE": algs(map[tpm2.TPMAlgID]string{
+		tpm2.TPMAlgRSASSA:    "TPMS_SIGNATURE_RSA",
+		tpm2.TPMAlgRSAPSS:    "TPMS_SIGNATURE_RSA",
+		tpm2.TPMAlgECDSA:     "TPMS_SIGNATURE_ECC",
+		tpm2.TPMAlgECDAA:     "TPMS_SIGNATURE_ECC",
+		tpm2.TPMAlgSM2:       "TPMS_SIGNATURE_ECC",
+		tpm2.TPMAlgECSchnorr: "TPMS_SIGNATURE_ECC",
+		tpm2.TPMAlgHMAC:      "TPMT_HA",
+	}),
+	"TPMU_SYM_KEY_BITS": algs(map[tpm2.TPMAlgID]string{
+		tpm2.TPMAlgAES:      "TPM_KEY_BITS",
+		tpm2.TPMAlgSM4:      "TPM_KEY_BITS",
+		tpm2.TPMAlgCamellia: "TPM_KEY_BITS",
+		tpm2.TPMAlgXOR:      "TPMI_ALG_HASH",
+	}),
+	"TPMU_SYM_MODE": algs(map[tpm2.TPMAlgID]string{
+		tpm2.TPMAlgAES:      "TPMI_ALG_CIPHER_MODE",
+		tpm2.TPMAlgSM4:      "TPMI_ALG_CIPHER_MODE",
+		tpm2.TPMAlgCamellia: "TPMI_ALG_CIPHER_MODE",
+		tpm2.TPMAlgXOR:      "",
+	}),
+}
@@ -0,0 +1,125 @@
+package tpmproxy
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// TcpTapForwarderFactory is a ForwarderFactory that mirrors the traffic of the
+// Forwarders created by another ForwarderFactory onto loopback TCP connections.
+// Each Forwarder gets its own TCP connection to Addr, so the traffic can be
+// captured with Wireshark without relaying through TCP.
+// The mirrored traffic is what is exchanged with the forwarding destination,
+// that is, after any interception of requests and before any interception
+// of responses.
+type TcpTapForwarderFactory struct {
+	// Addr is the address the mirror connections are made to.
+	Addr string
+	// ForwarderFactory creates the mirrored Forwarders.
+	ForwarderFactory ForwarderFactory
+
+	mu       sync.Mutex
+	listener net.Listener
+}
+
+// NewTcpTapForwarderFactory creates a new TcpTapForwarderFactory.
+func NewTcpTapForwarderFactory(addr string, forwarderFactory ForwarderFactory) *TcpTapForwarderFactory {
+	return &TcpTapForwarderFactory{
+		Addr:             addr,
+		ForwarderFactory: forwarderFactory,
+	}
+}
+
+// newConnPair creates a connected pair of mirror connections.
+func (f *TcpTapForwarderFactory) newConnPair() (net.Conn, net.Conn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.listener == nil {
+		listener, err := net.Listen("tcp", f.Addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		f.listener = listener
+	}
+	client, err := net.Dial("tcp", f.listener.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	// another client of Addr may be accepted before the dialled one
+	for {
+		server, err := f.listener.Accept()
+		if err != nil {
+			client.Close()
+			return nil, nil, err
+		}
+		if server.RemoteAddr().String() == client.LocalAddr().String() {
+			return client, server, nil
+		}
+		server.Close()
+	}
+}
+
+// NewForwarder creates a new mirrored Forwarder.
+func (f *TcpTapForwarderFactory) NewForwarder() (Forwarder, error) {
+	fwd, err := f.ForwarderFactory.NewForwarder()
+	if err != nil {
+		return nil, err
+	}
+	client, server, err := f.newConnPair()
+	if err != nil {
+		fwd.Close()
+		return nil, err
+	}
+	// Nobody reads the mirrored traffic, so drain it.
+	go io.Copy(io.Discard, client)
+	go io.Copy(io.Discard, server)
+	return &TcpTapForwarder{
+		Forwarder: fwd,
+		client:    client,
+		server:    server,
+	}, nil
+}
+
+// Close stops accepting mirror connections.
+func (f *TcpTapForwarderFactory) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.listener == nil {
+		return nil
+	}
+	err := f.listener.Close()
+	f.listener = nil
+	return err
+}
+
+// TcpTapForwarder is a Forwarder that mirrors the written data from the
+// client side and the read data from the server side of a TCP connection.
+type TcpTapForwarder struct {
+	Forwarder
+	client net.Conn
+	server net.Conn
+}
+
+func (f *TcpTapForwarder) Write(p []byte) (int, error) {
+	n, err := f.Forwarder.Write(p)
+	if n > 0 {
+		f.client.Write(p[:n])
+	}
+	return n, err
+}
+
+func (f *TcpTapForwarder) Read(p []byte) (int, error) {
+	n, err := f.Forwarder.Read(p)
+	if n > 0 {
+		f.server.Write(p[:n])
+	}
+	return n, err
+}
+
+func (f *TcpTapForwarder) Close() error {
+	f.client.Close()
+	f.server.Close()
+	return f.Forwarder.Close()
+}
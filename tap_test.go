@@ -0,0 +1,33 @@
+package tpmproxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTcpTapForwarderFactoryConnPair(t *testing.T) {
+	f := NewTcpTapForwarderFactory("127.0.0.1:0", nil)
+	defer f.Close()
+	client, server, err := f.newConnPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	server.Close()
+
+	// another client connecting first is not paired
+	other, err := net.Dial("tcp", f.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	client, server, err = f.newConnPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+	if server.RemoteAddr().String() != client.LocalAddr().String() {
+		t.Errorf("paired %v with %v", server.RemoteAddr(), client.LocalAddr())
+	}
+}
@@ -0,0 +1,340 @@
+package tpmproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// TraceRecord is the JSON record of a command and its response written by
+// TraceRecorder.
+type TraceRecord struct {
+	// Time is the time the command was received.
+	Time time.Time `json:"time"`
+	// ConnID is the ConnID of the request.
+	ConnID uint64 `json:"conn_id"`
+	// Locality is the Locality of the request.
+	Locality uint8 `json:"locality"`
+	// CommandCode is the command code of the command.
+	CommandCode tpm2.TPMCC `json:"command_code"`
+	// CommandName is the CommandName of the command.
+	CommandName string `json:"command_name"`
+	// Request is the command sent to the TPM in hex.
+	Request string `json:"request"`
+	// Response is the response returned to the client in hex.
+	Response string `json:"response"`
+	// OriginalRequest is the command before Interceptor if it was modified.
+	OriginalRequest string `json:"original_request,omitempty"`
+	// OriginalResponse is the response before Interceptor if it was modified.
+	OriginalResponse string `json:"original_response,omitempty"`
+	// Modified reports whether Interceptor modified the command or response.
+	Modified bool `json:"modified"`
+	// Blocked reports whether Interceptor blocked the command.
+	Blocked bool `json:"blocked,omitempty"`
+	// Handles are the handles of the command.
+	Handles []string `json:"handles,omitempty"`
+	// ResponseCode is the response code of the response.
+	ResponseCode tpm2.TPMRC `json:"response_code"`
+	// DecodedResponseCode is the ResponseCode decoded with its message.
+	DecodedResponseCode *ResponseCode `json:"decoded_response_code,omitempty"`
+	// DecodedCommand is the registered command structure as JSON values, or
+	// the SchemaField tree of the command.
+	DecodedCommand any `json:"decoded_command,omitempty"`
+	// DecodedResponse is the registered response structure as JSON values, or
+	// the SchemaField tree of the response.
+	DecodedResponse any `json:"decoded_response,omitempty"`
+	// DecodeError is the error decoding the command or response.
+	DecodeError string `json:"decode_error,omitempty"`
+}
+
+// TraceRecorder is an Interceptor that writes a TraceRecord in JSON per line
+// for each command and its response. Attach it to a relayer as its
+// Interceptor.
+// The commands registered with RegisterCommand are decoded with RoughParser. Byte strings
+// are written in hex, handles as hex strings, and sized structures and unions
+// as their contents. The other commands of TPM 2.0 Part 3 are decoded into
+// SchemaField trees.
+type TraceRecorder struct {
+	// Interceptor is the wrapped Interceptor. It may be nil.
+	Interceptor Interceptor
+
+	mu      sync.Mutex
+	enc     *json.Encoder
+	pending map[*Request]*traceExchange
+	err     error
+}
+
+// traceExchange is a command waiting for its response.
+type traceExchange struct {
+	record *TraceRecord
+	// command is the command sent to the TPM, or the blocked command.
+	command []byte
+}
+
+// NewTraceRecorder creates a new TraceRecorder writing to w.
+func NewTraceRecorder(w io.Writer, interceptor Interceptor) *TraceRecorder {
+	return &TraceRecorder{
+		Interceptor: interceptor,
+		enc:         json.NewEncoder(w),
+		pending:     make(map[*Request]*traceExchange),
+	}
+}
+
+// Err returns the first error writing the trace.
+// Once writing fails, nothing is recorded anymore.
+func (r *TraceRecorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// ReadTrace reads the records written by TraceRecorder.
+func ReadTrace(r io.Reader) ([]*TraceRecord, error) {
+	dec := json.NewDecoder(r)
+	var records []*TraceRecord
+	for {
+		rec := &TraceRecord{}
+		if err := dec.Decode(rec); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return records, err
+		}
+		records = append(records, rec)
+	}
+}
+
+func (r *TraceRecorder) HandleRequest(request *Request) []byte {
+	rec := &TraceRecord{
+		Time:        time.Now(),
+		ConnID:      request.ConnID,
+		Locality:    request.Locality,
+		CommandCode: request.Hdr.CommandCode,
+		CommandName: CommandName(request.Hdr.CommandCode),
+	}
+	original := bytes.Clone(request.Raw)
+	modified := request.Raw
+	if r.Interceptor != nil {
+		modified = r.Interceptor.HandleRequest(request)
+	}
+	command := modified
+	switch {
+	case modified == nil:
+		command = original
+		rec.Request = hex.EncodeToString(original)
+		rec.Blocked = true
+		rec.Modified = true
+	case !bytes.Equal(modified, original):
+		rec.Request = hex.EncodeToString(modified)
+		rec.OriginalRequest = hex.EncodeToString(original)
+		rec.Modified = true
+	default:
+		rec.Request = hex.EncodeToString(modified)
+	}
+
+	r.mu.Lock()
+	r.pending[request] = &traceExchange{rec, command}
+	r.mu.Unlock()
+	return modified
+}
+
+func (r *TraceRecorder) HandleResponse(request *Request, response []byte) []byte {
+	original := bytes.Clone(response)
+	modified := response
+	if r.Interceptor != nil {
+		modified = r.Interceptor.HandleResponse(request, response)
+	}
+
+	r.mu.Lock()
+	ex, ok := r.pending[request]
+	delete(r.pending, request)
+	r.mu.Unlock()
+	if !ok {
+		return modified
+	}
+	rec := ex.record
+
+	rec.Response = hex.EncodeToString(modified)
+	if response != nil && !bytes.Equal(modified, original) {
+		rec.OriginalResponse = hex.EncodeToString(original)
+		rec.Modified = true
+	}
+	if len(modified) >= TpmHeaderSize {
+		rec.ResponseCode = tpm2.TPMRC(binary.BigEndian.Uint32(modified[6:10]))
+		rec.DecodedResponseCode = DecodeResponseCode(rec.ResponseCode)
+	}
+	rec.decode(ex.command, modified)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = r.enc.Encode(rec)
+	}
+	return modified
+}
+
+// decode fills the handles and the decoded structures of the record.
+func (rec *TraceRecord) decode(command, response []byte) {
+	t := LookupCommand(rec.CommandCode)
+	if t == nil {
+		rec.decodeSchema(command, response)
+		return
+	}
+	cmd := t.NewCommand()
+	rsp := t.NewResponse()
+
+	handles := command[min(len(command), TpmHeaderSize):]
+	for n := commandHandles(cmd); n > 0 && len(handles) >= 4; n-- {
+		rec.Handles = append(rec.Handles, fmt.Sprintf("0x%08x", binary.BigEndian.Uint32(handles)))
+		handles = handles[4:]
+	}
+
+	p := RoughParser{
+		RawRequest:  command,
+		RawResponse: response,
+		Cmd:         cmd,
+		Rsp:         rsp,
+	}
+	if err := p.ParseCommand(); err != nil {
+		rec.DecodeError = err.Error()
+		return
+	}
+	rec.DecodedCommand = traceValue(reflect.ValueOf(cmd))
+	if err := p.ParseResponse(); err != nil {
+		if len(response) > 0 && rec.ResponseCode == tpm2.TPMRCSuccess {
+			rec.DecodeError = err.Error()
+		}
+		return
+	}
+	rec.DecodedResponse = traceValue(reflect.ValueOf(rsp))
+}
+
+// decodeSchema fills the handles and the decoded fields of the record by the
+// layouts of TPM 2.0 Part 3, for the commands without registered structures.
+func (rec *TraceRecord) decodeSchema(command, response []byte) {
+	if commandSchemas[rec.CommandCode] == nil {
+		return
+	}
+	cmd, err := DecodeCommandSchema(command)
+	if handles := cmd.Field("handles"); handles != nil {
+		for _, h := range handles.Fields {
+			if v, ok := h.Value.(string); ok {
+				rec.Handles = append(rec.Handles, v)
+			}
+		}
+	}
+	if err != nil {
+		rec.DecodeError = err.Error()
+		return
+	}
+	rec.DecodedCommand = cmd
+	rsp, err := DecodeResponseSchema(command, response)
+	if err != nil {
+		if len(response) > 0 && rec.ResponseCode == tpm2.TPMRCSuccess {
+			rec.DecodeError = err.Error()
+		}
+		return
+	}
+	rec.DecodedResponse = rsp
+}
+
+var (
+	tpmHandleType = reflect.TypeOf(tpm2.TPMHandle(0))
+	errorType     = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// traceValue converts a go-tpm structure to JSON values.
+func traceValue(v reflect.Value) any {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return traceValue(v.Elem())
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.Type() == tpmHandleType {
+			return fmt.Sprintf("0x%08x", v.Uint())
+		}
+		return v.Uint()
+	case reflect.String:
+		return v.String()
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			return hex.EncodeToString(b)
+		}
+		values := make([]any, v.Len())
+		for i := range values {
+			values[i] = traceValue(v.Index(i))
+		}
+		return values
+	case reflect.Struct:
+		fields := make(map[string]any)
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				fields[v.Type().Field(i).Name] = traceValue(v.Field(i))
+			}
+		}
+		if len(fields) == 0 {
+			return traceContents(v)
+		}
+		return fields
+	}
+	return nil
+}
+
+// traceContents converts the contents of a sized structure or a union, which
+// have only unexported fields, to JSON values. A union is converted to an
+// object with its member.
+func traceContents(v reflect.Value) any {
+	if !v.CanAddr() {
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		v = c
+	}
+	p := v.Addr()
+	for i := 0; i < p.NumMethod(); i++ {
+		m := p.Type().Method(i)
+		if m.Type.NumIn() != 1 || m.Type.NumOut() != 2 || m.Type.Out(1) != errorType {
+			continue
+		}
+		if out, ok := callContents(p.Method(i)); ok {
+			if m.Name == "Contents" {
+				return traceValue(out)
+			}
+			return map[string]any{m.Name: traceValue(out)}
+		}
+	}
+	// a sized structure with invalid contents
+	if m := p.MethodByName("Bytes"); m.IsValid() && m.Type().NumIn() == 0 && m.Type().NumOut() == 1 {
+		return traceValue(m.Call(nil)[0])
+	}
+	return nil
+}
+
+// callContents calls a contents accessor, which may panic if the union is
+// empty.
+func callContents(m reflect.Value) (out reflect.Value, ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	results := m.Call(nil)
+	if !results[1].IsNil() {
+		return reflect.Value{}, false
+	}
+	return results[0], true
+}
@@ -0,0 +1,63 @@
+package tpmproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestTraceRecorder(t *testing.T) {
+	var buf bytes.Buffer
+	r := NewTraceRecorder(&buf, &tamperingInterceptor{})
+	// GetRandom of 4 bytes at locality 3
+	command := []byte{0x80, 0x01, 0, 0, 0, 0x0c, 0, 0, 0x01, 0x7b, 0, 4}
+	response := []byte{0x80, 0x01, 0, 0, 0, 0x10, 0, 0, 0, 0, 0, 4, 1, 2, 3, 4}
+	h := (&TpmRequestResponseHandlerFactory{
+		Interceptor: r,
+		ConnID:      7,
+		Locality:    func() uint8 { return 3 },
+	}).NewRequestResponseHandler()
+	h.HandleRequest(command)
+	h.HandleResponse(response)
+	// FlushContext failing with TPM_RC_HANDLE
+	command = []byte{0x80, 0x01, 0, 0, 0, 0x0e, 0, 0, 0x01, 0x65, 0x80, 0, 0, 1}
+	response = []byte{0x80, 0x01, 0, 0, 0, 0x0a, 0, 0, 0x01, 0x8b}
+	h = (&TpmRequestResponseHandlerFactory{Interceptor: r}).NewRequestResponseHandler()
+	h.HandleRequest(command)
+	h.HandleResponse(response)
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	dec := json.NewDecoder(&buf)
+	var rec map[string]any
+	if err := dec.Decode(&rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec["conn_id"] != 7.0 || rec["locality"] != 3.0 || rec["command_name"] != "GetRandom" ||
+		rec["modified"] != true || rec["original_response"] != "80010000001000000000000401020304" ||
+		rec["response"] != "800100000010000000000004010203fb" {
+		t.Errorf("unexpected record %v", rec)
+	}
+	cmd, _ := rec["decoded_command"].(map[string]any)
+	rsp, _ := rec["decoded_response"].(map[string]any)
+	if cmd["BytesRequested"] != 4.0 || rsp["RandomBytes"].(map[string]any)["Buffer"] != "010203fb" {
+		t.Errorf("unexpected decoded structures %v, %v", cmd, rsp)
+	}
+
+	rec = nil
+	if err := dec.Decode(&rec); err != nil {
+		t.Fatal(err)
+	}
+	handles, _ := rec["handles"].([]any)
+	if rec["response_code"] != float64(0x18b^0xff) || len(handles) != 1 || handles[0] != "0x80000001" ||
+		rec["decoded_response"] != nil || rec["decode_error"] != nil {
+		t.Errorf("unexpected record %v", rec)
+	}
+	if rc, _ := rec["decoded_response_code"].(map[string]any); rc["code"] != float64(0x18b^0xff) || rc["name"] == "" {
+		t.Errorf("unexpected decoded response code %v", rec["decoded_response_code"])
+	}
+	if cmd, _ := rec["decoded_command"].(map[string]any); cmd["FlushHandle"] != "0x80000001" {
+		t.Errorf("unexpected decoded command %v", rec["decoded_command"])
+	}
+}
@@ -18,3 +18,25 @@ func FilterClosedErr(err error) error {
 		return err
 	}
 }
+
+// parseUnixRights returns the file descriptors passed in the SCM_RIGHTS
+// control messages of oob.
+func parseUnixRights(oob []byte) []int {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	var fds []int
+	for i := range msgs {
+		if rights, err := syscall.ParseUnixRights(&msgs[i]); err == nil {
+			fds = append(fds, rights...)
+		}
+	}
+	return fds
+}
+
+func closeFds(fds []int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+}